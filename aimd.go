@@ -0,0 +1,56 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// aimd adapts the limit of the throttler to the outcomes of the requests:
+// it halves the limit once per window that has seen a 429 or 503 response,
+// and raises it by one after every window without them, up to the configured ceiling.
+type aimd struct {
+	mu        sync.Mutex
+	throttler *Throttler
+	ceiling   uint64
+	start     time.Time
+	failed    bool
+}
+
+func newAIMD(throttler *Throttler) *aimd {
+	return &aimd{
+		throttler: throttler,
+		ceiling:   throttler.Limit(),
+	}
+}
+
+// observe accounts the outcome of a request completed at the specified time.
+func (a *aimd) observe(now time.Time, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.ceiling == 0 {
+		return
+	}
+
+	limit := a.throttler.Limit()
+
+	if a.start.IsZero() {
+		a.start = now
+	}
+
+	// the window is over, so it is accounted before the outcome
+	if now.Sub(a.start) >= a.throttler.size {
+		if !a.failed && limit < a.ceiling {
+			limit++
+			a.throttler.SetLimit(limit)
+		}
+
+		a.start = now
+		a.failed = false
+	}
+
+	if failed && !a.failed {
+		a.failed = true
+		a.throttler.SetLimit(max(limit/2, 1))
+	}
+}
@@ -0,0 +1,123 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ErrReaderClosed is returned by the reads from a closed PacedReader.
+var ErrReaderClosed = errors.New("read from a closed paced reader")
+
+// PacedReader paces the reads from the underlying reader, taking a slot of the limiter per byte read,
+// e.g. to cap the bandwidth of a download.
+type PacedReader struct {
+	reader  io.Reader
+	limiter Limiter
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+}
+
+// NewPacedReader creates a new instance of PacedReader, which gives up waiting for the limiter once the context is done.
+// The limiter can be shared, e.g. to cap the total bandwidth of several readers.
+func NewPacedReader(ctx context.Context, reader io.Reader, limiter Limiter) *PacedReader {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	return &PacedReader{
+		reader:  reader,
+		limiter: limiter,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Read reads up to a window worth of bytes and returns them once the limiter admits them.
+// If the context is done or the reader is closed while waiting, the bytes read are returned along with the error.
+func (r *PacedReader) Read(p []byte) (int, error) {
+	if err := context.Cause(r.ctx); err != nil {
+		return 0, err
+	}
+
+	if len(p) == 0 {
+		return r.reader.Read(p)
+	}
+
+	// a read never takes more than a window, so the bytes of a window never exceed the limit
+	n, err := r.reader.Read(p[:chunkSize(r.limiter, len(p))])
+
+	if n > 0 {
+		if waitErr := r.limiter.AcquireN(r.ctx, uint64(n)); waitErr != nil {
+			return n, causeOf(r.ctx, waitErr)
+		}
+	}
+
+	return n, err
+}
+
+// Close stops the pending and following reads and closes the underlying reader, if it's an io.Closer.
+func (r *PacedReader) Close() error {
+	r.cancel(ErrReaderClosed)
+
+	if closer, ok := r.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// chunkSize returns the number of bytes out of n that fit into a window of the limiter, if it tells its limit.
+func chunkSize(limiter Limiter, n int) int {
+	if limiter, ok := limiter.(interface{ Limit() uint64 }); ok {
+		if limit := limiter.Limit(); limit > 0 && uint64(n) > limit {
+			return int(limit)
+		}
+	}
+
+	return n
+}
+
+// causeOf returns the cause the context is done with, e.g. a closed reader rather than a cancelled context, or the error otherwise.
+func causeOf(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+
+	return err
+}
+
+// paceBody returns a copy of the request whose body, as well as the ones made by GetBody, is read at the pace of the throttler.
+// The content length is left intact.
+func paceBody(request *http.Request, throttler *Throttler) *http.Request {
+	if request.Body == nil || request.Body == http.NoBody {
+		return request
+	}
+
+	ctx := request.Context()
+	paced := request.Clone(ctx)
+	paced.Body = NewPacedReader(ctx, request.Body, throttler)
+
+	if getBody := request.GetBody; getBody != nil {
+		paced.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+
+			if err != nil || body == http.NoBody {
+				return body, err
+			}
+
+			return NewPacedReader(ctx, body, throttler), nil
+		}
+	}
+
+	return paced
+}
+
+// paceResponse makes the response body be read at the pace of the throttler, leaving the headers intact.
+// The bodies of switched protocols are left as they are, since they are writable too.
+func paceResponse(ctx context.Context, response *http.Response, throttler *Throttler) {
+	if response.Body == nil || response.Body == http.NoBody || response.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+
+	response.Body = NewPacedReader(ctx, response.Body, throttler)
+}
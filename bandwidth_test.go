@@ -0,0 +1,90 @@
+package throttle_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestPacedReader(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	reader := throttle.NewPacedReader(context.Background(), strings.NewReader(strings.Repeat("x", 25)), throttle.New(10, throttle.WithClock(clock)))
+	totals := make(map[time.Duration]int)
+
+	for {
+		buf := make([]byte, 64)
+		n, err := reader.Read(buf)
+		totals[clock.Now().Sub(epoch)] += n
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	expected := map[time.Duration]int{0: 10, time.Second: 10, time.Second * 2: 5}
+
+	for window, total := range expected {
+		if totals[window] != total {
+			t.Fatal(fmt.Sprintf("Expected %d bytes to be read at %s, but got %d", total, window, totals[window]))
+		}
+	}
+}
+
+func TestPacedReader_Close(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	body := &closingReader{Reader: strings.NewReader(strings.Repeat("x", 25))}
+	reader := throttle.NewPacedReader(context.Background(), body, throttle.New(10, throttle.WithClock(clock)))
+	buf := make([]byte, 64)
+
+	if n, err := reader.Read(buf); n != 10 || err != nil {
+		t.Fatal(fmt.Sprintf("Expected to read 10 bytes, but got %d and %v", n, err))
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := reader.Read(buf)
+		done <- err
+	}()
+
+	// the pending read gives up once the reader is closed, without waiting for the clock
+	clock.BlockUntilSleepers(1)
+
+	if err := reader.Close(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if err := <-done; !errors.Is(err, throttle.ErrReaderClosed) {
+		t.Fatal(fmt.Sprintf("Expected throttle.ErrReaderClosed, but got %v", err))
+	}
+
+	if !body.closed {
+		t.Fatal("Expected the underlying reader to be closed")
+	}
+
+	if _, err := reader.Read(buf); !errors.Is(err, throttle.ErrReaderClosed) {
+		t.Fatal(fmt.Sprintf("Expected throttle.ErrReaderClosed, but got %v", err))
+	}
+}
+
+type closingReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closingReader) Close() error {
+	r.closed = true
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package throttle
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// DoAll sends the requests using the client with at most concurrency of them in flight and returns the results positionally.
+// The pace is set by the client transport, so the client is expected to be throttled, e.g. with NewRoundTripper.
+// A failed request doesn't stop the others. Once the context is done, the requests that haven't been sent yet fail with the context error,
+// while the requests in flight are governed by their own contexts.
+// Closing the bodies of the returned responses is up to the caller.
+func DoAll(ctx context.Context, client *http.Client, reqs []*http.Request, concurrency int) ([]*http.Response, []error) {
+	responses := make([]*http.Response, len(reqs))
+	errs := make([]error, len(reqs))
+
+	if concurrency <= 0 || concurrency > len(reqs) {
+		concurrency = len(reqs)
+	}
+
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+
+	for range concurrency {
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+
+					continue
+				}
+
+				responses[i], errs[i] = client.Do(reqs[i])
+			}
+		}()
+	}
+
+	for i := range reqs {
+		indexes <- i
+	}
+
+	close(indexes)
+	wg.Wait()
+
+	return responses, errs
+}
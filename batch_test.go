@@ -0,0 +1,157 @@
+package throttle_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// driveBatch advances the clock by a window every time all the workers with requests left are parked in it, until none are left.
+func driveBatch(clock *throttletest.ManualClock, remaining *atomic.Int64, workers int64) {
+	for {
+		left := remaining.Load()
+
+		if left == 0 {
+			return
+		}
+
+		if int64(clock.Sleepers()) == min(left, workers) {
+			clock.Advance(time.Second)
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
+func TestDoAll(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+
+	var mu sync.Mutex
+	received := make(map[time.Duration]int)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[clock.Now().Sub(epoch).Truncate(time.Second)]++
+		mu.Unlock()
+
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	var remaining atomic.Int64
+	remaining.Store(12)
+
+	throttled := throttle.NewRoundTripper(http.DefaultTransport, 3, throttle.WithClock(clock))
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			defer remaining.Add(-1)
+
+			return throttled.RoundTrip(req)
+		}),
+	}
+
+	reqs := make([]*http.Request, 0, 12)
+
+	for i := range 12 {
+		url := fmt.Sprintf("%s/items/%d", server.URL, i)
+
+		// a request that fails must not stop the others
+		if i == 5 {
+			url = "unsupported://items/5"
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		reqs = append(reqs, req)
+	}
+
+	var (
+		responses []*http.Response
+		errs      []error
+	)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		responses, errs = throttle.DoAll(context.Background(), client, reqs, 4)
+	}()
+
+	driveBatch(clock, &remaining, 4)
+	<-done
+
+	for i := range reqs {
+		if i == 5 {
+			if errs[i] == nil || responses[i] != nil {
+				t.Fatal("Expected request #5 to fail")
+			}
+
+			continue
+		}
+
+		if errs[i] != nil {
+			t.Fatal(fmt.Sprintf("Expected no error for request #%d, but got %s", i, errs[i]))
+		}
+
+		expected := fmt.Sprintf("/items/%d", i)
+
+		if actual := responses[i].Header.Get("X-Path"); actual != expected {
+			t.Fatal(fmt.Sprintf("Expected response #%d to be for %s, but got %s", i, expected, actual))
+		}
+
+		responses[i].Body.Close()
+	}
+
+	var total int
+
+	for window, count := range received {
+		if count > 3 {
+			t.Fatal(fmt.Sprintf("Expected at most 3 requests in window %s, but got %d", window, count))
+		}
+
+		total += count
+	}
+
+	if total != 11 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 11 requests, but got %d", total))
+	}
+}
+
+func TestDoAll_ContextCancelled(t *testing.T) {
+	server, received := newCountingServer(t)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, 3),
+	}
+
+	reqs := make([]*http.Request, 0, 5)
+
+	for range 5 {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		reqs = append(reqs, req)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	responses, errs := throttle.DoAll(ctx, client, reqs, 2)
+
+	for i := range reqs {
+		if errs[i] != context.Canceled || responses[i] != nil {
+			t.Fatal(fmt.Sprintf("Expected request #%d to fail with context.Canceled, but got %v", i, errs[i]))
+		}
+	}
+
+	if actual := received.Load(); actual != 0 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive no requests, but got %d", actual))
+	}
+}
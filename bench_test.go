@@ -0,0 +1,63 @@
+package throttle_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func newBenchThrottler(limit uint64) func(clock throttle.Clock) throttle.Limiter {
+	return func(clock throttle.Clock) throttle.Limiter {
+		return throttle.New(limit, throttle.WithClock(clock))
+	}
+}
+
+func BenchmarkThrottler_Uncontended(b *testing.B) {
+	throttletest.Benchmark(b, newBenchThrottler(1000), throttletest.Workload{
+		Workers: 1,
+	})
+}
+
+func BenchmarkThrottler_Waiters100(b *testing.B) {
+	throttletest.Benchmark(b, newBenchThrottler(10), throttletest.Workload{
+		Workers: 100,
+	})
+}
+
+func BenchmarkThrottler_Mixed(b *testing.B) {
+	throttletest.Benchmark(b, newBenchThrottler(100), throttletest.Workload{
+		Workers:  16,
+		TryEvery: 2,
+	})
+}
+
+// BenchmarkKeyedThrottler_DistinctKeys compares a single lock with the sharded ones, with 64 goroutines calling distinct keys.
+func BenchmarkKeyedThrottler_DistinctKeys(b *testing.B) {
+	const goroutines = 64
+	const keysPerGoroutine = 1024
+
+	for _, shards := range []int{1, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			keyed := throttle.NewKeyed[int](1_000_000, throttle.WithShards(shards))
+
+			var wg sync.WaitGroup
+			wg.Add(goroutines)
+			b.ResetTimer()
+
+			for g := range goroutines {
+				go func(g int) {
+					defer wg.Done()
+
+					for i := g; i < b.N; i += goroutines {
+						keyed.TryAcquire(g*keysPerGoroutine + i%keysPerGoroutine)
+					}
+				}(g)
+			}
+
+			wg.Wait()
+		})
+	}
+}
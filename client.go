@@ -0,0 +1,25 @@
+package throttle
+
+import "net/http"
+
+// NewClient creates an http.Client that throttles its requests with a specified limit on top of http.DefaultTransport.
+func NewClient(limit uint64, setters ...TransportOption) *http.Client {
+	return &http.Client{
+		Transport: NewRoundTripper(http.DefaultTransport, limit, setters...),
+	}
+}
+
+// WrapClient returns a copy of the client that throttles its requests with the specified throttler.
+// The settings of the client, like Timeout, Jar and CheckRedirect, are preserved, and its transport,
+// http.DefaultTransport if there is none, is wrapped. The client itself is left intact.
+func WrapClient(client *http.Client, throttler *Throttler, setters ...TransportOption) *http.Client {
+	wrapped := &http.Client{}
+
+	if client != nil {
+		*wrapped = *client
+	}
+
+	wrapped.Transport = NewRoundTripperWith(wrapped.Transport, throttler, setters...)
+
+	return wrapped
+}
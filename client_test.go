@@ -0,0 +1,93 @@
+package throttle_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestNewClient(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := throttle.NewClient(1, throttle.WithClock(clock))
+
+	if err := doRequest(client, context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	done := goRequest(client, server.URL)
+	clock.BlockUntilSleepers(1)
+
+	if actual := received.Load(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 1 request, but got %d", actual))
+	}
+
+	clock.Advance(time.Second)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+}
+
+func TestWrapClient(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	jar, _ := cookiejar.New(nil)
+	checkRedirect := func(*http.Request, []*http.Request) error { return nil }
+
+	var sent int
+
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	original := &http.Client{
+		Transport:     transport,
+		Timeout:       time.Minute,
+		Jar:           jar,
+		CheckRedirect: checkRedirect,
+	}
+
+	client := throttle.WrapClient(original, throttle.New(1, throttle.WithClock(clock)))
+
+	if client == original {
+		t.Fatal("Expected a copy of the client")
+	}
+
+	if client.Timeout != time.Minute || client.Jar != jar || client.CheckRedirect == nil {
+		t.Fatal("Expected the settings of the client to be preserved")
+	}
+
+	if _, ok := original.Transport.(*throttle.ThrottledRoundTripper); ok {
+		t.Fatal("Expected the original client to be left intact")
+	}
+
+	if err := doRequest(client, context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	done := goRequest(client, server.URL)
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Second)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if sent != 2 || received.Load() != 2 {
+		t.Fatal(fmt.Sprintf("Expected the requests to go through the original transport, but got %d", sent))
+	}
+
+	// a client without a transport gets the default one
+	if err := doRequest(throttle.WrapClient(&http.Client{}, throttle.New(1)), context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+}
@@ -0,0 +1,154 @@
+package throttle
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipKeyer derives the key of a request from the address of the client that has sent it.
+type ipKeyer struct {
+	// forwarded makes the keyer trust the forwarding headers of every request
+	forwarded bool
+	// trusted are the networks of the proxies whose forwarding headers are trusted
+	trusted []netip.Prefix
+	// prefix is the length of the networks the IPv6 addresses are reduced to, 0 to keep them whole
+	prefix int
+}
+
+// key returns the address of the client, reduced to its network for IPv6 if configured so.
+func (k ipKeyer) key(request *http.Request) string {
+	client, ok := k.client(request)
+
+	if !ok {
+		return request.RemoteAddr
+	}
+
+	if client.Is6() && k.prefix > 0 {
+		if network, err := client.Prefix(k.prefix); err == nil {
+			return network.String()
+		}
+	}
+
+	return client.String()
+}
+
+// client returns the address of the client, taken from RemoteAddr or, if the forwarding headers are trusted,
+// from X-Forwarded-For or X-Real-IP. It reports false if RemoteAddr is not an address.
+func (k ipKeyer) client(request *http.Request) (netip.Addr, bool) {
+	remote, ok := parseIP(request.RemoteAddr)
+
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	switch {
+	case k.trusted != nil:
+		if k.isTrusted(remote) {
+			return k.behindProxies(request, remote), true
+		}
+	case k.forwarded:
+		if ip, ok := parseIP(firstForwarded(request)); ok {
+			return ip, true
+		}
+	}
+
+	return remote, true
+}
+
+// behindProxies walks the X-Forwarded-For chain from right to left past the trusted proxies and returns the first untrusted hop,
+// or, if the chain is malformed, the remote address.
+func (k ipKeyer) behindProxies(request *http.Request, remote netip.Addr) netip.Addr {
+	values := request.Header.Values("X-Forwarded-For")
+
+	if len(values) == 0 {
+		if ip, ok := parseIP(request.Header.Get("X-Real-IP")); ok {
+			return ip
+		}
+
+		return remote
+	}
+
+	hops := strings.Split(strings.Join(values, ","), ",")
+	client := remote
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseIP(hops[i])
+
+		if !ok {
+			return remote
+		}
+
+		client = ip
+
+		if !k.isTrusted(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// isTrusted reports whether the address belongs to a trusted proxy.
+func (k ipKeyer) isTrusted(ip netip.Addr) bool {
+	for _, network := range k.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// firstForwarded returns the client address set by a proxy, the first one of X-Forwarded-For taking precedence over X-Real-IP.
+func firstForwarded(request *http.Request) string {
+	if value := request.Header.Get("X-Forwarded-For"); value != "" {
+		first, _, _ := strings.Cut(value, ",")
+
+		return first
+	}
+
+	return request.Header.Get("X-Real-IP")
+}
+
+// parseIP parses an address with or without a port, unmapping the IPv4 addresses embedded into IPv6 ones.
+func parseIP(addr string) (netip.Addr, bool) {
+	host := strings.TrimSpace(addr)
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return ip.Unmap().WithZone(""), true
+}
+
+// parseNetworks parses the networks in the CIDR notation, taking the bare addresses for the networks of a single address.
+func parseNetworks(cidrs []string) ([]netip.Prefix, error) {
+	networks := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		if ip, err := netip.ParseAddr(cidr); err == nil {
+			networks = append(networks, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+
+			continue
+		}
+
+		network, err := netip.ParsePrefix(cidr)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+		}
+
+		networks = append(networks, network.Masked())
+	}
+
+	return networks, nil
+}
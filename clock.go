@@ -7,6 +7,13 @@ type Clock interface {
 	Sleep(dur time.Duration)
 }
 
+// TimerClock is a Clock that can also deliver interruptible timers.
+// Operations that may be cancelled, like AcquireContext, wait on After instead of Sleep.
+type TimerClock interface {
+	Clock
+	After(dur time.Duration) <-chan time.Time
+}
+
 type DefaultClock struct{}
 
 func (c *DefaultClock) Now() time.Time {
@@ -16,3 +23,47 @@ func (c *DefaultClock) Now() time.Time {
 func (c *DefaultClock) Sleep(dur time.Duration) {
 	time.Sleep(dur)
 }
+
+func (c *DefaultClock) After(dur time.Duration) <-chan time.Time {
+	return time.After(dur)
+}
+
+// sleepingClock adapts a Clock that can only sleep to TimerClock.
+// After runs Sleep in a separate goroutine, so an abandoned timer keeps sleeping until it expires.
+type sleepingClock struct {
+	Clock
+}
+
+func (c *sleepingClock) After(dur time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+
+	go func() {
+		c.Sleep(dur)
+		ch <- c.Now()
+	}()
+
+	return ch
+}
+
+// toTimerClock returns the clock as is if it implements TimerClock, otherwise wraps it into an adapter.
+func toTimerClock(clock Clock) TimerClock {
+	if clock == nil {
+		return nil
+	}
+
+	if tc, ok := clock.(TimerClock); ok {
+		return tc
+	}
+
+	return &sleepingClock{clock}
+}
+
+// nowFuncClock takes the current time from a function and waits in real time.
+type nowFuncClock struct {
+	DefaultClock
+	now func() time.Time
+}
+
+func (c *nowFuncClock) Now() time.Time {
+	return c.now()
+}
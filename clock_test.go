@@ -0,0 +1,131 @@
+package throttle_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// legacyClock hides everything but the original Clock methods of the wrapped clock.
+type legacyClock struct {
+	clock throttle.Clock
+}
+
+func (c *legacyClock) Now() time.Time {
+	return c.clock.Now()
+}
+
+func (c *legacyClock) Sleep(dur time.Duration) {
+	c.clock.Sleep(dur)
+}
+
+func TestThrottler_AcquireContext_Interrupted(t *testing.T) {
+	useCases := []struct {
+		Name  string
+		Clock func(clock *throttletest.ManualClock) throttle.Clock
+	}{
+		{
+			Name: "timer clock",
+			Clock: func(clock *throttletest.ManualClock) throttle.Clock {
+				return clock
+			},
+		},
+		{
+			Name: "legacy clock",
+			Clock: func(clock *throttletest.ManualClock) throttle.Clock {
+				return &legacyClock{clock}
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			throttler := throttle.New(2, throttle.WithClock(useCase.Clock(clock)))
+
+			for range 2 {
+				if err := throttler.AcquireContext(context.Background()); err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelled := make(chan error, 1)
+
+			go func() {
+				cancelled <- throttler.AcquireContext(ctx)
+			}()
+
+			clock.BlockUntilSleepers(1)
+			cancel()
+
+			select {
+			case err := <-cancelled:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected the cancelled call to return without advancing the clock")
+			}
+
+			// the cancelled call must give its slot back, so that 2 of the next 3 calls fit into the next window
+			admitted := make(chan time.Time, 3)
+
+			for i := range 3 {
+				go func() {
+					if err := throttler.AcquireContext(context.Background()); err == nil {
+						admitted <- clock.Now()
+					}
+				}()
+
+				// the abandoned timer of the cancelled call is still pending
+				clock.BlockUntilSleepers(i + 2)
+			}
+
+			clock.Advance(time.Second)
+
+			for range 2 {
+				if actual := <-admitted; !actual.Equal(epoch.Add(time.Second)) {
+					t.Fatal(fmt.Sprintf("Expected to be admitted at %s, but got %s", epoch.Add(time.Second), actual))
+				}
+			}
+
+			if actual := clock.Sleepers(); actual != 1 {
+				t.Fatal(fmt.Sprintf("Expected 1 call to wait for the following window, but got %d", actual))
+			}
+
+			clock.Advance(time.Second)
+
+			if actual := <-admitted; !actual.Equal(epoch.Add(time.Second * 2)) {
+				t.Fatal(fmt.Sprintf("Expected to be admitted at %s, but got %s", epoch.Add(time.Second*2), actual))
+			}
+		})
+	}
+}
+
+func TestThrottler_AcquireContext_DefaultClock(t *testing.T) {
+	throttler := throttle.New(1)
+
+	if err := throttler.AcquireContext(context.Background()); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	ts := time.Now()
+	err := throttler.AcquireContext(ctx)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(fmt.Sprintf("Expected context.DeadlineExceeded, but got %v", err))
+	}
+
+	if elapsed := time.Since(ts); elapsed > time.Millisecond*500 {
+		t.Fatal(fmt.Sprintf("Expected to return once the context is done, but waited %s", elapsed))
+	}
+}
@@ -0,0 +1,45 @@
+package throttle
+
+import "sync"
+
+// keyedConcurrency caps the number of requests in flight per key.
+type keyedConcurrency struct {
+	mu     sync.Mutex
+	max    int
+	counts map[string]int
+}
+
+func newKeyedConcurrency(max int) *keyedConcurrency {
+	return &keyedConcurrency{
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// acquire takes a slot of the key and reports whether there was one.
+func (c *keyedConcurrency) acquire(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] >= c.max {
+		return false
+	}
+
+	c.counts[key]++
+
+	return true
+}
+
+// release gives back a slot of the key, forgetting the key once it has nothing in flight.
+func (c *keyedConcurrency) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+
+		return
+	}
+
+	c.counts[key]--
+}
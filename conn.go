@@ -0,0 +1,222 @@
+package throttle
+
+import (
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// pacedConn paces the reads and the writes of the underlying connection, each direction by a throttler of its own.
+	pacedConn struct {
+		net.Conn
+		reader    *Throttler
+		writer    *Throttler
+		done      chan struct{}
+		closed    sync.Once
+		deadlines deadlines
+		// readMu serializes the reads, which may leave the bytes read but not admitted yet in pending
+		readMu     sync.Mutex
+		pending    []byte
+		pendingErr error
+		writeMu    sync.Mutex
+	}
+
+	// deadlines holds the read and the write deadlines of a connection, which bound the waits for the limit.
+	deadlines struct {
+		mu    sync.Mutex
+		read  time.Time
+		write time.Time
+	}
+)
+
+// NewConn creates a connection that reads and writes at most the specified number of bytes per window each, one second by default,
+// 0 meaning no limit for the direction. A read returns up to a window worth of bytes, and a write is split into writes of up to a window worth of bytes.
+// The deadlines are passed to the underlying connection and bound the waits for the limit as well: a read or a write that would be admitted
+// after the deadline waits until the deadline and fails with a timeout error, as the underlying connection does. The bytes read before
+// are kept for the next read. A deadline changed while a read or a write waits for the limit applies from the next one on.
+// Closing the connection stops the pending waits.
+func NewConn(conn net.Conn, readBps, writeBps uint64, setters ...Option) net.Conn {
+	return &pacedConn{
+		Conn:   conn,
+		reader: New(readBps, setters...),
+		writer: New(writeBps, setters...),
+		done:   make(chan struct{}),
+	}
+}
+
+// Read reads up to a window worth of bytes and returns them once the read throttler admits them.
+func (c *pacedConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(p) == 0 {
+		return c.Conn.Read(p)
+	}
+
+	p = p[:chunkSize(c.reader, len(p))]
+
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+
+		if err := c.admit(c.reader, n, c.deadlines.get(true)); err != nil {
+			return 0, c.opError("read", err)
+		}
+
+		c.pending = c.pending[n:]
+
+		if len(c.pending) > 0 {
+			return n, nil
+		}
+
+		err := c.pendingErr
+		c.pending, c.pendingErr = nil, nil
+
+		return n, err
+	}
+
+	n, err := c.Conn.Read(p)
+
+	if n > 0 {
+		if admitErr := c.admit(c.reader, n, c.deadlines.get(true)); admitErr != nil {
+			c.pending = append([]byte(nil), p[:n]...)
+			c.pendingErr = err
+
+			return 0, c.opError("read", admitErr)
+		}
+	}
+
+	return n, err
+}
+
+// Write writes the bytes in chunks of up to a window worth of bytes, each once the write throttler admits it.
+func (c *pacedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var written int
+
+	for len(p) > 0 {
+		chunk := p[:chunkSize(c.writer, len(p))]
+
+		if err := c.admit(c.writer, len(chunk), c.deadlines.get(false)); err != nil {
+			return written, c.opError("write", err)
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close stops the pending waits and closes the underlying connection.
+func (c *pacedConn) Close() error {
+	c.closed.Do(func() {
+		close(c.done)
+	})
+
+	return c.Conn.Close()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *pacedConn) SetDeadline(t time.Time) error {
+	c.deadlines.set(true, true, t)
+
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (c *pacedConn) SetReadDeadline(t time.Time) error {
+	c.deadlines.set(true, false, t)
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection.
+func (c *pacedConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines.set(false, true, t)
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// admit waits for n slots of the throttler, see acquireUntil.
+func (c *pacedConn) admit(throttler *Throttler, n int, deadline time.Time) error {
+	_, err := throttler.acquireUntil(uint64(n), deadline, c.done)
+
+	return err
+}
+
+// acquireUntil waits for n slots, unless they would be admitted after the deadline, if any,
+// in which case it waits until the deadline instead and returns os.ErrDeadlineExceeded without taking them.
+// If done is closed while waiting, the slots are given back and net.ErrClosed is returned.
+func (t *Throttler) acquireUntil(n uint64, deadline time.Time, done <-chan struct{}) (reservation, error) {
+	maxWait := time.Duration(math.MaxInt64)
+
+	if !deadline.IsZero() {
+		maxWait = deadline.Sub(t.clock.Now())
+	}
+
+	res, ok := t.reserveWithin(n, maxWait)
+
+	if !ok {
+		res.wait = max(maxWait, 0)
+	}
+
+	if res.wait > 0 {
+		select {
+		case <-t.clock.After(res.wait):
+		case <-done:
+			if ok {
+				t.cancel(res)
+			}
+
+			return reservation{}, net.ErrClosed
+		}
+	}
+
+	if !ok {
+		return reservation{}, os.ErrDeadlineExceeded
+	}
+
+	return res, nil
+}
+
+// opError wraps the error the way the errors of the connections are.
+func (c *pacedConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// set sets the read deadline, the write one, or both.
+func (d *deadlines) set(read, write bool, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if read {
+		d.read = t
+	}
+
+	if write {
+		d.write = t
+	}
+}
+
+// get returns the read or the write deadline.
+func (d *deadlines) get(read bool) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if read {
+		return d.read
+	}
+
+	return d.write
+}
@@ -0,0 +1,194 @@
+package throttle_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// recordingConn records the bytes written per window as they are passed to the connection.
+type recordingConn struct {
+	net.Conn
+	writes *windowWriter
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.writes.Write(p)
+
+	return c.Conn.Write(p)
+}
+
+func TestNewConn(t *testing.T) {
+	payload := strings.Repeat("0123456789", 5)
+
+	t.Run("write", func(t *testing.T) {
+		clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+		client, server := net.Pipe()
+		dst := newWindowWriter(clock)
+		conn := throttle.NewConn(&recordingConn{client, dst}, 0, 20, throttle.WithClock(clock))
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+
+			io.Copy(io.Discard, server)
+		}()
+
+		if n, err := conn.Write([]byte(payload)); n != len(payload) || err != nil {
+			t.Fatal(fmt.Sprintf("Expected to write %d bytes, but got %d and %v", len(payload), n, err))
+		}
+
+		conn.Close()
+		<-done
+
+		if dst.buf.String() != payload {
+			t.Fatal(fmt.Sprintf("Expected %q to be written, but got %q", payload, dst.buf.String()))
+		}
+
+		expected := map[time.Duration]int{0: 20, time.Second: 20, time.Second * 2: 10}
+
+		for window, total := range expected {
+			if dst.totals[window] != total {
+				t.Fatal(fmt.Sprintf("Expected %d bytes to be written at %s, but got %d", total, window, dst.totals[window]))
+			}
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+		client, server := net.Pipe()
+		conn := throttle.NewConn(client, 20, 0, throttle.WithClock(clock))
+
+		go func() {
+			server.Write([]byte(payload))
+			server.Close()
+		}()
+
+		dst := newWindowWriter(clock)
+
+		if _, err := io.CopyBuffer(dst, conn, make([]byte, 64)); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		if dst.buf.String() != payload {
+			t.Fatal(fmt.Sprintf("Expected %q to be read, but got %q", payload, dst.buf.String()))
+		}
+
+		expected := map[time.Duration]int{0: 20, time.Second: 20, time.Second * 2: 10}
+
+		for window, total := range expected {
+			if dst.totals[window] != total {
+				t.Fatal(fmt.Sprintf("Expected %d bytes to be read at %s, but got %d", total, window, dst.totals[window]))
+			}
+		}
+	})
+
+	t.Run("addresses", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		conn := throttle.NewConn(client, 1, 1)
+		defer conn.Close()
+
+		if conn.LocalAddr() != client.LocalAddr() || conn.RemoteAddr() != client.RemoteAddr() {
+			t.Fatal("Expected the addresses of the underlying connection")
+		}
+	})
+}
+
+func TestNewConn_ReadDeadline(t *testing.T) {
+	// the deadlines of the pipe are in real time
+	start := time.Now()
+	clock := throttletest.NewManualClock(start)
+	client, server := net.Pipe()
+	conn := throttle.NewConn(client, 10, 0, throttle.WithClock(clock))
+
+	defer conn.Close()
+	defer server.Close()
+
+	go server.Write([]byte(strings.Repeat("x", 20)))
+
+	buf := make([]byte, 64)
+
+	if n, err := conn.Read(buf); n != 10 || err != nil {
+		t.Fatal(fmt.Sprintf("Expected to read 10 bytes, but got %d and %v", n, err))
+	}
+
+	conn.SetReadDeadline(start.Add(time.Minute))
+	conn.SetReadDeadline(start.Add(time.Millisecond * 500))
+
+	done := make(chan error, 1)
+
+	go func() {
+		n, err := conn.Read(buf)
+
+		if n != 0 {
+			t.Error(fmt.Sprintf("Expected no bytes, but got %d", n))
+		}
+
+		done <- err
+	}()
+
+	// the next window opens after the deadline, so the read waits until the deadline only
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Millisecond * 500)
+
+	var netErr net.Error
+
+	if err := <-done; !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal(fmt.Sprintf("Expected a timeout error, but got %v", err))
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	go func() {
+		n, err := conn.Read(buf)
+
+		if n != 10 || err != nil {
+			t.Error(fmt.Sprintf("Expected the bytes read before the deadline, but got %d and %v", n, err))
+		}
+
+		done <- err
+	}()
+
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Millisecond * 500)
+	<-done
+}
+
+func TestNewConn_Close(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	client, server := net.Pipe()
+	conn := throttle.NewConn(client, 0, 10, throttle.WithClock(clock))
+
+	go io.Copy(io.Discard, server)
+
+	done := make(chan error, 1)
+	var written int
+
+	go func() {
+		var err error
+
+		written, err = conn.Write([]byte(strings.Repeat("x", 25)))
+		done <- err
+	}()
+
+	// the pending write gives up once the connection is closed, without waiting for the clock
+	clock.BlockUntilSleepers(1)
+	conn.Close()
+
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatal(fmt.Sprintf("Expected net.ErrClosed, but got %v", err))
+	}
+
+	if written != 10 {
+		t.Fatal(fmt.Sprintf("Expected 10 bytes to be written, but got %d", written))
+	}
+}
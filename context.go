@@ -0,0 +1,49 @@
+package throttle
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	throttlerKey struct{}
+
+	bypassKey struct{}
+
+	waitKey struct{}
+)
+
+// WithRequestThrottler returns a copy of the context that makes the throttled RoundTripper acquire on the specified throttler.
+// The override fully replaces the throttlers of the transport for the request rather than adding to them.
+func WithRequestThrottler(ctx context.Context, throttler *Throttler) context.Context {
+	return context.WithValue(ctx, throttlerKey{}, throttler)
+}
+
+// requestThrottler returns the throttler set by WithRequestThrottler, if any.
+func requestThrottler(ctx context.Context) *Throttler {
+	throttler, _ := ctx.Value(throttlerKey{}).(*Throttler)
+
+	return throttler
+}
+
+// WithBypass returns a copy of the context that makes the throttled RoundTripper send the request right away, regardless of the limit.
+// The bypassed requests don't take any slots, unless the transport is configured with WithBypassCounted.
+// Bypassing is only possible through the context, so it can't be triggered by the request itself, e.g. by its headers.
+func WithBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+// bypassed reports whether the context has been made by WithBypass.
+func bypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassKey{}).(bool)
+
+	return bypass
+}
+
+// WaitFromContext returns the time the request has spent waiting for the throttled RoundTripper configured with WithWaitContext.
+// The context is the one of the request passed to the underlying transport, which is available as the Request of the response.
+func WaitFromContext(ctx context.Context) (time.Duration, bool) {
+	wait, ok := ctx.Value(waitKey{}).(time.Duration)
+
+	return wait, ok
+}
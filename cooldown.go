@@ -0,0 +1,133 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCooldownStatuses are the statuses WithErrorCooldown counts as failures by default.
+var DefaultCooldownStatuses = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// cooldown holds the requests for a while after a run of failures, then lets a single probe through before reopening.
+type cooldown struct {
+	mu        sync.Mutex
+	clock     TimerClock
+	threshold int
+	duration  time.Duration
+	statuses  map[int]bool
+	failFast  bool
+	failures  int
+	until     time.Time
+	open      bool
+	probe     chan struct{}
+}
+
+func newCooldown(clock TimerClock, threshold int, duration time.Duration, statuses []int, failFast bool) *cooldown {
+	c := &cooldown{
+		clock:     clock,
+		threshold: max(threshold, 1),
+		duration:  duration,
+		statuses:  make(map[int]bool, len(statuses)),
+		failFast:  failFast,
+	}
+
+	for _, status := range statuses {
+		c.statuses[status] = true
+	}
+
+	return c
+}
+
+// enter waits until the request may be sent, or rejects it in the fail-fast mode.
+// It reports whether the request is the probe, whose outcome decides whether to reopen.
+func (c *cooldown) enter(ctx context.Context) (bool, error) {
+	for {
+		c.mu.Lock()
+
+		if !c.open {
+			c.mu.Unlock()
+
+			return false, nil
+		}
+
+		now := c.clock.Now()
+		wait := c.until.Sub(now)
+		probe := c.probe
+
+		// the cooldown is over and no probe is in flight, so this request becomes the one
+		if wait <= 0 && probe == nil {
+			c.probe = make(chan struct{})
+			c.mu.Unlock()
+
+			return true, nil
+		}
+
+		c.mu.Unlock()
+
+		if c.failFast {
+			return false, fmt.Errorf("%w, retry after %s", ErrCooldown, max(wait, 0))
+		}
+
+		var next <-chan time.Time
+
+		// the requests wait for the end of the cooldown or, once it's over, for the outcome of the probe
+		if wait > 0 {
+			next = c.clock.After(wait)
+		}
+
+		select {
+		case <-next:
+		case <-probe:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// record counts the outcome of a sent request, opening the cooldown after the threshold of consecutive failures.
+func (c *cooldown) record(probe bool, response *http.Response, err error) {
+	failed := err != nil || c.statuses[response.StatusCode]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if probe {
+		close(c.probe)
+		c.probe = nil
+	}
+
+	if !failed {
+		c.failures = 0
+		c.open = false
+
+		return
+	}
+
+	c.failures++
+
+	if probe || c.failures >= c.threshold {
+		c.open = true
+		c.until = c.clock.Now().Add(c.duration)
+	}
+}
+
+// abort gives up the probe of a request that has not been sent, so another one can take over.
+func (c *cooldown) abort(probe bool) {
+	if !probe {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	close(c.probe)
+	c.probe = nil
+}
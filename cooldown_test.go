@@ -0,0 +1,208 @@
+package throttle_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// newFlakyServer creates a server answering with the scripted statuses in turn and with 200 once they are over.
+func newFlakyServer(t *testing.T, script ...int) (*httptest.Server, *atomic.Int64) {
+	var calls atomic.Int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		i := int(calls.Add(1)) - 1
+
+		if i < len(script) {
+			w.WriteHeader(script[i])
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func TestRoundTripper_ErrorCooldown(t *testing.T) {
+	server, calls := newFlakyServer(
+		t,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable,
+	)
+
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			100,
+			throttle.WithClock(clock),
+			throttle.WithErrorCooldown(3, time.Second*10),
+		),
+	}
+
+	for i := range 3 {
+		if err := doRequest(client, context.Background(), server.URL); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error for request #%d, but got %s", i, err))
+		}
+	}
+
+	// the probe is held for the cooldown and fails
+	done := goRequest(client, server.URL)
+	clock.BlockUntilSleepers(1)
+
+	if actual := calls.Load(); actual != 3 {
+		t.Fatal(fmt.Sprintf("Expected the request to be held, but the server received %d requests", actual))
+	}
+
+	clock.Advance(time.Second * 10)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// so the cooldown starts over, and the next probe succeeds
+	done = goRequest(client, server.URL)
+	clock.BlockUntilSleepers(1)
+
+	if actual := calls.Load(); actual != 4 {
+		t.Fatal(fmt.Sprintf("Expected the request to be held, but the server received %d requests", actual))
+	}
+
+	clock.Advance(time.Second * 10)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// the transport has reopened
+	for i := range 3 {
+		if err := doRequest(client, context.Background(), server.URL); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error for request #%d, but got %s", i, err))
+		}
+	}
+
+	if actual := calls.Load(); actual != 8 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 8 requests, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_ErrorCooldown_FailFast(t *testing.T) {
+	var calls atomic.Int64
+
+	probing := make(chan struct{})
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		switch calls.Add(1) {
+		case 1, 2, 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 4:
+			close(probing)
+			<-release
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			100,
+			throttle.WithClock(clock),
+			throttle.WithErrorCooldown(3, time.Second*10),
+			throttle.WithCooldownFailFast(),
+		),
+	}
+
+	for i := range 3 {
+		if err := doRequest(client, context.Background(), server.URL); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error for request #%d, but got %s", i, err))
+		}
+	}
+
+	if err := doRequest(client, context.Background(), server.URL); !errors.Is(err, throttle.ErrCooldown) {
+		t.Fatal(fmt.Sprintf("Expected ErrCooldown, but got %v", err))
+	}
+
+	clock.Advance(time.Second * 10)
+
+	// a single probe is let through
+	done := goRequest(client, server.URL)
+	<-probing
+
+	if err := doRequest(client, context.Background(), server.URL); !errors.Is(err, throttle.ErrCooldown) {
+		t.Fatal(fmt.Sprintf("Expected ErrCooldown while probing, but got %v", err))
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if err := doRequest(client, context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected the transport to reopen, but got %s", err))
+	}
+
+	if actual := calls.Load(); actual != 5 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 5 requests, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_ErrorCooldown_Statuses(t *testing.T) {
+	var calls atomic.Int64
+
+	failure := errors.New("connection refused")
+
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if calls.Add(1) == 1 {
+			return nil, failure
+		}
+
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Request: req, Body: http.NoBody}, nil
+	})
+
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			transport,
+			100,
+			throttle.WithClock(throttletest.NewManualClock(epoch)),
+			throttle.WithErrorCooldown(2, time.Minute),
+			throttle.WithCooldownStatuses(http.StatusTooManyRequests),
+			throttle.WithCooldownFailFast(),
+		),
+	}
+
+	// a transport error and a listed status in a row
+	if err := doRequest(client, context.Background(), "http://example.com"); !errors.Is(err, failure) {
+		t.Fatal(fmt.Sprintf("Expected the transport error, but got %v", err))
+	}
+
+	if err := doRequest(client, context.Background(), "http://example.com"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if err := doRequest(client, context.Background(), "http://example.com"); !errors.Is(err, throttle.ErrCooldown) {
+		t.Fatal(fmt.Sprintf("Expected ErrCooldown, but got %v", err))
+	}
+
+	if actual := calls.Load(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected the transport to receive 2 requests, but got %d", actual))
+	}
+}
@@ -0,0 +1,110 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// DefaultChunkSize is the size of the chunks Copy reads and writes by default.
+const DefaultChunkSize = 32 << 10
+
+type (
+	// CopyOption configures Copy.
+	// Throttler options, like WithClock and WithWindow, are copy options too.
+	CopyOption interface {
+		applyCopy(opts *copyOptions)
+	}
+
+	// copyOptions holds configuration settings for Copy.
+	copyOptions struct {
+		throttler []Option
+		chunk     int
+		progress  func(written int64, rate float64)
+	}
+
+	copyOptionFunc func(opts *copyOptions)
+)
+
+func (fn copyOptionFunc) applyCopy(opts *copyOptions) {
+	fn(opts)
+}
+
+func (o Option) applyCopy(opts *copyOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+// WithProgress sets the function Copy reports its progress to after every chunk written:
+// the number of bytes written so far and the average rate since the start, in bytes per second.
+func WithProgress(progress func(written int64, rate float64)) CopyOption {
+	return copyOptionFunc(func(opts *copyOptions) {
+		opts.progress = progress
+	})
+}
+
+// Copy copies from the reader to the writer at most the specified number of bytes per window, one second by default, until io.EOF or an error,
+// returning the number of bytes written. It gives up once the context is done, between the chunks as well as while waiting for the limit,
+// in which case the bytes read but not admitted yet are not written.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader, bytesPerSec uint64, setters ...CopyOption) (int64, error) {
+	opts := &copyOptions{}
+
+	for _, setter := range setters {
+		setter.applyCopy(opts)
+	}
+
+	throttler, err := newChunkThrottler(bytesPerSec, opts.chunk, opts.throttler)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if opts.chunk <= 0 {
+		opts.chunk = DefaultChunkSize
+	}
+
+	reader := NewPacedReader(ctx, src, throttler)
+	buf := make([]byte, opts.chunk)
+	start := throttler.clock.Now()
+
+	var written int64
+
+	for {
+		n, err := reader.Read(buf)
+
+		// the bytes read while the context has been done are not admitted
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return written, ctxErr
+		}
+
+		if n > 0 {
+			w, writeErr := dst.Write(buf[:n])
+			written += int64(w)
+
+			if writeErr == nil && w < n {
+				writeErr = io.ErrShortWrite
+			}
+
+			if writeErr != nil {
+				return written, writeErr
+			}
+
+			if opts.progress != nil {
+				var rate float64
+
+				if elapsed := throttler.clock.Now().Sub(start); elapsed > 0 {
+					rate = float64(written) / elapsed.Seconds()
+				}
+
+				opts.progress(written, rate)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package throttle_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestCopy(t *testing.T) {
+	payload := strings.Repeat("0123456789", 9) + "01234"
+
+	useCases := []struct {
+		Name      string
+		ChunkSize int
+		Writes    int
+	}{
+		{
+			Name:      "small chunks",
+			ChunkSize: 3,
+			// a chunk per third of the window
+			Writes: 32,
+		},
+		{
+			Name:      "chunks of a window",
+			ChunkSize: 10,
+			Writes:    10,
+		},
+		{
+			Name:   "default chunks",
+			Writes: 10,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			dst := newWindowWriter(clock)
+
+			var reports int
+			var last int64
+			var rate float64
+
+			n, err := throttle.Copy(
+				context.Background(),
+				dst,
+				strings.NewReader(payload),
+				10,
+				throttle.WithClock(clock),
+				throttle.WithChunkSize(useCase.ChunkSize),
+				throttle.WithProgress(func(written int64, r float64) {
+					reports++
+					last = written
+					rate = r
+				}),
+			)
+
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if n != int64(len(payload)) || dst.buf.String() != payload {
+				t.Fatal(fmt.Sprintf("Expected the payload of %d bytes to be copied, but got %d", len(payload), n))
+			}
+
+			if dst.writes != useCase.Writes || reports != useCase.Writes {
+				t.Fatal(fmt.Sprintf("Expected %d writes and progress reports, but got %d and %d", useCase.Writes, dst.writes, reports))
+			}
+
+			if last != n {
+				t.Fatal(fmt.Sprintf("Expected the last report to tell %d bytes, but got %d", n, last))
+			}
+
+			if expected := float64(n) / clock.Now().Sub(epoch).Seconds(); rate != expected {
+				t.Fatal(fmt.Sprintf("Expected the rate to be %f, but got %f", expected, rate))
+			}
+
+			for window, total := range dst.totals {
+				if total > 10 {
+					t.Fatal(fmt.Sprintf("Expected up to 10 bytes per window, but got %d at %s", total, window))
+				}
+			}
+		})
+	}
+}
+
+func TestCopy_Cancel(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	dst := newWindowWriter(clock)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	var n int64
+
+	go func() {
+		var err error
+
+		n, err = throttle.Copy(ctx, dst, strings.NewReader(strings.Repeat("x", 95)), 10, throttle.WithClock(clock))
+		done <- err
+	}()
+
+	// the second chunk waits for the next window
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	if n != 10 || dst.buf.Len() != 10 {
+		t.Fatal(fmt.Sprintf("Expected the first 10 bytes to be copied, but got %d and %d written", n, dst.buf.Len()))
+	}
+
+	if actual := clock.Now(); !actual.Equal(epoch) {
+		t.Fatal(fmt.Sprintf("Expected no time to pass, but got %s", actual.Sub(epoch)))
+	}
+}
+
+func TestCopy_Error(t *testing.T) {
+	failure := errors.New("broken pipe")
+	n, err := throttle.Copy(context.Background(), failingWriter{failure}, strings.NewReader("payload"), 10)
+
+	if n != 0 || !errors.Is(err, failure) {
+		t.Fatal(fmt.Sprintf("Expected the write error, but got %d and %v", n, err))
+	}
+
+	// the cancelled context stops the copy before the first chunk
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := throttle.Copy(ctx, io.Discard, strings.NewReader("payload"), 10); !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
@@ -0,0 +1,123 @@
+package throttle
+
+import (
+	"context"
+	"net"
+)
+
+type (
+	// DialFunc is the signature of net.Dialer.DialContext, which http.Transport.DialContext takes.
+	DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Dialer paces the connections dialed, e.g. so that the peers limiting the rate of the connections don't turn them down.
+	Dialer struct {
+		dial      DialFunc
+		throttler *Throttler
+		// hosts paces the connections per host, if set
+		hosts *KeyedThrottler[string]
+	}
+
+	// DialerOption configures the dialers of NewDialer and NewDialFunc.
+	// Throttler options, like WithClock and WithWindow, are dialer options too.
+	DialerOption interface {
+		applyDialer(opts *dialerOptions)
+	}
+
+	// dialerOptions holds configuration settings for a Dialer.
+	dialerOptions struct {
+		throttler []Option
+		perHost   uint64
+	}
+
+	dialerOptionFunc func(opts *dialerOptions)
+)
+
+func (fn dialerOptionFunc) applyDialer(opts *dialerOptions) {
+	fn(opts)
+}
+
+func (o Option) applyDialer(opts *dialerOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+// WithPerHostDials caps the number of connections per window dialed to each host as well, whatever the port,
+// keeping a throttler per host, up to DefaultMaxKeys of them.
+func WithPerHostDials(dialsPerHost uint64) DialerOption {
+	return dialerOptionFunc(func(opts *dialerOptions) {
+		opts.perHost = dialsPerHost
+	})
+}
+
+// NewDialer creates a dialer that dials at most the specified number of connections per window with the net.Dialer, one second by default,
+// 0 meaning no limit but the one of WithPerHostDials, if set. A nil dialer stands for the zero net.Dialer.
+func NewDialer(dialer *net.Dialer, dialsPerSec uint64, setters ...DialerOption) *Dialer {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	return newDialer(dialer.DialContext, dialsPerSec, setters)
+}
+
+// NewDialFunc paces the connections the dial function dials, as NewDialer does,
+// e.g. to wrap the DialContext of an http.Transport: transport.DialContext = throttle.NewDialFunc(transport.DialContext, 10).
+func NewDialFunc(dial DialFunc, dialsPerSec uint64, setters ...DialerOption) DialFunc {
+	return newDialer(dial, dialsPerSec, setters).DialContext
+}
+
+func newDialer(dial DialFunc, dialsPerSec uint64, setters []DialerOption) *Dialer {
+	opts := &dialerOptions{}
+
+	for _, setter := range setters {
+		setter.applyDialer(opts)
+	}
+
+	d := &Dialer{
+		dial:      dial,
+		throttler: New(dialsPerSec, opts.throttler...),
+	}
+
+	if opts.perHost > 0 {
+		keyed := []KeyedOption{WithMaxKeys(DefaultMaxKeys), WithKeyNormalizer(HostKey)}
+
+		for _, o := range opts.throttler {
+			keyed = append(keyed, o)
+		}
+
+		d.hosts = NewKeyed[string](opts.perHost, keyed...)
+	}
+
+	return d
+}
+
+// Dial dials the address once the limits admit the connection, see DialContext.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials the address once the limit of its host, if any, and then the limit of the dialer admit the connection.
+// If the context is done while waiting, the address is not dialed, the slot of the host is given back, and the error of the context is returned.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var (
+		host *Throttler
+		res  reservation
+	)
+
+	if d.hosts != nil {
+		var err error
+
+		if host, res, err = d.hosts.acquireContext(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := d.throttler.AcquireContext(ctx); err != nil {
+		// the dial given up on doesn't take the quota of the host
+		if host != nil {
+			host.cancel(res)
+		}
+
+		return nil, err
+	}
+
+	return d.dial(ctx, network, addr)
+}
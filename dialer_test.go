@@ -0,0 +1,211 @@
+package throttle_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// stubDial records the addresses dialed along with the time, and dials in-memory connections.
+type stubDial struct {
+	clock *throttletest.ManualClock
+	mu    sync.Mutex
+	addrs []string
+	times []time.Duration
+}
+
+func (d *stubDial) DialContext(_ context.Context, _, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.addrs = append(d.addrs, addr)
+	d.times = append(d.times, d.clock.Now().Sub(epoch))
+
+	client, _ := net.Pipe()
+
+	return client, nil
+}
+
+func TestNewDialFunc(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Limit   uint64
+		Options []throttle.DialerOption
+		Addrs   []string
+		Times   []time.Duration
+	}{
+		{
+			Name:  "limit",
+			Limit: 2,
+			Addrs: []string{"a:25", "b:25", "c:25", "d:25", "e:25"},
+			Times: []time.Duration{0, 0, time.Second, time.Second, 2 * time.Second},
+		},
+		{
+			Name:    "limit per host",
+			Options: []throttle.DialerOption{throttle.WithPerHostDials(1)},
+			Addrs:   []string{"a:25", "b:25", "A:587", "b:25", "c:25"},
+			// the clock has moved on to the next window by the time the second dial to b waits
+			Times: []time.Duration{0, 0, time.Second, time.Second, time.Second},
+		},
+		{
+			Name:    "both limits",
+			Limit:   2,
+			Options: []throttle.DialerOption{throttle.WithPerHostDials(1)},
+			Addrs:   []string{"a:25", "b:25", "a:25", "c:25", "d:25"},
+			Times:   []time.Duration{0, 0, time.Second, time.Second, 2 * time.Second},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			stub := &stubDial{clock: clock}
+			dial := throttle.NewDialFunc(stub.DialContext, useCase.Limit, append(useCase.Options, throttle.WithClock(clock))...)
+
+			for _, addr := range useCase.Addrs {
+				conn, err := dial(context.Background(), "tcp", addr)
+
+				if err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+
+				conn.Close()
+			}
+
+			if !reflect.DeepEqual(stub.addrs, useCase.Addrs) {
+				t.Fatal(fmt.Sprintf("Expected %v to be dialed, but got %v", useCase.Addrs, stub.addrs))
+			}
+
+			if !reflect.DeepEqual(stub.times, useCase.Times) {
+				t.Fatal(fmt.Sprintf("Expected the dials at %v, but got %v", useCase.Times, stub.times))
+			}
+		})
+	}
+}
+
+func TestDialer_Cancel(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	stub := &stubDial{clock: clock}
+	dial := throttle.NewDialFunc(stub.DialContext, 1, throttle.WithClock(clock))
+
+	conn, err := dial(context.Background(), "tcp", "a:25")
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := dial(ctx, "tcp", "b:25")
+		done <- err
+	}()
+
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	if len(stub.addrs) != 1 {
+		t.Fatal(fmt.Sprintf("Expected the cancelled dial not to reach the dial func, but got %v", stub.addrs))
+	}
+
+	// a done context fails the dial right away, so the net.Dialer doesn't reach the network
+	dialer := throttle.NewDialer(&net.Dialer{}, 1, throttle.WithClock(clock))
+
+	if _, err := dialer.DialContext(ctx, "tcp", "127.0.0.1:1"); !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+}
+
+func TestDialer_CancelGivesBackHostSlot(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	stub := &stubDial{clock: clock}
+	dial := throttle.NewDialFunc(stub.DialContext, 2, throttle.WithPerHostDials(1), throttle.WithClock(clock))
+
+	dialAt := func(addr string) {
+		conn, err := dial(context.Background(), "tcp", addr)
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		conn.Close()
+	}
+
+	// the window of the dialer starts before the one of the host
+	dialAt("a:25")
+	clock.Advance(time.Millisecond * 500)
+	dialAt("c:25")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	// the slot of the host is taken, but the dialer's limit is reached
+	go func() {
+		_, err := dial(ctx, "tcp", "b:25")
+		done <- err
+	}()
+
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	go func() {
+		_, err := dial(context.Background(), "tcp", "b:25")
+		done <- err
+	}()
+
+	// the host has its slot back, so only the dialer's window holds the dial
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Millisecond * 500)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the dial to be admitted once the window of the dialer is over")
+	}
+
+	expected := []time.Duration{0, time.Millisecond * 500, time.Second}
+
+	if !reflect.DeepEqual(stub.times, expected) {
+		t.Fatal(fmt.Sprintf("Expected the dials at %v, but got %v", expected, stub.times))
+	}
+}
+
+func TestNewDialer_Nil(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	defer listener.Close()
+
+	conn, err := throttle.NewDialer(nil, 1).DialContext(context.Background(), "tcp", listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected the zero net.Dialer to dial, but got %s", err))
+	}
+
+	conn.Close()
+}
@@ -0,0 +1,37 @@
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLimitExceeded is returned when an operation is rejected instead of waiting for the rate limit.
+var ErrLimitExceeded = errors.New("rate limit exceeded")
+
+// ErrCooldown is returned when a request is rejected while the transport cools down after a run of failures, see WithErrorCooldown.
+var ErrCooldown = errors.New("cooling down after failures")
+
+// ErrAlreadyRegistered is returned when a throttler is registered under a name that is already taken, see Registry.
+var ErrAlreadyRegistered = errors.New("throttler already registered")
+
+// LimitError is returned when an operation is rejected instead of waiting for the rate limit.
+// It matches ErrLimitExceeded with errors.Is.
+type LimitError struct {
+	// RetryAfter is the estimated time after which the operation would be admitted, 0 if unknown.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *LimitError) Error() string {
+	if e.RetryAfter <= 0 {
+		return ErrLimitExceeded.Error()
+	}
+
+	return fmt.Sprintf("%s, retry after %s", ErrLimitExceeded, e.RetryAfter)
+}
+
+// Unwrap returns ErrLimitExceeded.
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
@@ -0,0 +1,78 @@
+package throttle
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// Exemptions lists the keys and the networks of the clients the middleware lets through without a limit, see WithExemptions.
+// The lists can be swapped at runtime, e.g. on a configuration reload, and the change applies to the next requests.
+// It is safe for concurrent use.
+type Exemptions struct {
+	mu       sync.RWMutex
+	keys     map[string]bool
+	networks []netip.Prefix
+}
+
+// NewExemptions creates a new instance of Exemptions with empty lists.
+func NewExemptions() *Exemptions {
+	return &Exemptions{
+		keys: make(map[string]bool),
+	}
+}
+
+// SetKeys replaces the exempted keys. The keys are compared to the ones the middleware extracts,
+// while for WithKeyByHeader they are compared to the header values.
+func (e *Exemptions) SetKeys(keys ...string) {
+	set := make(map[string]bool, len(keys)*2)
+
+	for _, key := range keys {
+		set[key] = true
+		// the middleware keyed by a header only knows the hashes of the values
+		set[hashKey(key)] = true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.keys = set
+}
+
+// SetCIDRs replaces the exempted networks, in the CIDR notation or as bare addresses.
+// If one of them can't be parsed, the lists are left intact and the error is returned.
+func (e *Exemptions) SetCIDRs(cidrs ...string) error {
+	networks, err := parseNetworks(cidrs)
+
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.networks = networks
+
+	return nil
+}
+
+// exempt reports whether the request of the key, sent by the client, is exempted.
+func (e *Exemptions) exempt(key string, client netip.Addr) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if key != "" && e.keys[key] {
+		return true
+	}
+
+	if !client.IsValid() {
+		return false
+	}
+
+	for _, network := range e.networks {
+		if network.Contains(client) {
+			return true
+		}
+	}
+
+	return false
+}
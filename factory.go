@@ -0,0 +1,34 @@
+package throttle
+
+import "net/http"
+
+// TransportFactory produces throttled RoundTrippers sharing a limiter, e.g. for several clients with different settings
+// that must all stay within a single upstream quota.
+type TransportFactory struct {
+	limiter Limiter
+	base    []TransportOption
+}
+
+// NewTransportFactory creates a new instance of TransportFactory with the shared limiter and the options every transport gets.
+func NewTransportFactory(limiter Limiter, base ...TransportOption) *TransportFactory {
+	if limiter == nil {
+		panic("throttle: nil limiter")
+	}
+
+	return &TransportFactory{
+		limiter: limiter,
+		base:    base,
+	}
+}
+
+// Wrap creates a throttled RoundTripper on top of the transport, paced by the shared limiter.
+// The extra options apply to this transport alone and override the base ones.
+// Only the shared limiter is common to the produced transports: the throttlers a transport creates by itself,
+// e.g. the ones of WithRouteLimits, as well as its counters, are its own.
+func (f *TransportFactory) Wrap(transport http.RoundTripper, extra ...TransportOption) *ThrottledRoundTripper {
+	setters := make([]TransportOption, 0, len(f.base)+len(extra))
+	setters = append(setters, f.base...)
+	setters = append(setters, extra...)
+
+	return NewTransportWithLimiter(transport, f.limiter, setters...)
+}
@@ -0,0 +1,99 @@
+package throttle_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestTransportFactory(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+
+	var (
+		mu        sync.Mutex
+		sent      = make(map[time.Duration]int)
+		skipped   atomic.Int64
+		remaining atomic.Int64
+	)
+
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		sent[clock.Now().Sub(epoch)]++
+		mu.Unlock()
+
+		remaining.Add(-1)
+
+		return &http.Response{StatusCode: http.StatusOK, Request: req, Body: http.NoBody}, nil
+	})
+
+	factory := throttle.NewTransportFactory(throttle.New(2, throttle.WithClock(clock)), throttle.WithClock(clock))
+	clients := []*http.Client{
+		{Transport: factory.Wrap(transport)},
+		{Transport: factory.Wrap(transport, throttle.WithSkip(func(req *http.Request) bool {
+			if req.URL.Path == "/health" {
+				skipped.Add(1)
+
+				return true
+			}
+
+			return false
+		}))},
+	}
+
+	remaining.Store(12)
+	errs := make(chan error, 12)
+
+	for _, client := range clients {
+		for range 6 {
+			go func() {
+				errs <- doRequest(client, context.Background(), "http://example.com/items")
+			}()
+		}
+	}
+
+	// advance the clock once all the requests left are parked
+	for remaining.Load() > 0 {
+		<-time.After(time.Millisecond)
+
+		if left := remaining.Load(); left > 0 && int64(clock.Sleepers()) == left {
+			clock.Advance(time.Second)
+		}
+	}
+
+	for range 12 {
+		if err := <-errs; err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	// both clients share the window
+	for window := range 6 {
+		if actual := sent[time.Duration(window)*time.Second]; actual != 2 {
+			t.Fatal(fmt.Sprintf("Expected 2 requests to be sent at %ds, but got %d", window, actual))
+		}
+	}
+
+	// while the options of the second client are its own
+	if err := doRequest(clients[1], context.Background(), "http://example.com/health"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := skipped.Load(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected the second client to skip the health check, but got %d skipped", actual))
+	}
+
+	throttled := goRequest(clients[0], "http://example.com/health")
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Second)
+
+	if err := <-throttled; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+}
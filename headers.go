@@ -0,0 +1,112 @@
+package throttle
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRetryAfter returns the deadline set by the Retry-After header value,
+// which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+
+	return time.Time{}, false
+}
+
+// unixResetThreshold separates the reset values given as a Unix time from the ones given as a number of seconds.
+const unixResetThreshold = 1e9
+
+// parseRateLimit returns the remaining requests and the reset time advertised by the named headers.
+// The reset time is parsed by parseReset or, if it's nil, by parseResetTime.
+func parseRateLimit(header http.Header, remainingName, resetName string, parseReset func(value string, now time.Time) (time.Time, bool), now time.Time) (uint64, time.Time, bool) {
+	remaining, err := strconv.ParseUint(strings.TrimSpace(header.Get(remainingName)), 10, 64)
+
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	if parseReset == nil {
+		parseReset = parseResetTime
+	}
+
+	reset, ok := parseReset(header.Get(resetName), now)
+
+	if !ok {
+		return 0, time.Time{}, false
+	}
+
+	return remaining, reset, true
+}
+
+// parseResetTime returns the reset time, which is either a Unix time or a number of seconds, told apart by the magnitude of the value.
+func parseResetTime(value string, now time.Time) (time.Time, bool) {
+	reset, ok := parseSeconds(value)
+
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if reset >= unixResetThreshold {
+		secs, frac := math.Modf(reset)
+
+		return time.Unix(int64(secs), int64(frac*float64(time.Second))), true
+	}
+
+	return now.Add(time.Duration(reset * float64(time.Second))), true
+}
+
+// parseResetAfter returns the reset time given as a number of seconds, possibly fractional.
+func parseResetAfter(value string, now time.Time) (time.Time, bool) {
+	reset, ok := parseSeconds(value)
+
+	if !ok || reset >= math.MaxInt64/float64(time.Second) {
+		return time.Time{}, false
+	}
+
+	return now.Add(time.Duration(reset * float64(time.Second))), true
+}
+
+// parseSeconds parses a non-negative, possibly fractional, number of seconds.
+func parseSeconds(value string) (float64, bool) {
+	secs, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+
+	if err != nil || secs < 0 || math.IsInf(secs, 0) || math.IsNaN(secs) {
+		return 0, false
+	}
+
+	return secs, true
+}
+
+// stripHeaders returns a clone of the request without the headers, or the request itself if it has none of them.
+func stripHeaders(request *http.Request, names []string) *http.Request {
+	for _, name := range names {
+		if _, found := request.Header[http.CanonicalHeaderKey(name)]; !found {
+			continue
+		}
+
+		clone := request.Clone(request.Context())
+
+		for _, name := range names {
+			clone.Header.Del(name)
+		}
+
+		return clone
+	}
+
+	return request
+}
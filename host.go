@@ -0,0 +1,130 @@
+package throttle
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hostPattern describes a host, optionally with a port, the requests to are throttled.
+type hostPattern struct {
+	host string
+	port string
+}
+
+// newHostPatterns parses the host patterns, e.g. "api.vendor.com", "*.vendor.com" or "api.vendor.com:8443".
+func newHostPatterns(hosts []string) []hostPattern {
+	patterns := make([]hostPattern, 0, len(hosts))
+
+	for _, host := range hosts {
+		patterns = append(patterns, splitHost(host))
+	}
+
+	return patterns
+}
+
+// splitHost splits the host into the lowercase host and the port, if there is one.
+func splitHost(host string) hostPattern {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return hostPattern{host: strings.ToLower(h), port: port}
+	}
+
+	return hostPattern{host: strings.ToLower(host)}
+}
+
+// match reports whether the request host matches the pattern.
+// The port is compared only if both withPort is set and the pattern has one,
+// a request without a port having the default one of its scheme.
+func (p hostPattern) match(request *http.Request, withPort bool) bool {
+	if !matchHost(p.host, strings.ToLower(request.URL.Hostname())) {
+		return false
+	}
+
+	if !withPort || p.port == "" {
+		return true
+	}
+
+	return p.port == portOf(request)
+}
+
+// matchHost reports whether the host matches the pattern, which is either a host or a wildcard subdomain, e.g. "*.vendor.com".
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+	}
+
+	return pattern == host
+}
+
+// portOf returns the port of the request URL or the default one of its scheme.
+func portOf(request *http.Request) string {
+	if port := request.URL.Port(); port != "" {
+		return port
+	}
+
+	if request.URL.Scheme == "https" {
+		return "443"
+	}
+
+	return "80"
+}
+
+// hostThrottlers holds the throttlers of the hosts.
+type hostThrottlers struct {
+	hosts    map[string]*Throttler
+	fallback *Throttler
+}
+
+// newHostThrottlers indexes the throttlers by the lowercase hosts without ports.
+func newHostThrottlers(throttlers map[string]*Throttler, fallback *Throttler) *hostThrottlers {
+	if throttlers == nil {
+		return nil
+	}
+
+	h := &hostThrottlers{
+		hosts:    make(map[string]*Throttler, len(throttlers)),
+		fallback: fallback,
+	}
+
+	keys := make([]string, 0, len(throttlers))
+
+	for key := range throttlers {
+		keys = append(keys, key)
+	}
+
+	// a host listed with several ports ends up with the last throttler in lexical order
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h.hosts[splitHost(key).host] = throttlers[key]
+	}
+
+	return h
+}
+
+// throttlerFor returns the throttler of the request host, nil if there is none.
+func (h *hostThrottlers) throttlerFor(request *http.Request) *Throttler {
+	if throttler, found := h.hosts[strings.ToLower(request.URL.Hostname())]; found {
+		return throttler
+	}
+
+	return h.fallback
+}
+
+// throttlers returns all the throttlers of the hosts.
+func (h *hostThrottlers) throttlers() []*Throttler {
+	var out []*Throttler
+
+	if h.fallback != nil {
+		out = append(out, h.fallback)
+	}
+
+	for _, throttler := range h.hosts {
+		if throttler != nil {
+			out = append(out, throttler)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,74 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+type (
+	// inflight caps the number of requests in flight.
+	inflight chan struct{}
+
+	// releasingBody releases the in-flight slot of the request once the response body is closed.
+	releasingBody struct {
+		io.ReadCloser
+		release func()
+	}
+
+	// releasingReadWriteBody is a releasingBody of a switched protocol, whose body is writable as well.
+	releasingReadWriteBody struct {
+		*releasingBody
+		io.Writer
+	}
+)
+
+// acquire takes a slot, waiting until one is free or the context is done.
+func (s inflight) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot.
+func (s inflight) release() {
+	<-s
+}
+
+// hold keeps the slot taken until the response body is closed or the request context is done, whichever happens first.
+func (s inflight) hold(ctx context.Context, response *http.Response) {
+	if response.Body == nil {
+		s.release()
+
+		return
+	}
+
+	release := sync.OnceFunc(s.release)
+	stop := context.AfterFunc(ctx, release)
+	body := &releasingBody{
+		ReadCloser: response.Body,
+		release: func() {
+			stop()
+			release()
+		},
+	}
+
+	if w, ok := response.Body.(io.Writer); ok {
+		response.Body = &releasingReadWriteBody{releasingBody: body, Writer: w}
+
+		return
+	}
+
+	response.Body = body
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+
+	return err
+}
@@ -0,0 +1,268 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrWriterClosed is returned by the writes to a closed PacedWriter.
+	ErrWriterClosed = errors.New("write to a closed paced writer")
+
+	// ErrWriteTooLarge is returned by the writes larger than a window when they are not allowed to be split, see WithWholeWrites.
+	ErrWriteTooLarge = errors.New("write larger than the limit")
+
+	// ErrChunkTooLarge is returned by Copy when the chunk size is larger than the limit, see WithChunkSize.
+	ErrChunkTooLarge = errors.New("chunk larger than the limit")
+)
+
+type (
+	// PacedWriter paces the writes to the underlying writer, taking a slot of the limiter per byte written,
+	// e.g. to cap the bandwidth of an upload.
+	PacedWriter struct {
+		writer  io.Writer
+		limiter Limiter
+		ctx     context.Context
+		cancel  context.CancelCauseFunc
+		whole   bool
+	}
+
+	// pacedWriterTo is a PacedReader over an io.WriterTo.
+	pacedWriterTo struct {
+		*PacedReader
+	}
+
+	// pacedReaderFrom is a PacedWriter over an io.ReaderFrom.
+	pacedReaderFrom struct {
+		*PacedWriter
+	}
+
+	// ReaderOption configures the reader of NewReader.
+	// Throttler options, like WithClock and WithWindow, are reader options too.
+	ReaderOption interface {
+		applyReader(opts *readerOptions)
+	}
+
+	// readerOptions holds configuration settings for the reader of NewReader.
+	readerOptions struct {
+		throttler []Option
+		chunk     int
+	}
+
+	// WriterOption configures the writer of NewWriter.
+	// Throttler options, like WithClock and WithWindow, are writer options too.
+	WriterOption interface {
+		applyWriter(opts *writerOptions)
+	}
+
+	// writerOptions holds configuration settings for the writer of NewWriter.
+	writerOptions struct {
+		throttler []Option
+		chunk     int
+		whole     bool
+	}
+
+	writerOptionFunc func(opts *writerOptions)
+
+	// ChunkSizeOption is the option of the chunk size, which applies to NewReader, NewWriter and Copy.
+	ChunkSizeOption interface {
+		ReaderOption
+		WriterOption
+		CopyOption
+	}
+
+	chunkSizeOption int
+)
+
+func (o Option) applyReader(opts *readerOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+func (fn writerOptionFunc) applyWriter(opts *writerOptions) {
+	fn(opts)
+}
+
+func (o Option) applyWriter(opts *writerOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+// WithWholeWrites makes the writer of NewWriter pass every write to the underlying writer as a whole,
+// e.g. for the protocols that care about the boundaries of the writes, failing the ones larger than a window with ErrWriteTooLarge.
+// By default, such writes are split into several writes of up to a window worth of bytes each.
+func WithWholeWrites() WriterOption {
+	return writerOptionFunc(func(opts *writerOptions) {
+		opts.whole = true
+	})
+}
+
+// WithChunkSize splits the reads and the writes into chunks of up to the specified number of bytes, each paced on its own,
+// so that the bytes flow evenly rather than a window worth at once: the window is divided into as many shorter ones
+// as there are whole chunks in the limit, each admitting a chunk. The limit is thus rounded down to a multiple of the chunk size.
+// A chunk size larger than the limit makes NewReader and NewWriter panic, and Copy fail with ErrChunkTooLarge.
+// For Copy, it's the size of the buffer too, DefaultChunkSize by default, in which case the chunks are paced per window.
+func WithChunkSize(size int) ChunkSizeOption {
+	return chunkSizeOption(size)
+}
+
+func (o chunkSizeOption) applyReader(opts *readerOptions) {
+	opts.chunk = int(o)
+}
+
+func (o chunkSizeOption) applyWriter(opts *writerOptions) {
+	opts.chunk = int(o)
+}
+
+func (o chunkSizeOption) applyCopy(opts *copyOptions) {
+	opts.chunk = int(o)
+}
+
+// NewReader creates a reader that reads at most the specified number of bytes per window from the underlying reader, one second by default.
+// A read returns up to a window worth of bytes, so that it never waits for more than a window, while the empty reads and io.EOF pass through.
+// The reader is a PacedReader, which also implements io.WriterTo if the underlying reader does.
+func NewReader(reader io.Reader, bytesPerSec uint64, setters ...ReaderOption) io.Reader {
+	opts := &readerOptions{}
+
+	for _, setter := range setters {
+		setter.applyReader(opts)
+	}
+
+	throttler, err := newChunkThrottler(bytesPerSec, opts.chunk, opts.throttler)
+
+	if err != nil {
+		panic("throttle: WithChunkSize exceeds the limit of NewReader")
+	}
+
+	paced := NewPacedReader(context.Background(), reader, throttler)
+
+	if _, ok := reader.(io.WriterTo); ok {
+		return &pacedWriterTo{paced}
+	}
+
+	return paced
+}
+
+// NewWriter creates a writer that writes at most the specified number of bytes per window to the underlying writer, one second by default.
+// A write larger than a window is split into several writes of up to a window worth of bytes each, unless WithWholeWrites is set.
+// The writer is a PacedWriter, which also implements io.ReaderFrom if the underlying writer does.
+func NewWriter(writer io.Writer, bytesPerSec uint64, setters ...WriterOption) io.Writer {
+	opts := &writerOptions{}
+
+	for _, setter := range setters {
+		setter.applyWriter(opts)
+	}
+
+	throttler, err := newChunkThrottler(bytesPerSec, opts.chunk, opts.throttler)
+
+	if err != nil {
+		panic("throttle: WithChunkSize exceeds the limit of NewWriter")
+	}
+
+	paced := NewPacedWriter(context.Background(), writer, throttler)
+	paced.whole = opts.whole
+
+	if _, ok := writer.(io.ReaderFrom); ok {
+		return &pacedReaderFrom{paced}
+	}
+
+	return paced
+}
+
+// newChunkThrottler creates the throttler of the specified limit admitting the chunks of the specified size evenly across the window, see WithChunkSize.
+func newChunkThrottler(limit uint64, chunk int, setters []Option) (*Throttler, error) {
+	if chunk <= 0 || limit == 0 {
+		return New(limit, setters...), nil
+	}
+
+	if uint64(chunk) > limit {
+		return nil, ErrChunkTooLarge
+	}
+
+	// the shorter windows are rounded up, so that as many of them as there are chunks in the limit never take less than the window
+	window := buildOptions(setters).window
+	chunks := time.Duration(limit / uint64(chunk))
+	setters = append(setters[:len(setters):len(setters)], WithWindow((window+chunks-1)/chunks))
+
+	return New(uint64(chunk), setters...), nil
+}
+
+// NewPacedWriter creates a new instance of PacedWriter, which gives up waiting for the limiter once the context is done.
+// The limiter can be shared, e.g. to cap the total bandwidth of several writers.
+func NewPacedWriter(ctx context.Context, writer io.Writer, limiter Limiter) *PacedWriter {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	return &PacedWriter{
+		writer:  writer,
+		limiter: limiter,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Write writes the bytes in chunks of up to a window worth of bytes, each once the limiter admits it, so a write larger than the limit
+// spans as many windows as needed and returns once all its bytes are written. The limiters that don't tell their limit, unlike Throttler, take the write as a whole.
+// If the context is done or the writer is closed while waiting, the number of bytes written so far is returned along with the error.
+func (w *PacedWriter) Write(p []byte) (int, error) {
+	if err := context.Cause(w.ctx); err != nil {
+		return 0, err
+	}
+
+	if w.whole && chunkSize(w.limiter, len(p)) < len(p) {
+		return 0, ErrWriteTooLarge
+	}
+
+	var written int
+
+	for len(p) > 0 {
+		chunk := p[:chunkSize(w.limiter, len(p))]
+
+		if err := w.limiter.AcquireN(w.ctx, uint64(len(chunk))); err != nil {
+			return written, causeOf(w.ctx, err)
+		}
+
+		n, err := w.writer.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		if n < len(chunk) {
+			return written, io.ErrShortWrite
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close stops the pending and following writes and closes the underlying writer, if it's an io.Closer.
+func (w *PacedWriter) Close() error {
+	w.cancel(ErrWriterClosed)
+
+	if closer, ok := w.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// WriteTo lets the underlying reader write to the writer, passing its writes on in chunks of up to a window worth of bytes once the limiter admits them.
+func (r *pacedWriterTo) WriteTo(writer io.Writer) (int64, error) {
+	if err := context.Cause(r.ctx); err != nil {
+		return 0, err
+	}
+
+	return r.reader.(io.WriterTo).WriteTo(&PacedWriter{writer: writer, limiter: r.limiter, ctx: r.ctx})
+}
+
+// ReadFrom lets the underlying writer read from the reader, passing it up to a window worth of bytes per read once the limiter admits them.
+func (w *pacedReaderFrom) ReadFrom(reader io.Reader) (int64, error) {
+	if err := context.Cause(w.ctx); err != nil {
+		return 0, err
+	}
+
+	return w.writer.(io.ReaderFrom).ReadFrom(&PacedReader{reader: reader, limiter: w.limiter, ctx: w.ctx})
+}
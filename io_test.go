@@ -0,0 +1,394 @@
+package throttle_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// windowWriter counts the bytes written per window of a second, and records the time of every write.
+type windowWriter struct {
+	clock  *throttletest.ManualClock
+	buf    bytes.Buffer
+	totals map[time.Duration]int
+	writes int
+	times  []time.Duration
+}
+
+func newWindowWriter(clock *throttletest.ManualClock) *windowWriter {
+	return &windowWriter{clock: clock, totals: make(map[time.Duration]int)}
+}
+
+func (w *windowWriter) Write(p []byte) (int, error) {
+	elapsed := w.clock.Now().Sub(epoch)
+	w.totals[elapsed.Truncate(time.Second)] += len(p)
+	w.writes++
+	w.times = append(w.times, elapsed)
+
+	return w.buf.Write(p)
+}
+
+// plainReader hides the io.WriterTo of the underlying reader.
+type plainReader struct {
+	io.Reader
+}
+
+func TestNewReader(t *testing.T) {
+	payload := strings.Repeat("0123456789", 9) + "01234"
+
+	useCases := []struct {
+		Name     string
+		Reader   func() io.Reader
+		WriterTo bool
+	}{
+		{
+			Name: "reader",
+			Reader: func() io.Reader {
+				return &plainReader{strings.NewReader(payload)}
+			},
+		},
+		{
+			Name: "writer to",
+			Reader: func() io.Reader {
+				return strings.NewReader(payload)
+			},
+			WriterTo: true,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			reader := throttle.NewReader(useCase.Reader(), 10, throttle.WithClock(clock))
+
+			if _, ok := reader.(io.WriterTo); ok != useCase.WriterTo {
+				t.Fatal(fmt.Sprintf("Expected the reader to implement io.WriterTo: %t", useCase.WriterTo))
+			}
+
+			writer := newWindowWriter(clock)
+			n, err := io.CopyBuffer(writer, reader, make([]byte, 64))
+
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if n != int64(len(payload)) || writer.buf.String() != payload {
+				t.Fatal(fmt.Sprintf("Expected the payload of %d bytes to be read, but got %d", len(payload), n))
+			}
+
+			// 95 bytes at 10 per second
+			if actual := clock.Now().Sub(epoch); actual != time.Second*9 {
+				t.Fatal(fmt.Sprintf("Expected the payload to be read in 9s, but got %s", actual))
+			}
+
+			for window, total := range writer.totals {
+				if total > 10 {
+					t.Fatal(fmt.Sprintf("Expected up to 10 bytes per window, but got %d at %s", total, window))
+				}
+			}
+		})
+	}
+}
+
+func TestNewReader_PassThrough(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	reader := throttle.NewReader(strings.NewReader("x"), 1, throttle.WithClock(clock))
+
+	if n, err := reader.Read(nil); n != 0 || err != nil {
+		t.Fatal(fmt.Sprintf("Expected the empty read to pass through, but got %d and %v", n, err))
+	}
+
+	if n, err := reader.Read(make([]byte, 8)); n != 1 || err != nil {
+		t.Fatal(fmt.Sprintf("Expected to read 1 byte, but got %d and %v", n, err))
+	}
+
+	// the end of the reader doesn't wait for the next window
+	if _, err := reader.Read(make([]byte, 8)); !errors.Is(err, io.EOF) {
+		t.Fatal(fmt.Sprintf("Expected io.EOF, but got %v", err))
+	}
+
+	if actual := clock.Sleepers(); actual != 0 {
+		t.Fatal(fmt.Sprintf("Expected no waits, but got %d", actual))
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	dst := newWindowWriter(clock)
+	writer := throttle.NewWriter(dst, 10, throttle.WithClock(clock))
+
+	if _, ok := writer.(io.ReaderFrom); ok {
+		t.Fatal("Expected the writer not to implement io.ReaderFrom")
+	}
+
+	payload := strings.Repeat("0123456789", 9) + "01234"
+	var written int
+
+	for _, chunk := range []string{payload[:25], payload[25:30], payload[30:]} {
+		n, err := writer.Write([]byte(chunk))
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		written += n
+	}
+
+	if written != len(payload) || dst.buf.String() != payload {
+		t.Fatal(fmt.Sprintf("Expected the payload of %d bytes to be written, but got %d", len(payload), written))
+	}
+
+	// 25 bytes in 3 writes, 5 in 1, and 65 in 7
+	if dst.writes != 11 {
+		t.Fatal(fmt.Sprintf("Expected 11 underlying writes, but got %d", dst.writes))
+	}
+
+	if actual := clock.Now().Sub(epoch); actual != time.Second*9 {
+		t.Fatal(fmt.Sprintf("Expected the payload to be written in 9s, but got %s", actual))
+	}
+
+	for window, total := range dst.totals {
+		if total > 10 {
+			t.Fatal(fmt.Sprintf("Expected up to 10 bytes per window, but got %d at %s", total, window))
+		}
+	}
+}
+
+func TestNewWriter_ChunkSize(t *testing.T) {
+	payload := strings.Repeat("x", 100)
+
+	useCases := []struct {
+		Name      string
+		ChunkSize int
+		Times     []time.Duration
+	}{
+		{
+			Name:  "window chunks",
+			Times: []time.Duration{0, time.Second},
+		},
+		{
+			Name:      "small chunks",
+			ChunkSize: 10,
+			Times: []time.Duration{
+				0, 200 * time.Millisecond, 400 * time.Millisecond, 600 * time.Millisecond, 800 * time.Millisecond,
+				time.Second, 1200 * time.Millisecond, 1400 * time.Millisecond, 1600 * time.Millisecond, 1800 * time.Millisecond,
+			},
+		},
+		{
+			Name:      "chunks not dividing the limit",
+			ChunkSize: 30,
+			// the limit is rounded down to 30 bytes per second
+			Times: []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			dst := newWindowWriter(clock)
+			writer := throttle.NewWriter(dst, 50, throttle.WithClock(clock), throttle.WithChunkSize(useCase.ChunkSize))
+
+			n, err := writer.Write([]byte(payload))
+
+			if err != nil || n != len(payload) {
+				t.Fatal(fmt.Sprintf("Expected %d bytes to be written, but got %d and %v", len(payload), n, err))
+			}
+
+			if !reflect.DeepEqual(dst.times, useCase.Times) {
+				t.Fatal(fmt.Sprintf("Expected the writes at %v, but got %v", useCase.Times, dst.times))
+			}
+
+			for window, total := range dst.totals {
+				if total > 50 {
+					t.Fatal(fmt.Sprintf("Expected up to 50 bytes per window, but got %d at %s", total, window))
+				}
+			}
+		})
+	}
+}
+
+func TestNewReader_ChunkSize(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	dst := newWindowWriter(clock)
+	reader := throttle.NewReader(&plainReader{strings.NewReader(strings.Repeat("x", 50))}, 50, throttle.WithClock(clock), throttle.WithChunkSize(25))
+
+	if _, err := io.Copy(dst, reader); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	expected := []time.Duration{0, 500 * time.Millisecond}
+
+	if !reflect.DeepEqual(dst.times, expected) {
+		t.Fatal(fmt.Sprintf("Expected the reads at %v, but got %v", expected, dst.times))
+	}
+}
+
+func TestWithChunkSize_TooLarge(t *testing.T) {
+	useCases := []struct {
+		Name string
+		New  func()
+	}{
+		{
+			Name: "reader",
+			New: func() {
+				throttle.NewReader(strings.NewReader(""), 10, throttle.WithChunkSize(11))
+			},
+		},
+		{
+			Name: "writer",
+			New: func() {
+				throttle.NewWriter(io.Discard, 10, throttle.WithChunkSize(11))
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("Expected a panic")
+				}
+			}()
+
+			useCase.New()
+		})
+	}
+
+	if _, err := throttle.Copy(context.Background(), io.Discard, strings.NewReader("x"), 10, throttle.WithChunkSize(11)); !errors.Is(err, throttle.ErrChunkTooLarge) {
+		t.Fatal(fmt.Sprintf("Expected ErrChunkTooLarge, but got %v", err))
+	}
+}
+
+func TestNewWriter_WholeWrites(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	dst := newWindowWriter(clock)
+	writer := throttle.NewWriter(dst, 10, throttle.WithClock(clock), throttle.WithWholeWrites())
+
+	if n, err := writer.Write([]byte(strings.Repeat("x", 11))); n != 0 || !errors.Is(err, throttle.ErrWriteTooLarge) {
+		t.Fatal(fmt.Sprintf("Expected throttle.ErrWriteTooLarge, but got %d and %v", n, err))
+	}
+
+	for range 3 {
+		if n, err := writer.Write([]byte(strings.Repeat("x", 6))); n != 6 || err != nil {
+			t.Fatal(fmt.Sprintf("Expected to write 6 bytes, but got %d and %v", n, err))
+		}
+	}
+
+	// every write is passed as a whole, in a window of its own
+	if dst.writes != 3 || len(dst.totals) != 3 {
+		t.Fatal(fmt.Sprintf("Expected 3 writes in 3 windows, but got %d in %d", dst.writes, len(dst.totals)))
+	}
+}
+
+func TestNewWriter_ReaderFrom(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	var dst bytes.Buffer
+	writer := throttle.NewWriter(&dst, 10, throttle.WithClock(clock))
+
+	if _, ok := writer.(io.ReaderFrom); !ok {
+		t.Fatal("Expected the writer to implement io.ReaderFrom")
+	}
+
+	payload := strings.Repeat("0123456789", 9) + "01234"
+	n, err := io.Copy(writer, &plainReader{strings.NewReader(payload)})
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if n != int64(len(payload)) || dst.String() != payload {
+		t.Fatal(fmt.Sprintf("Expected the payload of %d bytes to be written, but got %d", len(payload), n))
+	}
+
+	if actual := clock.Now().Sub(epoch); actual != time.Second*9 {
+		t.Fatal(fmt.Sprintf("Expected the payload to be written in 9s, but got %s", actual))
+	}
+}
+
+func TestPacedWriter_LargeWrite(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	dst := newWindowWriter(clock)
+	writer := throttle.NewPacedWriter(context.Background(), dst, throttle.New(10, throttle.WithClock(clock)))
+	payload := strings.Repeat("0123456789", 10)
+
+	n, err := writer.Write([]byte(payload))
+
+	if err != nil || n != len(payload) || dst.buf.String() != payload {
+		t.Fatal(fmt.Sprintf("Expected the payload of %d bytes to be written, but got %d and %v", len(payload), n, err))
+	}
+
+	expected := make(map[time.Duration]int)
+
+	for i := range 10 {
+		expected[time.Duration(i)*time.Second] = 10
+	}
+
+	if !reflect.DeepEqual(dst.totals, expected) {
+		t.Fatal(fmt.Sprintf("Expected 10 bytes in each of 10 windows, but got %v", dst.totals))
+	}
+}
+
+func TestPacedWriter_LargeWriteCancel(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	dst := newWindowWriter(clock)
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := throttle.NewPacedWriter(ctx, dst, throttle.New(10, throttle.WithClock(clock)))
+	done := make(chan error, 1)
+
+	var n int
+
+	go func() {
+		var err error
+
+		n, err = writer.Write([]byte(strings.Repeat("x", 100)))
+		done <- err
+	}()
+
+	// the first chunk is written right away, and the next 3 once their windows come
+	for range 3 {
+		clock.BlockUntilSleepers(1)
+		clock.Advance(time.Second)
+	}
+
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	if n != 40 || dst.buf.Len() != 40 {
+		t.Fatal(fmt.Sprintf("Expected 40 bytes to be written, but got %d and %d written", n, dst.buf.Len()))
+	}
+}
+
+func TestPacedWriter_Close(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	writer := throttle.NewPacedWriter(context.Background(), io.Discard, throttle.New(10, throttle.WithClock(clock)))
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := writer.Write([]byte(strings.Repeat("x", 25)))
+		done <- err
+	}()
+
+	// the pending write gives up once the writer is closed, without waiting for the clock
+	clock.BlockUntilSleepers(1)
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if err := <-done; !errors.Is(err, throttle.ErrWriterClosed) {
+		t.Fatal(fmt.Sprintf("Expected throttle.ErrWriterClosed, but got %v", err))
+	}
+}
@@ -0,0 +1,58 @@
+package throttle
+
+import "net/http"
+
+// DefaultMaxKeys is the number of keys a keyed transport or middleware keeps throttlers for by default.
+const DefaultMaxKeys = 10000
+
+// keyedThrottlers holds a throttler per request key, evicting the least recently used ones beyond the cap.
+type keyedThrottlers struct {
+	key        func(request *http.Request) string
+	throttlers *KeyedThrottler[string]
+	// unkeyed paces the requests with an empty key, nil if they share a regular bucket
+	unkeyed *Throttler
+}
+
+func newKeyedThrottlers(key func(request *http.Request) string, limit uint64, opts *transportOptions) *keyedThrottlers {
+	k := newThrottlersByKey(limit, opts.throttler, opts.maxKeys)
+	k.key = key
+
+	if opts.unthrottledEmptyKey {
+		k.unkeyed = New(0, opts.throttler...)
+	}
+
+	return k
+}
+
+// newThrottlersByKey creates the throttlers looked up by key alone, without a key function.
+func newThrottlersByKey(limit uint64, setters []Option, maxKeys int) *keyedThrottlers {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+
+	keyed := make([]KeyedOption, 0, len(setters)+1)
+
+	for _, setter := range setters {
+		keyed = append(keyed, setter)
+	}
+
+	return &keyedThrottlers{
+		throttlers: NewKeyed[string](limit, append(keyed, WithMaxKeys(maxKeys))...),
+	}
+}
+
+// throttlerFor returns the throttler of the request key.
+func (k *keyedThrottlers) throttlerFor(request *http.Request) *Throttler {
+	key := k.key(request)
+
+	if key == "" && k.unkeyed != nil {
+		return k.unkeyed
+	}
+
+	return k.get(key)
+}
+
+// get returns the throttler of the key, creating it if necessary.
+func (k *keyedThrottlers) get(key string) *Throttler {
+	return k.throttlers.Get(key)
+}
@@ -0,0 +1,142 @@
+package throttle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// KeyedConfig describes the limits of a KeyedThrottler of string keys, e.g. loaded from a JSON or a YAML file.
+// The window is written as a duration, e.g. "1m", or as a number of nanoseconds.
+type KeyedConfig struct {
+	// DefaultLimit is the limit of the keys without a limit of their own, 0 meaning no limit.
+	DefaultLimit uint64 `json:"defaultLimit" yaml:"defaultLimit"`
+	// Window is the duration of the windows, 0 meaning the window of the options, one second by default.
+	Window time.Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	// Overrides are the limits of the keys that have their own, 0 meaning no limit.
+	Overrides map[string]uint64 `json:"overrides,omitempty" yaml:"overrides,omitempty"`
+}
+
+// keyedConfigJSON is KeyedConfig with the window as it's written.
+type keyedConfigJSON struct {
+	DefaultLimit uint64            `json:"defaultLimit"`
+	Window       json.RawMessage   `json:"window,omitempty"`
+	Overrides    map[string]uint64 `json:"overrides,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler, writing the window as a duration.
+func (c KeyedConfig) MarshalJSON() ([]byte, error) {
+	out := keyedConfigJSON{DefaultLimit: c.DefaultLimit, Overrides: c.Overrides}
+
+	if c.Window != 0 {
+		out.Window, _ = json.Marshal(c.Window.String())
+	}
+
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, reading the window as a duration or as a number of nanoseconds.
+func (c *KeyedConfig) UnmarshalJSON(data []byte) error {
+	var in keyedConfigJSON
+
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	var window time.Duration
+
+	if len(in.Window) > 0 {
+		var text string
+
+		if err := json.Unmarshal(in.Window, &text); err == nil {
+			parsed, err := time.ParseDuration(text)
+
+			if err != nil {
+				return fmt.Errorf("throttle: invalid window: %w", err)
+			}
+
+			window = parsed
+		} else if err := json.Unmarshal(in.Window, &window); err != nil {
+			return fmt.Errorf("throttle: invalid window: %w", err)
+		}
+	}
+
+	*c = KeyedConfig{DefaultLimit: in.DefaultLimit, Window: window, Overrides: in.Overrides}
+
+	return nil
+}
+
+// NewKeyedFromConfig creates a new instance of KeyedThrottler with the limits of the config.
+// The overrides are kept rather than applied, so a key gets its throttler on first use, as any other key.
+// The window of the config, if any, takes precedence over the one of the options.
+func NewKeyedFromConfig(cfg KeyedConfig, setters ...KeyedOption) *KeyedThrottler[string] {
+	if cfg.Window > 0 {
+		setters = append(setters[:len(setters):len(setters)], WithWindow(cfg.Window))
+	}
+
+	k := NewKeyed[string](cfg.DefaultLimit, setters...)
+	k.overrides = k.canonicalLimits(cfg.Overrides)
+
+	return k
+}
+
+// ApplyConfig applies the limits of the config to the KeyedThrottler, e.g. once the config file has been reloaded.
+// The default limit and the overrides replace the current ones, including the limits set by SetLimit,
+// and the keys that lose their override fall back to WithLimitFor or the default limit.
+// The existing keys get their new limits right away, while the slots taken in the current window are kept,
+// so the keys whose limit hasn't changed are not affected at all.
+// The window can't be changed once the throttlers are created, so a config with another window is refused,
+// as are the overrides of a KeyedThrottler whose keys are not strings.
+func (k *KeyedThrottler[K]) ApplyConfig(cfg KeyedConfig) error {
+	if cfg.Window > 0 && cfg.Window != k.window {
+		return fmt.Errorf("throttle: the window can't be changed from %s to %s", k.window, cfg.Window)
+	}
+
+	limits, ok := any(cfg.Overrides).(map[K]uint64)
+
+	if len(cfg.Overrides) > 0 && !ok {
+		return errors.New("throttle: the overrides take string keys rather than the keys of the KeyedThrottler")
+	}
+
+	overrides := k.canonicalLimits(limits)
+
+	k.overridesMu.Lock()
+	previous := k.overrides
+	k.overrides = overrides
+	k.overridesMu.Unlock()
+
+	k.limit.Store(cfg.DefaultLimit)
+
+	for _, shard := range k.shards {
+		shard.mu.Lock()
+
+		for el := shard.order.Front(); el != nil; el = el.Next() {
+			slot := el.Value.(*keyedSlot[K])
+			_, before := previous[slot.key]
+			_, after := overrides[slot.key]
+
+			switch {
+			case before || after:
+				k.apply(slot)
+			case !slot.fixed:
+				slot.throttler.SetLimit(cfg.DefaultLimit)
+			}
+		}
+
+		shard.mu.Unlock()
+	}
+
+	return nil
+}
+
+// canonicalLimits returns a copy of the limits by the canonical keys.
+func (k *KeyedThrottler[K]) canonicalLimits(limits map[K]uint64) map[K]uint64 {
+	out := make(map[K]uint64, len(limits))
+
+	for key, limit := range limits {
+		out[k.canonical(key)] = limit
+	}
+
+	return out
+}
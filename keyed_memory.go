@@ -0,0 +1,58 @@
+package throttle
+
+import (
+	"container/list"
+	"unsafe"
+)
+
+// WithMemoryBudget bounds the estimated memory the keys of KeyedThrottler take, evicting the least recently used ones beyond it.
+// The estimate of a key is the size of its throttler and of the structures holding it, plus the size of the key itself:
+// the length of a string key, or what WithKeySize tells for the keys of the other types.
+// The budget is split evenly across the shards, as WithMaxKeys is, rounded up, and a key exceeding the budget of its shard on its own is held anyway.
+func WithMemoryBudget(bytes int) KeyedOption {
+	return keyedOptionFunc(func(opts *keyedOptions) {
+		opts.budget = bytes
+	})
+}
+
+// WithKeySize sets the function telling the number of bytes a key refers to beyond its fixed size, e.g. the length of the strings of a struct key,
+// which WithMemoryBudget counts in. The length of a string key is counted without it.
+// The type of the keys must be the one of the KeyedThrottler, or NewKeyed panics.
+func WithKeySize[K comparable](size func(key K) int) KeyedOption {
+	return keyedOptionFunc(func(opts *keyedOptions) {
+		opts.keySize = size
+	})
+}
+
+// MemoryEstimate returns the estimated number of bytes the keys take, see WithMemoryBudget.
+func (k *KeyedThrottler[K]) MemoryEstimate() int {
+	var n int
+
+	for _, shard := range k.shards {
+		shard.mu.Lock()
+		n += shard.bytes
+		shard.mu.Unlock()
+	}
+
+	return n
+}
+
+// sizeOf returns the estimated number of bytes the key takes along with its throttler.
+func (k *KeyedThrottler[K]) sizeOf(key K) int {
+	var (
+		slot      keyedSlot[K]
+		throttler Throttler
+		el        list.Element
+	)
+
+	// the slot, its throttler, its element of the order and its entry of the map, that is the key and the pointer to the element
+	size := int(unsafe.Sizeof(slot) + unsafe.Sizeof(throttler) + unsafe.Sizeof(el) + unsafe.Sizeof(key) + unsafe.Sizeof(&el))
+
+	if k.keySize != nil {
+		size += k.keySize(key)
+	} else if s, ok := any(key).(string); ok {
+		size += len(s)
+	}
+
+	return size
+}
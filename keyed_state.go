@@ -0,0 +1,274 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// KeyState is the state of the window of a key, as saved to a StateStore.
+	KeyState struct {
+		// Window is the time the latest window of the key starts at, later than now if the waiting callers have taken the next windows.
+		Window time.Time
+		// Taken is the number of slots taken in the window.
+		Taken uint64
+	}
+
+	// StateStore saves the state of the keys of a KeyedThrottler, e.g. to a database, so that it survives a restart, see WithStateStore.
+	// It must be safe for concurrent use.
+	StateStore[K comparable] interface {
+		// Load returns the state of the key and reports whether it's been found.
+		Load(key K) (KeyState, bool, error)
+		// Save saves the state of the key, replacing the previous one.
+		Save(key K, state KeyState) error
+	}
+
+	// MemoryStateStore is a StateStore keeping the states in memory, e.g. to share them between the KeyedThrottlers of a process, or in tests.
+	MemoryStateStore[K comparable] struct {
+		mu     sync.Mutex
+		states map[K]KeyState
+	}
+
+	// keyedPersistence saves the states of the keys in the background, the latest state of a key at a time.
+	keyedPersistence[K comparable] struct {
+		store StateStore[K]
+		mu    sync.Mutex
+		// pending are the states waiting to be saved, and batch the ones being saved
+		pending map[K]pendingState[K]
+		batch   map[K]pendingState[K]
+		// saving reports whether a goroutine is saving the pending states
+		saving bool
+		idle   *sync.Cond
+		// err is the latest error a state has failed to be saved or loaded with
+		err error
+	}
+
+	// pendingState is the state of a key waiting to be saved: the one of its slot, read once it's saved, or the given one, e.g. of an evicted key.
+	pendingState[K comparable] struct {
+		slot  *keyedSlot[K]
+		state KeyState
+	}
+)
+
+// NewMemoryStateStore creates a new instance of MemoryStateStore.
+func NewMemoryStateStore[K comparable]() *MemoryStateStore[K] {
+	return &MemoryStateStore[K]{states: make(map[K]KeyState)}
+}
+
+// Load returns the state of the key and reports whether it's been found.
+func (s *MemoryStateStore[K]) Load(key K) (KeyState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, found := s.states[key]
+
+	return state, found, nil
+}
+
+// Save saves the state of the key.
+func (s *MemoryStateStore[K]) Save(key K, state KeyState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[key] = state
+
+	return nil
+}
+
+// Len returns the number of keys the states are saved for.
+func (s *MemoryStateStore[K]) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.states)
+}
+
+// WithStateStore makes KeyedThrottler save the state of the window of every key to the store, and load it when the key is created,
+// so that the clients don't get a fresh quota once the process restarts.
+// The state of a key is saved in the background when its calls change it and when the key is evicted, so the calls don't wait for the store.
+// The changes made while the previous state of the key is being saved are saved at once, as they are by then,
+// while Flush saves the states of all the keys as they are, e.g. on shutdown.
+// The state is loaded before the key is created, without holding up the other keys, but the callers of the key wait for it, so the store should answer fast.
+// A state whose window is over is ignored, since the key would start afresh anyway, as is a state that fails to be loaded.
+// The calls made on the throttlers returned by Get are not saved until Flush.
+// The type of the keys must be the one of the KeyedThrottler, or NewKeyed panics.
+func WithStateStore[K comparable](store StateStore[K]) KeyedOption {
+	return keyedOptionFunc(func(opts *keyedOptions) {
+		opts.store = store
+	})
+}
+
+// Flush saves the states of the keys held, as they are at the moment, waits for them and the states scheduled so far to be saved,
+// e.g. before the process exits, and returns the latest error a state has failed to be saved or loaded with since the previous Flush, if any.
+func (k *KeyedThrottler[K]) Flush() error {
+	p := k.persistence
+
+	if p == nil {
+		return nil
+	}
+
+	var slots []*keyedSlot[K]
+
+	for _, shard := range k.shards {
+		shard.mu.Lock()
+
+		for el := shard.order.Front(); el != nil; el = el.Next() {
+			slots = append(slots, el.Value.(*keyedSlot[K]))
+		}
+
+		shard.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, slot := range slots {
+		p.put(slot.key, pendingState[K]{slot: slot})
+	}
+
+	for p.saving {
+		p.idle.Wait()
+	}
+
+	err := p.err
+	p.err = nil
+
+	return err
+}
+
+// load returns the state of the key saved to the store, or waiting to be saved, unless its window is over.
+func (k *KeyedThrottler[K]) load(key K, now time.Time) (KeyState, bool) {
+	state, found, err := k.persistence.load(key)
+
+	if err != nil {
+		k.persistence.fail(err)
+
+		return KeyState{}, false
+	}
+
+	if !found || state.Window.IsZero() || now.Sub(state.Window) > k.window {
+		return KeyState{}, false
+	}
+
+	return state, true
+}
+
+// changed schedules the state of the key to be saved once a call has changed it, unless it's scheduled already,
+// so the changes made until it's saved are saved at once, and the calls don't contend for the pending states.
+func (k *KeyedThrottler[K]) changed(slot *keyedSlot[K], res reservation) {
+	if k.persistence == nil || res.taken == 0 {
+		return
+	}
+
+	if slot.dirty.CompareAndSwap(false, true) {
+		k.persistence.schedule(slot.key, pendingState[K]{slot: slot})
+	}
+}
+
+// state returns the state of the window of the key and reports whether the key has a window.
+func (s *keyedSlot[K]) state() (KeyState, bool) {
+	s.throttler.mu.Lock()
+	defer s.throttler.mu.Unlock()
+
+	return KeyState{Window: s.throttler.window, Taken: s.throttler.counter}, !s.throttler.window.IsZero()
+}
+
+// load returns the state of the key waiting to be saved, e.g. of a key just evicted, or the one saved to the store.
+func (p *keyedPersistence[K]) load(key K) (KeyState, bool, error) {
+	p.mu.Lock()
+	pending, found := p.pending[key]
+
+	if !found {
+		pending, found = p.batch[key]
+	}
+
+	p.mu.Unlock()
+
+	if found {
+		state, _ := pending.current()
+
+		return state, true, nil
+	}
+
+	return p.store.Load(key)
+}
+
+// schedule schedules the state of the key to be saved.
+func (p *keyedPersistence[K]) schedule(key K, state pendingState[K]) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.put(key, state)
+}
+
+// put adds the state of the key to the pending ones, unless a later window of the key is pending already,
+// and starts saving them if nobody is. The pending states must be locked.
+func (p *keyedPersistence[K]) put(key K, state pendingState[K]) {
+	if pending, found := p.pending[key]; found && pending.slot == nil && state.slot == nil && pending.state.Window.After(state.state.Window) {
+		return
+	}
+
+	p.pending[key] = state
+
+	if !p.saving {
+		p.saving = true
+
+		go p.run()
+	}
+}
+
+// run saves the pending states until there are none left.
+func (p *keyedPersistence[K]) run() {
+	for {
+		p.mu.Lock()
+
+		p.batch = nil
+
+		if len(p.pending) == 0 {
+			p.saving = false
+			p.idle.Broadcast()
+			p.mu.Unlock()
+
+			return
+		}
+
+		batch := p.pending
+		p.batch = batch
+		p.pending = make(map[K]pendingState[K])
+		p.mu.Unlock()
+
+		for key, pending := range batch {
+			// the changes made from now on schedule the slot again
+			if pending.slot != nil {
+				pending.slot.dirty.Store(false)
+			}
+
+			state, ok := pending.current()
+
+			if !ok {
+				continue
+			}
+
+			if err := p.store.Save(key, state); err != nil {
+				p.fail(err)
+			}
+		}
+	}
+}
+
+// fail keeps the error for Flush.
+func (p *keyedPersistence[K]) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.err = err
+}
+
+// current returns the state to be saved and reports whether there is one.
+func (s pendingState[K]) current() (KeyState, bool) {
+	if s.slot != nil {
+		return s.slot.state()
+	}
+
+	return s.state, true
+}
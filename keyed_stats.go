@@ -0,0 +1,190 @@
+package throttle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// MetricAcquired ranks the keys by the number of their calls that have been admitted.
+	MetricAcquired Metric = iota
+	// MetricThrottled ranks the keys by the number of their calls that have waited for the limit or have been rejected.
+	MetricThrottled
+)
+
+// hotKeys is the number of keys ManagerStats samples.
+const hotKeys = 10
+
+type (
+	// Metric is the counter TopKeys ranks the keys by.
+	Metric int
+
+	// KeyedStats is a snapshot of the counters of a KeyedThrottler.
+	KeyedStats struct {
+		// Keys is the number of keys the throttlers are held for.
+		Keys int
+		// Acquired is the number of calls that have been admitted, including the ones of the evicted keys.
+		Acquired uint64
+		// Throttled is the number of calls that have waited for the limit or have been rejected, including the ones of the evicted keys.
+		Throttled uint64
+	}
+
+	// ManagerStats is a snapshot of the keys of a KeyedThrottler, e.g. to tune WithKeyTTL, WithMaxKeys and WithMemoryBudget.
+	// The keys held are the ones created less the ones forgotten, whatever the reason.
+	ManagerStats[K comparable] struct {
+		// Keys is the number of keys the throttlers are held for.
+		Keys int
+		// Memory is the estimated number of bytes the keys take, see WithMemoryBudget.
+		Memory int
+		// Created is the number of keys the throttlers have been created for, a key evicted and seen again counting twice.
+		Created uint64
+		// EvictedTTL is the number of keys forgotten as idle ones, see WithKeyTTL.
+		EvictedTTL uint64
+		// EvictedLRU is the number of keys evicted as the least recently used ones beyond WithMaxKeys.
+		EvictedLRU uint64
+		// EvictedMemory is the number of keys evicted as the least recently used ones beyond WithMemoryBudget.
+		EvictedMemory uint64
+		// HotKeys are the keys with the most calls admitted in the current window, see TopKeys.
+		HotKeys []KeyCount[K]
+	}
+
+	// KeyCount is the number of calls of a key in the current window, see TopKeys.
+	KeyCount[K comparable] struct {
+		Key       K
+		Acquired  uint64
+		Throttled uint64
+	}
+
+	// keyCounts holds the number of calls of a key in a window.
+	keyCounts struct {
+		mu        sync.Mutex
+		window    time.Time
+		acquired  uint64
+		throttled uint64
+	}
+)
+
+// Stats returns the totals of the KeyedThrottler.
+// The calls made on the throttlers returned by Get are not counted.
+func (k *KeyedThrottler[K]) Stats() KeyedStats {
+	return KeyedStats{
+		Keys:      k.Len(),
+		Acquired:  k.acquired.Load(),
+		Throttled: k.throttled.Load(),
+	}
+}
+
+// ManagerStats returns the snapshot of the keys of the KeyedThrottler, once the idle ones are forgotten.
+// The shards are locked at once, so that the counters match the keys held.
+func (k *KeyedThrottler[K]) ManagerStats() ManagerStats[K] {
+	now := k.clock.Now()
+
+	var stats ManagerStats[K]
+
+	for _, shard := range k.shards {
+		shard.mu.Lock()
+		k.expire(shard, now)
+		stats.Keys += len(shard.entries)
+		stats.Memory += shard.bytes
+	}
+
+	stats.Created = k.created.Load()
+	stats.EvictedTTL = k.expired.Load()
+	stats.EvictedLRU = k.overKeys.Load()
+	stats.EvictedMemory = k.overBudget.Load()
+
+	for _, shard := range k.shards {
+		shard.mu.Unlock()
+	}
+
+	stats.HotKeys = k.TopKeys(hotKeys, MetricAcquired)
+
+	return stats
+}
+
+// TopKeys returns up to n keys with the most calls in the current window by the metric, from the greatest count to the least.
+// The windows are counted on the clock of the KeyedThrottler, by its window size. The keys are collected shard by shard,
+// while their counts are read and ranked without locking the shards, so TopKeys doesn't hold the calls of the other keys back for long.
+func (k *KeyedThrottler[K]) TopKeys(n int, by Metric) []KeyCount[K] {
+	window := k.clock.Now().Truncate(k.window)
+
+	var slots []*keyedSlot[K]
+
+	// the shards are snapshot one by one
+	for _, shard := range k.shards {
+		shard.mu.Lock()
+
+		for el := shard.order.Front(); el != nil; el = el.Next() {
+			slots = append(slots, el.Value.(*keyedSlot[K]))
+		}
+
+		shard.mu.Unlock()
+	}
+
+	counts := make([]KeyCount[K], 0, len(slots))
+
+	for _, slot := range slots {
+		acquired, throttled := slot.counts.get(window)
+
+		if acquired > 0 || throttled > 0 {
+			counts = append(counts, KeyCount[K]{Key: slot.key, Acquired: acquired, Throttled: throttled})
+		}
+	}
+
+	// the keys with the same count are ranked from the most recently used one of their shard
+	sort.SliceStable(counts, func(i, j int) bool {
+		if by == MetricThrottled {
+			return counts[i].Throttled > counts[j].Throttled
+		}
+
+		return counts[i].Acquired > counts[j].Acquired
+	})
+
+	return counts[:min(max(n, 0), len(counts))]
+}
+
+// record counts a call of the key.
+func (k *KeyedThrottler[K]) record(slot *keyedSlot[K], acquired, throttled bool) {
+	if acquired {
+		k.acquired.Add(1)
+	}
+
+	if throttled {
+		k.throttled.Add(1)
+	}
+
+	slot.counts.add(k.clock.Now().Truncate(k.window), acquired, throttled)
+}
+
+// add counts a call in the window, forgetting the calls of the previous one.
+func (c *keyCounts) add(window time.Time, acquired, throttled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.window.Equal(window) {
+		c.window = window
+		c.acquired = 0
+		c.throttled = 0
+	}
+
+	if acquired {
+		c.acquired++
+	}
+
+	if throttled {
+		c.throttled++
+	}
+}
+
+// get returns the numbers of calls in the window.
+func (c *keyCounts) get(window time.Time) (uint64, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.window.Equal(window) {
+		return 0, 0
+	}
+
+	return c.acquired, c.throttled
+}
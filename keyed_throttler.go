@@ -0,0 +1,628 @@
+package throttle
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// KeyedThrottler manages a Throttler per key, e.g. per client or per host, creating them on first use.
+	// It is safe for concurrent use, and a key never gets more than one throttler, however many callers see it first at once.
+	KeyedThrottler[K comparable] struct {
+		limit   atomic.Uint64
+		limitOf func(key K) uint64
+		// normalize is the function of WithKeyNormalizer, if any
+		normalize func(key K) K
+		// keySize is the function of WithKeySize, if any
+		keySize func(key K) int
+		// overrides are the limits set by SetLimit
+		overrides   map[K]uint64
+		overridesMu sync.RWMutex
+		setters     []Option
+		clock       Clock
+		window      time.Duration
+		ttl         time.Duration
+		seed        maphash.Seed
+		shards      []*keyedShard[K]
+		persistence *keyedPersistence[K]
+		created     atomic.Uint64
+		expired     atomic.Uint64
+		overKeys    atomic.Uint64
+		overBudget  atomic.Uint64
+		acquired    atomic.Uint64
+		throttled   atomic.Uint64
+	}
+
+	// keyedShard holds the slots of the keys routed to it, each shard locked on its own.
+	keyedShard[K comparable] struct {
+		mu      sync.Mutex
+		maxKeys int
+		// budget is the share of WithMemoryBudget of the shard, and bytes is the estimated size of its keys
+		budget int
+		bytes  int
+		// swept is the time the idle keys have been last looked for
+		swept   time.Time
+		entries map[K]*list.Element
+		// order holds the slots from the most recently used to the least recently used one
+		order *list.List
+	}
+
+	// keyedSlot is the throttler of a key along with the time it's been last used.
+	keyedSlot[K comparable] struct {
+		key       K
+		throttler *Throttler
+		used      time.Time
+		// fixed reports whether the key has a limit of its own rather than the default one
+		fixed  bool
+		counts keyCounts
+		// size is the estimated number of bytes the key takes
+		size int
+		// dirty reports whether the state of the key is scheduled to be saved
+		dirty atomic.Bool
+	}
+
+	// KeyedOption configures a KeyedThrottler.
+	// Throttler options, like WithClock and WithWindow, are keyed options too:
+	// they apply to every throttler the KeyedThrottler creates.
+	KeyedOption interface {
+		applyKeyed(opts *keyedOptions)
+	}
+
+	// keyedOptions holds configuration settings for a KeyedThrottler.
+	keyedOptions struct {
+		throttler []Option
+		ttl       time.Duration
+		maxKeys   int
+		shards    int
+		budget    int
+		// keySize is the func(key K) int of WithKeySize
+		keySize any
+		// limitOf is the func(key K) uint64 of WithLimitFor
+		limitOf any
+		// normalize is the func(key K) K of WithKeyNormalizer
+		normalize any
+		// store is the StateStore[K] of WithStateStore
+		store any
+	}
+
+	keyedOptionFunc func(opts *keyedOptions)
+
+	// KeysOption is an option of both NewKeyedRoundTripper and KeyedThrottler.
+	KeysOption interface {
+		TransportOption
+		KeyedOption
+	}
+
+	maxKeysOption int
+)
+
+func (fn keyedOptionFunc) applyKeyed(opts *keyedOptions) {
+	fn(opts)
+}
+
+func (o Option) applyKeyed(opts *keyedOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+func (n maxKeysOption) applyTransport(opts *transportOptions) {
+	opts.maxKeys = int(n)
+}
+
+func (n maxKeysOption) applyKeyed(opts *keyedOptions) {
+	opts.maxKeys = int(n)
+}
+
+func buildKeyedOptions(setters []KeyedOption) *keyedOptions {
+	opts := &keyedOptions{}
+
+	for _, setter := range setters {
+		setter.applyKeyed(opts)
+	}
+
+	return opts
+}
+
+// WithKeyTTL makes KeyedThrottler forget the keys that haven't been used for the specified time, so that their number stays bounded.
+// The idle keys are looked for on access, at most once per TTL, without a goroutine of their own.
+// A key is forgotten only once its window is over, since the key that comes back starts afresh:
+// a TTL shorter than the window doesn't let a key exceed its limit, but keeps the key until the window ends.
+func WithKeyTTL(ttl time.Duration) KeyedOption {
+	return keyedOptionFunc(func(opts *keyedOptions) {
+		opts.ttl = ttl
+	})
+}
+
+// WithShards splits the keys of KeyedThrottler into n shards, rounded up to a power of two, each locked on its own,
+// so that the calls of distinct keys rarely contend, e.g. with hundreds of thousands of keys per minute.
+// The keys are routed to the shards by their hash, and WithMaxKeys is split evenly across the shards,
+// so the least recently used key evicted is the one of the shard a new key is routed to,
+// and there are no more shards than the keys allowed.
+// There is a single shard by default, which keeps the order of the keys exact.
+func WithShards(n int) KeyedOption {
+	return keyedOptionFunc(func(opts *keyedOptions) {
+		opts.shards = n
+	})
+}
+
+// WithLimitFor sets the function telling the limit of a key, e.g. a greater one for the premium tenants, and 0 for the default limit.
+// It's called when the throttler of a key is created, including when an evicted key is seen again, and on Refresh, rather than on every call.
+// It's called while the keys are locked, so it must not call the KeyedThrottler back.
+// The type of the keys must be the one of the KeyedThrottler, or NewKeyed panics.
+func WithLimitFor[K comparable](limit func(key K) uint64) KeyedOption {
+	return keyedOptionFunc(func(opts *keyedOptions) {
+		opts.limitOf = limit
+	})
+}
+
+// WithKeyNormalizer sets the function turning a key into its canonical form before it's looked up,
+// so that the variants of a key, e.g. the casings of a host, share a throttler rather than getting one each.
+// It applies to every method taking a key, and Stats and TopKeys report the keys in their canonical form.
+// It must be cheap and idempotent, since it's called on every call.
+// The type of the keys must be the one of the KeyedThrottler, or NewKeyed panics.
+func WithKeyNormalizer[K comparable](normalize func(key K) K) KeyedOption {
+	return keyedOptionFunc(func(opts *keyedOptions) {
+		opts.normalize = normalize
+	})
+}
+
+// LowercaseKey is a key normalizer that lowercases the key, e.g. a case-insensitive identifier.
+func LowercaseKey(key string) string {
+	return strings.ToLower(key)
+}
+
+// HostKey is a key normalizer that turns a host, optionally with a port, into the lowercased host without the port and the trailing dot,
+// e.g. "API.Example.com.:443" into "api.example.com" and "[::1]:80" into "::1".
+func HostKey(key string) string {
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	} else if strings.HasPrefix(key, "[") && strings.HasSuffix(key, "]") {
+		key = key[1 : len(key)-1]
+	}
+
+	return strings.ToLower(strings.TrimSuffix(key, "."))
+}
+
+// NewKeyed creates a new instance of KeyedThrottler whose throttlers admit the specified number of operations per window each.
+func NewKeyed[K comparable](limit uint64, setters ...KeyedOption) *KeyedThrottler[K] {
+	opts := buildKeyedOptions(setters)
+	limitOf, ok := opts.limitOf.(func(key K) uint64)
+
+	if opts.limitOf != nil && !ok {
+		panic("throttle: WithLimitFor takes the keys of another type than the KeyedThrottler")
+	}
+
+	normalize, ok := opts.normalize.(func(key K) K)
+
+	if opts.normalize != nil && !ok {
+		panic("throttle: WithKeyNormalizer takes the keys of another type than the KeyedThrottler")
+	}
+
+	keySize, ok := opts.keySize.(func(key K) int)
+
+	if opts.keySize != nil && !ok {
+		panic("throttle: WithKeySize takes the keys of another type than the KeyedThrottler")
+	}
+
+	store, ok := opts.store.(StateStore[K])
+
+	if opts.store != nil && !ok {
+		panic("throttle: WithStateStore takes the keys of another type than the KeyedThrottler")
+	}
+
+	throttler := buildOptions(opts.throttler)
+	k := &KeyedThrottler[K]{
+		limitOf:   limitOf,
+		normalize: normalize,
+		keySize:   keySize,
+		setters:   opts.throttler,
+		clock:     throttler.clock,
+		window:    throttler.window,
+		ttl:       opts.ttl,
+		seed:      maphash.MakeSeed(),
+	}
+
+	k.limit.Store(limit)
+
+	if store != nil {
+		k.persistence = &keyedPersistence[K]{store: store, pending: make(map[K]pendingState[K])}
+		k.persistence.idle = sync.NewCond(&k.persistence.mu)
+	}
+
+	shards := 1
+
+	if opts.shards > 1 {
+		shards = 1 << bits.Len(uint(opts.shards-1))
+	}
+
+	// every shard holds a key at least
+	for opts.maxKeys > 0 && shards > opts.maxKeys {
+		shards >>= 1
+	}
+
+	// the budget is rounded up, so that a budget smaller than the shards doesn't round down to none, which means no budget
+	budget := (max(opts.budget, 0) + shards - 1) / shards
+	k.shards = make([]*keyedShard[K], shards)
+
+	for i := range k.shards {
+		k.shards[i] = &keyedShard[K]{
+			maxKeys: opts.maxKeys / shards,
+			budget:  budget,
+			entries: make(map[K]*list.Element),
+			order:   list.New(),
+		}
+
+		// the rest of the cap goes to the first shards, so the caps add up to it
+		if i < opts.maxKeys%shards {
+			k.shards[i].maxKeys++
+		}
+	}
+
+	return k
+}
+
+// Acquire blocks until the operation of the key can be executed within the limit of the key.
+func (k *KeyedThrottler[K]) Acquire(key K) {
+	slot := k.slot(k.canonical(key))
+	res := slot.throttler.reserve(1)
+
+	k.record(slot, true, res.wait > 0)
+	k.changed(slot, res)
+
+	if res.wait > 0 {
+		slot.throttler.clock.Sleep(res.wait)
+	}
+}
+
+// AcquireContext blocks until the operation of the key can be executed within the limit of the key or the context is done.
+func (k *KeyedThrottler[K]) AcquireContext(ctx context.Context, key K) error {
+	_, _, err := k.acquireContext(ctx, key)
+
+	return err
+}
+
+// acquireContext is like AcquireContext, but returns the throttler of the key and the reservation, so the slot can be given back.
+func (k *KeyedThrottler[K]) acquireContext(ctx context.Context, key K) (*Throttler, reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, reservation{}, err
+	}
+
+	slot := k.slot(k.canonical(key))
+	res := slot.throttler.reserve(1)
+	err := slot.throttler.await(ctx, res)
+
+	k.record(slot, err == nil, res.wait > 0)
+	k.changed(slot, res)
+
+	return slot.throttler, res, err
+}
+
+// TryAcquire takes a slot of the key if the operation can be executed right away and reports whether it did.
+func (k *KeyedThrottler[K]) TryAcquire(key K) bool {
+	_, ok := k.TryReserve(key)
+
+	return ok
+}
+
+// TryReserve is like TryAcquire, but returns the reservation of the slot of the key, so that it can be given back with Cancel.
+func (k *KeyedThrottler[K]) TryReserve(key K) (Reservation, bool) {
+	slot := k.slot(k.canonical(key))
+	res, ok := slot.throttler.tryReserve(1)
+
+	k.record(slot, ok, !ok)
+	k.changed(slot, res)
+
+	if !ok {
+		return Reservation{}, false
+	}
+
+	return Reservation{throttler: slot.throttler, res: res}, true
+}
+
+// Get returns the throttler of the key, creating it if necessary.
+// A throttler evicted while the caller holds it keeps working, but it's not the one of the key anymore,
+// so the calls in progress complete against it, and the next ones are paced by a new throttler.
+// The calls made on the returned throttler directly are not counted by Stats and TopKeys.
+func (k *KeyedThrottler[K]) Get(key K) *Throttler {
+	return k.slot(k.canonical(key)).throttler
+}
+
+// canonical returns the key as WithKeyNormalizer turns it, or as it is without a normalizer.
+func (k *KeyedThrottler[K]) canonical(key K) K {
+	if k.normalize == nil {
+		return key
+	}
+
+	return k.normalize(key)
+}
+
+// slot returns the slot of the canonical key, creating it if necessary.
+func (k *KeyedThrottler[K]) slot(key K) *keyedSlot[K] {
+	now := k.clock.Now()
+	shard := k.shardOf(key)
+
+	shard.mu.Lock()
+	slot := k.lookup(shard, key, now)
+	shard.mu.Unlock()
+
+	if slot != nil {
+		return slot
+	}
+
+	var (
+		state  KeyState
+		loaded bool
+	)
+
+	// the state is loaded without the shard locked, so the store doesn't hold up the other keys of the shard
+	if k.persistence != nil {
+		state, loaded = k.load(key, now)
+	}
+
+	shard.mu.Lock()
+
+	// another caller may have created the key in the meantime
+	if slot := k.lookup(shard, key, now); slot != nil {
+		shard.mu.Unlock()
+
+		return slot
+	}
+
+	size := k.sizeOf(key)
+
+	var evicted []*keyedSlot[K]
+
+	for evictions := k.overflow(shard, size); evictions != nil; evictions = k.overflow(shard, size) {
+		el := shard.order.Back()
+
+		if k.persistence != nil {
+			evicted = append(evicted, el.Value.(*keyedSlot[K]))
+		}
+
+		shard.remove(el)
+		evictions.Add(1)
+	}
+
+	limit, fixed := k.limitFor(key)
+	slot = &keyedSlot[K]{key: key, throttler: New(limit, k.setters...), used: now, fixed: fixed, size: size}
+
+	if loaded {
+		slot.throttler.window = state.Window
+		slot.throttler.counter = state.Taken
+	}
+
+	shard.entries[key] = shard.order.PushFront(slot)
+	shard.bytes += size
+	k.created.Add(1)
+	shard.mu.Unlock()
+
+	// the evicted keys are saved as they are, so they don't start afresh once they are seen again
+	for _, slot := range evicted {
+		if state, ok := slot.state(); ok {
+			k.persistence.schedule(slot.key, pendingState[K]{state: state})
+		}
+	}
+
+	return slot
+}
+
+// lookup returns the slot of the key, nil if there is none, marking it as the most recently used one. The shard must be locked.
+func (k *KeyedThrottler[K]) lookup(shard *keyedShard[K], key K, now time.Time) *keyedSlot[K] {
+	k.expire(shard, now)
+
+	el, found := shard.entries[key]
+
+	if !found {
+		return nil
+	}
+
+	slot := el.Value.(*keyedSlot[K])
+	slot.used = now
+	shard.order.MoveToFront(el)
+
+	return slot
+}
+
+// shardOf returns the shard the key is routed to.
+func (k *KeyedThrottler[K]) shardOf(key K) *keyedShard[K] {
+	if len(k.shards) == 1 {
+		return k.shards[0]
+	}
+
+	return k.shards[k.hash(key)&uint64(len(k.shards)-1)]
+}
+
+// hash returns the hash of the key. The strings and the integers are hashed as they are,
+// while the keys of the other types are hashed by their text, which is the same for the equal keys.
+func (k *KeyedThrottler[K]) hash(key K) uint64 {
+	switch v := any(key).(type) {
+	case string:
+		return maphash.String(k.seed, v)
+	case int:
+		return mix(uint64(v))
+	case int64:
+		return mix(uint64(v))
+	case uint64:
+		return mix(v)
+	case int32:
+		return mix(uint64(v))
+	case uint32:
+		return mix(uint64(v))
+	default:
+		return maphash.String(k.seed, fmt.Sprint(key))
+	}
+}
+
+// mix spreads the bits of an integer, so that the consecutive ones are routed to distinct shards (the finalizer of SplitMix64).
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// Refresh applies the limit WithLimitFor tells for the key to its throttler, e.g. once the tenant has upgraded.
+// The slots taken in the current window are kept, and a key without a throttler gets the limit once it's created.
+// The limit set by SetLimit takes precedence.
+func (k *KeyedThrottler[K]) Refresh(key K) {
+	key = k.canonical(key)
+	shard := k.shardOf(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if el, found := shard.entries[key]; found {
+		k.apply(el.Value.(*keyedSlot[K]))
+	}
+}
+
+// SetLimit sets the limit of the key, 0 meaning no limit, taking precedence over WithLimitFor and the default limit.
+// It applies right away, creating the throttler of the key if necessary, while the slots taken in the current window are kept,
+// and it sticks to the key, even if the key is evicted and seen again.
+func (k *KeyedThrottler[K]) SetLimit(key K, limit uint64) {
+	key = k.canonical(key)
+	slot := k.slot(key)
+
+	k.overridesMu.Lock()
+
+	if k.overrides == nil {
+		k.overrides = make(map[K]uint64)
+	}
+
+	k.overrides[key] = limit
+	k.overridesMu.Unlock()
+
+	shard := k.shardOf(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	k.apply(slot)
+}
+
+// SetDefaultLimit sets the limit of the keys created from now on and of the existing ones without a limit of their own,
+// that is the ones neither set by SetLimit nor told by WithLimitFor. The slots taken in the current window are kept.
+func (k *KeyedThrottler[K]) SetDefaultLimit(limit uint64) {
+	k.limit.Store(limit)
+
+	for _, shard := range k.shards {
+		shard.mu.Lock()
+
+		for el := shard.order.Front(); el != nil; el = el.Next() {
+			if slot := el.Value.(*keyedSlot[K]); !slot.fixed {
+				slot.throttler.SetLimit(limit)
+			}
+		}
+
+		shard.mu.Unlock()
+	}
+}
+
+// apply sets the limit of the key to the throttler of its slot. The shard of the key must be locked.
+func (k *KeyedThrottler[K]) apply(slot *keyedSlot[K]) {
+	limit, fixed := k.limitFor(slot.key)
+	slot.fixed = fixed
+	slot.throttler.SetLimit(limit)
+}
+
+// limitFor returns the limit of the key and reports whether it's a limit of its own rather than the default one.
+func (k *KeyedThrottler[K]) limitFor(key K) (uint64, bool) {
+	k.overridesMu.RLock()
+	limit, found := k.overrides[key]
+	k.overridesMu.RUnlock()
+
+	if found {
+		return limit, true
+	}
+
+	if k.limitOf != nil {
+		if limit := k.limitOf(key); limit > 0 {
+			return limit, true
+		}
+	}
+
+	return k.limit.Load(), false
+}
+
+// Len returns the number of keys the throttlers are held for, once the idle ones are forgotten.
+func (k *KeyedThrottler[K]) Len() int {
+	now := k.clock.Now()
+
+	var n int
+
+	for _, shard := range k.shards {
+		shard.mu.Lock()
+		k.expire(shard, now)
+		n += len(shard.entries)
+		shard.mu.Unlock()
+	}
+
+	return n
+}
+
+// Evictions returns the number of keys evicted as the least recently used ones beyond WithMaxKeys or WithMemoryBudget.
+func (k *KeyedThrottler[K]) Evictions() uint64 {
+	return k.overKeys.Load() + k.overBudget.Load()
+}
+
+// expire forgets the idle keys of the shard, unless they've been looked for less than a TTL ago. The shard must be locked.
+func (k *KeyedThrottler[K]) expire(shard *keyedShard[K], now time.Time) {
+	if k.ttl <= 0 || now.Sub(shard.swept) < k.ttl {
+		return
+	}
+
+	shard.swept = now
+
+	// the keys are walked from the least recently used one until the first one used within the TTL
+	for el := shard.order.Back(); el != nil; {
+		slot := el.Value.(*keyedSlot[K])
+
+		if now.Sub(slot.used) <= k.ttl {
+			return
+		}
+
+		prev := el.Prev()
+
+		// the key is kept until its window is over, so it doesn't start afresh within the window
+		if !slot.throttler.windowEnd().After(now) {
+			shard.remove(el)
+			k.expired.Add(1)
+		}
+
+		el = prev
+	}
+}
+
+// overflow returns the counter of the reason the least recently used key of the shard has to be evicted for a new key of the specified size,
+// or nil if the new key fits. A key exceeding the budget on its own is held anyway, as the only key of its shard. The shard must be locked.
+func (k *KeyedThrottler[K]) overflow(shard *keyedShard[K], size int) *atomic.Uint64 {
+	switch {
+	case shard.order.Len() == 0:
+		return nil
+	case shard.maxKeys > 0 && shard.order.Len() >= shard.maxKeys:
+		return &k.overKeys
+	case shard.budget > 0 && shard.bytes+size > shard.budget:
+		return &k.overBudget
+	default:
+		return nil
+	}
+}
+
+// remove forgets the key of the slot.
+func (s *keyedShard[K]) remove(el *list.Element) {
+	slot := el.Value.(*keyedSlot[K])
+
+	s.order.Remove(el)
+	delete(s.entries, slot.key)
+	s.bytes -= slot.size
+}
@@ -0,0 +1,1534 @@
+package throttle_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestKeyedThrottler(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](2, throttle.WithClock(clock))
+
+	steps := []struct {
+		Advance  time.Duration
+		Key      string
+		Expected bool
+	}{
+		{Key: "first", Expected: true},
+		{Key: "first", Expected: true},
+		{Key: "first", Expected: false},
+		// the keys don't share the limit
+		{Key: "second", Expected: true},
+		{Key: "second", Expected: true},
+		{Key: "second", Expected: false},
+		{Advance: time.Second + time.Millisecond, Key: "first", Expected: true},
+	}
+
+	for i, s := range steps {
+		clock.Advance(s.Advance)
+
+		if actual := keyed.TryAcquire(s.Key); actual != s.Expected {
+			t.Fatal(fmt.Sprintf("Expected call #%d to be admitted: %t, but got %t", i, s.Expected, actual))
+		}
+	}
+
+	if keyed.Get("first") != keyed.Get("first") {
+		t.Fatal("Expected the same throttler for the same key")
+	}
+
+	if actual := keyed.Len(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 keys, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_Get_Concurrent(t *testing.T) {
+	const goroutines = 64
+	const keys = 100
+
+	keyed := throttle.NewKeyed[int](1)
+	seen := make([][]*throttle.Throttler, goroutines)
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+
+	for g := range goroutines {
+		go func(g int) {
+			defer wg.Done()
+
+			<-start
+
+			seen[g] = make([]*throttle.Throttler, keys)
+
+			// every goroutine walks the keys in an order of its own
+			for i := range keys {
+				key := (i + g) % keys
+				seen[g][key] = keyed.Get(key)
+			}
+		}(g)
+	}
+
+	close(start)
+	wg.Wait()
+
+	for g := range goroutines {
+		for key := range keys {
+			if seen[g][key] != seen[0][key] {
+				t.Fatal(fmt.Sprintf("Expected a single throttler for key %d, but goroutine #%d got another one", key, g))
+			}
+		}
+	}
+
+	if actual := keyed.Len(); actual != keys {
+		t.Fatal(fmt.Sprintf("Expected %d keys, but got %d", keys, actual))
+	}
+}
+
+func TestKeyedThrottler_TryAcquire_Concurrent(t *testing.T) {
+	const keys = 20
+	const attempts = 50
+
+	keyed := throttle.NewKeyed[int](3, throttle.WithClock(throttletest.NewManualClock(epoch)))
+	admitted := make([]atomic.Int64, keys)
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(keys * attempts)
+
+	for i := range keys * attempts {
+		go func(key int) {
+			defer wg.Done()
+
+			<-start
+
+			if keyed.TryAcquire(key) {
+				admitted[key].Add(1)
+			}
+		}(i % keys)
+	}
+
+	close(start)
+	wg.Wait()
+
+	for key := range keys {
+		if actual := admitted[key].Load(); actual != 3 {
+			t.Fatal(fmt.Sprintf("Expected key %d to admit 3 calls in the window, but got %d", key, actual))
+		}
+	}
+}
+
+func TestKeyedThrottler_Acquire_Concurrent(t *testing.T) {
+	const keys = 5
+	const callers = 3
+
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](1, throttle.WithClock(clock))
+
+	var wg sync.WaitGroup
+	wg.Add(keys * callers)
+
+	for i := range keys * callers {
+		go func(key string) {
+			defer wg.Done()
+
+			keyed.Acquire(key)
+		}(fmt.Sprintf("key-%d", i%keys))
+	}
+
+	// the first caller of every key is admitted right away, the others wait for the windows that follow
+	clock.BlockUntilSleepers(keys * (callers - 1))
+	clock.Advance(time.Second * callers)
+	wg.Wait()
+
+	calls := clock.SleepCalls()
+
+	if len(calls) != keys*(callers-1) {
+		t.Fatal(fmt.Sprintf("Expected %d waits, but got %d", keys*(callers-1), len(calls)))
+	}
+
+	sort.Slice(calls, func(i, j int) bool { return calls[i] < calls[j] })
+
+	for i, actual := range calls {
+		expected := time.Second * time.Duration(1+i/keys)
+
+		if actual != expected {
+			t.Fatal(fmt.Sprintf("Expected wait #%d to be %s, but got %s", i, expected, actual))
+		}
+	}
+}
+
+func TestKeyedThrottler_KeyTTL(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[int](2, throttle.WithClock(clock), throttle.WithKeyTTL(time.Second*10))
+
+	for key := range 1000 {
+		keyed.TryAcquire(key)
+	}
+
+	clock.Advance(time.Second * 5)
+	keyed.TryAcquire(0)
+
+	steps := []struct {
+		Advance time.Duration
+		Len     int
+	}{
+		{Advance: 0, Len: 1000},
+		// the keys untouched for the TTL are forgotten, while the one used since is kept
+		{Advance: time.Second*5 + time.Millisecond, Len: 1},
+		// the idle keys are looked for once per TTL
+		{Advance: time.Second * 5, Len: 1},
+		{Advance: time.Second * 5, Len: 0},
+	}
+
+	for i, s := range steps {
+		clock.Advance(s.Advance)
+
+		if actual := keyed.Len(); actual != s.Len {
+			t.Fatal(fmt.Sprintf("Expected %d keys at step #%d, but got %d", s.Len, i, actual))
+		}
+	}
+}
+
+func TestKeyedThrottler_KeyTTL_Window(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](2, throttle.WithClock(clock), throttle.WithKeyTTL(time.Millisecond*100))
+
+	steps := []struct {
+		Advance  time.Duration
+		Expected bool
+		Len      int
+	}{
+		{Expected: true, Len: 1},
+		{Expected: true, Len: 1},
+		{Expected: false, Len: 1},
+		// the key is idle for longer than the TTL, but it's kept along with its slots until the window is over
+		{Advance: time.Millisecond * 500, Expected: false, Len: 1},
+		{Advance: time.Millisecond * 501, Expected: true, Len: 1},
+	}
+
+	for i, s := range steps {
+		clock.Advance(s.Advance)
+
+		if actual := keyed.TryAcquire("first"); actual != s.Expected {
+			t.Fatal(fmt.Sprintf("Expected call #%d to be admitted: %t, but got %t", i, s.Expected, actual))
+		}
+
+		if actual := keyed.Len(); actual != s.Len {
+			t.Fatal(fmt.Sprintf("Expected %d keys after call #%d, but got %d", s.Len, i, actual))
+		}
+	}
+
+	clock.Advance(time.Second * 2)
+
+	if actual := keyed.Len(); actual != 0 {
+		t.Fatal(fmt.Sprintf("Expected the idle key to be forgotten once its window is over, but got %d keys", actual))
+	}
+}
+
+func TestKeyedThrottler_MaxKeys(t *testing.T) {
+	useCases := []struct {
+		Name      string
+		Keys      int
+		Len       int
+		Evictions uint64
+	}{
+		{Name: "below", Keys: 9, Len: 9},
+		{Name: "exactly", Keys: 10, Len: 10},
+		{Name: "one more", Keys: 11, Len: 10, Evictions: 1},
+		{Name: "many more", Keys: 1000, Len: 10, Evictions: 990},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			keyed := throttle.NewKeyed[int](1, throttle.WithMaxKeys(10))
+
+			for key := range useCase.Keys {
+				keyed.Get(key)
+			}
+
+			if actual := keyed.Len(); actual != useCase.Len {
+				t.Fatal(fmt.Sprintf("Expected %d keys, but got %d", useCase.Len, actual))
+			}
+
+			if actual := keyed.Evictions(); actual != useCase.Evictions {
+				t.Fatal(fmt.Sprintf("Expected %d evictions, but got %d", useCase.Evictions, actual))
+			}
+		})
+	}
+}
+
+func TestKeyedThrottler_MaxKeys_LRU(t *testing.T) {
+	keyed := throttle.NewKeyed[string](1, throttle.WithMaxKeys(3))
+	first := keyed.Get("first")
+	second := keyed.Get("second")
+	third := keyed.Get("third")
+
+	// the first key is used again, so the second one is the least recently used
+	keyed.Get("first")
+	keyed.Get("fourth")
+
+	if keyed.Get("third") != third {
+		t.Fatal("Expected the third key to be kept")
+	}
+
+	if keyed.Get("first") != first {
+		t.Fatal("Expected the first key to be kept")
+	}
+
+	// the fourth key is the least recently used one by now
+	if keyed.Get("second") == second {
+		t.Fatal("Expected the second key to have been evicted")
+	}
+
+	if actual := keyed.Evictions(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 evictions, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_MaxKeys_InFlight(t *testing.T) {
+	keyed := throttle.NewKeyed[string](1, throttle.WithClock(throttletest.NewManualClock(epoch)), throttle.WithMaxKeys(1))
+	orphan := keyed.Get("first")
+
+	if !orphan.TryAcquire() {
+		t.Fatal("Expected the first call to be admitted")
+	}
+
+	keyed.Get("second")
+
+	// the evicted throttler keeps its state for the callers holding it
+	if orphan.TryAcquire() {
+		t.Fatal("Expected the evicted throttler to keep its window")
+	}
+
+	// while the key starts afresh
+	if !keyed.TryAcquire("first") {
+		t.Fatal("Expected the evicted key to start afresh")
+	}
+}
+
+func TestKeyedThrottler_MaxKeys_Concurrent(t *testing.T) {
+	const goroutines = 64
+	const keys = 100
+
+	keyed := throttle.NewKeyed[int](1, throttle.WithMaxKeys(keys))
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+
+	for g := range goroutines {
+		go func(g int) {
+			defer wg.Done()
+
+			<-start
+
+			for i := range keys {
+				keyed.Get(g*keys + i)
+			}
+		}(g)
+	}
+
+	close(start)
+	wg.Wait()
+
+	if actual := keyed.Len(); actual != keys {
+		t.Fatal(fmt.Sprintf("Expected %d keys, but got %d", keys, actual))
+	}
+
+	if actual := keyed.Evictions(); actual != (goroutines-1)*keys {
+		t.Fatal(fmt.Sprintf("Expected %d evictions, but got %d", (goroutines-1)*keys, actual))
+	}
+}
+
+func TestKeyedThrottler_LimitFor(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	limits := map[string]uint64{"premium": 5}
+
+	var mu sync.Mutex
+	var calls atomic.Int64
+
+	keyed := throttle.NewKeyed[string](
+		2,
+		throttle.WithClock(clock),
+		throttle.WithLimitFor(func(key string) uint64 {
+			calls.Add(1)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			return limits[key]
+		}),
+	)
+
+	admitted := func() map[string]int {
+		counts := make(map[string]int)
+
+		for range 10 {
+			for _, key := range []string{"free", "premium"} {
+				if keyed.TryAcquire(key) {
+					counts[key]++
+				}
+			}
+		}
+
+		return counts
+	}
+
+	steps := []struct {
+		Upgrade bool
+		Free    int
+		Premium int
+	}{
+		{Free: 2, Premium: 5},
+		{Free: 2, Premium: 5},
+		// the free key gets the premium limit once it's refreshed
+		{Upgrade: true, Free: 5, Premium: 5},
+	}
+
+	for i, s := range steps {
+		if s.Upgrade {
+			mu.Lock()
+			limits["free"] = 5
+			mu.Unlock()
+
+			keyed.Refresh("free")
+			keyed.Refresh("unknown")
+		}
+
+		counts := admitted()
+
+		if counts["free"] != s.Free || counts["premium"] != s.Premium {
+			t.Fatal(fmt.Sprintf("Expected window #%d to admit %d free and %d premium calls, but got %v", i, s.Free, s.Premium, counts))
+		}
+
+		clock.Advance(time.Second + time.Millisecond)
+	}
+
+	// once per key created and once per refresh of a known key
+	if actual := calls.Load(); actual != 3 {
+		t.Fatal(fmt.Sprintf("Expected the limit to be resolved 3 times, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_LimitFor_Type(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected a panic for the limit function of another key type")
+		}
+	}()
+
+	throttle.NewKeyed[string](1, throttle.WithLimitFor(func(int) uint64 { return 1 }))
+}
+
+func TestKeyedThrottler_Stats(t *testing.T) {
+	const keys = 50
+
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](20, throttle.WithClock(clock))
+
+	var acquired, throttled uint64
+
+	// the traffic is skewed: the key #i makes i+1 calls, so only the ones past the 20th key are throttled
+	for i := range keys {
+		for range i + 1 {
+			keyed.TryAcquire(fmt.Sprintf("key-%d", i))
+		}
+
+		acquired += uint64(min(i+1, 20))
+		throttled += uint64(max(i+1-20, 0))
+	}
+
+	stats := keyed.Stats()
+
+	if stats.Keys != keys || stats.Acquired != acquired || stats.Throttled != throttled {
+		t.Fatal(fmt.Sprintf("Expected %d keys, %d acquired and %d throttled, but got %+v", keys, acquired, throttled, stats))
+	}
+
+	useCases := []struct {
+		Name     string
+		By       throttle.Metric
+		N        int
+		Expected []throttle.KeyCount[string]
+	}{
+		{
+			Name: "throttled",
+			By:   throttle.MetricThrottled,
+			N:    3,
+			Expected: []throttle.KeyCount[string]{
+				{Key: "key-49", Acquired: 20, Throttled: 30},
+				{Key: "key-48", Acquired: 20, Throttled: 29},
+				{Key: "key-47", Acquired: 20, Throttled: 28},
+			},
+		},
+		{
+			Name: "acquired",
+			By:   throttle.MetricAcquired,
+			N:    2,
+			// the keys with the same count are ranked from the most recently used one
+			Expected: []throttle.KeyCount[string]{
+				{Key: "key-49", Acquired: 20, Throttled: 30},
+				{Key: "key-48", Acquired: 20, Throttled: 29},
+			},
+		},
+		{
+			Name: "fewer keys than asked",
+			By:   throttle.MetricThrottled,
+			N:    keys * 2,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			actual := keyed.TopKeys(useCase.N, useCase.By)
+
+			if useCase.Expected == nil {
+				if len(actual) != keys {
+					t.Fatal(fmt.Sprintf("Expected all %d keys, but got %d", keys, len(actual)))
+				}
+
+				return
+			}
+
+			if fmt.Sprint(actual) != fmt.Sprint(useCase.Expected) {
+				t.Fatal(fmt.Sprintf("Expected %v, but got %v", useCase.Expected, actual))
+			}
+		})
+	}
+
+	// the toplist covers the current window, while the totals keep counting
+	clock.Advance(time.Second)
+	keyed.TryAcquire("key-0")
+
+	if actual := keyed.TopKeys(10, throttle.MetricAcquired); len(actual) != 1 || actual[0].Key != "key-0" {
+		t.Fatal(fmt.Sprintf("Expected only the key used in the new window, but got %v", actual))
+	}
+
+	if actual := keyed.Stats().Acquired; actual != acquired+1 {
+		t.Fatal(fmt.Sprintf("Expected %d acquired in total, but got %d", acquired+1, actual))
+	}
+}
+
+func TestKeyedThrottler_Stats_Acquire(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	keyed := throttle.NewKeyed[string](1, throttle.WithClock(clock))
+
+	keyed.Acquire("first")
+	// the second call waits for the next window
+	keyed.Acquire("first")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = keyed.AcquireContext(ctx, "first")
+
+	if stats := keyed.Stats(); stats.Acquired != 2 || stats.Throttled != 1 {
+		t.Fatal(fmt.Sprintf("Expected 2 acquired and 1 throttled, but got %+v", stats))
+	}
+}
+
+func TestKeyedThrottler_SetLimit(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](2, throttle.WithClock(clock))
+
+	admit := func(key string) int {
+		var n int
+
+		for range 10 {
+			if keyed.TryAcquire(key) {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	steps := []struct {
+		Name     string
+		Change   func()
+		Expected map[string]int
+	}{
+		{
+			Name:     "default",
+			Expected: map[string]int{"first": 2, "second": 2},
+		},
+		{
+			Name: "raised mid-window",
+			Change: func() {
+				keyed.SetLimit("first", 4)
+			},
+			// the slots taken in the window still count
+			Expected: map[string]int{"first": 2, "second": 0},
+		},
+		{
+			Name:     "next window",
+			Expected: map[string]int{"first": 4, "second": 2},
+		},
+		{
+			Name: "default raised",
+			Change: func() {
+				keyed.SetDefaultLimit(3)
+			},
+			Expected: map[string]int{"first": 0, "second": 1, "third": 3},
+		},
+		{
+			Name:     "next window after the default raised",
+			Expected: map[string]int{"first": 4, "second": 3, "third": 3},
+		},
+		{
+			Name: "set for a new key",
+			Change: func() {
+				keyed.SetLimit("fourth", 1)
+			},
+			Expected: map[string]int{"fourth": 1},
+		},
+	}
+
+	for i, s := range steps {
+		if i > 0 && s.Change == nil {
+			clock.Advance(time.Second + time.Millisecond)
+		}
+
+		if s.Change != nil {
+			s.Change()
+		}
+
+		for key, expected := range s.Expected {
+			if actual := admit(key); actual != expected {
+				t.Fatal(fmt.Sprintf("Expected %s to admit %d calls at step %q, but got %d", key, expected, s.Name, actual))
+			}
+		}
+	}
+}
+
+func TestKeyedThrottler_SetLimit_Evicted(t *testing.T) {
+	keyed := throttle.NewKeyed[string](2, throttle.WithMaxKeys(1))
+	keyed.SetLimit("first", 5)
+	keyed.Get("second")
+
+	// the limit sticks to the key once it's seen again
+	if actual := keyed.Get("first").Limit(); actual != 5 {
+		t.Fatal(fmt.Sprintf("Expected the limit of 5, but got %d", actual))
+	}
+
+	keyed.SetDefaultLimit(7)
+
+	if actual := keyed.Get("first").Limit(); actual != 5 {
+		t.Fatal(fmt.Sprintf("Expected the limit of 5 to be kept, but got %d", actual))
+	}
+
+	if actual := keyed.Get("second").Limit(); actual != 7 {
+		t.Fatal(fmt.Sprintf("Expected the default limit of 7, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_SetLimit_Concurrent(t *testing.T) {
+	keyed := throttle.NewKeyed[int](1)
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(16)
+
+	for g := range 16 {
+		go func(g int) {
+			defer wg.Done()
+
+			<-start
+
+			for i := range 100 {
+				switch g % 4 {
+				case 0:
+					keyed.SetLimit(i%10, uint64(i))
+				case 1:
+					keyed.SetDefaultLimit(uint64(i))
+				default:
+					keyed.TryAcquire(i % 10)
+				}
+			}
+		}(g)
+	}
+
+	close(start)
+	wg.Wait()
+
+	// the last limits set stick
+	keyed.SetLimit(3, 42)
+
+	if actual := keyed.Get(3).Limit(); actual != 42 {
+		t.Fatal(fmt.Sprintf("Expected the limit of 42, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_Shards(t *testing.T) {
+	useCases := []struct {
+		Name   string
+		Shards int
+	}{
+		{Name: "single", Shards: 1},
+		{Name: "rounded up", Shards: 3},
+		{Name: "many", Shards: 64},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			const goroutines = 32
+			const keys = 500
+
+			keyed := throttle.NewKeyed[string](2, throttle.WithClock(throttletest.NewManualClock(epoch)), throttle.WithShards(useCase.Shards))
+			seen := make([]map[string]*throttle.Throttler, goroutines)
+			start := make(chan struct{})
+
+			var wg sync.WaitGroup
+			wg.Add(goroutines)
+
+			for g := range goroutines {
+				go func(g int) {
+					defer wg.Done()
+
+					<-start
+
+					seen[g] = make(map[string]*throttle.Throttler, keys)
+
+					for i := range keys {
+						key := fmt.Sprintf("key-%d", (i+g)%keys)
+						seen[g][key] = keyed.Get(key)
+						keyed.TryAcquire(key)
+					}
+				}(g)
+			}
+
+			close(start)
+			wg.Wait()
+
+			for g := range goroutines {
+				for key, throttler := range seen[g] {
+					if throttler != seen[0][key] {
+						t.Fatal(fmt.Sprintf("Expected a single throttler for %s, but goroutine #%d got another one", key, g))
+					}
+				}
+			}
+
+			stats := keyed.Stats()
+
+			// every key admits 2 calls out of one per goroutine
+			if stats.Keys != keys || stats.Acquired != keys*2 || stats.Throttled != keys*(goroutines-2) {
+				t.Fatal(fmt.Sprintf("Expected %d keys, %d acquired and %d throttled, but got %+v", keys, keys*2, keys*(goroutines-2), stats))
+			}
+
+			if actual := len(keyed.TopKeys(keys*2, throttle.MetricAcquired)); actual != keys {
+				t.Fatal(fmt.Sprintf("Expected the toplist to cover all %d keys across the shards, but got %d", keys, actual))
+			}
+		})
+	}
+}
+
+func TestKeyedThrottler_Shards_MaxKeys(t *testing.T) {
+	keyed := throttle.NewKeyed[int](1, throttle.WithMaxKeys(64), throttle.WithShards(4))
+
+	for key := range 1000 {
+		keyed.Get(key)
+	}
+
+	actual := keyed.Len()
+
+	// the cap is split evenly across the shards, so it's never exceeded
+	if actual > 64 || actual < 48 {
+		t.Fatal(fmt.Sprintf("Expected about 64 keys, but got %d", actual))
+	}
+
+	if evicted := keyed.Evictions(); evicted != uint64(1000-actual) {
+		t.Fatal(fmt.Sprintf("Expected %d evictions, but got %d", 1000-actual, evicted))
+	}
+}
+
+func TestKeyedThrottler_Shards_Race(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[int](
+		5,
+		throttle.WithClock(clock),
+		throttle.WithShards(8),
+		throttle.WithMaxKeys(100),
+		throttle.WithKeyTTL(time.Second),
+	)
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(32)
+
+	// creations, evictions by the cap and by the TTL, acquisitions and limit changes interleave
+	for g := range 32 {
+		go func(g int) {
+			defer wg.Done()
+
+			<-start
+
+			for i := range 500 {
+				key := (g*31 + i) % 300
+
+				switch i % 10 {
+				case 0:
+					clock.Advance(time.Millisecond * 100)
+				case 1:
+					keyed.SetLimit(key, uint64(i%7))
+				case 2:
+					keyed.Len()
+				case 3:
+					keyed.TopKeys(5, throttle.MetricThrottled)
+				case 4:
+					keyed.SetDefaultLimit(uint64(i % 5))
+				default:
+					keyed.TryAcquire(key)
+				}
+			}
+		}(g)
+	}
+
+	close(start)
+	wg.Wait()
+
+	if actual := keyed.Len(); actual > 100 {
+		t.Fatal(fmt.Sprintf("Expected 100 keys at most, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_KeyNormalizer(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](
+		2,
+		throttle.WithClock(clock),
+		throttle.WithMaxKeys(1),
+		throttle.WithKeyNormalizer(throttle.HostKey),
+	)
+
+	// the variants of the host share a single window
+	if !keyed.TryAcquire("API.Example.com") || !keyed.TryAcquire("api.example.com.") {
+		t.Fatal("Expected the first 2 calls to be admitted")
+	}
+
+	if keyed.TryAcquire("api.example.com:443") {
+		t.Fatal("Expected the variants of the host to share the limit")
+	}
+
+	if keyed.Get("Api.Example.Com") != keyed.Get("api.example.com") {
+		t.Fatal("Expected the variants of the host to share a throttler")
+	}
+
+	if actual := keyed.Len(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected 1 key, but got %d", actual))
+	}
+
+	keyed.SetLimit("API.EXAMPLE.COM.", 3)
+
+	if !keyed.TryAcquire("api.example.com") {
+		t.Fatal("Expected the limit set for a variant to apply to the host")
+	}
+
+	// the key is evicted under its canonical form, while its limit sticks to it
+	keyed.TryAcquire("other.example.com")
+
+	if actual := keyed.Evictions(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected 1 eviction, but got %d", actual))
+	}
+
+	clock.Advance(time.Second + time.Millisecond)
+
+	var admitted int
+
+	for range 10 {
+		if keyed.TryAcquire("Api.Example.Com") {
+			admitted++
+		}
+	}
+
+	if admitted != 3 {
+		t.Fatal(fmt.Sprintf("Expected 3 calls to be admitted, but got %d", admitted))
+	}
+
+	top := keyed.TopKeys(1, throttle.MetricAcquired)
+
+	if len(top) != 1 || top[0].Key != "api.example.com" {
+		t.Fatal(fmt.Sprintf("Expected the canonical key to be reported, but got %v", top))
+	}
+}
+
+func TestHostKey(t *testing.T) {
+	useCases := []struct {
+		Key      string
+		Expected string
+	}{
+		{Key: "example.com", Expected: "example.com"},
+		{Key: "API.Example.com.", Expected: "api.example.com"},
+		{Key: "api.example.com:8080", Expected: "api.example.com"},
+		{Key: "API.example.com.:443", Expected: "api.example.com"},
+		{Key: "10.0.0.1:80", Expected: "10.0.0.1"},
+		{Key: "[::1]:80", Expected: "::1"},
+		{Key: "[::1]", Expected: "::1"},
+		{Key: "2001:DB8::1", Expected: "2001:db8::1"},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Key, func(t *testing.T) {
+			if actual := throttle.HostKey(useCase.Key); actual != useCase.Expected {
+				t.Fatal(fmt.Sprintf("Expected %q, but got %q", useCase.Expected, actual))
+			}
+		})
+	}
+}
+
+func TestKeyedThrottler_Config(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+
+	var cfg throttle.KeyedConfig
+
+	if err := json.Unmarshal([]byte(`{"defaultLimit": 2, "window": "1m", "overrides": {"acme": 5, "Globex": 3}}`), &cfg); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	keyed := throttle.NewKeyedFromConfig(cfg, throttle.WithClock(clock), throttle.WithKeyNormalizer(throttle.LowercaseKey))
+
+	admit := func(key string, n int) int {
+		var admitted int
+
+		for range n {
+			if keyed.TryAcquire(key) {
+				admitted++
+			}
+		}
+
+		return admitted
+	}
+
+	// the overrides apply once the keys are seen
+	if actual := keyed.Len(); actual != 0 {
+		t.Fatal(fmt.Sprintf("Expected no keys before the traffic, but got %d", actual))
+	}
+
+	expected := map[string]int{"acme": 5, "globex": 3, "initech": 2, "umbrella": 2}
+
+	for key, n := range expected {
+		if actual := admit(key, 10); actual != n {
+			t.Fatal(fmt.Sprintf("Expected %s to admit %d calls, but got %d", key, n, actual))
+		}
+	}
+
+	// within the window of a minute
+	clock.Advance(time.Second * 30)
+
+	err := keyed.ApplyConfig(throttle.KeyedConfig{
+		DefaultLimit: 4,
+		Overrides:    map[string]uint64{"acme": 5, "initech": 1, "umbrella": 8},
+	})
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// the slots taken in the window are kept
+	expected = map[string]int{
+		// unchanged
+		"acme": 0,
+		// the override removed, so back to the new default
+		"globex": 1,
+		// lowered below the slots taken
+		"initech": 0,
+		// raised
+		"umbrella": 6,
+		// a new key gets the new default
+		"hooli": 4,
+	}
+
+	for key, n := range expected {
+		if actual := admit(key, 10); actual != n {
+			t.Fatal(fmt.Sprintf("Expected %s to admit %d calls after the reload, but got %d", key, n, actual))
+		}
+	}
+
+	clock.Advance(time.Minute + time.Millisecond)
+
+	expected = map[string]int{"acme": 5, "globex": 4, "initech": 1, "umbrella": 8, "hooli": 4}
+
+	for key, n := range expected {
+		if actual := admit(key, 10); actual != n {
+			t.Fatal(fmt.Sprintf("Expected %s to admit %d calls in the next window, but got %d", key, n, actual))
+		}
+	}
+
+	if err := keyed.ApplyConfig(throttle.KeyedConfig{DefaultLimit: 4, Window: time.Second}); err == nil {
+		t.Fatal("Expected the window change to be refused")
+	}
+}
+
+func TestKeyedConfig_JSON(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Data     string
+		Expected time.Duration
+		Error    bool
+	}{
+		{Name: "duration", Data: `{"defaultLimit": 1, "window": "1m30s"}`, Expected: time.Second * 90},
+		{Name: "nanoseconds", Data: `{"defaultLimit": 1, "window": 1000000000}`, Expected: time.Second},
+		{Name: "none", Data: `{"defaultLimit": 1}`},
+		{Name: "invalid", Data: `{"defaultLimit": 1, "window": "soon"}`, Error: true},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var cfg throttle.KeyedConfig
+
+			err := json.Unmarshal([]byte(useCase.Data), &cfg)
+
+			if useCase.Error {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if cfg.Window != useCase.Expected || cfg.DefaultLimit != 1 {
+				t.Fatal(fmt.Sprintf("Expected a limit of 1 per %s, but got %d per %s", useCase.Expected, cfg.DefaultLimit, cfg.Window))
+			}
+
+			data, _ := json.Marshal(cfg)
+
+			var decoded throttle.KeyedConfig
+
+			if err := json.Unmarshal(data, &decoded); err != nil || decoded.Window != cfg.Window {
+				t.Fatal(fmt.Sprintf("Expected %s to round-trip, but got %s (%v)", data, decoded.Window, err))
+			}
+		})
+	}
+}
+
+type (
+	failingStateStore struct {
+		throttle.StateStore[string]
+	}
+
+	// countingStateStore counts the states saved to the store.
+	countingStateStore struct {
+		throttle.StateStore[string]
+		saves atomic.Int64
+	}
+
+	// blockingStateStore blocks the loads of a key until it's released.
+	blockingStateStore struct {
+		throttle.StateStore[string]
+		key      string
+		loading  chan struct{}
+		released chan struct{}
+	}
+
+	// blockingSaveStore blocks the first save until it's released.
+	blockingSaveStore struct {
+		*countingStateStore
+		once     sync.Once
+		saving   chan struct{}
+		released chan struct{}
+	}
+)
+
+func (s failingStateStore) Load(string) (throttle.KeyState, bool, error) {
+	return throttle.KeyState{}, false, errors.New("unavailable")
+}
+
+func (s *countingStateStore) Save(key string, state throttle.KeyState) error {
+	s.saves.Add(1)
+
+	return s.StateStore.Save(key, state)
+}
+
+func (s *blockingSaveStore) Save(key string, state throttle.KeyState) error {
+	s.once.Do(func() {
+		close(s.saving)
+		<-s.released
+	})
+
+	return s.countingStateStore.Save(key, state)
+}
+
+func (s *blockingStateStore) Load(key string) (throttle.KeyState, bool, error) {
+	if key == s.key {
+		close(s.loading)
+		<-s.released
+	}
+
+	return s.StateStore.Load(key)
+}
+
+func TestKeyedThrottler_TryReserve(t *testing.T) {
+	keyed := throttle.NewKeyed[string](1, throttle.WithClock(throttletest.NewManualClock(epoch)))
+
+	res, ok := keyed.TryReserve("acme")
+
+	if !ok {
+		t.Fatal("Expected the slot of the key to be reserved")
+	}
+
+	if _, ok := keyed.TryReserve("acme"); ok {
+		t.Fatal("Expected no slots beyond the limit of the key")
+	}
+
+	res.Cancel()
+
+	if !keyed.TryAcquire("acme") {
+		t.Fatal("Expected the cancelled slot to be given back")
+	}
+}
+
+func TestKeyedThrottler_StateStore(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	store := throttle.NewMemoryStateStore[string]()
+
+	admit := func(keyed *throttle.KeyedThrottler[string], key string) int {
+		var n int
+
+		for range 20 {
+			if keyed.TryAcquire(key) {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	before := throttle.NewKeyed[string](10, throttle.WithClock(clock), throttle.WithStateStore[string](store))
+
+	for range 7 {
+		before.Acquire("acme")
+	}
+
+	if actual := admit(before, "globex"); actual != 10 {
+		t.Fatal(fmt.Sprintf("Expected 10 calls to be admitted, but got %d", actual))
+	}
+
+	if err := before.Flush(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := store.Len(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 states to be saved, but got %d", actual))
+	}
+
+	// the restart within the window
+	clock.Advance(time.Millisecond * 500)
+
+	after := throttle.NewKeyed[string](10, throttle.WithClock(clock), throttle.WithStateStore[string](store))
+
+	expected := map[string]int{"acme": 3, "globex": 0, "initech": 10}
+
+	for key, n := range expected {
+		if actual := admit(after, key); actual != n {
+			t.Fatal(fmt.Sprintf("Expected %s to admit %d calls after the restart, but got %d", key, n, actual))
+		}
+	}
+
+	if err := after.Flush(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// the restart once the windows are over
+	clock.Advance(time.Second + time.Millisecond)
+
+	restarted := throttle.NewKeyed[string](10, throttle.WithClock(clock), throttle.WithStateStore[string](store))
+
+	for _, key := range []string{"acme", "globex", "initech"} {
+		if actual := admit(restarted, key); actual != 10 {
+			t.Fatal(fmt.Sprintf("Expected %s to start afresh once its window is over, but got %d calls admitted", key, actual))
+		}
+	}
+}
+
+func TestKeyedThrottler_StateStore_Error(t *testing.T) {
+	keyed := throttle.NewKeyed[string](2, throttle.WithStateStore[string](failingStateStore{throttle.NewMemoryStateStore[string]()}))
+
+	// the key starts afresh
+	if !keyed.TryAcquire("acme") || !keyed.TryAcquire("acme") || keyed.TryAcquire("acme") {
+		t.Fatal("Expected the key to admit 2 calls")
+	}
+
+	if err := keyed.Flush(); err == nil {
+		t.Fatal("Expected the load error to be reported")
+	}
+
+	if err := keyed.Flush(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected the error to be reported once, but got %s", err))
+	}
+}
+
+func TestKeyedThrottler_StateStore_Concurrent(t *testing.T) {
+	store := throttle.NewMemoryStateStore[int]()
+	keyed := throttle.NewKeyed[int](1000, throttle.WithStateStore[int](store), throttle.WithShards(4))
+
+	var wg sync.WaitGroup
+
+	for i := range 8 {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := range 100 {
+				keyed.TryAcquire((i + j) % 10)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if err := keyed.Flush(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	var taken uint64
+
+	for key := range 10 {
+		state, found, _ := store.Load(key)
+
+		if !found {
+			t.Fatal(fmt.Sprintf("Expected the state of key %d to be saved", key))
+		}
+
+		taken += state.Taken
+	}
+
+	if taken != 800 {
+		t.Fatal(fmt.Sprintf("Expected the saved states to take 800 slots, but got %d", taken))
+	}
+}
+
+func TestKeyedThrottler_StateStore_Coalesced(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	store := &countingStateStore{StateStore: throttle.NewMemoryStateStore[string]()}
+	blocking := &blockingSaveStore{countingStateStore: store, saving: make(chan struct{}), released: make(chan struct{})}
+	keyed := throttle.NewKeyed[string](1000, throttle.WithClock(clock), throttle.WithStateStore[string](blocking))
+
+	// the first change is being saved while the rest are made
+	keyed.TryAcquire("acme")
+	<-blocking.saving
+
+	for range 99 {
+		keyed.TryAcquire("acme")
+	}
+
+	close(blocking.released)
+
+	// the state of the first change, the one of the rest, saved at once, and the one of Flush
+	if err := keyed.Flush(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := store.saves.Load(); actual > 3 {
+		t.Fatal(fmt.Sprintf("Expected at most 3 states to be saved, but got %d", actual))
+	}
+
+	state, found, _ := store.Load("acme")
+
+	if !found || state.Taken != 100 || !state.Window.Equal(epoch) {
+		t.Fatal(fmt.Sprintf("Expected the state with 100 slots taken to be saved, but got %+v", state))
+	}
+}
+
+func TestKeyedThrottler_StateStore_RestartExhausted(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	store := throttle.NewMemoryStateStore[string]()
+	before := throttle.NewKeyed[string](10, throttle.WithClock(clock), throttle.WithStateStore[string](store))
+
+	for range 9 {
+		if !before.TryAcquire("acme") {
+			t.Fatal("Expected the calls within the limit to be admitted")
+		}
+	}
+
+	// the process is killed without Flush once the states scheduled so far are saved
+	deadline := time.Now().Add(time.Second * 5)
+
+	for {
+		state, _, _ := store.Load("acme")
+
+		if state.Taken == 9 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected the state with 9 slots taken to be saved, but got %+v", state))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(time.Millisecond * 500)
+
+	after := throttle.NewKeyed[string](10, throttle.WithClock(clock), throttle.WithStateStore[string](store))
+
+	if !after.TryAcquire("acme") {
+		t.Fatal("Expected the last slot of the window to be admitted after the restart")
+	}
+
+	if after.TryAcquire("acme") {
+		t.Fatal("Expected the quota used up before the restart to be kept")
+	}
+}
+
+func TestKeyedThrottler_StateStore_Evicted(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	store := throttle.NewMemoryStateStore[string]()
+	keyed := throttle.NewKeyed[string](10, throttle.WithClock(clock), throttle.WithStateStore[string](store), throttle.WithMaxKeys(1))
+
+	for range 7 {
+		keyed.Acquire("acme")
+	}
+
+	// evicts acme
+	keyed.Acquire("globex")
+
+	var n int
+
+	for keyed.TryAcquire("acme") {
+		n++
+	}
+
+	if n != 3 {
+		t.Fatal(fmt.Sprintf("Expected the evicted key to admit 3 calls once seen again, but got %d", n))
+	}
+
+	if err := keyed.Flush(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+}
+
+func TestKeyedThrottler_StateStore_SlowLoad(t *testing.T) {
+	store := &blockingStateStore{
+		StateStore: throttle.NewMemoryStateStore[string](),
+		key:        "acme",
+		loading:    make(chan struct{}),
+		released:   make(chan struct{}),
+	}
+	keyed := throttle.NewKeyed[string](10, throttle.WithStateStore[string](store))
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		keyed.TryAcquire("acme")
+	}()
+
+	<-store.loading
+
+	// the key of the same shard isn't held up by the load
+	if !keyed.TryAcquire("globex") {
+		t.Fatal("Expected the other key to be admitted while acme is being loaded")
+	}
+
+	close(store.released)
+	<-done
+
+	if actual := keyed.Len(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 keys, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_MemoryBudget(t *testing.T) {
+	// the estimate of a key without any bytes of its own
+	base := throttle.NewKeyed[string](1)
+	base.Get("")
+	overhead := base.MemoryEstimate()
+
+	key := func(i int) string {
+		return fmt.Sprintf("%0100d", i)
+	}
+
+	// 10 keys of 100 bytes fit into the budget
+	budget := (overhead+100)*10 + 50
+	keyed := throttle.NewKeyed[string](1, throttle.WithClock(throttletest.NewManualClock(epoch)), throttle.WithMemoryBudget(budget))
+	hot := key(0)
+
+	for i := range 10 {
+		keyed.Get(key(i))
+	}
+
+	keyed.TryAcquire(hot)
+
+	if actual := keyed.Evictions(); actual != 0 {
+		t.Fatal(fmt.Sprintf("Expected no evictions within the budget, but got %d", actual))
+	}
+
+	if actual := keyed.MemoryEstimate(); actual != (overhead+100)*10 {
+		t.Fatal(fmt.Sprintf("Expected the estimate of 10 keys to be %d, but got %d", (overhead+100)*10, actual))
+	}
+
+	for i := 10; i < 30; i++ {
+		keyed.Get(hot)
+		keyed.Get(key(i))
+
+		if actual := keyed.MemoryEstimate(); actual > budget {
+			t.Fatal(fmt.Sprintf("Expected the estimate to stay within %d, but got %d", budget, actual))
+		}
+	}
+
+	if actual := keyed.Len(); actual != 10 {
+		t.Fatal(fmt.Sprintf("Expected 10 keys, but got %d", actual))
+	}
+
+	if actual := keyed.Evictions(); actual != 20 {
+		t.Fatal(fmt.Sprintf("Expected 20 evictions, but got %d", actual))
+	}
+
+	// the hot key survives, while the cold ones are evicted
+	if keyed.TryAcquire(hot) {
+		t.Fatal("Expected the hot key to keep its window")
+	}
+
+	// a longer key takes the place of 2 short ones
+	keyed.Get(strings.Repeat("x", overhead+200))
+
+	if actual := keyed.Len(); actual != 9 {
+		t.Fatal(fmt.Sprintf("Expected 9 keys, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_MemoryBudget_SmallerThanShards(t *testing.T) {
+	// a budget of a byte per shard, which every key exceeds on its own
+	keyed := throttle.NewKeyed[string](1, throttle.WithShards(16), throttle.WithMemoryBudget(8))
+
+	for i := range 1000 {
+		keyed.Get(fmt.Sprintf("key-%d", i))
+	}
+
+	// a key per shard at most, rather than no budget at all
+	if actual := keyed.Len(); actual > 16 {
+		t.Fatal(fmt.Sprintf("Expected at most 16 keys, but got %d", actual))
+	}
+
+	if keyed.Evictions() == 0 {
+		t.Fatal("Expected the keys to be evicted")
+	}
+}
+
+func TestKeyedThrottler_KeySize(t *testing.T) {
+	type tenant struct {
+		ID   int
+		Name string
+	}
+
+	base := throttle.NewKeyed[tenant](1)
+	base.Get(tenant{})
+	overhead := base.MemoryEstimate()
+
+	keyed := throttle.NewKeyed[tenant](
+		1,
+		throttle.WithMemoryBudget((overhead+10)*3),
+		throttle.WithKeySize(func(key tenant) int {
+			return len(key.Name)
+		}),
+	)
+
+	for i := range 5 {
+		keyed.Get(tenant{ID: i, Name: "0123456789"})
+	}
+
+	if actual := keyed.MemoryEstimate(); actual != (overhead+10)*3 {
+		t.Fatal(fmt.Sprintf("Expected the estimate to be %d, but got %d", (overhead+10)*3, actual))
+	}
+
+	if actual := keyed.Evictions(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 evictions, but got %d", actual))
+	}
+}
+
+func TestKeyedThrottler_ManagerStats(t *testing.T) {
+	base := throttle.NewKeyed[string](1)
+	base.Get("")
+	overhead := base.MemoryEstimate()
+
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](
+		10,
+		throttle.WithClock(clock),
+		throttle.WithKeyTTL(time.Minute),
+		throttle.WithMaxKeys(3),
+		throttle.WithMemoryBudget(overhead*3+100),
+	)
+
+	long := strings.Repeat("x", 150)
+
+	steps := []struct {
+		Name     string
+		Advance  time.Duration
+		Keys     []string
+		Expected throttle.ManagerStats[string]
+	}{
+		{
+			Name:     "created",
+			Keys:     []string{"a", "b", "c"},
+			Expected: throttle.ManagerStats[string]{Keys: 3, Memory: (overhead + 1) * 3, Created: 3},
+		},
+		{
+			Name:     "beyond the max keys",
+			Keys:     []string{"d"},
+			Expected: throttle.ManagerStats[string]{Keys: 3, Memory: (overhead + 1) * 3, Created: 4, EvictedLRU: 1},
+		},
+		{
+			// b is evicted for the max keys, then c for the memory
+			Name:     "beyond the memory budget",
+			Keys:     []string{long},
+			Expected: throttle.ManagerStats[string]{Keys: 2, Memory: overhead*2 + 151, Created: 5, EvictedLRU: 2, EvictedMemory: 1},
+		},
+		{
+			Name:     "idle",
+			Advance:  time.Minute * 2,
+			Keys:     []string{"e", "e", "e"},
+			Expected: throttle.ManagerStats[string]{Keys: 1, Memory: overhead + 1, Created: 6, EvictedLRU: 2, EvictedMemory: 1, EvictedTTL: 2},
+		},
+		{
+			Name:     "seen again",
+			Keys:     []string{"a"},
+			Expected: throttle.ManagerStats[string]{Keys: 2, Memory: (overhead + 1) * 2, Created: 7, EvictedLRU: 2, EvictedMemory: 1, EvictedTTL: 2},
+		},
+	}
+
+	for _, s := range steps {
+		clock.Advance(s.Advance)
+
+		for _, key := range s.Keys {
+			keyed.Acquire(key)
+		}
+
+		actual := keyed.ManagerStats()
+		hot := actual.HotKeys
+		actual.HotKeys = nil
+
+		if !reflect.DeepEqual(actual, s.Expected) {
+			t.Fatal(fmt.Sprintf("Expected %+v at step %q, but got %+v", s.Expected, s.Name, actual))
+		}
+
+		if evicted := actual.EvictedTTL + actual.EvictedLRU + actual.EvictedMemory; uint64(actual.Keys) != actual.Created-evicted {
+			t.Fatal(fmt.Sprintf("Expected the keys to match the counters at step %q, but got %+v", s.Name, actual))
+		}
+
+		if len(hot) != actual.Keys {
+			t.Fatal(fmt.Sprintf("Expected %d hot keys at step %q, but got %v", actual.Keys, s.Name, hot))
+		}
+	}
+
+	hot := keyed.ManagerStats().HotKeys
+
+	if hot[0].Key != "e" || hot[0].Acquired != 3 || hot[1].Key != "a" || hot[1].Acquired != 1 {
+		t.Fatal(fmt.Sprintf("Expected e and a to be the hot keys, but got %v", hot))
+	}
+}
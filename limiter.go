@@ -0,0 +1,18 @@
+package throttle
+
+import "context"
+
+// Limiter is implemented by types that pace operations, like Throttler.
+// Code that depends on it instead of *Throttler can be tested with a scripted fake.
+type Limiter interface {
+	// Acquire blocks until the operation can be executed.
+	Acquire()
+	// AcquireContext blocks until the operation can be executed or the context is done.
+	AcquireContext(ctx context.Context) error
+	// AcquireN blocks until the operation weighing n can be executed or the context is done.
+	AcquireN(ctx context.Context, n uint64) error
+	// TryAcquire reports whether the operation can be executed right away, taking a slot if so.
+	TryAcquire() bool
+	// TryAcquireN reports whether the operation weighing n can be executed right away, taking the slots if so.
+	TryAcquireN(n uint64) bool
+}
@@ -0,0 +1,129 @@
+package throttle
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+type (
+	// LineReader reads the records of the underlying reader at most the specified number of records per window, whatever their size,
+	// e.g. to ship the lines of a log at a steady pace. It's used like bufio.Scanner, whose split functions it takes.
+	LineReader struct {
+		scanner   *bufio.Scanner
+		throttler *Throttler
+		// pending reports whether the record scanned hasn't been admitted yet, because the context has been done while waiting for it
+		pending bool
+		err     error
+	}
+
+	// LineReaderOption configures the reader of NewLineReader.
+	// Throttler options, like WithClock and WithWindow, are line reader options too.
+	LineReaderOption interface {
+		applyLineReader(opts *lineReaderOptions)
+	}
+
+	// lineReaderOptions holds configuration settings for the reader of NewLineReader.
+	lineReaderOptions struct {
+		throttler []Option
+		split     bufio.SplitFunc
+		maxSize   int
+	}
+
+	lineReaderOptionFunc func(opts *lineReaderOptions)
+)
+
+func (fn lineReaderOptionFunc) applyLineReader(opts *lineReaderOptions) {
+	fn(opts)
+}
+
+func (o Option) applyLineReader(opts *lineReaderOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+// WithSplit sets the function splitting the input into records, bufio.ScanLines by default,
+// e.g. bufio.ScanWords, or a function of its own for the length-prefixed records.
+func WithSplit(split bufio.SplitFunc) LineReaderOption {
+	return lineReaderOptionFunc(func(opts *lineReaderOptions) {
+		opts.split = split
+	})
+}
+
+// WithMaxRecordSize sets the size of the largest record, bufio.MaxScanTokenSize by default.
+// A larger record stops the reader, whose Err returns bufio.ErrTooLong.
+func WithMaxRecordSize(size int) LineReaderOption {
+	return lineReaderOptionFunc(func(opts *lineReaderOptions) {
+		opts.maxSize = size
+	})
+}
+
+// NewLineReader creates a reader of the records of the underlying reader, the lines by default, that delivers at most the specified number of records
+// per window, one second by default, 0 meaning no limit. Each record takes a slot, whatever its size, and the final one is delivered even without a terminator.
+func NewLineReader(reader io.Reader, linesPerSec uint64, setters ...LineReaderOption) *LineReader {
+	opts := &lineReaderOptions{}
+
+	for _, setter := range setters {
+		setter.applyLineReader(opts)
+	}
+
+	scanner := bufio.NewScanner(reader)
+
+	if opts.split != nil {
+		scanner.Split(opts.split)
+	}
+
+	if opts.maxSize > 0 {
+		scanner.Buffer(make([]byte, 0, min(opts.maxSize, 4096)), opts.maxSize)
+	}
+
+	return &LineReader{
+		scanner:   scanner,
+		throttler: New(linesPerSec, opts.throttler...),
+	}
+}
+
+// Scan advances the reader to the next record once the limit admits it, which is then available through Bytes or Text,
+// and reports whether there is one. It returns false once the input is over or an error occurs, which Err returns.
+func (r *LineReader) Scan() bool {
+	return r.ScanContext(context.Background())
+}
+
+// ScanContext is like Scan, but gives up waiting for the limit once the context is done, in which case Err returns the error of the context.
+// The record that has been waiting is then delivered by the next call, so no record is lost.
+func (r *LineReader) ScanContext(ctx context.Context) bool {
+	if !r.pending {
+		if !r.scanner.Scan() {
+			return false
+		}
+
+		r.pending = true
+	}
+
+	if r.err = r.throttler.AcquireContext(ctx); r.err != nil {
+		return false
+	}
+
+	r.pending = false
+
+	return true
+}
+
+// Bytes returns the latest record delivered by Scan. The underlying array may be overwritten by the next call.
+func (r *LineReader) Bytes() []byte {
+	return r.scanner.Bytes()
+}
+
+// Text returns the latest record delivered by Scan as a string.
+func (r *LineReader) Text() string {
+	return r.scanner.Text()
+}
+
+// Err returns the error that has stopped the reader, if any, or the one of the context the latest ScanContext has given up with.
+// As for bufio.Scanner, io.EOF is not an error.
+func (r *LineReader) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	return r.scanner.Err()
+}
@@ -0,0 +1,154 @@
+package throttle_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// scanPrefixed splits the records prefixed with their length, a digit.
+func scanPrefixed(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	size := int(data[0] - '0')
+
+	if len(data) < size+1 {
+		if atEOF {
+			return 0, nil, errors.New("truncated record")
+		}
+
+		return 0, nil, nil
+	}
+
+	return size + 1, data[1 : size+1], nil
+}
+
+func TestNewLineReader(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Input   string
+		Options []throttle.LineReaderOption
+		Records []string
+		Times   []time.Duration
+		Err     error
+	}{
+		{
+			Name:    "lines",
+			Input:   "a\nbb\n\nccc\nd\n",
+			Records: []string{"a", "bb", "", "ccc", "d"},
+			Times:   []time.Duration{0, 0, time.Second, time.Second, 2 * time.Second},
+		},
+		{
+			Name:    "final line without a terminator",
+			Input:   "a\r\nb\r\nc",
+			Records: []string{"a", "b", "c"},
+			Times:   []time.Duration{0, 0, time.Second},
+		},
+		{
+			Name: "long lines",
+			// longer than the initial buffer of the scanner
+			Input:   strings.Repeat("x", 10000) + "\n" + strings.Repeat("y", 10000) + "\n",
+			Records: []string{strings.Repeat("x", 10000), strings.Repeat("y", 10000)},
+			Times:   []time.Duration{0, 0},
+		},
+		{
+			Name:    "lines longer than the max size",
+			Input:   "a\n" + strings.Repeat("x", 100) + "\nb\n",
+			Options: []throttle.LineReaderOption{throttle.WithMaxRecordSize(64)},
+			Records: []string{"a"},
+			Times:   []time.Duration{0},
+			Err:     bufio.ErrTooLong,
+		},
+		{
+			Name:    "words",
+			Input:   "a bb  ccc\nd",
+			Options: []throttle.LineReaderOption{throttle.WithSplit(bufio.ScanWords)},
+			Records: []string{"a", "bb", "ccc", "d"},
+			Times:   []time.Duration{0, 0, time.Second, time.Second},
+		},
+		{
+			Name:    "length-prefixed records",
+			Input:   "3abc01\n5hello",
+			Options: []throttle.LineReaderOption{throttle.WithSplit(scanPrefixed)},
+			Records: []string{"abc", "", "\n", "hello"},
+			Times:   []time.Duration{0, 0, time.Second, time.Second},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			reader := throttle.NewLineReader(strings.NewReader(useCase.Input), 2, append(useCase.Options, throttle.WithClock(clock))...)
+
+			var (
+				records []string
+				times   []time.Duration
+			)
+
+			for reader.Scan() {
+				records = append(records, reader.Text())
+				times = append(times, clock.Now().Sub(epoch))
+			}
+
+			if !errors.Is(reader.Err(), useCase.Err) {
+				t.Fatal(fmt.Sprintf("Expected the error %v, but got %v", useCase.Err, reader.Err()))
+			}
+
+			if !reflect.DeepEqual(records, useCase.Records) {
+				t.Fatal(fmt.Sprintf("Expected the records %q, but got %q", useCase.Records, records))
+			}
+
+			if !reflect.DeepEqual(times, useCase.Times) {
+				t.Fatal(fmt.Sprintf("Expected the records at %v, but got %v", useCase.Times, times))
+			}
+		})
+	}
+}
+
+func TestLineReader_ScanContext(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	reader := throttle.NewLineReader(strings.NewReader("a\nb\n"), 1, throttle.WithClock(clock))
+
+	if !reader.Scan() || reader.Text() != "a" {
+		t.Fatal(fmt.Sprintf("Expected the first line, but got %q and %v", reader.Text(), reader.Err()))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool, 1)
+
+	go func() {
+		done <- reader.ScanContext(ctx)
+	}()
+
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	if <-done {
+		t.Fatal("Expected the scan to give up")
+	}
+
+	if err := reader.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	// the line that has been waiting is delivered by the next scan
+	clock.Advance(time.Second)
+
+	if !reader.Scan() || reader.Text() != "b" || reader.Err() != nil {
+		t.Fatal(fmt.Sprintf("Expected the second line, but got %q and %v", reader.Text(), reader.Err()))
+	}
+
+	if reader.Scan() || reader.Err() != nil {
+		t.Fatal(fmt.Sprintf("Expected the end of the input, but got %q and %v", reader.Text(), reader.Err()))
+	}
+}
@@ -0,0 +1,133 @@
+package throttle
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+type (
+	// pacedListener paces the connections accepted by the underlying listener.
+	pacedListener struct {
+		net.Listener
+		throttler *Throttler
+		// conns caps the number of open connections, if set
+		conns  inflight
+		ctx    context.Context
+		cancel context.CancelFunc
+	}
+
+	// releasingConn releases the slot of the connection once it's closed.
+	releasingConn struct {
+		net.Conn
+		release func()
+	}
+
+	// ListenerOption configures the listener of NewListener.
+	// Throttler options, like WithClock and WithWindow, are listener options too.
+	ListenerOption interface {
+		applyListener(opts *listenerOptions)
+	}
+
+	// listenerOptions holds configuration settings for the listener of NewListener.
+	listenerOptions struct {
+		throttler []Option
+		maxConns  int
+	}
+
+	listenerOptionFunc func(opts *listenerOptions)
+)
+
+func (fn listenerOptionFunc) applyListener(opts *listenerOptions) {
+	fn(opts)
+}
+
+func (o Option) applyListener(opts *listenerOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+// WithMaxConns caps the number of connections of the listener open at once: Accept waits while n connections are open.
+// A connection is open until it's closed by its Close, which may be called several times, while a connection closed by the peer
+// keeps its slot until it's closed on this side as well. The connections are wrapped, so they are not of the types of the underlying listener.
+func WithMaxConns(n int) ListenerOption {
+	return listenerOptionFunc(func(opts *listenerOptions) {
+		opts.maxConns = n
+	})
+}
+
+// NewListener creates a listener that accepts at most the specified number of connections per window, one second by default, 0 meaning no limit,
+// e.g. to protect a service from connection floods. Accept waits for the limit before it accepts a connection,
+// so the connections beyond the limit wait in the backlog of the listener. Accept is safe for concurrent use,
+// and closing the listener makes the pending calls return an error matching net.ErrClosed right away.
+func NewListener(listener net.Listener, acceptsPerSec uint64, setters ...ListenerOption) net.Listener {
+	opts := &listenerOptions{}
+
+	for _, setter := range setters {
+		setter.applyListener(opts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	paced := &pacedListener{
+		Listener:  listener,
+		throttler: New(acceptsPerSec, opts.throttler...),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	if opts.maxConns > 0 {
+		paced.conns = make(inflight, opts.maxConns)
+	}
+
+	return paced
+}
+
+// Accept waits for a free slot of the open connections, if capped, and for the limit, then accepts the next connection.
+func (l *pacedListener) Accept() (net.Conn, error) {
+	if l.conns == nil {
+		if err := l.throttler.AcquireContext(l.ctx); err != nil {
+			return nil, l.closed()
+		}
+
+		return l.Listener.Accept()
+	}
+
+	if err := l.conns.acquire(l.ctx); err != nil {
+		return nil, l.closed()
+	}
+
+	if err := l.throttler.AcquireContext(l.ctx); err != nil {
+		l.conns.release()
+
+		return nil, l.closed()
+	}
+
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		l.conns.release()
+
+		return nil, err
+	}
+
+	return &releasingConn{Conn: conn, release: sync.OnceFunc(l.conns.release)}, nil
+}
+
+// Close stops the pending calls of Accept and closes the underlying listener.
+func (l *pacedListener) Close() error {
+	l.cancel()
+
+	return l.Listener.Close()
+}
+
+// closed returns the error of the calls of Accept made on a closed listener.
+func (l *pacedListener) closed() error {
+	return &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: net.ErrClosed}
+}
+
+// Close closes the connection and releases its slot, once however many times it's called.
+func (c *releasingConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+
+	return err
+}
@@ -0,0 +1,248 @@
+package throttle_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// memoryListener is a listener of in-memory connections.
+type memoryListener struct {
+	conns  chan net.Conn
+	done   chan struct{}
+	closed sync.Once
+}
+
+func newMemoryListener() *memoryListener {
+	return &memoryListener{conns: make(chan net.Conn, 100), done: make(chan struct{})}
+}
+
+// dial queues a new connection and returns its client side.
+func (l *memoryListener) dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+
+	return client
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closed.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "memory", Net: "memory"}
+}
+
+func TestNewListener(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	memory := newMemoryListener()
+	listener := throttle.NewListener(memory, 2, throttle.WithClock(clock))
+
+	defer listener.Close()
+
+	for range 6 {
+		memory.dial()
+	}
+
+	for i := range 6 {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		conn.Close()
+
+		expected := time.Duration(i/2) * time.Second
+
+		if actual := clock.Now().Sub(epoch); actual != expected {
+			t.Fatal(fmt.Sprintf("Expected connection #%d to be accepted at %s, but got %s", i, expected, actual))
+		}
+	}
+}
+
+func TestNewListener_Concurrent(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	memory := newMemoryListener()
+	listener := throttle.NewListener(memory, 2, throttle.WithClock(clock))
+
+	for range 5 {
+		memory.dial()
+	}
+
+	accepted := make(chan error, 6)
+
+	for range 6 {
+		go func() {
+			_, err := listener.Accept()
+			accepted <- err
+		}()
+	}
+
+	// 2 connections are accepted right away, while the rest wait for the next windows
+	clock.BlockUntilSleepers(4)
+
+	for _, expected := range []int{2, 2, 1} {
+		for range expected {
+			if err := <-accepted; err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+		}
+
+		select {
+		case <-accepted:
+			t.Fatal(fmt.Sprintf("Expected %d connections to be accepted in the window", expected))
+		case <-time.After(time.Millisecond * 10):
+		}
+
+		clock.Advance(time.Second)
+	}
+
+	// the last call, which waits for the backlog rather than for the limit, returns once the listener is closed
+	listener.Close()
+
+	if err := <-accepted; !errors.Is(err, net.ErrClosed) {
+		t.Fatal(fmt.Sprintf("Expected net.ErrClosed, but got %v", err))
+	}
+}
+
+func TestNewListener_Close(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	memory := newMemoryListener()
+	listener := throttle.NewListener(memory, 1, throttle.WithClock(clock))
+
+	memory.dial()
+	memory.dial()
+
+	if _, err := listener.Accept(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := listener.Accept()
+		done <- err
+	}()
+
+	// the pending call gives up once the listener is closed, without waiting for the clock
+	clock.BlockUntilSleepers(1)
+	listener.Close()
+
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatal(fmt.Sprintf("Expected net.ErrClosed, but got %v", err))
+	}
+
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal(fmt.Sprintf("Expected net.ErrClosed, but got %v", err))
+	}
+}
+
+func TestNewListener_MaxConns(t *testing.T) {
+	memory := newMemoryListener()
+	listener := throttle.NewListener(memory, 0, throttle.WithMaxConns(2))
+
+	defer listener.Close()
+
+	for range 4 {
+		memory.dial()
+	}
+
+	var conns []net.Conn
+
+	for range 2 {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		conns = append(conns, conn)
+	}
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatal("Expected Accept to wait while 2 connections are open")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	// closing a connection twice frees a single slot
+	conns[0].Close()
+	conns[0].Close()
+
+	conn := <-accepted
+
+	if conn == nil {
+		t.Fatal("Expected a connection to be accepted once a slot is free")
+	}
+
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatal("Expected Accept to wait while 2 connections are open")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	conn.Close()
+
+	if conn := <-accepted; conn == nil {
+		t.Fatal("Expected a connection to be accepted once a slot is free")
+	}
+}
+
+func TestNewListener_MaxConns_Close(t *testing.T) {
+	memory := newMemoryListener()
+	listener := throttle.NewListener(memory, 0, throttle.WithMaxConns(1))
+
+	memory.dial()
+	memory.dial()
+
+	if _, err := listener.Accept(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := listener.Accept()
+		done <- err
+	}()
+
+	// the call waiting for a slot gives up once the listener is closed
+	time.Sleep(time.Millisecond * 10)
+	listener.Close()
+
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatal(fmt.Sprintf("Expected net.ErrClosed, but got %v", err))
+	}
+}
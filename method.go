@@ -0,0 +1,70 @@
+package throttle
+
+import (
+	"sort"
+	"strings"
+)
+
+// methods holds the throttlers of the method groups.
+type methods struct {
+	groups   map[string]*Throttler
+	fallback *Throttler
+}
+
+// newMethods creates a throttler for every method group and one for the methods that are not listed.
+// A group is a comma-separated list of methods, e.g. "POST,PUT,PATCH,DELETE".
+func newMethods(limits map[string]uint64, fallback uint64, setters []Option) *methods {
+	if limits == nil {
+		return nil
+	}
+
+	m := &methods{
+		groups:   make(map[string]*Throttler),
+		fallback: New(fallback, setters...),
+	}
+
+	keys := make([]string, 0, len(limits))
+
+	for key := range limits {
+		keys = append(keys, key)
+	}
+
+	// a method listed in several groups ends up in the last one in lexical order
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		throttler := New(limits[key], setters...)
+
+		for _, method := range strings.Split(key, ",") {
+			if method = strings.TrimSpace(method); method != "" {
+				m.groups[strings.ToUpper(method)] = throttler
+			}
+		}
+	}
+
+	return m
+}
+
+// throttlerFor returns the throttler of the method group.
+func (m *methods) throttlerFor(method string) *Throttler {
+	if method == "" {
+		method = "GET"
+	}
+
+	if throttler, found := m.groups[strings.ToUpper(method)]; found {
+		return throttler
+	}
+
+	return m.fallback
+}
+
+// throttlers returns all the throttlers of the method groups.
+func (m *methods) throttlers() []*Throttler {
+	out := []*Throttler{m.fallback}
+
+	for _, throttler := range m.groups {
+		out = append(out, throttler)
+	}
+
+	return out
+}
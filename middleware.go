@@ -0,0 +1,543 @@
+package throttle
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limitMiddleware admits the requests served by the wrapped handlers.
+type limitMiddleware struct {
+	throttler       *Throttler
+	limit           uint64
+	key             func(request *http.Request) (string, error)
+	resolve         func(request *http.Request) (string, uint64)
+	keys            *keyedThrottlers
+	missingKey      MissingKeyPolicy
+	clock           TimerClock
+	headers         bool
+	format          ResetFormat
+	style           HeaderStyle
+	window          time.Duration
+	retryDate       bool
+	rejection       func(w http.ResponseWriter, r *http.Request, info RejectionInfo)
+	mode            Mode
+	maxWait         time.Duration
+	shedAfter       time.Duration
+	shedStatus      int
+	global          *Throttler
+	excluded        []route
+	concurrent      *keyedConcurrency
+	busyStatus      int
+	metrics         func(event MiddlewareEvent)
+	rawKeys         bool
+	route           func(request *http.Request) string
+	excludedMetrics bool
+	exemptions      []*Exemptions
+	ips             ipKeyer
+	weigher         Weigher
+	failures        *authFailures
+	// done is closed once the server shuts down, nil if it's not watched
+	done <-chan struct{}
+}
+
+const (
+	// ScopeGlobal is the scope of the limit set by WithGlobalLimit.
+	ScopeGlobal = "global"
+	// ScopeKey is the scope of the limit of a key or, if the middleware is not keyed, of its only limit.
+	ScopeKey = "key"
+	// ScopeConcurrency is the scope of the limit set by WithMaxConcurrentPerKey.
+	ScopeConcurrency = "concurrency"
+	// ScopeShutdown is the scope of the rejections of WithShutdown.
+	ScopeShutdown = "shutdown"
+)
+
+// ScopeHeader is the header the middleware tells the scope of the tripped limit in when WithGlobalLimit or WithMaxConcurrentPerKey is set.
+const ScopeHeader = "X-RateLimit-Scope"
+
+type (
+	// admission is the decision the middleware has taken on a request.
+	admission struct {
+		state windowState
+		// retryAfter is the time after which a rejected request would be admitted
+		retryAfter time.Duration
+		ok         bool
+		shed       bool
+		// closed reports whether the request has been released by the shutdown
+		closed bool
+		// scope is the scope of the limit that has decided
+		scope string
+	}
+
+	// scopedThrottler is a throttler the middleware admits the requests by, along with the scope of its limit.
+	scopedThrottler struct {
+		throttler *Throttler
+		scope     string
+	}
+)
+
+// RejectionInfo describes a request rejected by the middleware for exceeding the limit.
+type RejectionInfo struct {
+	// Key is the key the request has been limited by, empty if the limit is not keyed or the request has no key.
+	// The values of WithKeyByHeader are hashed.
+	Key string
+	// Limit is the number of requests admitted per window.
+	Limit uint64
+	// RetryAfter is the time until the limit is restored, a second at least.
+	RetryAfter time.Duration
+	// Shed reports whether the request has been shed because of the backlog, see WithShedAfter.
+	Shed bool
+	// Scope is the scope of the tripped limit, ScopeGlobal, ScopeKey or ScopeConcurrency.
+	Scope string
+}
+
+// Middleware creates an http.Handler middleware limiting the requests served per window on the server side.
+// Unlike the client side, the requests beyond the limit don't wait, unless ModeWait is set: they are rejected with 429 Too Many Requests,
+// and the wrapped handler is not invoked for them. The rejections carry Retry-After, telling when the limit is restored.
+// The limit is shared by every handler the returned function wraps or, when the middleware is keyed, e.g. with WithKeyByIP, by the requests of a client.
+func Middleware(limit uint64, setters ...MiddlewareOption) func(http.Handler) http.Handler {
+	opts := buildMiddlewareOptions(setters)
+	m := &limitMiddleware{
+		throttler:       New(limit, opts.throttler...),
+		limit:           limit,
+		key:             opts.key,
+		resolve:         opts.resolve,
+		missingKey:      opts.missingKey,
+		clock:           buildOptions(opts.throttler).clock,
+		headers:         opts.headers,
+		format:          opts.format,
+		style:           opts.style,
+		window:          buildOptions(opts.throttler).window,
+		retryDate:       opts.retryDate,
+		rejection:       opts.rejection,
+		mode:            opts.mode,
+		maxWait:         opts.maxWait,
+		shedAfter:       opts.shedAfter,
+		shedStatus:      opts.shedStatus,
+		excluded:        opts.excluded,
+		busyStatus:      opts.busyStatus,
+		metrics:         opts.metrics,
+		rawKeys:         opts.rawKeys,
+		route:           opts.route,
+		excludedMetrics: opts.excludedMetrics,
+		exemptions:      opts.exemptions,
+		ips:             opts.ipKeyer(),
+		weigher:         opts.weigher,
+	}
+
+	if opts.maxConcurrent > 0 {
+		m.concurrent = newKeyedConcurrency(opts.maxConcurrent)
+	}
+
+	if opts.globalLimit > 0 {
+		m.global = New(opts.globalLimit, opts.throttler...)
+	}
+
+	if opts.shutdown != nil {
+		m.done = opts.shutdown.Done()
+	}
+
+	if opts.penalty > 0 {
+		m.failures = newAuthFailures(opts.failureThreshold, m.window, opts.penalty, opts.failureStatuses)
+	}
+
+	if m.key != nil || m.resolve != nil {
+		m.keys = newThrottlersByKey(limit, opts.throttler, DefaultMaxKeys)
+	}
+
+	return m.wrap
+}
+
+// wrap returns a handler that passes the admitted requests to the next one.
+func (m *limitMiddleware) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, excluded := matchRoute(m.excluded, r.URL.Path); excluded {
+			if m.excludedMetrics {
+				m.emit(r, DecisionExcluded, "", "", 0)
+			}
+
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		if m.closed() {
+			m.emit(r, DecisionRejected, "", ScopeShutdown, 0)
+			m.unavailable(w)
+
+			return
+		}
+
+		key, throttler, ok := m.throttlerFor(r)
+
+		if !ok {
+			m.emit(r, DecisionRejected, "", "", 0)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+			return
+		}
+
+		// the request is exempted from the limit, the keyed ones being checked by throttlerFor already
+		if throttler == nil || key == "" && m.exempt(r, key) {
+			m.emit(r, DecisionExempt, key, "", 0)
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		// the in-flight slot comes first, so the requests rejected for it don't take the slots of the limit
+		if m.concurrent != nil {
+			if !m.concurrent.acquire(key) {
+				m.emit(r, DecisionRejected, key, ScopeConcurrency, 0)
+				m.rejectWith(w, r, RejectionInfo{
+					Key:        key,
+					Limit:      uint64(m.concurrent.max),
+					RetryAfter: time.Second,
+					Scope:      ScopeConcurrency,
+				})
+
+				return
+			}
+
+			// the slot is given back once the handler returns, even if it panics
+			defer m.concurrent.release(key)
+		}
+
+		start := m.clock.Now()
+		adm := m.admit(r.Context(), throttler, m.weigh(r))
+		wait := m.clock.Now().Sub(start)
+
+		if m.headers {
+			m.advertise(w.Header(), adm.state, throttler)
+		}
+
+		if adm.closed {
+			m.emit(r, DecisionRejected, key, ScopeShutdown, wait)
+			m.unavailable(w)
+
+			return
+		}
+
+		if !adm.ok {
+			decision := DecisionRejected
+
+			if adm.shed {
+				decision = DecisionShed
+			}
+
+			m.emit(r, decision, key, adm.scope, wait)
+			m.rejectWith(w, r, RejectionInfo{
+				Key:   key,
+				Limit: adm.state.limit,
+				// the clients are told to come back in a second at least, so they don't retry right away
+				RetryAfter: max(adm.retryAfter, time.Second),
+				Shed:       adm.shed,
+				Scope:      adm.scope,
+			})
+
+			return
+		}
+
+		m.emit(r, DecisionAdmitted, key, "", wait)
+
+		// the responses of the keys are watched for the authentication failures
+		if m.failures != nil && key != "" {
+			wrapped, sw := newStatusWriter(w)
+			next.ServeHTTP(wrapped, r)
+			m.penalize(key, throttler, sw)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// closed reports whether the server has been shut down.
+func (m *limitMiddleware) closed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// unavailable answers a request released or refused because of the shutdown with 503 Service Unavailable,
+// closing the connection, so the client doesn't send the next requests over it.
+func (m *limitMiddleware) unavailable(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// exempt reports whether the key or the client of the request is listed in the exemptions.
+func (m *limitMiddleware) exempt(request *http.Request, key string) bool {
+	if len(m.exemptions) == 0 {
+		return false
+	}
+
+	client, _ := m.ips.client(request)
+
+	for _, exemptions := range m.exemptions {
+		if exemptions.exempt(key, client) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weigh returns the number of slots the request takes.
+func (m *limitMiddleware) weigh(request *http.Request) uint64 {
+	if m.weigher == nil {
+		return 1
+	}
+
+	return m.weigher(request)
+}
+
+// admit takes n slots of the global throttler, if any, and then of the request one, waiting for them in ModeWait.
+// It returns the decision along with the state of the window of the throttler that has made it.
+// If the request throttler rejects the request, the slots taken from the global one are given back.
+func (m *limitMiddleware) admit(ctx context.Context, throttler *Throttler, n uint64) admission {
+	steps := make([]scopedThrottler, 0, 2)
+
+	if m.global != nil {
+		steps = append(steps, scopedThrottler{throttler: m.global, scope: ScopeGlobal})
+	}
+
+	steps = append(steps, scopedThrottler{throttler: throttler, scope: ScopeKey})
+	taken := make([]reservation, 0, len(steps))
+
+	var wait time.Duration
+
+	for _, step := range steps {
+		res, ok := m.take(step.throttler, n)
+
+		if !ok {
+			rollback(steps, taken)
+
+			adm := admission{state: step.throttler.currentState(), scope: step.scope}
+
+			if m.mode == ModeWait {
+				adm.retryAfter = res.wait
+				adm.shed = m.shedAfter > 0 && res.wait > m.shedAfter
+			} else {
+				adm.retryAfter = adm.state.reset
+			}
+
+			return adm
+		}
+
+		taken = append(taken, res)
+		wait = max(wait, res.wait)
+	}
+
+	adm := admission{retryAfter: wait, ok: true, scope: ScopeKey}
+
+	if wait > 0 {
+		select {
+		case <-m.clock.After(wait):
+		case <-ctx.Done():
+			// the slots are given back if the client gives up
+			rollback(steps, taken)
+			adm.ok = false
+		case <-m.done:
+			rollback(steps, taken)
+			adm.ok = false
+			adm.closed = true
+		}
+	}
+
+	adm.state = throttler.currentState()
+
+	return adm
+}
+
+// take reserves n slots of the throttler, unless the request would have to wait for them longer than allowed.
+func (m *limitMiddleware) take(throttler *Throttler, n uint64) (reservation, bool) {
+	if m.mode != ModeWait {
+		return throttler.tryReserve(n)
+	}
+
+	// the request isn't queued if it would wait longer than any of the bounds
+	if bound := m.waitBound(); bound > 0 {
+		return throttler.reserveWithin(n, bound)
+	}
+
+	return throttler.reserve(n), true
+}
+
+// rollback gives back the slots taken from the throttlers.
+func rollback(steps []scopedThrottler, taken []reservation) {
+	for i, res := range taken {
+		steps[i].throttler.cancel(res)
+	}
+}
+
+// waitBound returns the longest time a request may wait in ModeWait, 0 if it's unbounded.
+func (m *limitMiddleware) waitBound() time.Duration {
+	if m.shedAfter > 0 && (m.maxWait <= 0 || m.shedAfter < m.maxWait) {
+		return m.shedAfter
+	}
+
+	return m.maxWait
+}
+
+// throttlerFor returns the key of the request and the throttler it is admitted by, nil if the request is not limited or exempted,
+// and reports whether the request may be served at all.
+// The requests without a key share the default throttler, unless the policy says otherwise.
+func (m *limitMiddleware) throttlerFor(request *http.Request) (string, *Throttler, bool) {
+	if m.keys == nil {
+		return "", m.throttler, true
+	}
+
+	if key, limit := m.keyOf(request); key != "" {
+		// the exempted keys don't take throttlers of their own, so they can't grow the keys nor evict the limited ones
+		if m.exempt(request, key) {
+			return key, nil, true
+		}
+
+		throttler := m.keys.get(key)
+
+		// the slots taken in the current window are kept when the limit of the key changes, e.g. on an upgrade
+		if m.resolve != nil && throttler.Limit() != limit {
+			throttler.SetLimit(limit)
+		}
+
+		return key, throttler, true
+	}
+
+	switch m.missingKey {
+	case MissingKeyReject:
+		return "", nil, false
+	case MissingKeySkip:
+		return "", nil, true
+	default:
+		return "", m.throttler, true
+	}
+}
+
+// keyOf returns the key of the request, empty if it has none, and the limit of the key.
+func (m *limitMiddleware) keyOf(request *http.Request) (string, uint64) {
+	if m.resolve != nil {
+		key, limit := m.resolve(request)
+
+		if limit == 0 {
+			limit = m.limit
+		}
+
+		return key, limit
+	}
+
+	key, err := m.key(request)
+
+	if err != nil {
+		return "", m.limit
+	}
+
+	return key, m.limit
+}
+
+// advertise sets the headers describing the state of the limit in the configured styles.
+func (m *limitMiddleware) advertise(header http.Header, state windowState, throttler *Throttler) {
+	if m.style&HeaderXRateLimit != 0 {
+		reset := ceilSeconds(state.reset)
+
+		if m.format == ResetUnix {
+			reset = ceilSeconds(time.Duration(m.clock.Now().Add(state.reset).UnixNano()))
+		}
+
+		header.Set(DefaultLimitHeader, strconv.FormatUint(state.limit, 10))
+		header.Set(DefaultRemainingHeader, strconv.FormatUint(state.remaining, 10))
+		header.Set(DefaultResetHeader, strconv.FormatInt(reset, 10))
+	}
+
+	if policies := m.policies(throttler); m.style&HeaderIETF != 0 && len(policies) > 0 {
+		header.Set(RateLimitPolicyHeader, m.formatPolicies(policies))
+		header.Set(RateLimitHeader, formatQuotas(policies))
+	}
+}
+
+// policies returns the limits the request is admitted by, named after their scopes: the one of the key first and the global one next.
+// The throttlers without a limit are left out.
+func (m *limitMiddleware) policies(throttler *Throttler) []scopedThrottler {
+	policies := make([]scopedThrottler, 0, 2)
+
+	if throttler.Limit() > 0 {
+		policies = append(policies, scopedThrottler{throttler: throttler, scope: ScopeKey})
+	}
+
+	if m.global != nil {
+		policies = append(policies, scopedThrottler{throttler: m.global, scope: ScopeGlobal})
+	}
+
+	return policies
+}
+
+// formatPolicies serializes the policies as the structured field list of RateLimit-Policy, e.g. `"key";q=10;w=1`.
+func (m *limitMiddleware) formatPolicies(policies []scopedThrottler) string {
+	// the window is advertised in whole seconds, a second at least
+	window := strconv.FormatInt(max(ceilSeconds(m.window), 1), 10)
+	items := make([]string, 0, len(policies))
+
+	for _, policy := range policies {
+		items = append(items, strconv.Quote(policy.scope)+";q="+strconv.FormatUint(policy.throttler.Limit(), 10)+";w="+window)
+	}
+
+	return strings.Join(items, ", ")
+}
+
+// formatQuotas serializes the state of the policies as the structured field list of RateLimit, e.g. `"key";r=4;t=1`.
+func formatQuotas(policies []scopedThrottler) string {
+	items := make([]string, 0, len(policies))
+
+	for _, policy := range policies {
+		state := policy.throttler.currentState()
+		items = append(items, strconv.Quote(policy.scope)+";r="+strconv.FormatUint(state.remaining, 10)+";t="+strconv.FormatInt(ceilSeconds(state.reset), 10))
+	}
+
+	return strings.Join(items, ", ")
+}
+
+// ceilSeconds returns the duration in whole seconds, rounded up.
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// rejectWith answers a request beyond the limit with the handler set by WithRejectionHandler or, if there is none, a minimal response.
+func (m *limitMiddleware) rejectWith(w http.ResponseWriter, r *http.Request, info RejectionInfo) {
+	if m.rejection != nil {
+		m.rejection(w, r, info)
+	} else {
+		m.reject(w, info)
+	}
+}
+
+// reject answers a request beyond the limit with a minimal 429 response, or the status of WithShedStatus if it's been shed,
+// or the one of WithConcurrencyStatus if it's been rejected for the requests in flight.
+func (m *limitMiddleware) reject(w http.ResponseWriter, info RejectionInfo) {
+	if m.retryDate {
+		at := m.clock.Now().Add(info.RetryAfter + time.Second - 1).Truncate(time.Second)
+		w.Header().Set("Retry-After", at.UTC().Format(http.TimeFormat))
+	} else {
+		w.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(info.RetryAfter), 10))
+	}
+
+	if m.global != nil || m.concurrent != nil {
+		w.Header().Set(ScopeHeader, info.Scope)
+	}
+
+	status := http.StatusTooManyRequests
+
+	switch {
+	case info.Shed:
+		status = m.shedStatus
+	case info.Scope == ScopeConcurrency:
+		status = m.busyStatus
+	}
+
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,64 @@
+package throttle
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// DecisionAdmitted is the decision on a request passed to the wrapped handler.
+	DecisionAdmitted Decision = "admitted"
+	// DecisionRejected is the decision on a request rejected for exceeding a limit or lacking a key.
+	DecisionRejected Decision = "rejected"
+	// DecisionShed is the decision on a request shed because of the backlog, see WithShedAfter.
+	DecisionShed Decision = "shed"
+	// DecisionExempt is the decision on a request served without a limit, e.g. for lack of a key with MissingKeySkip.
+	DecisionExempt Decision = "exempt"
+	// DecisionExcluded is the decision on a request to a path excluded by WithExcludePaths,
+	// reported only with WithExcludedMetrics.
+	DecisionExcluded Decision = "excluded"
+)
+
+type (
+	// Decision is what the middleware has done with a request.
+	Decision string
+
+	// MiddlewareEvent describes the decision the middleware has taken on a request, see WithMetricsHook.
+	MiddlewareEvent struct {
+		// Decision is what the middleware has done with the request.
+		Decision Decision
+		// Key is the hashed key of the request, or the key itself with WithRawMetricKeys, empty if the request has none.
+		Key string
+		// Route is the route of the request, its path unless WithMetricsRoute says otherwise.
+		Route string
+		// Scope is the scope of the limit that has rejected the request, if any.
+		Scope string
+		// Wait is the time the request has waited for the decision.
+		Wait time.Duration
+	}
+)
+
+// emit passes the event of the request to the metrics hook, if any.
+func (m *limitMiddleware) emit(request *http.Request, decision Decision, key, scope string, wait time.Duration) {
+	if m.metrics == nil {
+		return
+	}
+
+	if !m.rawKeys {
+		key = hashKey(key)
+	}
+
+	route := request.URL.Path
+
+	if m.route != nil {
+		route = m.route(request)
+	}
+
+	m.metrics(MiddlewareEvent{
+		Decision: decision,
+		Key:      key,
+		Route:    route,
+		Scope:    scope,
+		Wait:     wait,
+	})
+}
@@ -0,0 +1,466 @@
+package throttle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// MissingKeyShared makes the requests without a key share a bucket of their own.
+	MissingKeyShared MissingKeyPolicy = iota
+	// MissingKeyReject makes the middleware reject the requests without a key with 400 Bad Request.
+	MissingKeyReject
+	// MissingKeySkip makes the middleware serve the requests without a key unlimited.
+	MissingKeySkip
+)
+
+const (
+	// ResetSeconds makes WithLimitHeaders advertise the reset as the number of seconds left until it.
+	ResetSeconds ResetFormat = iota
+	// ResetUnix makes WithLimitHeaders advertise the reset as a Unix time in seconds.
+	ResetUnix
+)
+
+const (
+	// ModeReject makes the middleware reject the requests beyond the limit right away.
+	ModeReject Mode = iota
+	// ModeWait makes the middleware hold the requests beyond the limit until they fit into it,
+	// rejecting them only if the client gives up or the wait would exceed WithMaxQueueWait.
+	ModeWait
+)
+
+const (
+	// HeaderXRateLimit makes the middleware advertise the state of the limit in X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset.
+	HeaderXRateLimit HeaderStyle = 1 << iota
+	// HeaderIETF makes the middleware advertise the state of the limit in RateLimit and RateLimit-Policy,
+	// as defined by draft-ietf-httpapi-ratelimit-headers.
+	HeaderIETF
+)
+
+// DefaultLimitHeader is the header WithLimitHeaders advertises the limit in.
+const DefaultLimitHeader = "X-RateLimit-Limit"
+
+type (
+	// MiddlewareOption configures the server middleware.
+	// Throttler options, like WithClock and WithWindow, are middleware options too:
+	// they apply to every throttler the middleware creates.
+	MiddlewareOption interface {
+		applyMiddleware(opts *middlewareOptions)
+	}
+
+	// middlewareOptions holds configuration settings for the server middleware.
+	middlewareOptions struct {
+		throttler        []Option
+		key              func(request *http.Request) (string, error)
+		resolve          func(request *http.Request) (string, uint64)
+		byIP             bool
+		forwarded        bool
+		trusted          []netip.Prefix
+		ipv6Prefix       int
+		exemptions       []*Exemptions
+		exemptKeys       []string
+		exemptCIDRs      []string
+		err              error
+		header           string
+		missingKey       MissingKeyPolicy
+		headers          bool
+		format           ResetFormat
+		style            HeaderStyle
+		retryDate        bool
+		rejection        func(w http.ResponseWriter, r *http.Request, info RejectionInfo)
+		mode             Mode
+		maxWait          time.Duration
+		shedAfter        time.Duration
+		shedStatus       int
+		globalLimit      uint64
+		excluded         []route
+		maxConcurrent    int
+		busyStatus       int
+		metrics          func(event MiddlewareEvent)
+		rawKeys          bool
+		route            func(request *http.Request) string
+		excludedMetrics  bool
+		weigher          Weigher
+		failureThreshold int
+		penalty          time.Duration
+		failureStatuses  []int
+		shutdown         context.Context
+	}
+
+	middlewareOptionFunc func(opts *middlewareOptions)
+
+	// MissingKeyPolicy decides what happens to the requests a keyed middleware finds no key for.
+	MissingKeyPolicy int
+
+	// ResetFormat is the format WithLimitHeaders advertises the reset time in.
+	ResetFormat int
+
+	// HeaderStyle is the set of headers the middleware advertises the state of the limit in.
+	HeaderStyle int
+
+	// Mode decides what the middleware does with the requests beyond the limit.
+	Mode int
+)
+
+func (fn middlewareOptionFunc) applyMiddleware(opts *middlewareOptions) {
+	fn(opts)
+}
+
+func (o Option) applyMiddleware(opts *middlewareOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+func buildMiddlewareOptions(setters []MiddlewareOption) *middlewareOptions {
+	opts := &middlewareOptions{
+		shedStatus: http.StatusTooManyRequests,
+		busyStatus: http.StatusTooManyRequests,
+	}
+
+	for _, setter := range setters {
+		setter.applyMiddleware(opts)
+	}
+
+	if opts.exemptKeys != nil || opts.exemptCIDRs != nil {
+		exemptions := NewExemptions()
+		exemptions.SetKeys(opts.exemptKeys...)
+
+		if err := exemptions.SetCIDRs(opts.exemptCIDRs...); err != nil && opts.err == nil {
+			opts.err = err
+		}
+
+		opts.exemptions = append(opts.exemptions, exemptions)
+	}
+
+	if opts.headers && opts.style == 0 {
+		opts.style = HeaderXRateLimit
+	}
+
+	if opts.err != nil {
+		panic("throttle: " + opts.err.Error())
+	}
+
+	if opts.key != nil {
+		return opts
+	}
+
+	if opts.header != "" {
+		header := opts.header
+
+		opts.key = func(request *http.Request) (string, error) {
+			return hashKey(request.Header.Get(header)), nil
+		}
+	}
+
+	if opts.byIP {
+		keyer := opts.ipKeyer()
+
+		opts.key = func(request *http.Request) (string, error) {
+			return keyer.key(request), nil
+		}
+	}
+
+	return opts
+}
+
+// ipKeyer returns the keyer of the client addresses.
+func (opts *middlewareOptions) ipKeyer() ipKeyer {
+	return ipKeyer{forwarded: opts.forwarded, trusted: opts.trusted, prefix: opts.ipv6Prefix}
+}
+
+// WithKeyByIP makes the middleware apply the limit per client IP rather than to all requests together.
+// The address is taken from RemoteAddr, unless WithTrustedProxies or WithForwardedHeaders is set.
+// Up to DefaultMaxKeys clients are tracked, and the least recently seen ones are forgotten beyond it.
+func WithKeyByIP() MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.byIP = true
+	})
+}
+
+// WithForwardedHeaders makes WithKeyByIP take the client address from the X-Forwarded-For or X-Real-IP header set by a proxy.
+// The headers are easy to forge, so it must be set only when every request comes through a proxy that overwrites them,
+// otherwise WithTrustedProxies is the safe choice.
+func WithForwardedHeaders() MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.forwarded = true
+	})
+}
+
+// WithTrustedProxies makes WithKeyByIP consult the forwarding headers only for the requests coming from the listed networks,
+// in the CIDR notation or as bare addresses, so the clients can't forge their address by setting the headers themselves.
+// The X-Forwarded-For chain is walked from right to left past the trusted proxies, and the first untrusted hop is taken for the client.
+// If the chain is malformed, the address of the proxy is taken instead. Without X-Forwarded-For, X-Real-IP is used.
+// It takes precedence over WithForwardedHeaders, and the constructor panics if a network can't be parsed.
+func WithTrustedProxies(cidrs ...string) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		networks, err := parseNetworks(cidrs)
+
+		if err != nil {
+			opts.err = err
+
+			return
+		}
+
+		opts.trusted = append(opts.trusted, networks...)
+	})
+}
+
+// WithIPv6Prefix makes WithKeyByIP bucket the IPv6 clients by their network of the specified prefix length, e.g. 64,
+// since a single client usually gets a whole /64 to pick the addresses from.
+func WithIPv6Prefix(bits int) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.ipv6Prefix = bits
+	})
+}
+
+// WithKeyByHeader makes the middleware apply the limit per value of the request header, e.g. X-API-Key or Authorization,
+// rather than to all requests together. The values are hashed, so the secrets they carry are neither kept nor exposed,
+// and the long ones take no more memory than the short ones.
+// The requests without the header are handled according to WithMissingKey.
+func WithKeyByHeader(name string) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.header = name
+	})
+}
+
+// WithKeyFunc makes the middleware apply the limit per key the function returns for a request, e.g. the ID of the user
+// set in the context by the authentication middleware. It runs once per request, before the request is admitted,
+// and takes precedence over WithKeyByIP and WithKeyByHeader.
+// The requests the function returns an empty key or an error for are handled according to WithMissingKey.
+func WithKeyFunc(key func(request *http.Request) (string, error)) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.key = key
+	})
+}
+
+// WithLimitResolver makes the middleware apply a limit of its own per key the function returns for a request, e.g. the limit of the tier
+// of the user set in the context by the authentication middleware. It runs once per request and takes precedence over WithKeyFunc.
+// When the limit of a known key changes, e.g. on an upgrade, it's applied with SetLimit, so the requests admitted in the current window still count.
+// A zero limit, e.g. when the tier can't be looked up, falls back to the limit of the middleware,
+// and the requests the function returns an empty key for are handled according to WithMissingKey.
+func WithLimitResolver(resolve func(request *http.Request) (key string, limit uint64)) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.resolve = resolve
+	})
+}
+
+// WithMissingKey sets what happens to the requests a keyed middleware finds no key for, MissingKeyShared by default.
+func WithMissingKey(policy MissingKeyPolicy) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.missingKey = policy
+	})
+}
+
+// hashKey returns a digest of the key, or an empty string for a blank one.
+func hashKey(key string) string {
+	if strings.TrimSpace(key) == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// WithLimitHeaders makes the middleware advertise the state of the limit on every response it lets through or rejects:
+// the limit in X-RateLimit-Limit, the requests left in the window in X-RateLimit-Remaining and the time the limit is restored
+// in X-RateLimit-Reset, in the specified format. The values are taken at the time the request is admitted or rejected.
+func WithLimitHeaders(format ResetFormat) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.headers = true
+		opts.format = format
+	})
+}
+
+// WithHeaderStyle makes the middleware advertise the state of the limit like WithLimitHeaders, in the headers of the specified style,
+// HeaderXRateLimit by default, HeaderIETF, or both of them with HeaderIETF|HeaderXRateLimit.
+// The HeaderIETF style tells every limit along with its window in seconds in RateLimit-Policy, e.g. `"key";q=10;w=1, "global";q=500;w=1`
+// with WithGlobalLimit, and the requests left and the seconds until the reset of each in RateLimit, e.g. `"key";r=4;t=1, "global";r=320;t=1`.
+// The policies are named after the scopes of the limits, and the ones without a limit are left out.
+// The format of WithLimitHeaders applies to X-RateLimit-Reset only.
+func WithHeaderStyle(style HeaderStyle) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.headers = true
+		opts.style = style
+	})
+}
+
+// WithRetryAfterDate makes the middleware set Retry-After on the rejected requests as an HTTP date
+// rather than as the number of seconds to wait. It has no effect with WithRejectionHandler.
+func WithRetryAfterDate() MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.retryDate = true
+	})
+}
+
+// WithRejectionHandler sets the handler answering the requests rejected for exceeding the limit,
+// e.g. to speak the error format of the API. The handler owns the response: neither the status nor Retry-After
+// are set for it, while the headers set before, like the ones of WithLimitHeaders, are kept.
+func WithRejectionHandler(handler func(w http.ResponseWriter, r *http.Request, info RejectionInfo)) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.rejection = handler
+	})
+}
+
+// WithMode sets what the middleware does with the requests beyond the limit, ModeReject by default.
+// ModeWait smooths the bursts out rather than rejecting them, which suits the internal services.
+func WithMode(mode Mode) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.mode = mode
+	})
+}
+
+// WithMaxQueueWait bounds the time a request waits for the limit in ModeWait.
+// The requests that would wait longer are rejected right away. By default, only the request context bounds the wait.
+func WithMaxQueueWait(d time.Duration) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.maxWait = d
+	})
+}
+
+// WithShedAfter makes the middleware in ModeWait shed the load once the backlog grows:
+// the requests estimated to wait longer than d for the limit are rejected right away rather than queued,
+// with the status set by WithShedStatus, 429 by default.
+func WithShedAfter(d time.Duration) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.shedAfter = d
+	})
+}
+
+// WithShedStatus sets the status the requests shed by WithShedAfter are rejected with, e.g. 503 Service Unavailable.
+func WithShedStatus(status int) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.shedStatus = status
+	})
+}
+
+// WithGlobalLimit adds a limit to all requests together on top of the one per key, e.g. to protect the whole instance.
+// The global limit is checked first, and the slot it has given is taken back if the limit of the key rejects the request,
+// so the rejected requests don't count against it. The rejections tell the scope of the tripped limit in X-RateLimit-Scope.
+func WithGlobalLimit(limit uint64) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.globalLimit = limit
+	})
+}
+
+// WithExcludePaths exempts the requests whose path matches one of the patterns, e.g. the health checks, from the limit:
+// they are neither limited nor counted, and the key isn't even extracted for them.
+// The patterns follow the rules of WithRouteLimits: a pattern without wildcards matches the path itself and everything below it,
+// e.g. "/healthz" matches "/healthz" and "/healthz/live", while a pattern with wildcards is matched using path.Match, e.g. "/debug/*".
+func WithExcludePaths(patterns ...string) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.excluded = append(opts.excluded, newPatterns(patterns)...)
+	})
+}
+
+// WithMaxConcurrentPerKey caps the number of requests of a key the wrapped handler serves at once, on top of the rate limit,
+// e.g. to keep a client from pinning the workers with slow streaming requests. If the middleware is not keyed, the cap applies to all requests together.
+// A request holds its slot until the handler returns, even by panicking, so the handlers of long-lived requests have to return once the client disconnects.
+// The requests beyond the cap are rejected with the status set by WithConcurrencyStatus, 429 by default.
+func WithMaxConcurrentPerKey(n int) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.maxConcurrent = n
+	})
+}
+
+// WithConcurrencyStatus sets the status the requests beyond WithMaxConcurrentPerKey are rejected with, e.g. 503 Service Unavailable.
+func WithConcurrencyStatus(status int) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.busyStatus = status
+	})
+}
+
+// WithMetricsHook sets the hook the middleware reports its decision on every request to, exactly once per request,
+// e.g. to count the admitted, rejected and shed requests. The hook is called on the request path once the decision is taken
+// and before the wrapped handler runs, so it must not block: pushing to a metrics library or to a buffered channel is fine.
+// The requests to the paths excluded by WithExcludePaths are not reported, unless WithExcludedMetrics is set.
+func WithMetricsHook(hook func(event MiddlewareEvent)) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.metrics = hook
+	})
+}
+
+// WithRawMetricKeys makes WithMetricsHook report the keys as they are rather than hashed.
+// The values of WithKeyByHeader stay hashed, since they are never kept as they are.
+func WithRawMetricKeys() MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.rawKeys = true
+	})
+}
+
+// WithMetricsRoute sets the function naming the route of a request reported by WithMetricsHook, e.g. to collapse the IDs in the paths.
+// The path of the request is used by default.
+func WithMetricsRoute(route func(request *http.Request) string) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.route = route
+	})
+}
+
+// WithExcludedMetrics makes WithMetricsHook report the requests to the paths excluded by WithExcludePaths as DecisionExcluded.
+func WithExcludedMetrics() MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.excludedMetrics = true
+	})
+}
+
+// WithExemptions makes the middleware let the requests whose key or client is listed in the exemptions through without a limit,
+// e.g. the internal batch jobs. The exemptions are checked once the key is extracted and before the request is limited,
+// and their lists can be swapped at runtime. The client address follows the rules of WithKeyByIP, even if the middleware isn't keyed by it.
+// The exempted requests are reported to WithMetricsHook as DecisionExempt.
+func WithExemptions(exemptions *Exemptions) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.exemptions = append(opts.exemptions, exemptions)
+	})
+}
+
+// WithExempt is a shorthand for WithExemptions with the keys that never change.
+func WithExempt(keys ...string) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.exemptKeys = append(opts.exemptKeys, keys...)
+	})
+}
+
+// WithExemptCIDRs is a shorthand for WithExemptions with the networks that never change.
+// The constructor panics if a network can't be parsed.
+func WithExemptCIDRs(cidrs ...string) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.exemptCIDRs = append(opts.exemptCIDRs, cidrs...)
+	})
+}
+
+// WithRequestWeigher makes every request take as many slots of the limit as the weigher returns, e.g. ByMethod or ByContentLength,
+// so the expensive requests count for more than the cheap ones. The weight applies to WithGlobalLimit too, and a zero weight lets the request through without a limit.
+// In ModeReject, a request heavier than the limit is never admitted, while in ModeWait it waits for as many windows as it needs.
+func WithRequestWeigher(weigher Weigher) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.weigher = weigher
+	})
+}
+
+// WithAuthFailurePenalty makes the middleware freeze a key for the penalty once its requests have failed the authentication threshold times
+// within a window of the limit, e.g. to slow down the brute-force attempts of a client keyed by WithKeyByIP.
+// The failures are told by the statuses of the responses, DefaultAuthFailureStatuses by default, a response below 400 forgets them,
+// and the other ones are ignored. The frozen key is rejected as exceeding its limit until the penalty is over.
+// The requests without a key are not watched, nor are the ones whose handler hijacks the connection.
+func WithAuthFailurePenalty(threshold int, penalty time.Duration, statuses ...int) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.failureThreshold = threshold
+		opts.penalty = penalty
+		opts.failureStatuses = statuses
+	})
+}
+
+// WithShutdown ties the middleware to the lifecycle of the server: once the context is done, e.g. cancelled by the function
+// registered with http.Server.RegisterOnShutdown, the requests waiting in ModeWait are released right away, and so are the new ones,
+// rather than holding the shutdown until their windows open. They are answered with 503 Service Unavailable and Connection: close,
+// and reported to WithMetricsHook as rejected with ScopeShutdown. The requests already passed to the wrapped handler are left alone,
+// and so are the ones to the paths excluded by WithExcludePaths.
+func WithShutdown(ctx context.Context) MiddlewareOption {
+	return middlewareOptionFunc(func(opts *middlewareOptions) {
+		opts.shutdown = ctx
+	})
+}
@@ -0,0 +1,216 @@
+package throttle
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultAuthFailureStatuses are the statuses WithAuthFailurePenalty counts as authentication failures by default.
+var DefaultAuthFailureStatuses = []int{http.StatusUnauthorized, http.StatusForbidden}
+
+type (
+	// authFailures counts the authentication failures per key, freezing the keys that fail too often.
+	authFailures struct {
+		mu        sync.Mutex
+		threshold int
+		window    time.Duration
+		penalty   time.Duration
+		statuses  map[int]bool
+		entries   map[string]*failureCount
+	}
+
+	// failureCount is the number of failures of a key since the start of its window.
+	failureCount struct {
+		count int
+		since time.Time
+	}
+
+	// statusWriter is a http.ResponseWriter that captures the status written by the handler.
+	statusWriter struct {
+		http.ResponseWriter
+		status   int
+		hijacked bool
+	}
+
+	// flushStatusWriter is a statusWriter over a writer that implements http.Flusher.
+	flushStatusWriter struct {
+		*statusWriter
+	}
+
+	// hijackStatusWriter is a statusWriter over a writer that implements http.Hijacker.
+	hijackStatusWriter struct {
+		*statusWriter
+	}
+
+	// flushHijackStatusWriter is a statusWriter over a writer that implements both http.Flusher and http.Hijacker.
+	flushHijackStatusWriter struct {
+		*statusWriter
+	}
+)
+
+// newStatusWriter wraps the writer into a statusWriter that implements http.Flusher and http.Hijacker only if the writer does,
+// so that the handlers checking them pick the right path.
+func newStatusWriter(w http.ResponseWriter) (http.ResponseWriter, *statusWriter) {
+	sw := &statusWriter{ResponseWriter: w}
+	_, flusher := w.(http.Flusher)
+	_, hijacker := w.(http.Hijacker)
+
+	switch {
+	case flusher && hijacker:
+		return flushHijackStatusWriter{sw}, sw
+	case flusher:
+		return flushStatusWriter{sw}, sw
+	case hijacker:
+		return hijackStatusWriter{sw}, sw
+	default:
+		return sw, sw
+	}
+}
+
+func newAuthFailures(threshold int, window, penalty time.Duration, statuses []int) *authFailures {
+	if len(statuses) == 0 {
+		statuses = DefaultAuthFailureStatuses
+	}
+
+	f := &authFailures{
+		threshold: max(threshold, 1),
+		window:    window,
+		penalty:   penalty,
+		statuses:  make(map[int]bool, len(statuses)),
+		entries:   make(map[string]*failureCount),
+	}
+
+	for _, status := range statuses {
+		f.statuses[status] = true
+	}
+
+	return f
+}
+
+// record counts the response status of the key and reports whether the key has to be frozen.
+// A failure starts a window if there is none, a success forgets the failures, and the other statuses are ignored.
+func (f *authFailures) record(key string, status int, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.statuses[status] {
+		if status < http.StatusBadRequest {
+			delete(f.entries, key)
+		}
+
+		return false
+	}
+
+	entry, found := f.entries[key]
+
+	if !found || now.Sub(entry.since) > f.window {
+		// the keys that haven't failed lately are forgotten before a new one is tracked
+		if !found && len(f.entries) >= DefaultMaxKeys {
+			f.sweep(now)
+		}
+
+		entry = &failureCount{since: now}
+		f.entries[key] = entry
+	}
+
+	entry.count++
+
+	if entry.count < f.threshold {
+		return false
+	}
+
+	delete(f.entries, key)
+
+	return true
+}
+
+// sweep forgets the keys whose window is over.
+func (f *authFailures) sweep(now time.Time) {
+	for key, entry := range f.entries {
+		if now.Sub(entry.since) > f.window {
+			delete(f.entries, key)
+		}
+	}
+}
+
+// penalize freezes the throttler of the key if its response is the last straw.
+func (m *limitMiddleware) penalize(key string, throttler *Throttler, w *statusWriter) {
+	// the status of a hijacked connection is unknown
+	if w.hijacked {
+		return
+	}
+
+	// the handler that writes nothing answers 200
+	status := w.status
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	now := m.clock.Now()
+
+	if m.failures.record(key, status, now) {
+		throttler.PauseUntil(now.Add(m.failures.penalty))
+	}
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	// the informational responses may be followed by the final one
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying writer, so that http.ResponseController reaches it.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// flush sends the buffered data to the client.
+func (w *statusWriter) flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// hijack lets the handler take over the connection.
+func (w *statusWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+
+	if err == nil {
+		w.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+func (w flushStatusWriter) Flush() {
+	w.flush()
+}
+
+func (w hijackStatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w flushHijackStatusWriter) Flush() {
+	w.flush()
+}
+
+func (w flushHijackStatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
@@ -0,0 +1,1849 @@
+package throttle_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// serve sends a request to the handler and returns the response status.
+func serve(handler http.Handler, request *http.Request) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	return recorder.Code
+}
+
+func TestMiddleware(t *testing.T) {
+	const limit = 5
+
+	var served atomic.Int64
+
+	clock := throttletest.NewManualClock(epoch)
+	handler := throttle.Middleware(limit, throttle.WithClock(clock))(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		served.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var (
+		wg       sync.WaitGroup
+		rejected atomic.Int64
+	)
+
+	for range limit * 4 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)) == http.StatusTooManyRequests {
+				rejected.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if actual := served.Load(); actual != limit {
+		t.Fatal(fmt.Sprintf("Expected %d handlers to run, but got %d", limit, actual))
+	}
+
+	if actual := rejected.Load(); actual != limit*3 {
+		t.Fatal(fmt.Sprintf("Expected %d requests to be rejected, but got %d", limit*3, actual))
+	}
+
+	clock.Advance(time.Second + time.Millisecond)
+
+	if actual := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)); actual != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the next window to admit the request, but got %d", actual))
+	}
+}
+
+// requestFrom creates a request sent from the specified remote address.
+func requestFrom(addr string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = addr
+
+	return request
+}
+
+func TestMiddleware_KeyByIP(t *testing.T) {
+	useCases := []struct {
+		Name      string
+		Options   []throttle.MiddlewareOption
+		Saturated *http.Request
+		Same      *http.Request
+		Other     *http.Request
+	}{
+		{
+			Name:      "IPv4",
+			Saturated: requestFrom("192.0.2.1:1234"),
+			Same:      requestFrom("192.0.2.1:5678"),
+			Other:     requestFrom("192.0.2.2:1234"),
+		},
+		{
+			Name:      "IPv6",
+			Saturated: requestFrom("[2001:db8::1]:1234"),
+			Same:      requestFrom("[2001:db8::1]:5678"),
+			Other:     requestFrom("[2001:db8::2]:1234"),
+		},
+		{
+			Name:      "IPv6 prefix",
+			Options:   []throttle.MiddlewareOption{throttle.WithIPv6Prefix(64)},
+			Saturated: requestFrom("[2001:db8:0:1::1]:1234"),
+			Same:      requestFrom("[2001:db8:0:1::2]:1234"),
+			Other:     requestFrom("[2001:db8:0:2::1]:1234"),
+		},
+		{
+			Name:    "forwarded headers",
+			Options: []throttle.MiddlewareOption{throttle.WithForwardedHeaders()},
+			Saturated: func() *http.Request {
+				request := requestFrom("10.0.0.1:1234")
+				request.Header.Set("X-Forwarded-For", "192.0.2.1, 10.0.0.2")
+
+				return request
+			}(),
+			Same: func() *http.Request {
+				request := requestFrom("10.0.0.1:1234")
+				request.Header.Set("X-Real-IP", "192.0.2.1")
+
+				return request
+			}(),
+			Other: func() *http.Request {
+				request := requestFrom("10.0.0.1:1234")
+				request.Header.Set("X-Forwarded-For", "192.0.2.2")
+
+				return request
+			}(),
+		},
+		{
+			Name: "untrusted forwarded headers",
+			Saturated: func() *http.Request {
+				request := requestFrom("10.0.0.1:1234")
+				request.Header.Set("X-Forwarded-For", "192.0.2.1")
+
+				return request
+			}(),
+			Same: func() *http.Request {
+				request := requestFrom("10.0.0.1:1234")
+				request.Header.Set("X-Forwarded-For", "192.0.2.2")
+
+				return request
+			}(),
+			Other: requestFrom("10.0.0.2:1234"),
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			setters := append([]throttle.MiddlewareOption{throttle.WithClock(clock), throttle.WithKeyByIP()}, useCase.Options...)
+			handler := throttle.Middleware(2, setters...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			for i := range 2 {
+				if actual := serve(handler, useCase.Saturated); actual != http.StatusOK {
+					t.Fatal(fmt.Sprintf("Expected request #%d to be served, but got %d", i, actual))
+				}
+			}
+
+			if actual := serve(handler, useCase.Same); actual != http.StatusTooManyRequests {
+				t.Fatal(fmt.Sprintf("Expected the saturated client to be rejected, but got %d", actual))
+			}
+
+			if actual := serve(handler, useCase.Other); actual != http.StatusOK {
+				t.Fatal(fmt.Sprintf("Expected the other client to be served, but got %d", actual))
+			}
+		})
+	}
+}
+
+// requestWithKey creates a request carrying the API key, none if it's empty.
+func requestWithKey(key string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if key != "" {
+		request.Header.Set("X-API-Key", key)
+	}
+
+	return request
+}
+
+func TestMiddleware_KeyByHeader(t *testing.T) {
+	long := strings.Repeat("k", 1<<20)
+
+	useCases := []struct {
+		Name      string
+		Policy    throttle.MissingKeyPolicy
+		Saturated string
+		Other     string
+		Missing   int
+	}{
+		{
+			Name:      "two keys",
+			Saturated: "first",
+			Other:     "second",
+			Missing:   http.StatusOK,
+		},
+		{
+			Name:      "long keys",
+			Saturated: long + "1",
+			Other:     long + "2",
+			Missing:   http.StatusOK,
+		},
+		{
+			Name:      "anonymous",
+			Saturated: "",
+			Other:     "first",
+			Missing:   http.StatusTooManyRequests,
+		},
+		{
+			Name:      "rejected anonymous",
+			Policy:    throttle.MissingKeyReject,
+			Saturated: "first",
+			Other:     "second",
+			Missing:   http.StatusBadRequest,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			handler := throttle.Middleware(
+				2,
+				throttle.WithClock(throttletest.NewManualClock(epoch)),
+				throttle.WithKeyByHeader("X-API-Key"),
+				throttle.WithMissingKey(useCase.Policy),
+			)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			for i := range 2 {
+				if actual := serve(handler, requestWithKey(useCase.Saturated)); actual != http.StatusOK {
+					t.Fatal(fmt.Sprintf("Expected request #%d to be served, but got %d", i, actual))
+				}
+			}
+
+			if actual := serve(handler, requestWithKey(useCase.Saturated)); actual != http.StatusTooManyRequests {
+				t.Fatal(fmt.Sprintf("Expected the saturated key to be rejected, but got %d", actual))
+			}
+
+			if actual := serve(handler, requestWithKey(useCase.Other)); actual != http.StatusOK {
+				t.Fatal(fmt.Sprintf("Expected the other key to be served, but got %d", actual))
+			}
+
+			if actual := serve(handler, requestWithKey("")); actual != useCase.Missing {
+				t.Fatal(fmt.Sprintf("Expected the request without a key to get %d, but got %d", useCase.Missing, actual))
+			}
+		})
+	}
+}
+
+type userKey struct{}
+
+var errAnonymous = errors.New("anonymous")
+
+// authenticate is a fake authentication middleware that takes the user from the Authorization header.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func userOf(request *http.Request) (string, error) {
+	if user, ok := request.Context().Value(userKey{}).(string); ok {
+		return user, nil
+	}
+
+	return "", errAnonymous
+}
+
+// requestBy creates a request authenticated as the user, anonymous if it's empty.
+func requestBy(user string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if user != "" {
+		request.Header.Set("Authorization", "Bearer "+user)
+	}
+
+	return request
+}
+
+func TestMiddleware_KeyFunc(t *testing.T) {
+	useCases := []struct {
+		Name      string
+		Policy    throttle.MissingKeyPolicy
+		Anonymous []int
+	}{
+		{
+			Name:      "shared bucket",
+			Policy:    throttle.MissingKeyShared,
+			Anonymous: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			Name:      "reject",
+			Policy:    throttle.MissingKeyReject,
+			Anonymous: []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest},
+		},
+		{
+			Name:      "skip",
+			Policy:    throttle.MissingKeySkip,
+			Anonymous: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var calls atomic.Int64
+
+			limit := throttle.Middleware(
+				2,
+				throttle.WithClock(throttletest.NewManualClock(epoch)),
+				throttle.WithKeyFunc(func(request *http.Request) (string, error) {
+					calls.Add(1)
+
+					return userOf(request)
+				}),
+				throttle.WithMissingKey(useCase.Policy),
+			)
+			handler := authenticate(limit(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})))
+
+			for i := range 2 {
+				if actual := serve(handler, requestBy("alice")); actual != http.StatusOK {
+					t.Fatal(fmt.Sprintf("Expected request #%d to be served, but got %d", i, actual))
+				}
+			}
+
+			if actual := serve(handler, requestBy("alice")); actual != http.StatusTooManyRequests {
+				t.Fatal(fmt.Sprintf("Expected the saturated user to be rejected, but got %d", actual))
+			}
+
+			if actual := serve(handler, requestBy("bob")); actual != http.StatusOK {
+				t.Fatal(fmt.Sprintf("Expected the other user to be served, but got %d", actual))
+			}
+
+			for i, expected := range useCase.Anonymous {
+				if actual := serve(handler, requestBy("")); actual != expected {
+					t.Fatal(fmt.Sprintf("Expected anonymous request #%d to get %d, but got %d", i, expected, actual))
+				}
+			}
+
+			if actual := calls.Load(); actual != 7 {
+				t.Fatal(fmt.Sprintf("Expected the key function to run once per request, but it ran %d times", actual))
+			}
+		})
+	}
+}
+
+func TestMiddleware_LimitHeaders(t *testing.T) {
+	type step struct {
+		Advance   time.Duration
+		Status    int
+		Remaining string
+		// Reset is the advertised time left until the reset
+		Reset int64
+		// ResetAt is the advertised time of the reset, relative to the epoch
+		ResetAt int64
+	}
+
+	steps := []step{
+		{Status: http.StatusOK, Remaining: "2", Reset: 10, ResetAt: 10},
+		{Advance: time.Second * 4, Status: http.StatusOK, Remaining: "1", Reset: 6, ResetAt: 10},
+		{Advance: time.Millisecond * 500, Status: http.StatusOK, Remaining: "0", Reset: 6, ResetAt: 10},
+		{Advance: time.Second * 5, Status: http.StatusTooManyRequests, Remaining: "0", Reset: 1, ResetAt: 10},
+		{Advance: time.Second, Status: http.StatusOK, Remaining: "2", Reset: 10, ResetAt: 21},
+	}
+
+	useCases := []struct {
+		Name     string
+		Format   throttle.ResetFormat
+		Expected func(s step) int64
+	}{
+		{
+			Name:   "seconds",
+			Format: throttle.ResetSeconds,
+			Expected: func(s step) int64 {
+				return s.Reset
+			},
+		},
+		{
+			Name:   "unix",
+			Format: throttle.ResetUnix,
+			Expected: func(s step) int64 {
+				return epoch.Unix() + s.ResetAt
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			handler := throttle.Middleware(
+				3,
+				throttle.WithClock(clock),
+				throttle.WithWindow(time.Second*10),
+				throttle.WithLimitHeaders(useCase.Format),
+			)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			for i, s := range steps {
+				clock.Advance(s.Advance)
+
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+				if recorder.Code != s.Status {
+					t.Fatal(fmt.Sprintf("Expected request #%d to get %d, but got %d", i, s.Status, recorder.Code))
+				}
+
+				if actual := recorder.Header().Get("X-RateLimit-Limit"); actual != "3" {
+					t.Fatal(fmt.Sprintf("Expected request #%d to advertise the limit of 3, but got %q", i, actual))
+				}
+
+				if actual := recorder.Header().Get("X-RateLimit-Remaining"); actual != s.Remaining {
+					t.Fatal(fmt.Sprintf("Expected request #%d to advertise %s remaining, but got %q", i, s.Remaining, actual))
+				}
+
+				expected := strconv.FormatInt(useCase.Expected(s), 10)
+
+				if actual := recorder.Header().Get("X-RateLimit-Reset"); actual != expected {
+					t.Fatal(fmt.Sprintf("Expected request #%d to advertise the reset of %s, but got %q", i, expected, actual))
+				}
+			}
+		})
+	}
+}
+
+func TestMiddleware_RetryAfter(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Options  []throttle.MiddlewareOption
+		Expected []string
+	}{
+		{
+			Name:     "seconds",
+			Expected: []string{"10", "8", "1", "1"},
+		},
+		{
+			Name:    "date",
+			Options: []throttle.MiddlewareOption{throttle.WithRetryAfterDate()},
+			Expected: []string{
+				epoch.Add(time.Second * 10).Format(http.TimeFormat),
+				epoch.Add(time.Second * 10).Format(http.TimeFormat),
+				epoch.Add(time.Second * 11).Format(http.TimeFormat),
+				epoch.Add(time.Second * 11).Format(http.TimeFormat),
+			},
+		},
+	}
+
+	// the rejections happen at 0s, 2.5s, 9.9s and, at the very end of the window, 10s
+	advances := []time.Duration{0, time.Millisecond * 2500, time.Millisecond * 7400, time.Millisecond * 100}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			setters := append([]throttle.MiddlewareOption{throttle.WithClock(clock), throttle.WithWindow(time.Second * 10)}, useCase.Options...)
+			handler := throttle.Middleware(1, setters...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if actual := recorder.Header().Get("Retry-After"); actual != "" {
+				t.Fatal(fmt.Sprintf("Expected no Retry-After on a served request, but got %q", actual))
+			}
+
+			for i, advance := range advances {
+				clock.Advance(advance)
+
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+				if recorder.Code != http.StatusTooManyRequests {
+					t.Fatal(fmt.Sprintf("Expected request #%d to be rejected, but got %d", i, recorder.Code))
+				}
+
+				if actual := recorder.Header().Get("Retry-After"); actual != useCase.Expected[i] {
+					t.Fatal(fmt.Sprintf("Expected request #%d to carry Retry-After %q, but got %q", i, useCase.Expected[i], actual))
+				}
+			}
+		})
+	}
+}
+
+func TestMiddleware_RejectionHandler(t *testing.T) {
+	var infos []throttle.RejectionInfo
+
+	limit := throttle.Middleware(
+		1,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithRejectionHandler(func(w http.ResponseWriter, _ *http.Request, info throttle.RejectionInfo) {
+			infos = append(infos, info)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, `{"error":{"code":"rate_limited","retry_after":%d}}`, int(info.RetryAfter.Seconds()))
+		}),
+	)
+
+	// an earlier middleware sets a header of its own
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "42")
+
+		limit(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(w, r)
+	})
+
+	if actual := serve(handler, requestWithKey("first")); actual != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the request to be served, but got %d", actual))
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, requestWithKey("first"))
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatal(fmt.Sprintf("Expected 429, but got %d", recorder.Code))
+	}
+
+	if actual := recorder.Body.String(); actual != `{"error":{"code":"rate_limited","retry_after":1}}` {
+		t.Fatal(fmt.Sprintf("Expected the JSON body, but got %q", actual))
+	}
+
+	if actual := recorder.Header().Get("Content-Type"); actual != "application/json" {
+		t.Fatal(fmt.Sprintf("Expected the JSON content type, but got %q", actual))
+	}
+
+	if actual := recorder.Header().Get("X-Request-Id"); actual != "42" {
+		t.Fatal(fmt.Sprintf("Expected the header of the earlier middleware to be kept, but got %q", actual))
+	}
+
+	if actual := recorder.Header().Get("Retry-After"); actual != "" {
+		t.Fatal(fmt.Sprintf("Expected the handler to own Retry-After, but got %q", actual))
+	}
+
+	if len(infos) != 1 {
+		t.Fatal(fmt.Sprintf("Expected the handler to be called once, but got %d", len(infos)))
+	}
+
+	if info := infos[0]; info.Key == "" || info.Key == "first" || info.Limit != 1 || info.RetryAfter != time.Second {
+		t.Fatal(fmt.Sprintf("Expected the hashed key, the limit of 1 and the retry after 1s, but got %+v", info))
+	}
+}
+
+func TestMiddleware_ModeWait(t *testing.T) {
+	t.Run("burst", func(t *testing.T) {
+		var (
+			mu     sync.Mutex
+			served []time.Duration
+		)
+
+		clock := throttletest.NewManualClock(epoch)
+		handler := throttle.Middleware(
+			2,
+			throttle.WithClock(clock),
+			throttle.WithMode(throttle.ModeWait),
+		)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			mu.Lock()
+			served = append(served, clock.Now().Sub(epoch))
+			mu.Unlock()
+
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		var wg sync.WaitGroup
+
+		codes := make(chan int, 4)
+
+		for range 4 {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				codes <- serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+			}()
+		}
+
+		// the requests beyond the limit are held until the next window
+		clock.BlockUntilSleepers(2)
+		clock.Advance(time.Second)
+		wg.Wait()
+		close(codes)
+
+		for code := range codes {
+			if code != http.StatusOK {
+				t.Fatal(fmt.Sprintf("Expected every request to be served, but got %d", code))
+			}
+		}
+
+		var late int
+
+		for _, at := range served {
+			if at == time.Second {
+				late++
+			}
+		}
+
+		if late != 2 {
+			t.Fatal(fmt.Sprintf("Expected 2 requests to be served in the next window, but got %v", served))
+		}
+	})
+
+	t.Run("max wait", func(t *testing.T) {
+		clock := throttletest.NewManualClock(epoch)
+		handler := throttle.Middleware(
+			1,
+			throttle.WithClock(clock),
+			throttle.WithMode(throttle.ModeWait),
+			throttle.WithMaxQueueWait(time.Millisecond*500),
+		)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if recorder.Code != http.StatusTooManyRequests {
+			t.Fatal(fmt.Sprintf("Expected the request to be rejected right away, but got %d", recorder.Code))
+		}
+
+		if actual := recorder.Header().Get("Retry-After"); actual != "1" {
+			t.Fatal(fmt.Sprintf("Expected Retry-After 1, but got %q", actual))
+		}
+
+		clock.Advance(time.Millisecond * 600)
+
+		// the next window is within reach now
+		done := make(chan int, 1)
+
+		go func() {
+			done <- serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+
+		clock.BlockUntilSleepers(1)
+		clock.Advance(time.Millisecond * 400)
+
+		if actual := <-done; actual != http.StatusOK {
+			t.Fatal(fmt.Sprintf("Expected the request to be served, but got %d", actual))
+		}
+	})
+
+	t.Run("client gives up", func(t *testing.T) {
+		var served atomic.Int64
+
+		clock := throttletest.NewManualClock(epoch)
+		handler := throttle.Middleware(
+			1,
+			throttle.WithClock(clock),
+			throttle.WithMode(throttle.ModeWait),
+		)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			served.Add(1)
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan int, 1)
+
+		go func() {
+			done <- serve(handler, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		}()
+
+		clock.BlockUntilSleepers(1)
+		cancel()
+
+		if actual := <-done; actual != http.StatusTooManyRequests {
+			t.Fatal(fmt.Sprintf("Expected the abandoned request to be released with 429, but got %d", actual))
+		}
+
+		if actual := served.Load(); actual != 1 {
+			t.Fatal(fmt.Sprintf("Expected the handler not to run for the abandoned request, but it ran %d times", actual))
+		}
+
+		// the slot of the abandoned request is given back
+		clock.Advance(time.Second)
+
+		if actual := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)); actual != http.StatusOK {
+			t.Fatal(fmt.Sprintf("Expected the next window to admit the request, but got %d", actual))
+		}
+	})
+}
+
+func TestMiddleware_ShedAfter(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Options []throttle.MiddlewareOption
+		Status  int
+	}{
+		{
+			Name:   "default status",
+			Status: http.StatusTooManyRequests,
+		},
+		{
+			Name:    "custom status",
+			Options: []throttle.MiddlewareOption{throttle.WithShedStatus(http.StatusServiceUnavailable)},
+			Status:  http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			setters := append([]throttle.MiddlewareOption{
+				throttle.WithClock(clock),
+				throttle.WithMode(throttle.ModeWait),
+				throttle.WithShedAfter(time.Second * 2),
+			}, useCase.Options...)
+			handler := throttle.Middleware(1, setters...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			if actual := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)); actual != http.StatusOK {
+				t.Fatal(fmt.Sprintf("Expected the first request to be served, but got %d", actual))
+			}
+
+			// a backlog of the requests waiting for 1s and 2s
+			backlog := make([]chan int, 2)
+
+			for i := range backlog {
+				backlog[i] = make(chan int, 1)
+
+				go func(done chan<- int) {
+					done <- serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+				}(backlog[i])
+
+				clock.BlockUntilSleepers(i + 1)
+			}
+
+			// the next one would wait for 3s, so it's shed
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if recorder.Code != useCase.Status {
+				t.Fatal(fmt.Sprintf("Expected the request to be shed with %d, but got %d", useCase.Status, recorder.Code))
+			}
+
+			if actual := recorder.Header().Get("Retry-After"); actual != "3" {
+				t.Fatal(fmt.Sprintf("Expected Retry-After 3, but got %q", actual))
+			}
+
+			for i, done := range backlog {
+				clock.Advance(time.Second)
+
+				if actual := <-done; actual != http.StatusOK {
+					t.Fatal(fmt.Sprintf("Expected queued request #%d to be served, but got %d", i, actual))
+				}
+			}
+		})
+	}
+}
+
+func TestMiddleware_GlobalLimit(t *testing.T) {
+	handler := throttle.Middleware(
+		2,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithGlobalLimit(3),
+	)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	steps := []struct {
+		Key    string
+		Status int
+		Scope  string
+	}{
+		{Key: "first", Status: http.StatusOK},
+		{Key: "first", Status: http.StatusOK},
+		// the rejected request gives its global slot back
+		{Key: "first", Status: http.StatusTooManyRequests, Scope: throttle.ScopeKey},
+		{Key: "second", Status: http.StatusOK},
+		{Key: "second", Status: http.StatusTooManyRequests, Scope: throttle.ScopeGlobal},
+		{Key: "third", Status: http.StatusTooManyRequests, Scope: throttle.ScopeGlobal},
+	}
+
+	for i, s := range steps {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, requestWithKey(s.Key))
+
+		if recorder.Code != s.Status {
+			t.Fatal(fmt.Sprintf("Expected request #%d to get %d, but got %d", i, s.Status, recorder.Code))
+		}
+
+		if actual := recorder.Header().Get(throttle.ScopeHeader); actual != s.Scope {
+			t.Fatal(fmt.Sprintf("Expected request #%d to be rejected by the %q limit, but got %q", i, s.Scope, actual))
+		}
+	}
+}
+
+func TestMiddleware_ExcludePaths(t *testing.T) {
+	var calls atomic.Int64
+
+	handler := throttle.Middleware(
+		1,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyFunc(func(_ *http.Request) (string, error) {
+			calls.Add(1)
+
+			return "key", nil
+		}),
+		throttle.WithExcludePaths("/healthz", "/readyz", "/debug/*"),
+	)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	if actual := serve(handler, httptest.NewRequest(http.MethodGet, "/items", nil)); actual != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the first request to be served, but got %d", actual))
+	}
+
+	for i := range 10 {
+		for _, p := range []string{"/healthz", "/readyz/live", "/debug/vars"} {
+			if actual := serve(handler, httptest.NewRequest(http.MethodGet, p, nil)); actual != http.StatusOK {
+				t.Fatal(fmt.Sprintf("Expected request #%d to %s to be served, but got %d", i, p, actual))
+			}
+		}
+	}
+
+	for _, p := range []string{"/items", "/healthzx", "/debug/pprof/heap"} {
+		if actual := serve(handler, httptest.NewRequest(http.MethodGet, p, nil)); actual != http.StatusTooManyRequests {
+			t.Fatal(fmt.Sprintf("Expected the request to %s to be rejected, but got %d", p, actual))
+		}
+	}
+
+	if actual := calls.Load(); actual != 4 {
+		t.Fatal(fmt.Sprintf("Expected the key to be extracted for the limited requests only, but it was %d times", actual))
+	}
+}
+
+func TestMiddleware_MaxConcurrentPerKey(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	handler := throttle.Middleware(
+		100,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithMaxConcurrentPerKey(2),
+		throttle.WithConcurrencyStatus(http.StatusServiceUnavailable),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic":
+			panic("handler failure")
+		case "/stream":
+			started <- struct{}{}
+
+			// a streaming handler returns once the client disconnects
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(ctx context.Context, path string) *http.Request {
+		request := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		request.Header.Set("X-API-Key", "busy")
+
+		return request
+	}
+
+	stream := func(ctx context.Context) <-chan int {
+		done := make(chan int, 1)
+
+		go func() {
+			done <- serve(handler, request(ctx, "/stream"))
+		}()
+
+		<-started
+
+		return done
+	}
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	first := stream(context.Background())
+	second := stream(ctx)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request(context.Background(), "/"))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatal(fmt.Sprintf("Expected the request beyond the cap to get 503, but got %d", recorder.Code))
+	}
+
+	if actual := recorder.Header().Get(throttle.ScopeHeader); actual != throttle.ScopeConcurrency {
+		t.Fatal(fmt.Sprintf("Expected the concurrency scope, but got %q", actual))
+	}
+
+	if actual := serve(handler, requestWithKey("idle")); actual != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the other key to be served, but got %d", actual))
+	}
+
+	// the slot of the disconnected client is given back
+	disconnect()
+	<-second
+
+	if actual := serve(handler, request(context.Background(), "/")); actual != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the released slot to be reused, but got %d", actual))
+	}
+
+	// and so is the one of the panicking handler
+	for range 3 {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("Expected the handler to panic")
+				}
+			}()
+
+			serve(handler, request(context.Background(), "/panic"))
+		}()
+	}
+
+	close(release)
+
+	if actual := <-first; actual != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the stream to end with 200, but got %d", actual))
+	}
+}
+
+func TestMiddleware_MetricsHook(t *testing.T) {
+	hash := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+
+		return hex.EncodeToString(sum[:])
+	}
+
+	useCases := []struct {
+		Name     string
+		Options  []throttle.MiddlewareOption
+		Key      string
+		Excluded bool
+	}{
+		{
+			Name: "hashed keys",
+			Key:  hash("alice"),
+		},
+		{
+			Name:    "raw keys",
+			Options: []throttle.MiddlewareOption{throttle.WithRawMetricKeys()},
+			Key:     "alice",
+		},
+		{
+			Name:     "excluded paths",
+			Options:  []throttle.MiddlewareOption{throttle.WithExcludedMetrics()},
+			Key:      hash("alice"),
+			Excluded: true,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				events []throttle.MiddlewareEvent
+			)
+
+			clock := throttletest.NewManualClock(epoch)
+			setters := append([]throttle.MiddlewareOption{
+				throttle.WithClock(clock),
+				throttle.WithKeyFunc(userOf),
+				throttle.WithMissingKey(throttle.MissingKeyReject),
+				throttle.WithMode(throttle.ModeWait),
+				throttle.WithShedAfter(time.Second),
+				throttle.WithExcludePaths("/healthz"),
+				throttle.WithMetricsRoute(func(r *http.Request) string {
+					return strings.TrimRight(r.URL.Path, "0123456789")
+				}),
+				throttle.WithMetricsHook(func(event throttle.MiddlewareEvent) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					events = append(events, event)
+				}),
+			}, useCase.Options...)
+
+			handler := authenticate(throttle.Middleware(1, setters...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})))
+
+			get := func(path, user string) *http.Request {
+				request := requestBy(user)
+				request.URL.Path = path
+
+				return request
+			}
+
+			serve(handler, get("/healthz", ""))
+			serve(handler, get("/items/1", "alice"))
+
+			// the next request waits for the next window, while the one after it would wait too long
+			done := make(chan int, 1)
+
+			go func() {
+				done <- serve(handler, get("/items/2", "alice"))
+			}()
+
+			clock.BlockUntilSleepers(1)
+			serve(handler, get("/items/3", "alice"))
+			clock.Advance(time.Second)
+			<-done
+
+			serve(handler, get("/items/4", ""))
+
+			expected := []throttle.MiddlewareEvent{
+				{Decision: throttle.DecisionAdmitted, Key: useCase.Key, Route: "/items/"},
+				{Decision: throttle.DecisionShed, Key: useCase.Key, Route: "/items/", Scope: throttle.ScopeKey},
+				{Decision: throttle.DecisionAdmitted, Key: useCase.Key, Route: "/items/", Wait: time.Second},
+				{Decision: throttle.DecisionRejected, Route: "/items/"},
+			}
+
+			if useCase.Excluded {
+				expected = append([]throttle.MiddlewareEvent{{Decision: throttle.DecisionExcluded, Route: "/healthz"}}, expected...)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if len(events) != len(expected) {
+				t.Fatal(fmt.Sprintf("Expected %d events, but got %+v", len(expected), events))
+			}
+
+			for i, event := range events {
+				if event != expected[i] {
+					t.Fatal(fmt.Sprintf("Expected event #%d to be %+v, but got %+v", i, expected[i], event))
+				}
+			}
+		})
+	}
+}
+
+func TestMiddleware_TrustedProxies(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Remote   string
+		Headers  map[string][]string
+		Expected string
+	}{
+		{
+			Name:     "spoofed header from an untrusted source",
+			Remote:   "192.0.2.1:1234",
+			Headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			Expected: "192.0.2.1",
+		},
+		{
+			Name:     "single proxy",
+			Remote:   "10.0.0.1:1234",
+			Headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			Expected: "198.51.100.1",
+		},
+		{
+			Name:     "multiple hops",
+			Remote:   "10.0.0.1:1234",
+			Headers:  map[string][]string{"X-Forwarded-For": {"203.0.113.9, 198.51.100.1, 10.0.0.2"}},
+			Expected: "198.51.100.1",
+		},
+		{
+			Name:     "multiple header lines",
+			Remote:   "10.0.0.1:1234",
+			Headers:  map[string][]string{"X-Forwarded-For": {"203.0.113.9", "198.51.100.1, 10.0.0.2"}},
+			Expected: "198.51.100.1",
+		},
+		{
+			Name:     "trusted hops only",
+			Remote:   "10.0.0.1:1234",
+			Headers:  map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			Expected: "10.0.0.3",
+		},
+		{
+			Name:     "malformed hop",
+			Remote:   "10.0.0.1:1234",
+			Headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1, garbage"}},
+			Expected: "10.0.0.1",
+		},
+		{
+			Name:     "real IP",
+			Remote:   "10.0.0.1:1234",
+			Headers:  map[string][]string{"X-Real-IP": {"198.51.100.1"}},
+			Expected: "198.51.100.1",
+		},
+		{
+			Name:     "IPv6 proxy",
+			Remote:   "[2001:db8::1]:443",
+			Headers:  map[string][]string{"X-Forwarded-For": {"2001:db9::5, [2001:db8::2]:8080"}},
+			Expected: "2001:db9::5",
+		},
+		{
+			Name:     "IPv6 spoofed header from an untrusted source",
+			Remote:   "[2001:db9::1]:443",
+			Headers:  map[string][]string{"X-Forwarded-For": {"2001:db9::5"}},
+			Expected: "2001:db9::1",
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var key string
+
+			handler := throttle.Middleware(
+				10,
+				throttle.WithKeyByIP(),
+				throttle.WithTrustedProxies("10.0.0.0/8", "2001:db8::/32"),
+				throttle.WithRawMetricKeys(),
+				throttle.WithMetricsHook(func(event throttle.MiddlewareEvent) {
+					key = event.Key
+				}),
+			)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			request := requestFrom(useCase.Remote)
+
+			for name, values := range useCase.Headers {
+				for _, value := range values {
+					request.Header.Add(name, value)
+				}
+			}
+
+			serve(handler, request)
+
+			if key != useCase.Expected {
+				t.Fatal(fmt.Sprintf("Expected the client to be %s, but got %s", useCase.Expected, key))
+			}
+		})
+	}
+
+	t.Run("invalid network", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected the constructor to panic")
+			}
+		}()
+
+		throttle.Middleware(10, throttle.WithKeyByIP(), throttle.WithTrustedProxies("10.0.0.0/33"))
+	})
+}
+
+func TestMiddleware_Exemptions(t *testing.T) {
+	exemptions := throttle.NewExemptions()
+	exemptions.SetKeys("batch")
+
+	var decisions []throttle.Decision
+
+	handler := throttle.Middleware(
+		1,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithExemptions(exemptions),
+		throttle.WithExemptCIDRs("10.0.0.0/8"),
+		throttle.WithMetricsHook(func(event throttle.MiddlewareEvent) {
+			decisions = append(decisions, event.Decision)
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	from := func(addr, key string) *http.Request {
+		request := requestWithKey(key)
+		request.RemoteAddr = addr
+
+		return request
+	}
+
+	// saturate the keys, but the exempted one
+	for _, key := range []string{"batch", "partner", "user"} {
+		serve(handler, from("192.0.2.1:1234", key))
+	}
+
+	expected := []struct {
+		Request *http.Request
+		Status  int
+	}{
+		{Request: from("192.0.2.1:1234", "batch"), Status: http.StatusOK},
+		{Request: from("10.1.2.3:1234", "user"), Status: http.StatusOK},
+		{Request: from("192.0.2.1:1234", "partner"), Status: http.StatusTooManyRequests},
+		{Request: from("192.0.2.1:1234", "user"), Status: http.StatusTooManyRequests},
+	}
+
+	for i := range 3 {
+		for j, exp := range expected {
+			if actual := serve(handler, exp.Request); actual != exp.Status {
+				t.Fatal(fmt.Sprintf("Expected request #%d.%d to get %d, but got %d", i, j, exp.Status, actual))
+			}
+		}
+	}
+
+	// the lists are swapped without a restart
+	exemptions.SetKeys("partner")
+
+	if err := exemptions.SetCIDRs("192.0.2.0/24"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// the key that is no longer exempted is limited
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if actual := serve(handler, from("198.51.100.1:1234", "batch")); actual != status {
+			t.Fatal(fmt.Sprintf("Expected request #%d of the key that is no longer exempted to get %d, but got %d", i, status, actual))
+		}
+	}
+
+	for _, request := range []*http.Request{from("198.51.100.1:1234", "partner"), from("192.0.2.1:1234", "user")} {
+		if actual := serve(handler, request); actual != http.StatusOK {
+			t.Fatal(fmt.Sprintf("Expected the newly exempted request to be served, but got %d", actual))
+		}
+	}
+
+	if err := exemptions.SetCIDRs("garbage"); err == nil {
+		t.Fatal("Expected an error for an invalid network")
+	}
+
+	if actual := serve(handler, from("192.0.2.1:1234", "user")); actual != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the invalid networks to leave the lists intact, but got %d", actual))
+	}
+
+	var exempt int
+
+	for _, decision := range decisions {
+		if decision == throttle.DecisionExempt {
+			exempt++
+		}
+	}
+
+	if exempt != 10 {
+		t.Fatal(fmt.Sprintf("Expected 10 exempt requests to be reported, but got %d", exempt))
+	}
+}
+
+func TestMiddleware_ExemptKeysTakeNoThrottlers(t *testing.T) {
+	exemptions := throttle.NewExemptions()
+
+	handler := throttle.Middleware(
+		1,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithExemptions(exemptions),
+	)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	if actual := serve(handler, requestWithKey("user")); actual != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the first request to get 200, but got %d", actual))
+	}
+
+	keys := make([]string, throttle.DefaultMaxKeys)
+
+	for i := range keys {
+		keys[i] = fmt.Sprintf("exempt-%d", i)
+	}
+
+	exemptions.SetKeys(keys...)
+
+	// as many exempted keys as the middleware keeps throttlers for
+	for _, key := range keys {
+		if actual := serve(handler, requestWithKey(key)); actual != http.StatusOK {
+			t.Fatal(fmt.Sprintf("Expected the exempted key %q to get 200, but got %d", key, actual))
+		}
+	}
+
+	// the throttler of the key hasn't been evicted by them
+	if actual := serve(handler, requestWithKey("user")); actual != http.StatusTooManyRequests {
+		t.Fatal(fmt.Sprintf("Expected the limited key to get 429, but got %d", actual))
+	}
+}
+
+func TestMiddleware_RequestWeigher(t *testing.T) {
+	get := func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/", nil)
+	}
+
+	post := func(size int) func() *http.Request {
+		return func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", size)))
+		}
+	}
+
+	chunked := func() *http.Request {
+		request := post(10)()
+		request.ContentLength = -1
+
+		return request
+	}
+
+	useCases := []struct {
+		Name     string
+		Weigher  throttle.Weigher
+		Requests []func() *http.Request
+		// Admitted is the number of requests admitted in every window
+		Admitted int
+	}{
+		{
+			Name:     "by method",
+			Weigher:  throttle.ByMethod(1, 4),
+			Requests: []func() *http.Request{get, post(0), get, post(0), post(0), get, get},
+			// 1 + 4 + 1 + 4 slots, then the last POST doesn't fit, while the GETs do
+			Admitted: 6,
+		},
+		{
+			Name:     "by content length",
+			Weigher:  throttle.ByContentLength(100, 5),
+			Requests: []func() *http.Request{get, post(450), chunked, post(50), post(250), get},
+			// 1 + 5 + 5 + 1 slots, then the window is full
+			Admitted: 4,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			handler := throttle.Middleware(
+				12,
+				throttle.WithClock(clock),
+				throttle.WithRequestWeigher(useCase.Weigher),
+			)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			for window := range 5 {
+				var total uint64
+				var admitted int
+
+				for _, request := range useCase.Requests {
+					r := request()
+					weight := useCase.Weigher(r)
+
+					if serve(handler, r) == http.StatusOK {
+						total += weight
+						admitted++
+					}
+				}
+
+				if total > 12 {
+					t.Fatal(fmt.Sprintf("Expected window #%d to admit 12 slots at most, but got %d", window, total))
+				}
+
+				if admitted != useCase.Admitted {
+					t.Fatal(fmt.Sprintf("Expected window #%d to admit %d requests, but got %d", window, useCase.Admitted, admitted))
+				}
+
+				clock.Advance(time.Second + time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestMiddleware_LimitResolver(t *testing.T) {
+	var mu sync.Mutex
+
+	tiers := map[string]uint64{"alice": 2, "bob": 5}
+	handler := authenticate(throttle.Middleware(
+		1,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithLimitHeaders(throttle.ResetSeconds),
+		throttle.WithLimitResolver(func(r *http.Request) (string, uint64) {
+			user, _ := userOf(r)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			// the users without a tier get the limit of the middleware
+			return user, tiers[user]
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	steps := []struct {
+		User    string
+		Upgrade uint64
+		Status  int
+		Limit   string
+	}{
+		{User: "alice", Status: http.StatusOK, Limit: "2"},
+		{User: "alice", Status: http.StatusOK, Limit: "2"},
+		{User: "alice", Status: http.StatusTooManyRequests, Limit: "2"},
+		{User: "bob", Status: http.StatusOK, Limit: "5"},
+		{User: "bob", Status: http.StatusOK, Limit: "5"},
+		{User: "carol", Status: http.StatusOK, Limit: "1"},
+		{User: "carol", Status: http.StatusTooManyRequests, Limit: "1"},
+		// the 2 requests admitted before the upgrade still count
+		{User: "alice", Upgrade: 5, Status: http.StatusOK, Limit: "5"},
+		{User: "alice", Status: http.StatusOK, Limit: "5"},
+		{User: "alice", Status: http.StatusOK, Limit: "5"},
+		{User: "alice", Status: http.StatusTooManyRequests, Limit: "5"},
+		{User: "bob", Status: http.StatusOK, Limit: "5"},
+		// the anonymous requests share the bucket of the middleware
+		{Status: http.StatusOK, Limit: "1"},
+		{Status: http.StatusTooManyRequests, Limit: "1"},
+	}
+
+	for i, s := range steps {
+		if s.Upgrade > 0 {
+			mu.Lock()
+			tiers[s.User] = s.Upgrade
+			mu.Unlock()
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, requestBy(s.User))
+
+		if recorder.Code != s.Status {
+			t.Fatal(fmt.Sprintf("Expected request #%d to get %d, but got %d", i, s.Status, recorder.Code))
+		}
+
+		if actual := recorder.Header().Get(throttle.DefaultLimitHeader); actual != s.Limit {
+			t.Fatal(fmt.Sprintf("Expected request #%d to be limited to %s, but got %s", i, s.Limit, actual))
+		}
+	}
+}
+
+func TestMiddleware_HeaderStyle(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Options  []throttle.MiddlewareOption
+		Expected map[string]string
+	}{
+		{
+			Name:    "x-ratelimit",
+			Options: []throttle.MiddlewareOption{throttle.WithHeaderStyle(throttle.HeaderXRateLimit)},
+			Expected: map[string]string{
+				"X-RateLimit-Limit":            "3",
+				"X-RateLimit-Remaining":        "1",
+				"X-RateLimit-Reset":            "6",
+				throttle.RateLimitHeader:       "",
+				throttle.RateLimitPolicyHeader: "",
+			},
+		},
+		{
+			Name:    "ietf",
+			Options: []throttle.MiddlewareOption{throttle.WithHeaderStyle(throttle.HeaderIETF)},
+			Expected: map[string]string{
+				"X-RateLimit-Limit":            "",
+				throttle.RateLimitHeader:       `"key";r=1;t=6`,
+				throttle.RateLimitPolicyHeader: `"key";q=3;w=10`,
+			},
+		},
+		{
+			Name: "both",
+			Options: []throttle.MiddlewareOption{
+				throttle.WithHeaderStyle(throttle.HeaderIETF | throttle.HeaderXRateLimit),
+				throttle.WithLimitHeaders(throttle.ResetUnix),
+			},
+			Expected: map[string]string{
+				"X-RateLimit-Limit":            "3",
+				"X-RateLimit-Reset":            strconv.FormatInt(epoch.Unix()+10, 10),
+				throttle.RateLimitHeader:       `"key";r=1;t=6`,
+				throttle.RateLimitPolicyHeader: `"key";q=3;w=10`,
+			},
+		},
+		{
+			Name: "multiple policies",
+			Options: []throttle.MiddlewareOption{
+				throttle.WithHeaderStyle(throttle.HeaderIETF),
+				throttle.WithKeyByHeader("X-API-Key"),
+				throttle.WithGlobalLimit(50),
+			},
+			Expected: map[string]string{
+				throttle.RateLimitHeader:       `"key";r=1;t=6, "global";r=48;t=6`,
+				throttle.RateLimitPolicyHeader: `"key";q=3;w=10, "global";q=50;w=10`,
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			options := append([]throttle.MiddlewareOption{
+				throttle.WithClock(clock),
+				throttle.WithWindow(time.Second * 10),
+			}, useCase.Options...)
+			handler := throttle.Middleware(3, options...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			serve(handler, requestWithKey("first"))
+			clock.Advance(time.Second * 4)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, requestWithKey("first"))
+
+			for name, expected := range useCase.Expected {
+				if actual := recorder.Header().Get(name); actual != expected {
+					t.Fatal(fmt.Sprintf("Expected %s to be %q, but got %q", name, expected, actual))
+				}
+			}
+		})
+	}
+}
+
+func TestMiddleware_HeaderStyle_Server(t *testing.T) {
+	server := httptest.NewServer(throttle.Middleware(
+		2,
+		throttle.WithWindow(time.Minute),
+		throttle.WithHeaderStyle(throttle.HeaderIETF),
+		throttle.WithGlobalLimit(100),
+	)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer server.Close()
+
+	for i, remaining := range []uint64{1, 0, 0} {
+		res, err := http.Get(server.URL)
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		res.Body.Close()
+
+		policies, err := throttle.ParseRateLimitPolicy(res.Header.Get(throttle.RateLimitPolicyHeader))
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected request #%d to advertise valid policies, but got %s", i, err))
+		}
+
+		if len(policies) != 2 || policies[0].Quota != 2 || policies[1].Quota != 100 || policies[0].Window != time.Minute {
+			t.Fatal(fmt.Sprintf("Expected request #%d to advertise the key and the global policies, but got %+v", i, policies))
+		}
+
+		quotas, err := throttle.ParseRateLimit(res.Header.Get(throttle.RateLimitHeader))
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected request #%d to advertise valid quotas, but got %s", i, err))
+		}
+
+		if len(quotas) != 2 || quotas[0].Policy != throttle.ScopeKey || quotas[0].Remaining != remaining {
+			t.Fatal(fmt.Sprintf("Expected request #%d to advertise %d remaining, but got %+v", i, remaining, quotas))
+		}
+
+		if quotas[0].Reset <= 0 || quotas[0].Reset > time.Minute {
+			t.Fatal(fmt.Sprintf("Expected request #%d to advertise the reset within the window, but got %s", i, quotas[0].Reset))
+		}
+	}
+}
+
+func TestMiddleware_AuthFailurePenalty(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	handler := throttle.Middleware(
+		10,
+		throttle.WithClock(clock),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithAuthFailurePenalty(3, time.Minute),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+
+	login := func(key, password string) *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "/?password="+password, nil)
+		request.Header.Set("X-API-Key", key)
+
+		return request
+	}
+
+	steps := []struct {
+		Advance  time.Duration
+		Key      string
+		Password string
+		Status   int
+	}{
+		{Key: "mallory", Status: http.StatusUnauthorized},
+		{Key: "mallory", Status: http.StatusUnauthorized},
+		// the successful login forgets the failures
+		{Key: "mallory", Password: "secret", Status: http.StatusOK},
+		{Key: "mallory", Status: http.StatusUnauthorized},
+		{Key: "mallory", Status: http.StatusUnauthorized},
+		// the failures of the past windows don't count
+		{Advance: time.Second * 2, Key: "mallory", Status: http.StatusUnauthorized},
+		{Key: "mallory", Status: http.StatusUnauthorized},
+		{Key: "mallory", Status: http.StatusUnauthorized},
+		// the third failure in a window freezes the key, even for the right password
+		{Key: "mallory", Password: "secret", Status: http.StatusTooManyRequests},
+		{Key: "alice", Password: "secret", Status: http.StatusOK},
+		{Advance: time.Second * 30, Key: "mallory", Password: "secret", Status: http.StatusTooManyRequests},
+		{Advance: time.Second * 31, Key: "mallory", Password: "secret", Status: http.StatusOK},
+	}
+
+	for i, s := range steps {
+		clock.Advance(s.Advance)
+
+		if actual := serve(handler, login(s.Key, s.Password)); actual != s.Status {
+			t.Fatal(fmt.Sprintf("Expected request #%d to get %d, but got %d", i, s.Status, actual))
+		}
+	}
+}
+
+func TestMiddleware_AuthFailurePenalty_Status(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Handler http.HandlerFunc
+		Frozen  bool
+	}{
+		{
+			Name:    "implicit",
+			Handler: func(http.ResponseWriter, *http.Request) {},
+		},
+		{
+			Name: "write",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("ok"))
+			},
+		},
+		{
+			Name: "unauthorized",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, "who are you?", http.StatusUnauthorized)
+			},
+			Frozen: true,
+		},
+		{
+			Name: "forbidden after informational",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusEarlyHints)
+				w.WriteHeader(http.StatusForbidden)
+			},
+			Frozen: true,
+		},
+		{
+			Name: "flush",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.(http.Flusher).Flush()
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+		},
+		{
+			Name: "controller",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				if err := http.NewResponseController(w).Flush(); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			},
+		},
+		{
+			Name: "not found",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			handler := throttle.Middleware(
+				10,
+				throttle.WithClock(throttletest.NewManualClock(epoch)),
+				throttle.WithKeyByHeader("X-API-Key"),
+				throttle.WithAuthFailurePenalty(1, time.Minute),
+			)(useCase.Handler)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, requestWithKey("first"))
+
+			if useCase.Name == "flush" && !recorder.Flushed {
+				t.Fatal("Expected the flush to reach the underlying writer")
+			}
+
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, requestWithKey("first"))
+
+			if frozen := recorder.Code == http.StatusTooManyRequests; frozen != useCase.Frozen {
+				t.Fatal(fmt.Sprintf("Expected the key to be frozen: %t, but got %d", useCase.Frozen, recorder.Code))
+			}
+		})
+	}
+}
+
+// plainWriter is a http.ResponseWriter that implements neither http.Flusher nor http.Hijacker.
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestMiddleware_AuthFailurePenalty_Capabilities(t *testing.T) {
+	var flusher, hijacker bool
+
+	handler := throttle.Middleware(
+		10,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithAuthFailurePenalty(1, time.Minute),
+	)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, flusher = w.(http.Flusher)
+		_, hijacker = w.(http.Hijacker)
+	}))
+
+	// the wrapped writer implements only what the underlying writer does
+	handler.ServeHTTP(plainWriter{httptest.NewRecorder()}, requestWithKey("first"))
+
+	if flusher || hijacker {
+		t.Fatal(fmt.Sprintf("Expected the writer to implement neither http.Flusher nor http.Hijacker, but got %t and %t", flusher, hijacker))
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), requestWithKey("first"))
+
+	if !flusher || hijacker {
+		t.Fatal(fmt.Sprintf("Expected the writer to implement only http.Flusher, but got %t and %t", flusher, hijacker))
+	}
+}
+
+func TestMiddleware_AuthFailurePenalty_Hijack(t *testing.T) {
+	server := httptest.NewServer(throttle.Middleware(
+		10,
+		throttle.WithKeyByIP(),
+		throttle.WithAuthFailurePenalty(1, time.Minute),
+	)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		defer conn.Close()
+
+		_, _ = rw.WriteString("HTTP/1.1 401 Unauthorized\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		_ = rw.Flush()
+	})))
+	defer server.Close()
+
+	// the status written to a hijacked connection is unknown to the middleware, so the key isn't frozen
+	for i := range 2 {
+		res, err := http.Get(server.URL)
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatal(fmt.Sprintf("Expected request #%d to get 401 from the hijacked connection, but got %d", i, res.StatusCode))
+		}
+	}
+}
+
+func TestMiddleware_Shutdown(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var events []throttle.MiddlewareEvent
+	var mu sync.Mutex
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	handler := throttle.Middleware(
+		1,
+		throttle.WithClock(clock),
+		throttle.WithMode(throttle.ModeWait),
+		throttle.WithShutdown(ctx),
+		throttle.WithMetricsHook(func(event throttle.MiddlewareEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			events = append(events, event)
+		}),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			close(entered)
+			<-release
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// the request admitted before the shutdown is left alone
+	inflight := make(chan int)
+
+	go func() {
+		inflight <- serve(handler, httptest.NewRequest(http.MethodGet, "/?slow=1", nil))
+	}()
+
+	<-entered
+
+	const queued = 5
+
+	responses := make(chan *httptest.ResponseRecorder, queued)
+
+	for range queued {
+		go func() {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+			responses <- recorder
+		}()
+	}
+
+	clock.BlockUntilSleepers(queued)
+	cancel()
+
+	deadline := time.After(time.Millisecond * 100)
+
+	for i := range queued {
+		select {
+		case recorder := <-responses:
+			if recorder.Code != http.StatusServiceUnavailable {
+				t.Fatal(fmt.Sprintf("Expected queued request #%d to get 503, but got %d", i, recorder.Code))
+			}
+
+			if actual := recorder.Header().Get("Connection"); actual != "close" {
+				t.Fatal(fmt.Sprintf("Expected queued request #%d to close the connection, but got %q", i, actual))
+			}
+		case <-deadline:
+			t.Fatal(fmt.Sprintf("Expected the queued requests to be released promptly, but only %d have been", i))
+		}
+	}
+
+	// the new requests are refused right away
+	if status := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)); status != http.StatusServiceUnavailable {
+		t.Fatal(fmt.Sprintf("Expected the request after the shutdown to get 503, but got %d", status))
+	}
+
+	close(release)
+
+	if status := <-inflight; status != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the request in flight to get 200, but got %d", status))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var released int
+
+	for _, event := range events {
+		if event.Decision == throttle.DecisionRejected && event.Scope == throttle.ScopeShutdown {
+			released++
+		}
+	}
+
+	if released != queued+1 {
+		t.Fatal(fmt.Sprintf("Expected %d requests to be reported as released by the shutdown, but got %d", queued+1, released))
+	}
+}
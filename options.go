@@ -1,9 +1,14 @@
 package throttle
 
+import "time"
+
 type (
 	// options holds configuration settings for the throttler.
 	options struct {
-		clock Clock
+		clock  TimerClock
+		window time.Duration
+		rand   Rand
+		jitter time.Duration
 	}
 
 	Option func(opts *options)
@@ -20,12 +25,57 @@ func buildOptions(setters []Option) *options {
 		opts.clock = &DefaultClock{}
 	}
 
+	if opts.window <= 0 {
+		opts.window = windowSize
+	}
+
+	opts.rand = newLockedRand(opts.rand)
+
 	return opts
 }
 
 // WithClock sets a custom implementation of Clock interface.
+// Clocks that implement TimerClock are used as is, others are adapted by running Sleep in a separate goroutine.
 func WithClock(clock Clock) Option {
 	return func(opts *options) {
-		opts.clock = clock
+		opts.clock = toTimerClock(clock)
+	}
+}
+
+// WithNowFunc sets a custom source of the current time, keeping the default waiting behavior.
+// It replaces the whole clock, so when combined with WithClock, the last option wins.
+func WithNowFunc(now func() time.Time) Option {
+	return func(opts *options) {
+		if now == nil {
+			opts.clock = nil
+
+			return
+		}
+
+		opts.clock = &nowFuncClock{now: now}
+	}
+}
+
+// WithWindow sets the duration of the window the limit applies to. The default is one second.
+func WithWindow(window time.Duration) Option {
+	return func(opts *options) {
+		opts.window = window
+	}
+}
+
+// WithRand sets a source of randomness for the stochastic features, like jitter.
+// The source is guarded by a mutex, so it does not have to be safe for concurrent use,
+// but it must not be used by anything else while the throttler is alive.
+func WithRand(rand Rand) Option {
+	return func(opts *options) {
+		opts.rand = rand
+	}
+}
+
+// WithJitter adds a random delay in the range [0, max) to every call that has to wait for the next window,
+// so that the waiting callers don't all wake up at the same instant.
+func WithJitter(max time.Duration) Option {
+	return func(opts *options) {
+		opts.jitter = max
 	}
 }
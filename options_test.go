@@ -0,0 +1,94 @@
+package throttle_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestWithNowFunc_Replay(t *testing.T) {
+	timestamps := []time.Duration{
+		0,
+		seconds(0.5),
+		// the first window has expired, a new one starts here
+		seconds(1.2),
+		seconds(1.3),
+		// the second window is full and ends 50ms later
+		seconds(2.15),
+		// the third window has started at 2.2s when the previous one ended
+		seconds(2.3),
+		seconds(3.3),
+	}
+
+	expected := []bool{false, false, false, false, true, false, false}
+
+	var idx atomic.Int64
+
+	throttler := throttle.New(2, throttle.WithNowFunc(func() time.Time {
+		return epoch.Add(timestamps[idx.Load()])
+	}))
+
+	for i := range timestamps {
+		idx.Store(int64(i))
+
+		ts := time.Now()
+		throttler.Acquire()
+		elapsed := time.Since(ts)
+
+		if expected[i] && elapsed < seconds(0.05) {
+			t.Fatal(fmt.Sprintf("Expected call #%d to wait for the next window, but it took %s", i, elapsed))
+		}
+
+		if !expected[i] && elapsed >= seconds(0.05) {
+			t.Fatal(fmt.Sprintf("Expected call #%d to pass through, but it took %s", i, elapsed))
+		}
+	}
+}
+
+func TestWithNowFunc_Precedence(t *testing.T) {
+	useCases := []struct {
+		Name        string
+		Options     func(clock throttle.Clock, now func() time.Time) []throttle.Option
+		NowFuncUsed bool
+	}{
+		{
+			Name: "WithClock after WithNowFunc",
+			Options: func(clock throttle.Clock, now func() time.Time) []throttle.Option {
+				return []throttle.Option{throttle.WithNowFunc(now), throttle.WithClock(clock)}
+			},
+			NowFuncUsed: false,
+		},
+		{
+			Name: "WithNowFunc after WithClock",
+			Options: func(clock throttle.Clock, now func() time.Time) []throttle.Option {
+				return []throttle.Option{throttle.WithClock(clock), throttle.WithNowFunc(now)}
+			},
+			NowFuncUsed: true,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+
+			var calls atomic.Int64
+
+			now := func() time.Time {
+				calls.Add(1)
+
+				return epoch
+			}
+
+			throttler := throttle.New(1, useCase.Options(clock, now)...)
+			throttler.Acquire()
+
+			if actual := calls.Load() > 0; actual != useCase.NowFuncUsed {
+				t.Fatal(fmt.Sprintf("Expected the now func to be used: %t, but got %t", useCase.NowFuncUsed, actual))
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package throttle
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// pacedPacketConn paces the packets written to the underlying connection, and optionally the ones read from it.
+	pacedPacketConn struct {
+		net.PacketConn
+		packets *Throttler
+		// bytes paces the bytes written, if capped
+		bytes *Throttler
+		// reads paces the packets read, if paced
+		reads     *Throttler
+		failFast  bool
+		done      chan struct{}
+		closed    sync.Once
+		deadlines deadlines
+	}
+
+	// PacketConnOption configures the connection of NewPacketConn.
+	// Throttler options, like WithClock and WithWindow, are packet connection options too.
+	PacketConnOption interface {
+		applyPacketConn(opts *packetConnOptions)
+	}
+
+	// packetConnOptions holds configuration settings for the connection of NewPacketConn.
+	packetConnOptions struct {
+		throttler []Option
+		bytes     uint64
+		reads     bool
+		failFast  bool
+	}
+
+	packetConnOptionFunc func(opts *packetConnOptions)
+)
+
+func (fn packetConnOptionFunc) applyPacketConn(opts *packetConnOptions) {
+	fn(opts)
+}
+
+func (o Option) applyPacketConn(opts *packetConnOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+func (failFastOption) applyPacketConn(opts *packetConnOptions) {
+	opts.failFast = true
+}
+
+// WithPacketBytes caps the bytes the connection of NewPacketConn writes per window as well as the packets.
+// A packet larger than the cap waits for as many windows as it takes, rather than being dropped.
+func WithPacketBytes(bytesPerSec uint64) PacketConnOption {
+	return packetConnOptionFunc(func(opts *packetConnOptions) {
+		opts.bytes = bytesPerSec
+	})
+}
+
+// WithPacedReads makes the connection of NewPacketConn pace the packets it reads by the same number of packets per window as the ones it writes,
+// each direction on its own. A read waits for the limit before it reads a packet.
+func WithPacedReads() PacketConnOption {
+	return packetConnOptionFunc(func(opts *packetConnOptions) {
+		opts.reads = true
+	})
+}
+
+// NewPacketConn creates a packet connection that writes at most the specified number of packets per window, one second by default,
+// e.g. to cap the rate of a UDP exporter. The packets beyond the limit wait rather than being dropped,
+// unless WithFailFast is set, in which case they are not written and WriteTo returns a *LimitError.
+// The deadlines are passed to the underlying connection and bound the waits for the limit as well: a packet that would be admitted
+// after the deadline waits until the deadline and fails with a timeout error, as the underlying connection does.
+// Closing the connection stops the pending waits.
+func NewPacketConn(conn net.PacketConn, packetsPerSec uint64, setters ...PacketConnOption) net.PacketConn {
+	opts := &packetConnOptions{}
+
+	for _, setter := range setters {
+		setter.applyPacketConn(opts)
+	}
+
+	paced := &pacedPacketConn{
+		PacketConn: conn,
+		packets:    New(packetsPerSec, opts.throttler...),
+		failFast:   opts.failFast,
+		done:       make(chan struct{}),
+	}
+
+	if opts.bytes > 0 {
+		paced.bytes = New(opts.bytes, opts.throttler...)
+	}
+
+	if opts.reads {
+		paced.reads = New(packetsPerSec, opts.throttler...)
+	}
+
+	return paced
+}
+
+// WriteTo writes the packet once the limit admits it.
+func (c *pacedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.failFast {
+		if err := c.tryAdmit(len(p)); err != nil {
+			return 0, err
+		}
+
+		return c.PacketConn.WriteTo(p, addr)
+	}
+
+	deadline := c.deadlines.get(false)
+	res, err := c.packets.acquireUntil(1, deadline, c.done)
+
+	if err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+
+	if c.bytes != nil {
+		if _, err := c.bytes.acquireUntil(uint64(len(p)), deadline, c.done); err != nil {
+			c.packets.cancel(res)
+
+			return 0, c.opError("write", addr, err)
+		}
+	}
+
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// ReadFrom reads the next packet, once the limit admits it if the reads are paced.
+func (c *pacedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if c.reads == nil {
+		return c.PacketConn.ReadFrom(p)
+	}
+
+	res, err := c.reads.acquireUntil(1, c.deadlines.get(true), c.done)
+
+	if err != nil {
+		return 0, nil, c.opError("read", nil, err)
+	}
+
+	n, addr, err := c.PacketConn.ReadFrom(p)
+
+	// the slot of the read that has got no packet is given back
+	if err != nil && n == 0 {
+		c.reads.cancel(res)
+	}
+
+	return n, addr, err
+}
+
+// Close stops the pending waits and closes the underlying connection.
+func (c *pacedPacketConn) Close() error {
+	c.closed.Do(func() {
+		close(c.done)
+	})
+
+	return c.PacketConn.Close()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *pacedPacketConn) SetDeadline(t time.Time) error {
+	c.deadlines.set(true, true, t)
+
+	return c.PacketConn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (c *pacedPacketConn) SetReadDeadline(t time.Time) error {
+	c.deadlines.set(true, false, t)
+
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection.
+func (c *pacedPacketConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines.set(false, true, t)
+
+	return c.PacketConn.SetWriteDeadline(t)
+}
+
+// tryAdmit takes the slots of a packet of the specified size if it can be written right away, or returns a *LimitError.
+// A packet larger than the cap of the bytes is never admitted.
+func (c *pacedPacketConn) tryAdmit(size int) error {
+	res, ok := c.packets.tryReserve(1)
+
+	if !ok {
+		return &LimitError{RetryAfter: c.packets.EstimateWait(1)}
+	}
+
+	if c.bytes != nil {
+		if _, ok := c.bytes.tryReserve(uint64(size)); !ok {
+			c.packets.cancel(res)
+
+			return &LimitError{RetryAfter: c.bytes.EstimateWait(uint64(size))}
+		}
+	}
+
+	return nil
+}
+
+// opError wraps the error the way the errors of the connections are.
+func (c *pacedPacketConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: addr, Err: err}
+}
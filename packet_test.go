@@ -0,0 +1,186 @@
+package throttle_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// fakePacketConn records the times the packets are written at, and reads the packets queued.
+type fakePacketConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	clock   *throttletest.ManualClock
+	written []time.Duration
+	sizes   []int
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.written = append(c.written, c.clock.Now().Sub(epoch))
+	c.sizes = append(c.sizes, len(p))
+
+	return len(p), nil
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return copy(p, "packet"), &net.UDPAddr{}, nil
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+}
+
+func (c *fakePacketConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *fakePacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *fakePacketConn) Close() error {
+	return nil
+}
+
+func TestNewPacketConn(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Options  []throttle.PacketConnOption
+		Sizes    []int
+		Expected []time.Duration
+	}{
+		{
+			Name:     "packets",
+			Sizes:    []int{10, 10, 10, 10, 10},
+			Expected: []time.Duration{0, 0, time.Second, time.Second, time.Second * 2},
+		},
+		{
+			Name:    "bytes",
+			Options: []throttle.PacketConnOption{throttle.WithPacketBytes(100)},
+			Sizes:   []int{60, 40, 60, 250, 10},
+			// the packet larger than the cap takes the rest of its window and the 3 windows that follow rather than being dropped
+			Expected: []time.Duration{0, 0, time.Second, time.Second * 4, time.Second * 4},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			fake := &fakePacketConn{clock: clock}
+			conn := throttle.NewPacketConn(fake, 2, append(useCase.Options, throttle.WithClock(clock))...)
+
+			for _, size := range useCase.Sizes {
+				if n, err := conn.WriteTo(make([]byte, size), &net.UDPAddr{}); n != size || err != nil {
+					t.Fatal(fmt.Sprintf("Expected to write %d bytes, but got %d and %v", size, n, err))
+				}
+			}
+
+			for i, expected := range useCase.Expected {
+				if fake.written[i] != expected {
+					t.Fatal(fmt.Sprintf("Expected packet #%d to be written at %s, but got %s", i, expected, fake.written[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestNewPacketConn_FailFast(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	fake := &fakePacketConn{clock: clock}
+	conn := throttle.NewPacketConn(fake, 10, throttle.WithClock(clock), throttle.WithFailFast(), throttle.WithPacketBytes(100))
+
+	if _, err := conn.WriteTo(make([]byte, 80), &net.UDPAddr{}); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	_, err := conn.WriteTo(make([]byte, 80), &net.UDPAddr{})
+
+	var limitErr *throttle.LimitError
+
+	if !errors.As(err, &limitErr) || !errors.Is(err, throttle.ErrLimitExceeded) {
+		t.Fatal(fmt.Sprintf("Expected a *throttle.LimitError, but got %v", err))
+	}
+
+	if limitErr.RetryAfter != time.Second {
+		t.Fatal(fmt.Sprintf("Expected to retry after 1s, but got %s", limitErr.RetryAfter))
+	}
+
+	// the packet slot of the rejected packet is given back
+	for range 9 {
+		if _, err := conn.WriteTo(make([]byte, 1), &net.UDPAddr{}); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	if len(fake.written) != 10 {
+		t.Fatal(fmt.Sprintf("Expected 10 packets to be written, but got %d", len(fake.written)))
+	}
+}
+
+func TestNewPacketConn_Deadline(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	fake := &fakePacketConn{clock: clock}
+	conn := throttle.NewPacketConn(fake, 1, throttle.WithClock(clock))
+
+	conn.WriteTo([]byte("first"), &net.UDPAddr{})
+	conn.SetWriteDeadline(epoch.Add(time.Millisecond * 300))
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := conn.WriteTo([]byte("second"), &net.UDPAddr{})
+		done <- err
+	}()
+
+	// the next window opens after the deadline, so the packet waits until the deadline only
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Millisecond * 300)
+
+	var netErr net.Error
+
+	if err := <-done; !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal(fmt.Sprintf("Expected a timeout error, but got %v", err))
+	}
+
+	if len(fake.written) != 1 {
+		t.Fatal(fmt.Sprintf("Expected the packet not to be written, but got %d packets", len(fake.written)))
+	}
+
+	// the packet that timed out takes no slot
+	conn.SetWriteDeadline(time.Time{})
+	clock.Advance(time.Millisecond * 701)
+
+	if _, err := conn.WriteTo([]byte("third"), &net.UDPAddr{}); err != nil || clock.Sleepers() != 0 {
+		t.Fatal(fmt.Sprintf("Expected the packet to be written right away, but got %v", err))
+	}
+}
+
+func TestNewPacketConn_PacedReads(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	conn := throttle.NewPacketConn(&fakePacketConn{clock: clock}, 2, throttle.WithClock(clock), throttle.WithPacedReads())
+	buf := make([]byte, 64)
+
+	for i := range 5 {
+		if n, _, err := conn.ReadFrom(buf); n != 6 || err != nil {
+			t.Fatal(fmt.Sprintf("Expected to read a packet, but got %d and %v", n, err))
+		}
+
+		if expected, actual := time.Duration(i/2)*time.Second, clock.Now().Sub(epoch); actual != expected {
+			t.Fatal(fmt.Sprintf("Expected packet #%d to be read at %s, but got %s", i, expected, actual))
+		}
+	}
+
+	// the writes are paced on their own
+	if _, err := conn.WriteTo([]byte("packet"), &net.UDPAddr{}); err != nil || clock.Now().Sub(epoch) != time.Second*2 {
+		t.Fatal(fmt.Sprintf("Expected the packet to be written right away, but got %v", err))
+	}
+}
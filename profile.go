@@ -0,0 +1,94 @@
+package throttle
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile describes how a well-known API advertises its rate limits, so the transport can adapt to it with WithProvider.
+// Profiles are plain data, so one for another API is a value away, and it can be registered under its name with RegisterProfile.
+type Profile struct {
+	// Name identifies the profile, e.g. "github", matched case-insensitively.
+	Name string
+	// RemainingHeader and ResetHeader name the headers advertising the remaining requests and the reset time.
+	// When both are set, the transport adapts its limit to them, as with WithAdaptiveLimit.
+	RemainingHeader string
+	ResetHeader     string
+	// ParseReset parses the value of the reset header. If it's nil, the value is read as a Unix time or a number of seconds.
+	ParseReset func(value string, now time.Time) (time.Time, bool)
+	// RetryAfter is the longest Retry-After delay honored, as with WithRetryAfter. Zero leaves Retry-After alone.
+	RetryAfter time.Duration
+	// Backoff returns the time to pause the transport until after the response, if any,
+	// e.g. for a secondary limit signaled without a Retry-After header.
+	Backoff func(response *http.Response, now time.Time) (time.Time, bool)
+}
+
+var (
+	// ProfileGitHub follows the REST API of GitHub: X-RateLimit-Remaining and X-RateLimit-Reset as a Unix time,
+	// Retry-After for the secondary limits, and a minute of backoff for the 429 responses without it, as the docs advise.
+	ProfileGitHub = Profile{
+		Name:            "github",
+		RemainingHeader: "X-RateLimit-Remaining",
+		ResetHeader:     "X-RateLimit-Reset",
+		RetryAfter:      DefaultRetryAfterCap,
+		Backoff:         backoffWithoutRetryAfter(time.Minute),
+	}
+
+	// ProfileSlack follows the Web API of Slack, which advertises no quota, but answers with 429 and Retry-After in seconds.
+	ProfileSlack = Profile{
+		Name:       "slack",
+		RetryAfter: DefaultRetryAfterCap,
+	}
+
+	// ProfileDiscord follows the API of Discord: X-RateLimit-Remaining and X-RateLimit-Reset-After in fractional seconds,
+	// as well as Retry-After.
+	ProfileDiscord = Profile{
+		Name:            "discord",
+		RemainingHeader: "X-RateLimit-Remaining",
+		ResetHeader:     "X-RateLimit-Reset-After",
+		ParseReset:      parseResetAfter,
+		RetryAfter:      DefaultRetryAfterCap,
+	}
+
+	profiles = struct {
+		mu     sync.RWMutex
+		byName map[string]Profile
+	}{
+		byName: map[string]Profile{
+			ProfileGitHub.Name:  ProfileGitHub,
+			ProfileSlack.Name:   ProfileSlack,
+			ProfileDiscord.Name: ProfileDiscord,
+		},
+	}
+)
+
+// RegisterProfile adds the profile to the registry under its name, replacing the one registered under it before, if any.
+func RegisterProfile(profile Profile) {
+	profiles.mu.Lock()
+	defer profiles.mu.Unlock()
+
+	profiles.byName[strings.ToLower(profile.Name)] = profile
+}
+
+// LookupProfile returns the profile registered under the name, e.g. "github".
+func LookupProfile(name string) (Profile, bool) {
+	profiles.mu.RLock()
+	defer profiles.mu.RUnlock()
+
+	profile, found := profiles.byName[strings.ToLower(name)]
+
+	return profile, found
+}
+
+// backoffWithoutRetryAfter returns a Backoff pausing the transport for the delay after the 429 responses without Retry-After.
+func backoffWithoutRetryAfter(delay time.Duration) func(response *http.Response, now time.Time) (time.Time, bool) {
+	return func(response *http.Response, now time.Time) (time.Time, bool) {
+		if response.StatusCode != http.StatusTooManyRequests || response.Header.Get("Retry-After") != "" {
+			return time.Time{}, false
+		}
+
+		return now.Add(delay), true
+	}
+}
@@ -0,0 +1,153 @@
+package throttle_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestWithProvider_Quota(t *testing.T) {
+	useCases := []struct {
+		Name      string
+		Profile   throttle.Profile
+		Advertise func(h http.Header, remaining int, reset, now time.Time)
+	}{
+		{
+			Name:    "github",
+			Profile: throttle.ProfileGitHub,
+			Advertise: func(h http.Header, remaining int, reset, _ time.Time) {
+				h.Set("X-RateLimit-Limit", "5")
+				h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+				h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			},
+		},
+		{
+			Name:    "discord",
+			Profile: throttle.ProfileDiscord,
+			Advertise: func(h http.Header, remaining int, reset, now time.Time) {
+				h.Set("X-RateLimit-Limit", "5")
+				h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+				h.Set("X-RateLimit-Reset", strconv.FormatFloat(float64(reset.UnixMilli())/1000, 'f', 3, 64))
+				h.Set("X-RateLimit-Reset-After", strconv.FormatFloat(reset.Sub(now).Seconds(), 'f', 3, 64))
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			server, received := newQuotaServer(t, clock, 5, time.Second*10, useCase.Advertise)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(http.DefaultTransport, 10, throttle.WithClock(clock), throttle.WithProvider(useCase.Profile)),
+			}
+
+			sendSequentially(t, client, clock, server.URL, 15)
+
+			windows := received()
+
+			for idx := range 3 {
+				if len(windows[idx]) != 5 {
+					t.Fatal(fmt.Sprintf("Expected the server to receive 5 requests in window #%d, but got %v", idx, windows[idx]))
+				}
+			}
+		})
+	}
+}
+
+func TestWithProvider_Backoff(t *testing.T) {
+	useCases := []struct {
+		Name       string
+		Profile    throttle.Profile
+		RetryAfter string
+		Expected   time.Duration
+	}{
+		{
+			Name:       "slack honors Retry-After",
+			Profile:    throttle.ProfileSlack,
+			RetryAfter: "3",
+			Expected:   time.Second * 3,
+		},
+		{
+			Name:       "github honors Retry-After of a secondary limit",
+			Profile:    throttle.ProfileGitHub,
+			RetryAfter: "30",
+			Expected:   time.Second * 30,
+		},
+		{
+			Name:     "github backs off for a minute without Retry-After",
+			Profile:  throttle.ProfileGitHub,
+			Expected: time.Minute,
+		},
+		{
+			Name:     "slack goes on without Retry-After",
+			Profile:  throttle.ProfileSlack,
+			Expected: 0,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var calls atomic.Int64
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if calls.Add(1) == 1 {
+					if useCase.RetryAfter != "" {
+						w.Header().Set("Retry-After", useCase.RetryAfter)
+					}
+
+					w.WriteHeader(http.StatusTooManyRequests)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			t.Cleanup(server.Close)
+
+			clock := throttletest.NewManualClock(epoch)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(http.DefaultTransport, 10, throttle.WithClock(clock), throttle.WithProvider(useCase.Profile)),
+			}
+
+			if err := doRequest(client, context.Background(), server.URL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if err := await(clock, goRequest(client, server.URL)); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if actual := clock.Now().Sub(epoch); actual != useCase.Expected {
+				t.Fatal(fmt.Sprintf("Expected the next request to be sent after %s, but got %s", useCase.Expected, actual))
+			}
+		})
+	}
+}
+
+func TestLookupProfile(t *testing.T) {
+	for _, name := range []string{"github", "Slack", "DISCORD"} {
+		if _, found := throttle.LookupProfile(name); !found {
+			t.Fatal(fmt.Sprintf("Expected the %s profile to be registered", name))
+		}
+	}
+
+	if _, found := throttle.LookupProfile("acme"); found {
+		t.Fatal("Expected the acme profile not to be registered")
+	}
+
+	throttle.RegisterProfile(throttle.Profile{Name: "acme", RemainingHeader: "Acme-Left", ResetHeader: "Acme-Reset"})
+
+	profile, found := throttle.LookupProfile("ACME")
+
+	if !found || profile.RemainingHeader != "Acme-Left" {
+		t.Fatal(fmt.Sprintf("Expected the acme profile to be registered, but got %+v", profile))
+	}
+}
@@ -0,0 +1,90 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// quota tracks the requests the server has advertised to accept until its window resets
+// and adapts the limit of the throttler to spread them evenly over the time left.
+type quota struct {
+	mu        sync.Mutex
+	throttler *Throttler
+	limit     uint64
+	remaining uint64
+	reset     time.Time
+	inflight  uint64
+	known     bool
+}
+
+func newQuota(throttler *Throttler) *quota {
+	return &quota{
+		throttler: throttler,
+		limit:     throttler.Limit(),
+	}
+}
+
+// take accounts a request about to be sent.
+// If the advertised requests are used up, it returns the time the server window resets at and false.
+func (q *quota) take(now time.Time) (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.known && !now.Before(q.reset) {
+		// the server window is over, so the configured rate applies again
+		q.known = false
+		q.throttler.SetLimit(q.limit)
+	}
+
+	if q.known {
+		if q.remaining == 0 {
+			// the requests are held until the reset, after which the configured rate applies
+			q.throttler.SetLimit(q.limit)
+
+			return q.reset, false
+		}
+
+		q.remaining--
+	}
+
+	q.inflight++
+
+	return time.Time{}, true
+}
+
+// done accounts a request that has completed without advertising anything.
+func (q *quota) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.inflight -= min(q.inflight, 1)
+}
+
+// update accounts a completed request that has advertised the remaining requests and the reset time of the server window.
+func (q *quota) update(now time.Time, remaining uint64, reset time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.inflight -= min(q.inflight, 1)
+
+	if !reset.After(now) {
+		return
+	}
+
+	// the requests still in flight may have not been counted by the server yet
+	remaining -= min(remaining, q.inflight)
+
+	q.remaining = remaining
+	q.reset = reset
+	q.known = true
+
+	size := q.throttler.size
+	windows := uint64((reset.Sub(now) + size - 1) / size)
+	limit := q.limit
+
+	if perWindow := remaining / windows; limit == 0 || perWindow < limit {
+		limit = max(perWindow, 1)
+	}
+
+	q.throttler.SetLimit(limit)
+}
@@ -0,0 +1,34 @@
+package throttle
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Rand is a source of randomness used by the stochastic features, like jitter.
+// *rand.Rand satisfies it.
+type Rand interface {
+	Int63n(n int64) int64
+}
+
+// lockedRand makes a Rand safe for concurrent use.
+type lockedRand struct {
+	mu  sync.Mutex
+	src Rand
+}
+
+func newLockedRand(src Rand) *lockedRand {
+	if src == nil {
+		src = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return &lockedRand{src: src}
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.src.Int63n(n)
+}
@@ -0,0 +1,100 @@
+package throttle_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestWithJitter_Deterministic(t *testing.T) {
+	const (
+		seed   = 42
+		jitter = time.Millisecond * 100
+	)
+
+	arrivals := make([]time.Time, 10)
+
+	for i := range arrivals {
+		arrivals[i] = epoch
+	}
+
+	cfg := throttle.Config{Limit: 2}
+	first := throttle.Simulate(cfg, arrivals, throttle.WithRand(rand.New(rand.NewSource(seed))), throttle.WithJitter(jitter))
+	second := throttle.Simulate(cfg, arrivals, throttle.WithRand(rand.New(rand.NewSource(seed))), throttle.WithJitter(jitter))
+
+	// only the calls waiting for the next windows are delayed, each one consuming a number from the source
+	src := rand.New(rand.NewSource(seed))
+
+	for i, arrival := range arrivals {
+		expected := arrival.Add(time.Duration(i/2) * time.Second)
+
+		if i >= 2 {
+			expected = expected.Add(time.Duration(src.Int63n(int64(jitter))))
+		}
+
+		if !first[i].Equal(expected) {
+			t.Fatal(fmt.Sprintf("Expected arrival #%d to be admitted at %s, but got %s", i, expected.Sub(epoch), first[i].Sub(epoch)))
+		}
+
+		if !second[i].Equal(first[i]) {
+			t.Fatal(fmt.Sprintf("Expected arrival #%d to be admitted at the same time in both runs, but got %s and %s", i, first[i].Sub(epoch), second[i].Sub(epoch)))
+		}
+	}
+}
+
+func TestWithJitter_Bounds(t *testing.T) {
+	arrivals := make([]time.Time, 1000)
+
+	for i := range arrivals {
+		arrivals[i] = epoch
+	}
+
+	jitter := time.Millisecond * 250
+	admissions := throttle.Simulate(throttle.Config{Limit: 10}, arrivals, throttle.WithJitter(jitter))
+
+	for i, actual := range admissions {
+		window := epoch.Add(time.Duration(i/10) * time.Second)
+
+		if actual.Before(window) || !actual.Before(window.Add(jitter)) {
+			t.Fatal(fmt.Sprintf("Expected arrival #%d to be admitted within [%s, %s), but got %s", i, window.Sub(epoch), window.Add(jitter).Sub(epoch), actual.Sub(epoch)))
+		}
+	}
+}
+
+// countingRand counts the numbers drawn from it.
+type countingRand struct {
+	src   *rand.Rand
+	drawn int
+}
+
+func (r *countingRand) Int63n(n int64) int64 {
+	r.drawn++
+
+	return r.src.Int63n(n)
+}
+
+func TestWithJitter_EstimateWait(t *testing.T) {
+	const jitter = time.Millisecond * 100
+
+	src := &countingRand{src: rand.New(rand.NewSource(42))}
+	throttler := throttle.New(1, throttle.WithClock(throttletest.NewManualClock(epoch)), throttle.WithRand(src), throttle.WithJitter(jitter))
+
+	if !throttler.TryAcquire() {
+		t.Fatal("Expected the first call to be admitted")
+	}
+
+	// the estimates leave the jitter out and don't draw from the source
+	for range 3 {
+		if actual := throttler.EstimateWait(1); actual != time.Second {
+			t.Fatal(fmt.Sprintf("Expected the estimated wait to be %s, but got %s", time.Second, actual))
+		}
+	}
+
+	if src.drawn != 0 {
+		t.Fatal(fmt.Sprintf("Expected no numbers to be drawn by the estimates, but got %d", src.drawn))
+	}
+}
@@ -0,0 +1,312 @@
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RateLimitHeader is the standard field advertising the state of the server quotas.
+	RateLimitHeader = "RateLimit"
+
+	// RateLimitPolicyHeader is the standard field advertising the quota policies of the server.
+	RateLimitPolicyHeader = "RateLimit-Policy"
+)
+
+// ErrMalformedField is returned when a structured field can't be parsed.
+var ErrMalformedField = errors.New("malformed structured field")
+
+type (
+	// RateLimitPolicy is a quota policy advertised in the RateLimit-Policy field.
+	RateLimitPolicy struct {
+		// Name identifies the policy.
+		Name string
+		// Quota is the number of quota units the policy allows per window.
+		Quota uint64
+		// Window is the time the quota is allocated for, zero if not advertised.
+		Window time.Duration
+		// Unit is the quota unit, "request" if not advertised.
+		Unit string
+		// Partition is the key of the partition the policy applies to, if any.
+		Partition string
+	}
+
+	// RateLimitStatus is the state of a quota advertised in the RateLimit field.
+	RateLimitStatus struct {
+		// Policy is the name of the policy the quota belongs to.
+		Policy string
+		// Remaining is the number of quota units left.
+		Remaining uint64
+		// Reset is the time left until the quota is restored, zero if not advertised.
+		Reset time.Duration
+		// Partition is the key of the partition the quota applies to, if any.
+		Partition string
+	}
+
+	// sfItem is an item of a structured field list with its parameters.
+	sfItem struct {
+		value  string
+		params map[string]string
+	}
+)
+
+// ParseRateLimitPolicy parses the value of the RateLimit-Policy field, e.g. `"default";q=100;w=10, "daily";q=1000;w=86400`.
+// Unknown parameters are ignored, and so are the policies without a quota.
+func ParseRateLimitPolicy(value string) ([]RateLimitPolicy, error) {
+	items, err := parseSFList(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]RateLimitPolicy, 0, len(items))
+
+	for _, item := range items {
+		quota, ok := sfInteger(item.params["q"])
+
+		if !ok {
+			continue
+		}
+
+		window, _ := sfInteger(item.params["w"])
+		unit := item.params["qu"]
+
+		if unit == "" {
+			unit = "request"
+		}
+
+		policies = append(policies, RateLimitPolicy{
+			Name:      item.value,
+			Quota:     quota,
+			Window:    time.Duration(window) * time.Second,
+			Unit:      unit,
+			Partition: item.params["pk"],
+		})
+	}
+
+	return policies, nil
+}
+
+// ParseRateLimit parses the value of the RateLimit field, e.g. `"default";r=50;t=30`.
+// Unknown parameters are ignored, and so are the quotas without the remaining units.
+func ParseRateLimit(value string) ([]RateLimitStatus, error) {
+	items, err := parseSFList(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]RateLimitStatus, 0, len(items))
+
+	for _, item := range items {
+		remaining, ok := sfInteger(item.params["r"])
+
+		if !ok {
+			continue
+		}
+
+		reset, _ := sfInteger(item.params["t"])
+
+		statuses = append(statuses, RateLimitStatus{
+			Policy:    item.value,
+			Remaining: remaining,
+			Reset:     time.Duration(reset) * time.Second,
+			Partition: item.params["pk"],
+		})
+	}
+
+	return statuses, nil
+}
+
+// parseStandardRateLimit returns the remaining requests and the reset time of the most restrictive quota advertised by the standard fields,
+// which is the one with the fewest remaining units.
+// The quotas that don't advertise the reset time fall back to the window of their policy.
+func parseStandardRateLimit(header http.Header, now time.Time) (uint64, time.Time, bool) {
+	values := header.Values(RateLimitHeader)
+
+	if len(values) == 0 {
+		return 0, time.Time{}, false
+	}
+
+	statuses, err := ParseRateLimit(strings.Join(values, ", "))
+
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	windows := make(map[string]time.Duration)
+
+	if policies, err := ParseRateLimitPolicy(strings.Join(header.Values(RateLimitPolicyHeader), ", ")); err == nil {
+		for _, p := range policies {
+			windows[p.Name] = p.Window
+		}
+	}
+
+	var (
+		binding RateLimitStatus
+		found   bool
+	)
+
+	for _, s := range statuses {
+		if s.Reset <= 0 {
+			s.Reset = windows[s.Policy]
+		}
+
+		if s.Reset <= 0 {
+			continue
+		}
+
+		if !found || restrictive(s, binding) {
+			binding = s
+			found = true
+		}
+	}
+
+	if !found {
+		return 0, time.Time{}, false
+	}
+
+	return binding.Remaining, now.Add(binding.Reset), true
+}
+
+// restrictive reports whether the quota a runs out before the quota b.
+// Since the remaining units of every quota are refreshed by every response,
+// following the quota with the fewest of them keeps all the others within their limits too.
+func restrictive(a, b RateLimitStatus) bool {
+	if a.Remaining != b.Remaining {
+		return a.Remaining < b.Remaining
+	}
+
+	return a.Reset > b.Reset
+}
+
+// sfInteger parses a non-negative integer of a structured field.
+func sfInteger(value string) (uint64, bool) {
+	n, err := strconv.ParseUint(value, 10, 64)
+
+	return n, err == nil
+}
+
+// parseSFList parses a structured field list (RFC 8941), keeping the bare items and their parameters as strings.
+// Inner lists are not supported.
+func parseSFList(value string) ([]sfItem, error) {
+	var items []sfItem
+
+	rest := strings.TrimLeft(value, " \t")
+
+	for rest != "" {
+		item, next, err := parseSFItem(rest)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+		rest = strings.TrimLeft(next, " \t")
+
+		if rest == "" {
+			break
+		}
+
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("%w: expected a comma at %q", ErrMalformedField, rest)
+		}
+
+		rest = strings.TrimLeft(rest[1:], " \t")
+
+		if rest == "" {
+			return nil, fmt.Errorf("%w: trailing comma", ErrMalformedField)
+		}
+	}
+
+	return items, nil
+}
+
+func parseSFItem(value string) (sfItem, string, error) {
+	bare, rest, err := parseSFBareItem(value)
+
+	if err != nil {
+		return sfItem{}, "", err
+	}
+
+	item := sfItem{value: bare, params: make(map[string]string)}
+
+	for strings.HasPrefix(rest, ";") {
+		rest = strings.TrimLeft(rest[1:], " ")
+
+		end := strings.IndexFunc(rest, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.' || r == '*')
+		})
+
+		if end < 0 {
+			end = len(rest)
+		}
+
+		if end == 0 {
+			return sfItem{}, "", fmt.Errorf("%w: expected a parameter key at %q", ErrMalformedField, rest)
+		}
+
+		key := rest[:end]
+		rest = rest[end:]
+
+		// a parameter without a value is a boolean true
+		param := "?1"
+
+		if strings.HasPrefix(rest, "=") {
+			if param, rest, err = parseSFBareItem(rest[1:]); err != nil {
+				return sfItem{}, "", err
+			}
+		}
+
+		item.params[key] = param
+	}
+
+	return item, rest, nil
+}
+
+func parseSFBareItem(value string) (string, string, error) {
+	if value == "" {
+		return "", "", fmt.Errorf("%w: expected an item", ErrMalformedField)
+	}
+
+	switch value[0] {
+	case '"':
+		var sb strings.Builder
+
+		for i := 1; i < len(value); i++ {
+			switch c := value[i]; c {
+			case '\\':
+				if i+1 == len(value) || (value[i+1] != '"' && value[i+1] != '\\') {
+					return "", "", fmt.Errorf("%w: invalid escape in %q", ErrMalformedField, value)
+				}
+
+				i++
+				sb.WriteByte(value[i])
+			case '"':
+				return sb.String(), value[i+1:], nil
+			default:
+				sb.WriteByte(c)
+			}
+		}
+
+		return "", "", fmt.Errorf("%w: unterminated string %q", ErrMalformedField, value)
+	case '(':
+		return "", "", fmt.Errorf("%w: inner lists are not supported", ErrMalformedField)
+	}
+
+	end := strings.IndexAny(value, ";, \t")
+
+	if end < 0 {
+		end = len(value)
+	}
+
+	if end == 0 {
+		return "", "", fmt.Errorf("%w: expected an item at %q", ErrMalformedField, value)
+	}
+
+	return value[:end], value[end:], nil
+}
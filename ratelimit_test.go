@@ -0,0 +1,156 @@
+package throttle_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+)
+
+func TestParseRateLimitPolicy(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Value    string
+		Expected []throttle.RateLimitPolicy
+		Error    bool
+	}{
+		{
+			Name:  "single policy",
+			Value: `"default";q=100;w=10`,
+			Expected: []throttle.RateLimitPolicy{
+				{Name: "default", Quota: 100, Window: time.Second * 10, Unit: "request"},
+			},
+		},
+		{
+			Name:  "multiple windows",
+			Value: `"burst";q=100;w=60, "daily";q=1000;w=86400;qu="content-bytes";pk=:cHsdsRa894==:`,
+			Expected: []throttle.RateLimitPolicy{
+				{Name: "burst", Quota: 100, Window: time.Minute, Unit: "request"},
+				{Name: "daily", Quota: 1000, Window: time.Hour * 24, Unit: "content-bytes", Partition: ":cHsdsRa894==:"},
+			},
+		},
+		{
+			Name:  "unknown parameters and tokens",
+			Value: `permissive;q=10;w=1;foo=bar;flag;x="y\"z"`,
+			Expected: []throttle.RateLimitPolicy{
+				{Name: "permissive", Quota: 10, Window: time.Second, Unit: "request"},
+			},
+		},
+		{
+			Name:  "policy without quota is skipped",
+			Value: `"a";w=10,"b";q=5`,
+			Expected: []throttle.RateLimitPolicy{
+				{Name: "b", Quota: 5, Unit: "request"},
+			},
+		},
+		{
+			Name:     "empty",
+			Value:    "",
+			Expected: []throttle.RateLimitPolicy{},
+		},
+		{
+			Name:  "unterminated string",
+			Value: `"default;q=100`,
+			Error: true,
+		},
+		{
+			Name:  "trailing comma",
+			Value: `"default";q=100,`,
+			Error: true,
+		},
+		{
+			Name:  "missing comma",
+			Value: `"a";q=1 "b";q=2`,
+			Error: true,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			actual, err := throttle.ParseRateLimitPolicy(useCase.Value)
+
+			if useCase.Error {
+				if !errors.Is(err, throttle.ErrMalformedField) {
+					t.Fatal(fmt.Sprintf("Expected ErrMalformedField, but got %v", err))
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if !reflect.DeepEqual(actual, useCase.Expected) {
+				t.Fatal(fmt.Sprintf("Expected %+v, but got %+v", useCase.Expected, actual))
+			}
+		})
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Value    string
+		Expected []throttle.RateLimitStatus
+		Error    bool
+	}{
+		{
+			Name:  "single quota",
+			Value: `"default";r=50;t=30`,
+			Expected: []throttle.RateLimitStatus{
+				{Policy: "default", Remaining: 50, Reset: time.Second * 30},
+			},
+		},
+		{
+			Name:  "multiple quotas without reset",
+			Value: `"burst";r=0;t=5,  "daily";r=900;pk=:abc=:`,
+			Expected: []throttle.RateLimitStatus{
+				{Policy: "burst", Remaining: 0, Reset: time.Second * 5},
+				{Policy: "daily", Remaining: 900, Partition: ":abc=:"},
+			},
+		},
+		{
+			Name:  "unknown parameters",
+			Value: `"default";r=1;t=2;future=?1;note="hi"`,
+			Expected: []throttle.RateLimitStatus{
+				{Policy: "default", Remaining: 1, Reset: time.Second * 2},
+			},
+		},
+		{
+			Name:     "quota without remaining is skipped",
+			Value:    `"default";t=2`,
+			Expected: []throttle.RateLimitStatus{},
+		},
+		{
+			Name:  "inner list",
+			Value: `("a" "b");r=1`,
+			Error: true,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			actual, err := throttle.ParseRateLimit(useCase.Value)
+
+			if useCase.Error {
+				if !errors.Is(err, throttle.ErrMalformedField) {
+					t.Fatal(fmt.Sprintf("Expected ErrMalformedField, but got %v", err))
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if !reflect.DeepEqual(actual, useCase.Expected) {
+				t.Fatal(fmt.Sprintf("Expected %+v, but got %+v", useCase.Expected, actual))
+			}
+		})
+	}
+}
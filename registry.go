@@ -0,0 +1,101 @@
+package throttle
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultRegistry is the registry shared by the whole program, e.g. to register the throttler of an API once
+// and look it up wherever it's needed.
+var DefaultRegistry = NewRegistry()
+
+type (
+	// Registry holds throttlers by name, so that the packages of a program can share them without passing them around.
+	// It is safe for concurrent use.
+	Registry struct {
+		mu         sync.RWMutex
+		throttlers map[string]*Throttler
+	}
+
+	// registered is a throttler along with its name.
+	registered struct {
+		name      string
+		throttler *Throttler
+	}
+)
+
+// NewRegistry creates a new empty instance of Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		throttlers: make(map[string]*Throttler),
+	}
+}
+
+// Register adds the throttler under the name.
+// A name can't be taken twice: registering another throttler under it returns an error matching ErrAlreadyRegistered,
+// and the registered one is kept.
+func (r *Registry) Register(name string, throttler *Throttler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.throttlers[name]; found {
+		return fmt.Errorf("%w: %q", ErrAlreadyRegistered, name)
+	}
+
+	r.throttlers[name] = throttler
+
+	return nil
+}
+
+// Get returns the throttler registered under the name and reports whether there is one.
+func (r *Registry) Get(name string) (*Throttler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	throttler, found := r.throttlers[name]
+
+	return throttler, found
+}
+
+// MustGet is like Get, but panics if no throttler is registered under the name.
+func (r *Registry) MustGet(name string) *Throttler {
+	throttler, found := r.Get(name)
+
+	if !found {
+		panic(fmt.Sprintf("throttle: no throttler registered as %q", name))
+	}
+
+	return throttler
+}
+
+// Range calls fn for every registered throttler in the order of their names, until fn returns false.
+// It iterates over a snapshot, so fn may register throttlers, which are not visited.
+func (r *Registry) Range(fn func(name string, throttler *Throttler) bool) {
+	r.mu.RLock()
+	entries := make([]registered, 0, len(r.throttlers))
+
+	for name, throttler := range r.throttlers {
+		entries = append(entries, registered{name: name, throttler: throttler})
+	}
+
+	r.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	for _, entry := range entries {
+		if !fn(entry.name, entry.throttler) {
+			return
+		}
+	}
+}
+
+// Len returns the number of registered throttlers.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.throttlers)
+}
@@ -0,0 +1,131 @@
+package throttle_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ziflex/throttle"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := throttle.NewRegistry()
+	github := throttle.New(10)
+
+	if err := registry.Register("github", github); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// the name is not taken over
+	if err := registry.Register("github", throttle.New(20)); !errors.Is(err, throttle.ErrAlreadyRegistered) {
+		t.Fatal(fmt.Sprintf("Expected ErrAlreadyRegistered, but got %v", err))
+	}
+
+	if actual, found := registry.Get("github"); !found || actual != github {
+		t.Fatal("Expected the first registered throttler")
+	}
+
+	if _, found := registry.Get("gitlab"); found {
+		t.Fatal("Expected no throttler for an unknown name")
+	}
+
+	if registry.MustGet("github") != github {
+		t.Fatal("Expected the first registered throttler")
+	}
+}
+
+func TestRegistry_MustGet(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected a panic for an unknown name")
+		}
+	}()
+
+	throttle.NewRegistry().MustGet("unknown")
+}
+
+func TestRegistry_Range(t *testing.T) {
+	registry := throttle.NewRegistry()
+
+	for _, name := range []string{"stripe", "github", "slack", "aws"} {
+		_ = registry.Register(name, throttle.New(1))
+	}
+
+	useCases := []struct {
+		Name     string
+		Stop     string
+		Expected []string
+	}{
+		{Name: "all", Expected: []string{"aws", "github", "slack", "stripe"}},
+		{Name: "stopped", Stop: "github", Expected: []string{"aws", "github"}},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			// the order is the same every time
+			for range 10 {
+				var visited []string
+
+				registry.Range(func(name string, _ *throttle.Throttler) bool {
+					visited = append(visited, name)
+
+					return name != useCase.Stop
+				})
+
+				if fmt.Sprint(visited) != fmt.Sprint(useCase.Expected) {
+					t.Fatal(fmt.Sprintf("Expected %v, but got %v", useCase.Expected, visited))
+				}
+			}
+		})
+	}
+}
+
+func TestRegistry_Concurrent(t *testing.T) {
+	const goroutines = 32
+	const names = 10
+
+	registry := throttle.NewRegistry()
+	registeredBy := make([]int, names)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+
+	for g := range goroutines {
+		go func(g int) {
+			defer wg.Done()
+
+			for i := range names {
+				name := fmt.Sprintf("api-%d", i)
+
+				if err := registry.Register(name, throttle.New(uint64(g+1))); err == nil {
+					mu.Lock()
+					registeredBy[i]++
+					mu.Unlock()
+				}
+
+				if _, found := registry.Get(name); !found {
+					t.Error(fmt.Sprintf("Expected %s to be registered", name))
+				}
+
+				registry.Range(func(string, *throttle.Throttler) bool {
+					return true
+				})
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	// every name has been registered exactly once
+	for i, n := range registeredBy {
+		if n != 1 {
+			t.Fatal(fmt.Sprintf("Expected api-%d to be registered once, but got %d", i, n))
+		}
+	}
+
+	if actual := registry.Len(); actual != names {
+		t.Fatal(fmt.Sprintf("Expected %d throttlers, but got %d", names, actual))
+	}
+}
@@ -0,0 +1,56 @@
+package throttle
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// drainLimit is the most bytes read from the body of a response that is thrown away, so the connection can be reused.
+const drainLimit = 64 << 10
+
+var errNoBody = errors.New("request body can't be replayed")
+
+// IsReplayable reports whether the request is safe to send again:
+// its body is absent or can be recreated by GetBody, and its method is idempotent or it carries an idempotency key.
+func IsReplayable(request *http.Request) bool {
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return false
+	}
+
+	switch request.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return request.Header.Get("Idempotency-Key") != "" || request.Header.Get("X-Idempotency-Key") != ""
+}
+
+// rewind returns a copy of the request with a fresh body, ready to be sent again.
+func rewind(request *http.Request) (*http.Request, error) {
+	next := request.Clone(request.Context())
+
+	if request.Body == nil || request.Body == http.NoBody {
+		return next, nil
+	}
+
+	if request.GetBody == nil {
+		return nil, errNoBody
+	}
+
+	body, err := request.GetBody()
+
+	if err != nil {
+		return nil, err
+	}
+
+	next.Body = body
+
+	return next, nil
+}
+
+// drain reads the rest of the response body and closes it.
+func drain(response *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, drainLimit))
+	_ = response.Body.Close()
+}
@@ -0,0 +1,87 @@
+package throttle
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// route is a path pattern with its own throttler.
+type route struct {
+	pattern   string
+	glob      bool
+	throttler *Throttler
+}
+
+// newRoutes creates a throttler for every pattern and orders the routes by precedence.
+func newRoutes(limits map[string]uint64, setters []Option) []route {
+	routes := make([]route, 0, len(limits))
+
+	for pattern, limit := range limits {
+		routes = append(routes, route{
+			pattern:   pattern,
+			glob:      isGlob(pattern),
+			throttler: New(limit, setters...),
+		})
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+
+		if len(a.pattern) != len(b.pattern) {
+			return len(a.pattern) > len(b.pattern)
+		}
+
+		if a.glob != b.glob {
+			return !a.glob
+		}
+
+		return a.pattern < b.pattern
+	})
+
+	return routes
+}
+
+// newPatterns creates the routes without throttlers, only to match the paths against the patterns.
+func newPatterns(patterns []string) []route {
+	routes := make([]route, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		routes = append(routes, route{
+			pattern: pattern,
+			glob:    isGlob(pattern),
+		})
+	}
+
+	return routes
+}
+
+// isGlob reports whether the pattern has wildcards.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// matchRoute returns the route with the highest precedence that matches the path.
+func matchRoute(routes []route, p string) (route, bool) {
+	for _, r := range routes {
+		if r.match(p) {
+			return r, true
+		}
+	}
+
+	return route{}, false
+}
+
+func (r route) match(p string) bool {
+	if r.glob {
+		matched, err := path.Match(r.pattern, p)
+
+		return err == nil && matched
+	}
+
+	if !strings.HasPrefix(p, r.pattern) {
+		return false
+	}
+
+	return len(p) == len(r.pattern) || strings.HasSuffix(r.pattern, "/") || p[len(r.pattern)] == '/'
+}
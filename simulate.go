@@ -0,0 +1,27 @@
+package throttle
+
+import "time"
+
+// Config describes the rules a throttler enforces.
+type Config struct {
+	// Limit is the number of operations allowed within a window. Zero means no limit.
+	Limit uint64
+	// Window is the duration of the window. Zero means one second.
+	Window time.Duration
+}
+
+// Simulate calculates the admission time of each arrival under the specified configuration without waiting.
+// The arrivals are expected to be in chronological order and are admitted by the same code that serves Acquire,
+// so the result matches what a throttler would do if the operations arrived at these exact times.
+// Additional options, like WithJitter, are applied on top of the configuration.
+func Simulate(cfg Config, arrivals []time.Time, setters ...Option) []time.Time {
+	t := New(cfg.Limit, append([]Option{WithWindow(cfg.Window)}, setters...)...)
+	admissions := make([]time.Time, len(arrivals))
+
+	for i, at := range arrivals {
+		res := t.jittered(t.advance(at, 1))
+		admissions[i] = at.Add(res.wait)
+	}
+
+	return admissions
+}
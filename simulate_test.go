@@ -0,0 +1,108 @@
+package throttle_test
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+// replay runs the arrivals against a throttler driven by a manual clock, moving the time in steps,
+// and returns the admission offsets.
+func replay(cfg throttle.Config, arrivals []time.Duration, step time.Duration) []time.Duration {
+	clock := throttletest.NewManualClock(epoch)
+	throttler := throttle.New(cfg.Limit, throttle.WithClock(clock), throttle.WithWindow(cfg.Window))
+	admissions := make([]time.Duration, len(arrivals))
+
+	var pending atomic.Int64
+
+	// settle waits until every started call is either admitted or parked
+	settle := func() {
+		for int64(clock.Sleepers()) != pending.Load() {
+			runtime.Gosched()
+		}
+	}
+
+	next := 0
+
+	for elapsed := time.Duration(0); next < len(arrivals) || pending.Load() > 0; elapsed += step {
+		clock.Set(epoch.Add(elapsed))
+		settle()
+
+		for next < len(arrivals) && arrivals[next] == elapsed {
+			pending.Add(1)
+
+			go func(i int) {
+				throttler.Acquire()
+				admissions[i] = clock.Now().Sub(epoch)
+				pending.Add(-1)
+			}(next)
+
+			settle()
+			next++
+		}
+	}
+
+	return admissions
+}
+
+func TestSimulate(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Config   throttle.Config
+		Arrivals []time.Duration
+		Expected []time.Duration
+	}{
+		{
+			Name:     "unlimited",
+			Config:   throttle.Config{},
+			Arrivals: []time.Duration{0, 0, 0, seconds(0.1)},
+			Expected: []time.Duration{0, 0, 0, seconds(0.1)},
+		},
+		{
+			Name:     "burst",
+			Config:   throttle.Config{Limit: 2},
+			Arrivals: []time.Duration{0, 0, 0, 0, 0},
+			Expected: []time.Duration{0, 0, seconds(1), seconds(1), seconds(2)},
+		},
+		{
+			Name:     "sporadic",
+			Config:   throttle.Config{Limit: 2},
+			Arrivals: []time.Duration{0, seconds(0.5), seconds(0.9), seconds(1.2), seconds(2.5), seconds(2.6), seconds(2.7)},
+			Expected: []time.Duration{0, seconds(0.5), seconds(1), seconds(1.2), seconds(2.5), seconds(2.6), seconds(3.5)},
+		},
+		{
+			Name:     "custom window",
+			Config:   throttle.Config{Limit: 3, Window: seconds(0.5)},
+			Arrivals: []time.Duration{0, 0, seconds(0.1), seconds(0.2), seconds(0.3), seconds(0.4), seconds(0.4), seconds(1)},
+			Expected: []time.Duration{0, 0, seconds(0.1), seconds(0.5), seconds(0.5), seconds(0.5), seconds(1), seconds(1)},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			arrivals := make([]time.Time, len(useCase.Arrivals))
+
+			for i, at := range useCase.Arrivals {
+				arrivals[i] = epoch.Add(at)
+			}
+
+			simulated := throttle.Simulate(useCase.Config, arrivals)
+			replayed := replay(useCase.Config, useCase.Arrivals, seconds(0.1))
+
+			for i, expected := range useCase.Expected {
+				if actual := simulated[i].Sub(epoch); actual != expected {
+					t.Fatal(fmt.Sprintf("Expected arrival #%d to be admitted at %s, but got %s", i, expected, actual))
+				}
+
+				if actual := replayed[i]; actual != expected {
+					t.Fatal(fmt.Sprintf("Expected arrival #%d to be admitted at %s by the manual clock run, but got %s", i, expected, actual))
+				}
+			}
+		})
+	}
+}
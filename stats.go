@@ -0,0 +1,65 @@
+package throttle
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// TransportStats is a snapshot of the counters of a throttled RoundTripper.
+	// They cover all the throttlers of the transport, including the ones of the routes, hosts and keys.
+	TransportStats struct {
+		// Sent is the number of requests passed to the underlying transport, every retry counting on its own.
+		Sent uint64
+		// Unthrottled is the number of sent requests that have not been paced, e.g. the skipped or bypassing ones.
+		Unthrottled uint64
+		// Waited is the number of requests that have had to wait for the limit.
+		Waited uint64
+		// Wait is the total time the requests have spent waiting.
+		Wait time.Duration
+		// Rejected is the number of requests rejected with a *LimitError, e.g. by WithFailFast.
+		Rejected uint64
+		// Cancelled is the number of requests whose context has been done while they were waiting.
+		Cancelled uint64
+	}
+
+	// stats holds the counters of a throttled RoundTripper.
+	stats struct {
+		sent        atomic.Uint64
+		unthrottled atomic.Uint64
+		waited      atomic.Uint64
+		wait        atomic.Int64
+		rejected    atomic.Uint64
+		cancelled   atomic.Uint64
+	}
+)
+
+// snapshot returns the current values of the counters.
+func (s *stats) snapshot() TransportStats {
+	return TransportStats{
+		Sent:        s.sent.Load(),
+		Unthrottled: s.unthrottled.Load(),
+		Waited:      s.waited.Load(),
+		Wait:        time.Duration(s.wait.Load()),
+		Rejected:    s.rejected.Load(),
+		Cancelled:   s.cancelled.Load(),
+	}
+}
+
+// reset zeroes the counters.
+func (s *stats) reset() {
+	s.sent.Store(0)
+	s.unthrottled.Store(0)
+	s.waited.Store(0)
+	s.wait.Store(0)
+	s.rejected.Store(0)
+	s.cancelled.Store(0)
+}
+
+// waitedFor records the wait of an admitted request.
+func (s *stats) waitedFor(wait time.Duration) {
+	if wait > 0 {
+		s.waited.Add(1)
+		s.wait.Add(int64(wait))
+	}
+}
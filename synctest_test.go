@@ -0,0 +1,117 @@
+//go:build go1.25
+
+package throttle_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/ziflex/throttle"
+)
+
+func TestThrottler_Synctest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		throttler := throttle.New(1)
+		start := time.Now()
+
+		// 3 minutes of virtual time
+		for i := range 180 {
+			throttler.Acquire()
+
+			expected := time.Duration(i) * time.Second
+
+			if actual := time.Since(start); actual != expected {
+				t.Fatal(fmt.Sprintf("Expected call #%d to be admitted after %s, but got %s", i, expected, actual))
+			}
+		}
+	})
+}
+
+func TestThrottler_Synctest_AcquireContext(t *testing.T) {
+	useCases := []struct {
+		Name  string
+		Clock throttle.Clock
+	}{
+		{
+			Name:  "default clock",
+			Clock: &throttle.DefaultClock{},
+		},
+		{
+			Name:  "legacy clock",
+			Clock: &legacyClock{&throttle.DefaultClock{}},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				throttler := throttle.New(1, throttle.WithClock(useCase.Clock))
+				start := time.Now()
+
+				throttler.Acquire()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+				defer cancel()
+
+				if err := throttler.AcquireContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatal(fmt.Sprintf("Expected context.DeadlineExceeded, but got %v", err))
+				}
+
+				if actual := time.Since(start); actual != time.Millisecond*300 {
+					t.Fatal(fmt.Sprintf("Expected to give up after 300ms, but got %s", actual))
+				}
+
+				// the slot of the cancelled call is given back
+				if err := throttler.AcquireContext(context.Background()); err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+
+				if actual := time.Since(start); actual != time.Second {
+					t.Fatal(fmt.Sprintf("Expected to be admitted after 1s, but got %s", actual))
+				}
+			})
+		})
+	}
+}
+
+func TestRoundTripper_Synctest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		start := time.Now()
+		var sent []time.Duration
+
+		transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = append(sent, time.Since(start))
+
+			return &http.Response{StatusCode: http.StatusOK, Request: req, Body: http.NoBody}, nil
+		})
+
+		client := &http.Client{
+			Transport: throttle.NewRoundTripper(transport, 2),
+		}
+
+		for range 120 {
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+
+			res, err := client.Do(req)
+
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			res.Body.Close()
+		}
+
+		for i, actual := range sent {
+			expected := time.Duration(i/2) * time.Second
+
+			if actual != expected {
+				t.Fatal(fmt.Sprintf("Expected request #%d to be sent after %s, but got %s", i, expected, actual))
+			}
+		}
+	})
+}
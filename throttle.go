@@ -1,85 +1,385 @@
 package throttle
 
 import (
+	"context"
 	"sync"
 	"time"
 )
 
 const windowSize = time.Second
 
-// Throttler manages the execution of operations so that they don't exceed a specified rate limit.
-type Throttler struct {
-	mu      sync.Mutex
-	window  time.Time
-	clock   Clock
-	counter uint64
-	limit   uint64
-}
+var _ Limiter = (*Throttler)(nil)
+
+type (
+	// Throttler manages the execution of operations so that they don't exceed a specified rate limit.
+	Throttler struct {
+		mu      sync.Mutex
+		window  time.Time
+		size    time.Duration
+		clock   TimerClock
+		rand    Rand
+		jitter  time.Duration
+		counter uint64
+		limit   uint64
+	}
+
+	// windowState describes the window the next operation would be admitted in.
+	windowState struct {
+		limit     uint64
+		remaining uint64
+		// reset is the time left until the limit is restored
+		reset time.Duration
+	}
+
+	// Reservation holds the slot taken by TryReserve, so that it can be given back.
+	Reservation struct {
+		throttler *Throttler
+		res       reservation
+	}
+
+	// reservation describes the slots taken in a window.
+	reservation struct {
+		window time.Time
+		taken  uint64
+		wait   time.Duration
+	}
+)
 
 // New creates a new instance of Throttler with a specified limit.
 func New(limit uint64, setters ...Option) *Throttler {
 	opts := buildOptions(setters)
 
 	return &Throttler{
-		limit: limit,
-		clock: opts.clock,
+		limit:  limit,
+		size:   opts.window,
+		clock:  opts.clock,
+		rand:   opts.rand,
+		jitter: opts.jitter,
 	}
 }
 
 // Acquire blocks until the operation can be executed within the rate limit.
 func (t *Throttler) Acquire() {
+	res := t.reserve(1)
+
+	if res.wait > 0 {
+		t.clock.Sleep(res.wait)
+	}
+}
+
+// AcquireContext blocks until the operation can be executed within the rate limit or the context is done.
+// In the latter case, the reserved slot is given back and the context error is returned.
+func (t *Throttler) AcquireContext(ctx context.Context) error {
+	return t.AcquireN(ctx, 1)
+}
+
+// AcquireN is like AcquireContext, but the operation takes n slots of the limit.
+// An operation that doesn't fit into the rest of the current window is admitted in the next one as a whole,
+// while an operation that is heavier than the limit spans as many windows as needed and is admitted in the last one.
+func (t *Throttler) AcquireN(ctx context.Context, n uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return t.await(ctx, t.reserve(n))
+}
+
+// TryAcquire takes a slot if the operation can be executed right away and reports whether it did.
+func (t *Throttler) TryAcquire() bool {
+	return t.TryAcquireN(1)
+}
+
+// TryAcquireN is like TryAcquire, but the operation takes n slots of the limit.
+func (t *Throttler) TryAcquireN(n uint64) bool {
 	t.mu.Lock()
-	t.advance()
-	t.mu.Unlock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+
+	if !t.fits(now, n) {
+		return false
+	}
+
+	t.advance(now, n)
+
+	return true
 }
 
-// advance updates the throttler state, advancing the window or incrementing the counter as necessary.
-func (t *Throttler) advance() {
-	// pass through
-	if t.limit == 0 {
+// TryReserve is like TryAcquire, but returns the reservation of the slot, so that it can be given back with Cancel,
+// e.g. when another limit turns the operation down.
+func (t *Throttler) TryReserve() (Reservation, bool) {
+	res, ok := t.tryReserve(1)
+
+	if !ok {
+		return Reservation{}, false
+	}
+
+	return Reservation{throttler: t, res: res}, true
+}
+
+// Cancel gives the slot of the reservation back, unless its window is over. The zero Reservation has nothing to give back.
+func (r Reservation) Cancel() {
+	if r.throttler != nil {
+		r.throttler.cancel(r.res)
+	}
+}
+
+// tryReserve is like TryAcquireN, but returns the reservation, so the slots can be given back.
+func (t *Throttler) tryReserve(n uint64) (reservation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+
+	if !t.fits(now, n) {
+		return reservation{}, false
+	}
+
+	return t.advance(now, n), true
+}
+
+// currentState returns the state of the window at the moment.
+func (t *Throttler) currentState() windowState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.state(t.clock.Now())
+}
+
+// Remaining returns the number of slots that can be taken right away, 0 for a throttler without a limit.
+func (t *Throttler) Remaining() uint64 {
+	return t.currentState().remaining
+}
+
+// NextReset returns the time the limit is restored, that is the end of the latest window,
+// including the ones taken by the waiting callers. Without a window in progress, it's the end of the one that would start now.
+func (t *Throttler) NextReset() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+
+	return now.Add(t.state(now).reset)
+}
+
+// EstimateWait returns the time an operation taking n slots would wait if it were acquired now, without taking them.
+// The estimate leaves the jitter out, so it doesn't draw from the source of randomness. It holds as long as nobody else acquires slots in the meantime.
+func (t *Throttler) EstimateWait(n uint64) time.Duration {
+	res, _ := t.reserveWithin(n, -1)
+
+	return res.wait
+}
+
+// Limit returns the number of operations admitted per window.
+func (t *Throttler) Limit() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.limit
+}
+
+// SetLimit changes the number of operations admitted per window, 0 meaning no limit.
+// The slots already taken are kept, so a lower limit applies once the taken ones are used up.
+func (t *Throttler) SetLimit(limit uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.limit = limit
+}
+
+// PauseUntil holds the operations that haven't been admitted yet until the deadline.
+// The limit applies again from the deadline on, so the held operations don't burst once it passes.
+// A deadline earlier than the one already in effect is ignored, and a throttler without a limit is never paused.
+func (t *Throttler) PauseUntil(deadline time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.limit == 0 || !deadline.After(t.window) {
 		return
 	}
 
-	clock := t.clock
-	now := clock.Now()
+	t.reset(deadline)
+}
+
+// state returns the state of the window at the specified time.
+func (t *Throttler) state(now time.Time) windowState {
+	state := windowState{limit: t.limit, reset: t.size}
+
+	if t.limit == 0 {
+		return state
+	}
+
+	// a fresh window is about to start
+	if t.window.IsZero() || now.Sub(t.window) > t.size {
+		state.remaining = t.limit
+
+		return state
+	}
+
+	state.reset = t.window.Add(t.size).Sub(now)
+
+	// nothing is left if the next window has been taken by the waiting callers
+	if !t.window.After(now) && t.counter < t.limit {
+		state.remaining = t.limit - t.counter
+	}
+
+	return state
+}
+
+// windowEnd returns the time the latest window, including the ones taken by the waiting callers, ends at.
+func (t *Throttler) windowEnd() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.window.IsZero() {
+		return t.clock.Now()
+	}
+
+	return t.window.Add(t.size)
+}
+
+// reserve takes n slots in the current or upcoming windows.
+func (t *Throttler) reserve(n uint64) reservation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.jittered(t.advance(t.clock.Now(), n))
+}
+
+// reserveWithin takes n slots, unless the caller would have to wait longer than maxWait for them.
+// In the latter case, nothing is taken and the returned reservation holds the estimated wait, without the jitter.
+// The jitter is added only to the reservations taken, and doesn't push their wait past maxWait.
+func (t *Throttler) reserveWithin(n uint64, maxWait time.Duration) (reservation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	window, counter := t.window, t.counter
+	res := t.advance(t.clock.Now(), n)
+
+	if res.wait > maxWait {
+		t.window, t.counter = window, counter
+
+		return res, false
+	}
+
+	res = t.jittered(res)
+	res.wait = min(res.wait, maxWait)
+
+	return res, true
+}
+
+// await waits for the reservation or, if the context is done first, gives its slots back.
+func (t *Throttler) await(ctx context.Context, res reservation) error {
+	if res.wait <= 0 {
+		return nil
+	}
+
+	select {
+	case <-t.clock.After(res.wait):
+		return nil
+	case <-ctx.Done():
+		t.cancel(res)
+
+		return ctx.Err()
+	}
+}
+
+// fits reports whether n slots can be taken without waiting.
+func (t *Throttler) fits(now time.Time, n uint64) bool {
+	// pass through
+	if t.limit == 0 || n == 0 {
+		return true
+	}
+
+	// a fresh window is about to start
+	if t.window.IsZero() || now.Sub(t.window) > t.size {
+		return n <= t.limit
+	}
+
+	// the current window is exhausted and the next one has been taken by the waiting callers
+	if t.window.After(now) {
+		return false
+	}
+
+	return t.counter < t.limit && n <= t.limit-t.counter
+}
+
+// advance updates the throttler state, advancing the window or incrementing the counter as necessary.
+func (t *Throttler) advance(now time.Time, n uint64) reservation {
+	// pass through
+	if t.limit == 0 || n == 0 {
+		return reservation{}
+	}
 
 	// if this is the first operation, initialize the window
 	if t.window.IsZero() {
 		t.window = now
 	}
 
-	windowDur := now.Sub(t.window)
-
 	// if the current window has expired
-	if windowDur > windowSize {
+	if now.Sub(t.window) > t.size {
 		// start a new window
 		t.reset(now)
-
-		return
 	}
 
-	nextCount := t.counter + 1
+	var free uint64
 
-	// if adding another operation doesn't exceed the limit
-	if t.limit >= nextCount {
+	if t.counter < t.limit {
+		free = t.limit - t.counter
+	}
+
+	// if adding the operation doesn't exceed the limit
+	if n <= free {
 		// increment the counter
-		t.counter = nextCount
+		t.counter += n
+	} else if n <= t.limit {
+		// otherwise, move the operation to the next window as a whole, so no window admits more than the limit
+		t.reset(t.window.Add(t.size))
+		t.counter = n
+	} else {
+		// otherwise, spill the rest over the windows that follow the current one
+		rest := n - free
+		windows := (rest + t.limit - 1) / t.limit
 
-		return
+		t.reset(t.window.Add(t.size * time.Duration(windows)))
+		t.counter = rest - (windows-1)*t.limit
+		n = t.counter
 	}
 
-	sleepDur := windowSize - windowDur
+	res := reservation{window: t.window, taken: n}
+
+	// the window starts in the future when the previous ones are exhausted,
+	// so the caller has to wait until it opens
+	if t.window.After(now) {
+		res.wait = t.window.Sub(now)
+	}
+
+	return res
+}
 
-	// if the limit is reached, wait until the current window expires
-	// we use an optional clock offset to account for clock skew.
-	clock.Sleep(sleepDur)
+// jittered adds the jitter to the wait of a reservation that is taken, so that the estimates don't draw from the source of randomness.
+func (t *Throttler) jittered(res reservation) reservation {
+	if res.wait > 0 && t.jitter > 0 {
+		res.wait += time.Duration(t.rand.Int63n(int64(t.jitter)))
+	}
+
+	return res
+}
+
+// cancel gives back the slots taken by the reservation, unless its window has been already filled up.
+func (t *Throttler) cancel(res reservation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.window.Equal(res.window) {
+		return
+	}
 
-	// after sleeping, reset to a new window starting now
-	t.reset(clock.Now())
+	t.counter -= min(t.counter, res.taken)
 }
 
 // reset starts a new window from the specified start time and resets the operation counter.
 func (t *Throttler) reset(window time.Time) {
 	t.window = window
-	t.counter = 1
+	t.counter = 0
 }
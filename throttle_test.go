@@ -1,18 +1,47 @@
 package throttle_test
 
 import (
+	"context"
 	"fmt"
 	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
 	"math"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+var epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
 func seconds(fraction float64) time.Duration {
 	return time.Duration(float64(time.Second) * fraction)
 }
 
+func newScenarioThrottler(limit uint64) func(clock throttle.Clock) throttle.Limiter {
+	return func(clock throttle.Clock) throttle.Limiter {
+		return throttle.New(limit, throttle.WithClock(clock))
+	}
+}
+
+// drive advances the clock by a window every time all the remaining calls are parked in it, until none are left.
+func drive(clock *throttletest.ManualClock, remaining *atomic.Int64) {
+	for {
+		left := remaining.Load()
+
+		if left == 0 {
+			return
+		}
+
+		if int64(clock.Sleepers()) == left {
+			clock.Advance(time.Second)
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
 func TestThrottler_Do_Consistent(t *testing.T) {
 	useCases := []struct {
 		Limit uint64
@@ -84,20 +113,14 @@ func TestThrottler_Do_Consistent(t *testing.T) {
 }
 
 func TestThrottler_Do_Sporadic(t *testing.T) {
-	type Burst struct {
-		Warmup  time.Duration
-		Latency time.Duration
-		Calls   int
-	}
-
 	useCases := []struct {
 		Limit    uint64
-		Calls    []Burst
-		Expected map[float64]uint64
+		Calls    []throttletest.Burst
+		Expected map[int]uint64
 	}{
 		{
 			Limit: 10,
-			Calls: []Burst{
+			Calls: []throttletest.Burst{
 				{
 					Warmup: seconds(0.99),
 					Calls:  5,
@@ -111,7 +134,7 @@ func TestThrottler_Do_Sporadic(t *testing.T) {
 					Calls:  4,
 				},
 			},
-			Expected: map[float64]uint64{
+			Expected: map[int]uint64{
 				0: 5,
 				1: 2,
 				2: 4,
@@ -119,7 +142,7 @@ func TestThrottler_Do_Sporadic(t *testing.T) {
 		},
 		{
 			Limit: 5,
-			Calls: []Burst{
+			Calls: []throttletest.Burst{
 				{
 					Calls:   5,
 					Latency: seconds(0.255),
@@ -130,7 +153,7 @@ func TestThrottler_Do_Sporadic(t *testing.T) {
 					Latency: seconds(0.45),
 				},
 			},
-			Expected: map[float64]uint64{
+			Expected: map[int]uint64{
 				0: 3,
 				1: 3,
 				2: 2,
@@ -142,91 +165,30 @@ func TestThrottler_Do_Sporadic(t *testing.T) {
 
 	for _, useCase := range useCases {
 		t.Run(fmt.Sprintf("Sporadic %d RPS within %d calls", useCase.Limit, useCase.Calls), func(t *testing.T) {
-			var buffer int
-
-			for _, tp := range useCase.Calls {
-				buffer += tp.Calls
-			}
-
-			calls := make(chan time.Time, buffer)
-			throttler := throttle.New(useCase.Limit)
-			ts := time.Now()
-
-			var wg sync.WaitGroup
-			wg.Add(len(useCase.Calls))
-
-			go func() {
-				for _, tpl := range useCase.Calls {
-					warmup := tpl.Warmup
-					latency := tpl.Latency
-					callNum := tpl.Calls
-
-					if warmup > 0 {
-						time.Sleep(warmup)
-					}
-
-					for range callNum {
-						throttler.Acquire()
-
-						if latency > 0 {
-							time.Sleep(latency)
-						}
-
-						calls <- time.Now()
-					}
-
-					wg.Done()
-				}
-			}()
-
-			wg.Wait()
-			close(calls)
-
-			groups := map[float64]uint64{}
-
-			for c := range calls {
-				diff := c.Sub(ts)
-				dur := math.Abs(math.Floor(diff.Seconds()))
-				groups[dur]++
-
-				// fmt.Println(fmt.Sprintf("Elapsed %ds", int64(dur)))
-			}
-
-			for sec, actual := range groups {
-				expected, found := useCase.Expected[sec]
-
-				if !found {
-					t.Fatal(fmt.Sprintf("Expected to have calls within %ds time range", int64(sec)))
-				}
-
-				if actual != expected {
-					t.Fatal(fmt.Sprintf("Expected %d per second, but got %d", expected, actual))
-				}
-			}
+			throttletest.Run(t, newScenarioThrottler(useCase.Limit), throttletest.Scenario{
+				Bursts:   useCase.Calls,
+				Expected: useCase.Expected,
+			})
 		})
 	}
 }
 
 func TestThrottler_Do_Parallel(t *testing.T) {
-	type Call struct {
-		Latency time.Duration
-	}
-
 	useCases := []struct {
 		Limit    uint64
-		Calls    []Call
-		Expected map[float64]uint64
+		Calls    []throttletest.Call
+		Expected map[int]uint64
 	}{
 		{
 			Limit: 1,
-			Calls: []Call{
+			Calls: []throttletest.Call{
 				{},
 				{},
 				{},
 				{},
 				{},
 			},
-			Expected: map[float64]uint64{
+			Expected: map[int]uint64{
 				0: 1,
 				1: 1,
 				2: 1,
@@ -236,7 +198,7 @@ func TestThrottler_Do_Parallel(t *testing.T) {
 		},
 		{
 			Limit: 5,
-			Calls: []Call{
+			Calls: []throttletest.Call{
 				{
 					Latency: seconds(0.99),
 				},
@@ -253,14 +215,14 @@ func TestThrottler_Do_Parallel(t *testing.T) {
 					Latency: seconds(0.99),
 				},
 			},
-			Expected: map[float64]uint64{
+			Expected: map[int]uint64{
 				0: 5,
 			},
 		},
 
 		{
 			Limit: 5,
-			Calls: []Call{
+			Calls: []throttletest.Call{
 				{
 					Latency: seconds(0.5),
 				},
@@ -281,7 +243,7 @@ func TestThrottler_Do_Parallel(t *testing.T) {
 				},
 				{},
 			},
-			Expected: map[float64]uint64{
+			Expected: map[int]uint64{
 				0: 5,
 				1: 1,
 				2: 1,
@@ -291,51 +253,430 @@ func TestThrottler_Do_Parallel(t *testing.T) {
 
 	for _, useCase := range useCases {
 		t.Run(fmt.Sprintf("Parallel %d RPS", useCase.Limit), func(t *testing.T) {
-			calls := make(chan time.Time, len(useCase.Calls))
-			throttler := throttle.New(useCase.Limit)
-			ts := time.Now()
-
-			var wg sync.WaitGroup
-			wg.Add(len(useCase.Calls))
+			throttletest.Run(t, newScenarioThrottler(useCase.Limit), throttletest.Scenario{
+				Calls:    useCase.Calls,
+				Expected: useCase.Expected,
+			})
+		})
+	}
+}
 
-			for _, tpl := range useCase.Calls {
-				go func(latency time.Duration) {
-					defer wg.Done()
+func TestThrottler_Do_ManualClock(t *testing.T) {
+	useCases := []struct {
+		Limit uint64
+		Calls int
+	}{
+		{
+			Limit: 1,
+			Calls: 5,
+		},
+		{
+			Limit: 5,
+			Calls: 16,
+		},
+		{
+			Limit: 10,
+			Calls: 100,
+		},
+	}
 
-					throttler.Acquire()
+	for _, useCase := range useCases {
+		t.Run(fmt.Sprintf("Manual clock %d RPS within %d calls", useCase.Limit, useCase.Calls), func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			calls := make(chan time.Time, useCase.Calls)
+			throttler := throttle.New(useCase.Limit, throttle.WithClock(clock))
 
-					if latency > 0 {
-						time.Sleep(latency)
-					}
+			var remaining atomic.Int64
+			remaining.Store(int64(useCase.Calls))
 
-					calls <- time.Now()
-				}(tpl.Latency)
+			for range useCase.Calls {
+				go func() {
+					throttler.Acquire()
+					calls <- clock.Now()
+					remaining.Add(-1)
+				}()
 			}
 
-			wg.Wait()
+			drive(clock, &remaining)
 			close(calls)
 
-			groups := map[float64]uint64{}
+			groups := map[int64]uint64{}
 
 			for c := range calls {
-				diff := c.Sub(ts)
-				dur := math.Abs(math.Floor(diff.Seconds()))
-				groups[dur]++
+				groups[int64(c.Sub(epoch)/time.Second)]++
+			}
 
-				// fmt.Println(fmt.Sprintf("Elapsed %ds", int64(dur)))
+			expectedWindows := (useCase.Calls + int(useCase.Limit) - 1) / int(useCase.Limit)
+
+			if len(groups) != expectedWindows {
+				t.Fatal(fmt.Sprintf("Expected calls within %d windows, but got %d", expectedWindows, len(groups)))
 			}
 
 			for sec, actual := range groups {
-				expected, found := useCase.Expected[sec]
+				if actual > useCase.Limit {
+					t.Fatal(fmt.Sprintf("Expected %d per second, but got %d within %ds", useCase.Limit, actual, sec))
+				}
+			}
+		})
+	}
+}
+
+func TestThrottler_TryAcquire(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	throttler := throttle.New(2, throttle.WithClock(clock))
+
+	expected := []bool{true, true, false}
+
+	for i, exp := range expected {
+		if actual := throttler.TryAcquire(); actual != exp {
+			t.Fatal(fmt.Sprintf("Expected call #%d to return %t, but got %t", i, exp, actual))
+		}
+	}
+
+	clock.Advance(seconds(1.01))
+
+	if !throttler.TryAcquire() {
+		t.Fatal("Expected a slot in the new window")
+	}
+
+	// a waiting caller takes the rest of the current window and the next one
+	go throttler.AcquireN(context.Background(), 3)
+
+	clock.BlockUntilSleepers(1)
+	clock.Advance(seconds(0.5))
+
+	if throttler.TryAcquire() {
+		t.Fatal("Expected no slots while somebody is waiting for the next window")
+	}
+
+	clock.Advance(seconds(0.5))
+
+	if throttler.TryAcquire() {
+		t.Fatal("Expected no slots in the window taken by the waiting caller")
+	}
+
+	clock.Advance(seconds(1.01))
+
+	if !throttler.TryAcquireN(2) {
+		t.Fatal("Expected 2 slots in the new window")
+	}
+}
+
+func TestThrottler_TryReserve(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	throttler := throttle.New(2, throttle.WithClock(clock))
+
+	first, ok := throttler.TryReserve()
+
+	if !ok {
+		t.Fatal("Expected the first slot to be reserved")
+	}
+
+	if _, ok := throttler.TryReserve(); !ok {
+		t.Fatal("Expected the second slot to be reserved")
+	}
+
+	rejected, ok := throttler.TryReserve()
+
+	if ok {
+		t.Fatal("Expected no slots beyond the limit")
+	}
 
-				if !found {
-					t.Fatal(fmt.Sprintf("Expected to have calls within %ds time range", int64(sec)))
+	// the rejected reservation has nothing to give back
+	rejected.Cancel()
+	first.Cancel()
+
+	if actual := throttler.Remaining(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected the cancelled slot to be given back, but got %d remaining", actual))
+	}
+
+	last, _ := throttler.TryReserve()
+	clock.Advance(seconds(1.01))
+	throttler.TryAcquire()
+
+	// the slot of a window that is over isn't given back to the new one
+	last.Cancel()
+
+	if actual := throttler.Remaining(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected 1 slot remaining in the new window, but got %d", actual))
+	}
+}
+
+func TestThrottler_Remaining(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	throttler := throttle.New(3, throttle.WithClock(clock))
+
+	assert := func(remaining uint64, reset time.Duration) {
+		t.Helper()
+
+		if actual := throttler.Remaining(); actual != remaining {
+			t.Fatal(fmt.Sprintf("Expected %d remaining slots, but got %d", remaining, actual))
+		}
+
+		if actual := throttler.NextReset().Sub(clock.Now()); actual != reset {
+			t.Fatal(fmt.Sprintf("Expected the reset in %s, but got %s", reset, actual))
+		}
+	}
+
+	assert(3, time.Second)
+
+	throttler.TryAcquireN(2)
+	clock.Advance(seconds(0.25))
+
+	assert(1, seconds(0.75))
+
+	// a waiting caller takes the rest of the current window and the next one
+	go throttler.AcquireN(context.Background(), 3)
+
+	clock.BlockUntilSleepers(1)
+
+	assert(0, seconds(1.75))
+
+	clock.Advance(seconds(0.75))
+
+	assert(0, time.Second)
+
+	clock.Advance(seconds(1.01))
+
+	assert(3, time.Second)
+}
+
+func TestThrottler_EstimateWait(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	throttler := throttle.New(2, throttle.WithClock(clock))
+
+	throttler.TryAcquireN(2)
+	clock.Advance(seconds(0.25))
+
+	expected := []struct {
+		n    uint64
+		wait time.Duration
+	}{
+		{n: 1, wait: seconds(0.75)},
+		{n: 3, wait: seconds(1.75)},
+		{n: 0, wait: 0},
+	}
+
+	for _, exp := range expected {
+		if actual := throttler.EstimateWait(exp.n); actual != exp.wait {
+			t.Fatal(fmt.Sprintf("Expected an operation of %d to wait %s, but got %s", exp.n, exp.wait, actual))
+		}
+	}
+
+	// nothing has been taken by the estimates
+	if actual := throttler.Remaining(); actual != 0 {
+		t.Fatal(fmt.Sprintf("Expected no remaining slots, but got %d", actual))
+	}
+
+	clock.Advance(seconds(0.76))
+
+	if !throttler.TryAcquireN(2) {
+		t.Fatal("Expected 2 slots in the new window")
+	}
+}
+
+func TestThrottler_AcquireN(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Limit    uint64
+		Weights  []uint64
+		Expected []time.Duration
+	}{
+		{
+			Name:     "fits into a window",
+			Limit:    10,
+			Weights:  []uint64{3, 3, 4, 1},
+			Expected: []time.Duration{0, 0, 0, seconds(1)},
+		},
+		{
+			Name:     "spills over the next window",
+			Limit:    10,
+			Weights:  []uint64{8, 5, 5, 3},
+			Expected: []time.Duration{0, seconds(1), seconds(1), seconds(2)},
+		},
+		{
+			Name:     "moves to the next window as a whole",
+			Limit:    10,
+			Weights:  []uint64{8, 5, 5, 1},
+			Expected: []time.Duration{0, seconds(1), seconds(1), seconds(2)},
+		},
+		{
+			Name:     "heavier than the limit",
+			Limit:    10,
+			Weights:  []uint64{25, 5, 1},
+			Expected: []time.Duration{seconds(2), seconds(2), seconds(3)},
+		},
+		{
+			Name:     "zero weight",
+			Limit:    1,
+			Weights:  []uint64{1, 0, 1},
+			Expected: []time.Duration{0, 0, seconds(1)},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			throttler := throttle.New(useCase.Limit, throttle.WithClock(clock))
+
+			for i, weight := range useCase.Weights {
+				// every call arrives at the start
+				clock.Set(epoch)
+
+				if err := throttler.AcquireN(context.Background(), weight); err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
 				}
 
-				if actual != expected {
-					t.Fatal(fmt.Sprintf("Expected %d per second, but got %d", expected, actual))
+				if actual := clock.Now().Sub(epoch); actual != useCase.Expected[i] {
+					t.Fatal(fmt.Sprintf("Expected call #%d to be admitted at %s, but got %s", i, useCase.Expected[i], actual))
 				}
 			}
 		})
 	}
 }
+
+func TestThrottler_Do_Chaos(t *testing.T) {
+	useCases := []struct {
+		Limit uint64
+		Calls int
+	}{
+		{
+			Limit: 1,
+			Calls: 10,
+		},
+		{
+			Limit: 5,
+			Calls: 16,
+		},
+		{
+			Limit: 10,
+			Calls: 100,
+		},
+	}
+
+	for _, useCase := range useCases {
+		for seed := range int64(5) {
+			t.Run(fmt.Sprintf("Chaos %d RPS within %d calls with seed %d", useCase.Limit, useCase.Calls, seed), func(t *testing.T) {
+				inner := throttletest.NewManualClock(epoch)
+				clock := throttletest.WithChaos(inner, throttletest.ChaosOptions{
+					MaxOvershoot:    time.Millisecond * 50,
+					MaxNowIncrement: time.Microsecond * 100,
+					Seed:            seed,
+				})
+
+				calls := make(chan time.Time, useCase.Calls)
+				throttler := throttle.New(useCase.Limit, throttle.WithClock(clock))
+				ts := clock.Now()
+
+				var remaining atomic.Int64
+				remaining.Store(int64(useCase.Calls))
+
+				for range useCase.Calls {
+					go func() {
+						throttler.Acquire()
+						calls <- clock.Now()
+						remaining.Add(-1)
+					}()
+				}
+
+				for remaining.Load() > 0 {
+					if int64(inner.Sleepers()) == remaining.Load() {
+						inner.AdvanceToNext()
+					} else {
+						runtime.Gosched()
+					}
+				}
+
+				close(calls)
+
+				groups := map[int64]uint64{}
+
+				for c := range calls {
+					groups[int64(c.Sub(ts)/time.Second)]++
+				}
+
+				for sec, actual := range groups {
+					if actual > useCase.Limit {
+						t.Fatal(fmt.Sprintf("Expected %d per second, but got %d within %ds", useCase.Limit, actual, sec))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestThrottler_PauseUntil(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	throttler := throttle.New(2, throttle.WithClock(clock))
+
+	if !throttler.TryAcquire() {
+		t.Fatal("Expected a slot before the pause")
+	}
+
+	throttler.PauseUntil(epoch.Add(time.Second * 3))
+
+	// an earlier deadline doesn't shorten the pause
+	throttler.PauseUntil(epoch.Add(time.Second * 2))
+
+	if throttler.TryAcquire() {
+		t.Fatal("Expected no slots while paused")
+	}
+
+	done := make(chan time.Time, 3)
+
+	for range 3 {
+		go func() {
+			throttler.Acquire()
+			done <- clock.Now()
+		}()
+	}
+
+	clock.BlockUntilSleepers(3)
+	clock.Advance(time.Second * 3)
+
+	// the limit applies from the deadline on
+	for range 2 {
+		if actual := (<-done).Sub(epoch); actual != time.Second*3 {
+			t.Fatal(fmt.Sprintf("Expected to be admitted after 3s, but got %s", actual))
+		}
+	}
+
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Second)
+
+	if actual := (<-done).Sub(epoch); actual != time.Second*4 {
+		t.Fatal(fmt.Sprintf("Expected to be admitted after 4s, but got %s", actual))
+	}
+}
+
+func TestThrottler_SetLimit(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	throttler := throttle.New(1, throttle.WithClock(clock))
+
+	if !throttler.TryAcquire() {
+		t.Fatal("Expected a slot")
+	}
+
+	throttler.SetLimit(3)
+
+	if actual := throttler.Limit(); actual != 3 {
+		t.Fatal(fmt.Sprintf("Expected the limit to be 3, but got %d", actual))
+	}
+
+	if !throttler.TryAcquireN(2) {
+		t.Fatal("Expected the raised limit to apply to the current window")
+	}
+
+	throttler.SetLimit(1)
+	clock.Advance(seconds(1.01))
+
+	if !throttler.TryAcquire() || throttler.TryAcquire() {
+		t.Fatal("Expected the lowered limit to apply to the new window")
+	}
+
+	throttler.SetLimit(0)
+
+	if !throttler.TryAcquireN(100) {
+		t.Fatal("Expected no limit")
+	}
+}
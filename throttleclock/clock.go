@@ -0,0 +1,19 @@
+// Package throttleclock adapts clocks of popular third-party libraries to throttle.TimerClock.
+// It lives in a separate module, so that the core package stays free of these dependencies.
+package throttleclock
+
+import (
+	benbjohnson "github.com/benbjohnson/clock"
+	"github.com/jonboulle/clockwork"
+	"github.com/ziflex/throttle"
+)
+
+// FromClockwork adapts a clock from github.com/jonboulle/clockwork, including its FakeClock.
+func FromClockwork(clock clockwork.Clock) throttle.TimerClock {
+	return clock
+}
+
+// FromBenbjohnson adapts a clock from github.com/benbjohnson/clock, including its Mock.
+func FromBenbjohnson(clock benbjohnson.Clock) throttle.TimerClock {
+	return clock
+}
@@ -0,0 +1,174 @@
+package throttleclock_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	benbjohnson "github.com/benbjohnson/clock"
+	"github.com/jonboulle/clockwork"
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttleclock"
+)
+
+var epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type fakeClock struct {
+	throttle.TimerClock
+	advance func(dur time.Duration)
+	// blockUntil waits until n calls are parked in the clock
+	blockUntil func(n int)
+}
+
+// trackingMock tracks the timers created by the benbjohnson mock, which has no way to wait for them.
+type trackingMock struct {
+	*benbjohnson.Mock
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (c *trackingMock) After(dur time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadlines = append(c.deadlines, c.Now().Add(dur))
+
+	return c.Mock.After(dur)
+}
+
+func (c *trackingMock) Sleep(dur time.Duration) {
+	<-c.After(dur)
+}
+
+// pending returns the number of timers that haven't fired yet.
+func (c *trackingMock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	now := c.Now()
+
+	for _, deadline := range c.deadlines {
+		if deadline.After(now) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func newClockwork() fakeClock {
+	clock := clockwork.NewFakeClockAt(epoch)
+
+	return fakeClock{
+		TimerClock: throttleclock.FromClockwork(clock),
+		advance:    clock.Advance,
+		blockUntil: clock.BlockUntil,
+	}
+}
+
+func newBenbjohnson() fakeClock {
+	clock := &trackingMock{Mock: benbjohnson.NewMock()}
+	clock.Set(epoch)
+
+	return fakeClock{
+		TimerClock: throttleclock.FromBenbjohnson(clock),
+		advance: func(dur time.Duration) {
+			clock.Add(dur)
+		},
+		blockUntil: func(n int) {
+			for clock.pending() < n {
+				time.Sleep(time.Millisecond)
+			}
+		},
+	}
+}
+
+func TestAdapters(t *testing.T) {
+	useCases := []struct {
+		Name  string
+		Clock func() fakeClock
+	}{
+		{
+			Name:  "clockwork",
+			Clock: newClockwork,
+		},
+		{
+			Name:  "benbjohnson",
+			Clock: newBenbjohnson,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			t.Run("Acquire", func(t *testing.T) {
+				clock := useCase.Clock()
+				throttler := throttle.New(2, throttle.WithClock(clock))
+				admitted := make(chan time.Time, 6)
+
+				for range 2 {
+					throttler.Acquire()
+					admitted <- clock.Now()
+				}
+
+				for range 4 {
+					go func() {
+						throttler.Acquire()
+						admitted <- clock.Now()
+					}()
+				}
+
+				for _, expected := range []time.Duration{0, 0} {
+					if actual := (<-admitted).Sub(epoch); actual != expected {
+						t.Fatal(fmt.Sprintf("Expected to be admitted at %s, but got %s", expected, actual))
+					}
+				}
+
+				clock.blockUntil(4)
+				clock.advance(time.Second)
+
+				for _, expected := range []time.Duration{time.Second, time.Second} {
+					if actual := (<-admitted).Sub(epoch); actual != expected {
+						t.Fatal(fmt.Sprintf("Expected to be admitted at %s, but got %s", expected, actual))
+					}
+				}
+
+				clock.blockUntil(2)
+				clock.advance(time.Second)
+
+				for _, expected := range []time.Duration{time.Second * 2, time.Second * 2} {
+					if actual := (<-admitted).Sub(epoch); actual != expected {
+						t.Fatal(fmt.Sprintf("Expected to be admitted at %s, but got %s", expected, actual))
+					}
+				}
+			})
+
+			t.Run("AcquireContext", func(t *testing.T) {
+				clock := useCase.Clock()
+				throttler := throttle.New(1, throttle.WithClock(clock))
+
+				if err := throttler.AcquireContext(context.Background()); err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan error, 1)
+
+				go func() {
+					done <- throttler.AcquireContext(ctx)
+				}()
+
+				clock.blockUntil(1)
+				cancel()
+
+				if err := <-done; err != context.Canceled {
+					t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+				}
+
+				clock.advance(time.Second)
+			})
+		})
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/ziflex/throttle/throttleclock
+
+go 1.22
+
+replace github.com/ziflex/throttle => ../
+
+require (
+	github.com/benbjohnson/clock v1.3.5
+	github.com/jonboulle/clockwork v0.5.0
+	github.com/ziflex/throttle v0.0.0
+)
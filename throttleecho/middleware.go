@@ -0,0 +1,31 @@
+// Package throttleecho adapts the throttle middleware to echo.
+// It lives in a separate module, so that the core package stays free of this dependency.
+package throttleecho
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ziflex/throttle"
+)
+
+// Middleware creates an echo middleware limiting the requests served per window, see throttle.Middleware for the limit and the options.
+// The requests beyond the limit are answered the same way as by throttle.Middleware, including the headers,
+// and the next handler isn't called for them. The admitted requests go on to the next handler,
+// which runs within the middleware, so the slots of WithMaxConcurrentPerKey are held until it returns, and its error is returned as is.
+func Middleware(limit uint64, setters ...throttle.MiddlewareOption) echo.MiddlewareFunc {
+	wrap := throttle.Middleware(limit, setters...)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var err error
+
+			wrap(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				c.SetRequest(r)
+				err = next(c)
+			})).ServeHTTP(c.Response(), c.Request())
+
+			return err
+		}
+	}
+}
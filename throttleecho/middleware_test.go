@@ -0,0 +1,102 @@
+package throttleecho_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttleecho"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+var epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestMiddleware(t *testing.T) {
+	var served int
+
+	e := echo.New()
+	e.Use(throttleecho.Middleware(
+		2,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithLimitHeaders(throttle.ResetSeconds),
+	))
+	// the middleware after the limit is skipped for the rejected requests
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			served++
+
+			return next(c)
+		}
+	})
+	e.GET("/", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	steps := []struct {
+		Key        string
+		Status     int
+		Remaining  string
+		RetryAfter string
+		Served     int
+	}{
+		{Key: "first", Status: http.StatusOK, Remaining: "1", Served: 1},
+		{Key: "first", Status: http.StatusOK, Remaining: "0", Served: 2},
+		{Key: "first", Status: http.StatusTooManyRequests, Remaining: "0", RetryAfter: "1", Served: 2},
+		{Key: "second", Status: http.StatusOK, Remaining: "1", Served: 3},
+	}
+
+	for i, s := range steps {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("X-API-Key", s.Key)
+
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+
+		if recorder.Code != s.Status {
+			t.Fatal(fmt.Sprintf("Expected request #%d to get %d, but got %d", i, s.Status, recorder.Code))
+		}
+
+		if actual := recorder.Header().Get(throttle.DefaultRemainingHeader); actual != s.Remaining {
+			t.Fatal(fmt.Sprintf("Expected request #%d to have %s remaining, but got %s", i, s.Remaining, actual))
+		}
+
+		if actual := recorder.Header().Get("Retry-After"); actual != s.RetryAfter {
+			t.Fatal(fmt.Sprintf("Expected request #%d to retry after %q, but got %q", i, s.RetryAfter, actual))
+		}
+
+		if served != s.Served {
+			t.Fatal(fmt.Sprintf("Expected %d requests to reach the chain after request #%d, but got %d", s.Served, i, served))
+		}
+	}
+}
+
+func TestMiddleware_Error(t *testing.T) {
+	errTeapot := errors.New("teapot")
+
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		if errors.Is(err, errTeapot) {
+			_ = c.NoContent(http.StatusTeapot)
+		}
+	}
+	e.Use(throttleecho.Middleware(1, throttle.WithClock(throttletest.NewManualClock(epoch))))
+	e.GET("/", func(echo.Context) error {
+		return errTeapot
+	})
+
+	// the error of the handler reaches the error handler, while the rejection is answered by the middleware
+	for i, expected := range []int{http.StatusTeapot, http.StatusTooManyRequests} {
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if recorder.Code != expected {
+			t.Fatal(fmt.Sprintf("Expected request #%d to get %d, but got %d", i, expected, recorder.Code))
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Package throttlegin adapts the throttle middleware to gin.
+// It lives in a separate module, so that the core package stays free of this dependency.
+package throttlegin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ziflex/throttle"
+)
+
+// Middleware creates a gin middleware limiting the requests served per window, see throttle.Middleware for the limit and the options.
+// The requests beyond the limit are answered the same way as by throttle.Middleware, including the headers,
+// and the rest of the chain is aborted. The admitted requests go on with the rest of the chain,
+// which runs within the middleware, so the slots of WithMaxConcurrentPerKey are held until it returns.
+func Middleware(limit uint64, setters ...throttle.MiddlewareOption) gin.HandlerFunc {
+	wrap := throttle.Middleware(limit, setters...)
+
+	return func(c *gin.Context) {
+		var admitted bool
+
+		wrap(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			admitted = true
+			// the rest of the chain sees the request the middleware has passed on
+			c.Request = r
+			c.Next()
+		})).ServeHTTP(c.Writer, c.Request)
+
+		if !admitted {
+			c.Abort()
+		}
+	}
+}
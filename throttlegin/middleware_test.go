@@ -0,0 +1,128 @@
+package throttlegin_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttlegin"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+var epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var served int
+
+	router := gin.New()
+	router.Use(throttlegin.Middleware(
+		2,
+		throttle.WithClock(throttletest.NewManualClock(epoch)),
+		throttle.WithKeyByHeader("X-API-Key"),
+		throttle.WithLimitHeaders(throttle.ResetSeconds),
+	))
+	// the middleware after the limit is skipped for the rejected requests
+	router.Use(func(c *gin.Context) {
+		served++
+		c.Next()
+	})
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	steps := []struct {
+		Key        string
+		Status     int
+		Remaining  string
+		RetryAfter string
+		Served     int
+	}{
+		{Key: "first", Status: http.StatusOK, Remaining: "1", Served: 1},
+		{Key: "first", Status: http.StatusOK, Remaining: "0", Served: 2},
+		{Key: "first", Status: http.StatusTooManyRequests, Remaining: "0", RetryAfter: "1", Served: 2},
+		{Key: "second", Status: http.StatusOK, Remaining: "1", Served: 3},
+	}
+
+	for i, s := range steps {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("X-API-Key", s.Key)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != s.Status {
+			t.Fatal(fmt.Sprintf("Expected request #%d to get %d, but got %d", i, s.Status, recorder.Code))
+		}
+
+		if actual := recorder.Header().Get(throttle.DefaultRemainingHeader); actual != s.Remaining {
+			t.Fatal(fmt.Sprintf("Expected request #%d to have %s remaining, but got %s", i, s.Remaining, actual))
+		}
+
+		if actual := recorder.Header().Get("Retry-After"); actual != s.RetryAfter {
+			t.Fatal(fmt.Sprintf("Expected request #%d to retry after %q, but got %q", i, s.RetryAfter, actual))
+		}
+
+		if served != s.Served {
+			t.Fatal(fmt.Sprintf("Expected %d requests to reach the chain after request #%d, but got %d", s.Served, i, served))
+		}
+	}
+}
+
+func TestMiddleware_MaxConcurrentPerKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	router := gin.New()
+	router.Use(throttlegin.Middleware(10, throttle.WithKeyByIP(), throttle.WithMaxConcurrentPerKey(1)))
+	router.GET("/", func(c *gin.Context) {
+		if c.Query("slow") != "" {
+			close(entered)
+			<-release
+		}
+
+		c.Status(http.StatusOK)
+	})
+
+	done := make(chan int)
+
+	go func() {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/?slow=1", nil))
+		done <- recorder.Code
+	}()
+
+	<-entered
+
+	// the slot is held while the rest of the chain runs
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatal(fmt.Sprintf("Expected the concurrent request to get 429, but got %d", recorder.Code))
+	}
+
+	if actual := recorder.Header().Get(throttle.ScopeHeader); actual != throttle.ScopeConcurrency {
+		t.Fatal(fmt.Sprintf("Expected the %q scope, but got %q", throttle.ScopeConcurrency, actual))
+	}
+
+	close(release)
+
+	if status := <-done; status != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the slow request to get 200, but got %d", status))
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Expected the request after the slow one to get 200, but got %d", recorder.Code))
+	}
+}
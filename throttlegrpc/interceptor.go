@@ -0,0 +1,109 @@
+// Package throttlegrpc provides gRPC interceptors limiting the calls per window.
+// It lives in a separate module, so that the core package stays free of this dependency.
+package throttlegrpc
+
+import (
+	"context"
+
+	"github.com/ziflex/throttle"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	// Option configures an interceptor.
+	Option func(opts *options)
+
+	// options holds configuration settings for an interceptor.
+	options struct {
+		perMessage bool
+		keyed      *throttle.KeyedThrottler[string]
+		key        KeyFunc
+		methods    *methodThrottlers
+	}
+
+	// pacedClientStream paces the messages sent on the stream.
+	pacedClientStream struct {
+		grpc.ClientStream
+		limiter throttle.Limiter
+		// method is the throttler of the method of the stream, if any
+		method *throttle.Throttler
+	}
+)
+
+func buildOptions(setters []Option) *options {
+	opts := &options{}
+
+	for _, setter := range setters {
+		setter(opts)
+	}
+
+	return opts
+}
+
+// WithPerMessage makes StreamClientInterceptor take a slot per message sent on the stream rather than per stream opened.
+// The messages received are not limited.
+func WithPerMessage() Option {
+	return func(opts *options) {
+		opts.perMessage = true
+	}
+}
+
+// StreamClientInterceptor creates a client interceptor limiting the streams opened, a slot per stream, or the messages sent on them with WithPerMessage.
+// The limiter can be shared, e.g. with other clients of the same server, and may be nil with WithMethodLimits. If the context of the call
+// or of the stream is done while waiting, the error is the status of the context error, codes.Canceled or codes.DeadlineExceeded.
+func StreamClientInterceptor(limiter throttle.Limiter, setters ...Option) grpc.StreamClientInterceptor {
+	opts := buildOptions(setters)
+
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		paced := &pacedClientStream{limiter: limiter}
+
+		if opts.methods != nil {
+			paced.method = opts.methods.throttler(method)
+		}
+
+		if !opts.perMessage {
+			if err := paced.acquire(ctx); err != nil {
+				return nil, err
+			}
+
+			return streamer(ctx, desc, cc, method, callOpts...)
+		}
+
+		stream, err := streamer(ctx, desc, cc, method, callOpts...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		paced.ClientStream = stream
+
+		return paced, nil
+	}
+}
+
+// SendMsg sends the message once the limits admit it.
+func (s *pacedClientStream) SendMsg(m any) error {
+	if err := s.acquire(s.Context()); err != nil {
+		return err
+	}
+
+	return s.ClientStream.SendMsg(m)
+}
+
+// acquire waits for a slot of the throttler of the method, if any, and then of the limiter, unless it's nil.
+func (s *pacedClientStream) acquire(ctx context.Context) error {
+	if s.method != nil {
+		if err := s.method.AcquireContext(ctx); err != nil {
+			return status.FromContextError(err).Err()
+		}
+	}
+
+	if s.limiter != nil {
+		if err := s.limiter.AcquireContext(ctx); err != nil {
+			return status.FromContextError(err).Err()
+		}
+	}
+
+	return nil
+}
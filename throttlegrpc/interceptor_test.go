@@ -0,0 +1,254 @@
+package throttlegrpc_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttlegrpc"
+	"github.com/ziflex/throttle/throttletest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// chatDesc is the stream of the test service: the server answers every message with the time it's arrived at.
+var chatDesc = grpc.StreamDesc{
+	StreamName:    "Chat",
+	ServerStreams: true,
+	ClientStreams: true,
+	Handler: func(srv any, stream grpc.ServerStream) error {
+		server := srv.(*testServer)
+		server.served.Add(1)
+
+		for {
+			var in wrapperspb.StringValue
+
+			if err := stream.RecvMsg(&in); err != nil {
+				return nil
+			}
+
+			if err := stream.SendMsg(durationpb.New(server.clock.Now().Sub(epoch))); err != nil {
+				return err
+			}
+		}
+	},
+}
+
+// unaryDesc returns a unary method of the test service: the server answers with the time the call has arrived at.
+func unaryDesc(name string) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			var in wrapperspb.StringValue
+
+			if err := dec(&in); err != nil {
+				return nil, err
+			}
+
+			server := srv.(*testServer)
+			handler := func(context.Context, any) (any, error) {
+				server.served.Add(1)
+
+				server.mu.Lock()
+				server.calls[name]++
+				server.mu.Unlock()
+
+				return durationpb.New(server.clock.Now().Sub(epoch)), nil
+			}
+
+			if interceptor == nil {
+				return handler(ctx, &in)
+			}
+
+			return interceptor(ctx, &in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/throttle.Test/" + name}, handler)
+		},
+	}
+}
+
+// testServer serves the test service over an in-memory connection.
+type testServer struct {
+	clock *throttletest.ManualClock
+	// served is the number of calls and streams handled
+	served atomic.Int64
+	mu     sync.Mutex
+	// calls are the numbers of unary calls handled per method
+	calls map[string]int
+}
+
+// dial starts the test service with the server options and dials it with the dial options.
+func dial(t *testing.T, clock *throttletest.ManualClock, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) (*grpc.ClientConn, *testServer) {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(serverOpts...)
+	service := &testServer{clock: clock, calls: make(map[string]int)}
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "throttle.Test",
+		HandlerType: (*any)(nil),
+		Methods:     []grpc.MethodDesc{unaryDesc("Get"), unaryDesc("Search")},
+		Streams:     []grpc.StreamDesc{chatDesc},
+	}, service)
+
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		append(dialOpts,
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)...,
+	)
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+
+	return conn, service
+}
+
+// chat opens a stream and sends the messages one at a time, returning the times the server has received them at.
+func chat(ctx context.Context, conn *grpc.ClientConn, messages int) ([]time.Duration, error) {
+	stream, err := conn.NewStream(ctx, &chatDesc, "/throttle.Test/Chat")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var times []time.Duration
+
+	for range messages {
+		if err := stream.SendMsg(wrapperspb.String("hello")); err != nil {
+			return times, err
+		}
+
+		var arrival durationpb.Duration
+
+		if err := stream.RecvMsg(&arrival); err != nil {
+			return times, err
+		}
+
+		times = append(times, arrival.AsDuration())
+	}
+
+	return times, stream.CloseSend()
+}
+
+func TestStreamClientInterceptor(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Options []throttlegrpc.Option
+		// Times are the arrival times of the messages of 3 streams of 3 messages each
+		Times [][]time.Duration
+	}{
+		{
+			Name: "per stream",
+			Times: [][]time.Duration{
+				{0, 0, 0},
+				{0, 0, 0},
+				{time.Second, time.Second, time.Second},
+			},
+		},
+		{
+			Name:    "per message",
+			Options: []throttlegrpc.Option{throttlegrpc.WithPerMessage()},
+			Times: [][]time.Duration{
+				{0, 0, time.Second},
+				{time.Second, 2 * time.Second, 2 * time.Second},
+				{3 * time.Second, 3 * time.Second, 4 * time.Second},
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			limiter := throttle.New(2, throttle.WithClock(clock))
+			conn, _ := dial(t, clock, nil, grpc.WithStreamInterceptor(throttlegrpc.StreamClientInterceptor(limiter, useCase.Options...)))
+
+			var times [][]time.Duration
+
+			for range 3 {
+				arrivals, err := chat(context.Background(), conn, 3)
+
+				if err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+
+				times = append(times, arrivals)
+			}
+
+			if !reflect.DeepEqual(times, useCase.Times) {
+				t.Fatal(fmt.Sprintf("Expected the messages to arrive at %v, but got %v", useCase.Times, times))
+			}
+		})
+	}
+}
+
+func TestStreamClientInterceptor_Cancel(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Options []throttlegrpc.Option
+		// Messages is the number of messages sent before the call waits
+		Messages int
+	}{
+		{
+			Name: "per stream",
+		},
+		{
+			Name:     "per message",
+			Options:  []throttlegrpc.Option{throttlegrpc.WithPerMessage()},
+			Messages: 1,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			limiter := throttle.New(1, throttle.WithClock(clock))
+			conn, _ := dial(t, clock, nil, grpc.WithStreamInterceptor(throttlegrpc.StreamClientInterceptor(limiter, useCase.Options...)))
+
+			// the only slot of the window is taken
+			if useCase.Messages == 0 {
+				limiter.Acquire()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+
+			go func() {
+				times, err := chat(ctx, conn, useCase.Messages+1)
+
+				if len(times) != useCase.Messages {
+					err = fmt.Errorf("%d messages sent, expected %d: %w", len(times), useCase.Messages, err)
+				}
+
+				done <- err
+			}()
+
+			clock.BlockUntilSleepers(1)
+			cancel()
+
+			if err := <-done; status.Code(err) != codes.Canceled {
+				t.Fatal(fmt.Sprintf("Expected codes.Canceled, but got %v", err))
+			}
+		})
+	}
+}
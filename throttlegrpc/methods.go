@@ -0,0 +1,62 @@
+package throttlegrpc
+
+import (
+	"sync"
+
+	"github.com/ziflex/throttle"
+)
+
+type (
+	// methodThrottlers holds a throttler per listed method and one shared by the other methods, each created on its first call.
+	// The set of throttlers is fixed by the options, so that the method names of the calls, which the callers choose, don't make it grow,
+	// and the throttlers are looked up without locks nor allocations.
+	methodThrottlers struct {
+		listed   map[string]*lazyThrottler
+		unlisted *lazyThrottler
+	}
+
+	// lazyThrottler creates its throttler on the first call, nil if the limit is 0.
+	lazyThrottler struct {
+		once      sync.Once
+		limit     uint64
+		setters   []throttle.Option
+		throttler *throttle.Throttler
+	}
+)
+
+// WithMethodLimits makes the interceptors limit the calls per method as well, by the full name of the method, e.g. "/package.Service/Method",
+// keeping a throttler per listed method with its limit, and one with the default limit shared by the methods not listed, 0 meaning no limit.
+// The throttler options, e.g. WithWindow, apply to the throttlers of the methods. A call is admitted only if all the limits that apply to it admit it.
+func WithMethodLimits(limits map[string]uint64, defaultLimit uint64, setters ...throttle.Option) Option {
+	methods := &methodThrottlers{
+		listed:   make(map[string]*lazyThrottler, len(limits)),
+		unlisted: &lazyThrottler{limit: defaultLimit, setters: setters},
+	}
+
+	for method, limit := range limits {
+		methods.listed[method] = &lazyThrottler{limit: limit, setters: setters}
+	}
+
+	return func(opts *options) {
+		opts.methods = methods
+	}
+}
+
+// throttler returns the throttler of the method, nil if the method is not limited.
+func (m *methodThrottlers) throttler(method string) *throttle.Throttler {
+	if listed, found := m.listed[method]; found {
+		return listed.get()
+	}
+
+	return m.unlisted.get()
+}
+
+func (l *lazyThrottler) get() *throttle.Throttler {
+	l.once.Do(func() {
+		if l.limit > 0 {
+			l.throttler = throttle.New(l.limit, l.setters...)
+		}
+	})
+
+	return l.throttler
+}
@@ -0,0 +1,193 @@
+package throttlegrpc_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttlegrpc"
+	"github.com/ziflex/throttle/throttletest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestWithMethodLimits(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	limits := throttlegrpc.WithMethodLimits(map[string]uint64{"/throttle.Test/Search": 1}, 3, throttle.WithClock(clock))
+	conn, server := dial(t, clock, []grpc.ServerOption{
+		grpc.UnaryInterceptor(throttlegrpc.UnaryServerInterceptor(nil, limits)),
+	})
+
+	expected := make(map[string]int)
+
+	for window := range 3 {
+		var wg sync.WaitGroup
+
+		// the methods are called concurrently, each beyond its limit
+		for _, method := range []string{"Get", "Search"} {
+			for range 5 {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					err := conn.Invoke(context.Background(), "/throttle.Test/"+method, wrapperspb.String("hello"), &durationpb.Duration{})
+
+					if err != nil && status.Code(err) != codes.ResourceExhausted {
+						t.Error(fmt.Sprintf("Expected the call to succeed or fail with codes.ResourceExhausted, but got %s", err))
+					}
+				}()
+			}
+		}
+
+		wg.Wait()
+
+		expected["Get"] += 3
+		expected["Search"]++
+
+		server.mu.Lock()
+		actual := fmt.Sprint(server.calls)
+		server.mu.Unlock()
+
+		if actual != fmt.Sprint(expected) {
+			t.Fatal(fmt.Sprintf("Expected the calls %v to be handled by window #%d, but got %s", expected, window, actual))
+		}
+
+		clock.Advance(time.Second + time.Millisecond)
+	}
+}
+
+func TestWithMethodLimits_GlobalOverload(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](5, throttle.WithClock(clock), throttle.WithWindow(time.Minute))
+	opts := []throttlegrpc.Option{
+		throttlegrpc.WithKeys(keyed, throttlegrpc.KeyByMetadata("x-api-key")),
+		throttlegrpc.WithMethodLimits(map[string]uint64{"/throttle.Test/Search": 2}, 0, throttle.WithClock(clock), throttle.WithWindow(time.Minute)),
+	}
+	conn, _ := dial(t, clock, []grpc.ServerOption{
+		grpc.UnaryInterceptor(throttlegrpc.UnaryServerInterceptor(throttle.New(1, throttle.WithClock(clock)), opts...)),
+	})
+
+	search := func(key string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+
+		return conn.Invoke(ctx, "/throttle.Test/Search", wrapperspb.String("hello"), &durationpb.Duration{})
+	}
+
+	// the limiter is saturated for the rest of its window
+	if _, err := get(conn, "a"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	for i := range 3 {
+		if err := search("b"); status.Code(err) != codes.ResourceExhausted {
+			t.Fatal(fmt.Sprintf("Expected call #%d to fail with codes.ResourceExhausted, but got %v", i, err))
+		}
+	}
+
+	// the window of the limiter is over, while the ones of the method and of the keys go on
+	clock.Advance(time.Second + time.Millisecond)
+
+	if err := search("b"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected the method to have its quota, but got %s", err))
+	}
+
+	if actual := keyed.Get("b").Remaining(); actual != 4 {
+		t.Fatal(fmt.Sprintf("Expected 4 slots of the key to remain, but got %d", actual))
+	}
+}
+
+func TestWithMethodLimits_Unlimited(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	limits := throttlegrpc.WithMethodLimits(map[string]uint64{"/throttle.Test/Search": 1}, 0, throttle.WithClock(clock))
+	conn, server := dial(t, clock, []grpc.ServerOption{
+		grpc.UnaryInterceptor(throttlegrpc.UnaryServerInterceptor(nil, limits)),
+	})
+
+	for range 10 {
+		if err := conn.Invoke(context.Background(), "/throttle.Test/Get", wrapperspb.String("hello"), &durationpb.Duration{}); err != nil {
+			t.Fatal(fmt.Sprintf("Expected the unlisted method to be unlimited, but got %s", err))
+		}
+	}
+
+	if actual := server.served.Load(); actual != 10 {
+		t.Fatal(fmt.Sprintf("Expected 10 calls to be handled, but got %d", actual))
+	}
+}
+
+func TestWithMethodLimits_Client(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	limits := throttlegrpc.WithMethodLimits(map[string]uint64{"/throttle.Test/Chat": 1}, 0, throttle.WithClock(clock))
+	conn, _ := dial(t, clock, nil, grpc.WithStreamInterceptor(throttlegrpc.StreamClientInterceptor(nil, limits)))
+
+	var times []time.Duration
+
+	for range 3 {
+		arrivals, err := chat(context.Background(), conn, 1)
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		times = append(times, arrivals...)
+	}
+
+	expected := []time.Duration{0, time.Second, 2 * time.Second}
+
+	if !reflect.DeepEqual(times, expected) {
+		t.Fatal(fmt.Sprintf("Expected the streams to be opened at %v, but got %v", expected, times))
+	}
+}
+
+func TestWithMethodLimits_Allocations(t *testing.T) {
+	interceptor := throttlegrpc.UnaryServerInterceptor(nil, throttlegrpc.WithMethodLimits(map[string]uint64{"/throttle.Test/Search": 1}, 1<<40))
+	info := &grpc.UnaryServerInfo{FullMethod: "/throttle.Test/Get"}
+	handler := func(context.Context, any) (any, error) {
+		return nil, nil
+	}
+	ctx := context.Background()
+
+	// the throttler of the method is created by the first call
+	interceptor(ctx, nil, info, handler)
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		interceptor(ctx, nil, info, handler)
+	}); allocs != 0 {
+		t.Fatal(fmt.Sprintf("Expected no allocations, but got %f", allocs))
+	}
+}
+
+func TestWithMethodLimits_UnlistedShared(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	interceptor := throttlegrpc.UnaryServerInterceptor(nil, throttlegrpc.WithMethodLimits(map[string]uint64{"/throttle.Test/Search": 1}, 3, throttle.WithClock(clock)))
+	handler := func(context.Context, any) (any, error) {
+		return nil, nil
+	}
+
+	// the methods not listed, whatever their names, share the default limit
+	for i := range 5 {
+		info := &grpc.UnaryServerInfo{FullMethod: fmt.Sprintf("/throttle.Unknown/Method%d", i)}
+		_, err := interceptor(context.Background(), nil, info, handler)
+
+		if i < 3 && err != nil {
+			t.Fatal(fmt.Sprintf("Expected call #%d to succeed, but got %s", i, err))
+		}
+
+		if i >= 3 && status.Code(err) != codes.ResourceExhausted {
+			t.Fatal(fmt.Sprintf("Expected call #%d to fail with codes.ResourceExhausted, but got %v", i, err))
+		}
+	}
+
+	// the listed method keeps its own limit
+	if _, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/throttle.Test/Search"}, handler); err != nil {
+		t.Fatal(fmt.Sprintf("Expected the listed method to have its quota, but got %s", err))
+	}
+}
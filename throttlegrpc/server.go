@@ -0,0 +1,162 @@
+package throttlegrpc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPushbackKey is the trailer the rejected calls carry the time to retry after in, in milliseconds,
+// which the retry policy of the gRPC clients honors.
+const RetryPushbackKey = "grpc-retry-pushback-ms"
+
+type (
+	// KeyFunc returns the key of the call, e.g. the address of the client, see WithKeys.
+	KeyFunc func(ctx context.Context) string
+
+	// waitEstimator is a limiter that tells how long the rejected call should wait, as throttle.Throttler does.
+	waitEstimator interface {
+		EstimateWait(n uint64) time.Duration
+	}
+)
+
+// WithKeys makes the server interceptors limit the calls per key as well, each key taking a slot of its own throttler of the KeyedThrottler,
+// e.g. per client with KeyByPeer. A call is admitted only if both the limiter, unless it's nil, and the throttler of its key admit it.
+func WithKeys(keyed *throttle.KeyedThrottler[string], key KeyFunc) Option {
+	return func(opts *options) {
+		opts.keyed = keyed
+		opts.key = key
+	}
+}
+
+// KeyByPeer keys the calls by the IP address of the client, or the whole address if it has no port.
+func KeyByPeer(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	addr := p.Addr.String()
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// KeyByMetadata keys the calls by the first value of the metadata of the specified name, e.g. an API key, the empty string if there is none.
+func KeyByMetadata(name string) KeyFunc {
+	return func(ctx context.Context) string {
+		if values := metadata.ValueFromIncomingContext(ctx, name); len(values) > 0 {
+			return values[0]
+		}
+
+		return ""
+	}
+}
+
+// UnaryServerInterceptor creates a server interceptor admitting at most the calls the limiter does, rejecting the others right away
+// with codes.ResourceExhausted rather than queueing them. The rejected calls carry the time to retry after in the RetryPushbackKey trailer,
+// if the limiter tells it, as throttle.Throttler does. The limiter may be nil with WithKeys or WithMethodLimits.
+func UnaryServerInterceptor(limiter throttle.Limiter, setters ...Option) grpc.UnaryServerInterceptor {
+	opts := buildOptions(setters)
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if wait, ok := opts.admit(ctx, limiter, info.FullMethod); !ok {
+			grpc.SetTrailer(ctx, pushback(wait))
+
+			return nil, reject(wait)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor creates a server interceptor admitting at most the streams the limiter does, a slot per stream,
+// rejecting the others as UnaryServerInterceptor does.
+func StreamServerInterceptor(limiter throttle.Limiter, setters ...Option) grpc.StreamServerInterceptor {
+	opts := buildOptions(setters)
+
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if wait, ok := opts.admit(stream.Context(), limiter, info.FullMethod); !ok {
+			stream.SetTrailer(pushback(wait))
+
+			return reject(wait)
+		}
+
+		return handler(srv, stream)
+	}
+}
+
+// admit takes a slot of the throttler of the key of the call and of the one of its method, if any, and then of the limiter,
+// returning the estimated time to retry after, 0 if unknown, if any of them rejects the call.
+// The slots taken are given back if a later limit rejects the call, so the rejected calls don't use up the quotas of the key and of the method.
+func (o *options) admit(ctx context.Context, limiter throttle.Limiter, method string) (time.Duration, bool) {
+	var keyed, methodic throttle.Reservation
+
+	if o.keyed != nil {
+		key := o.key(ctx)
+		res, ok := o.keyed.TryReserve(key)
+
+		if !ok {
+			return o.keyed.Get(key).EstimateWait(1), false
+		}
+
+		keyed = res
+	}
+
+	if o.methods != nil {
+		if throttler := o.methods.throttler(method); throttler != nil {
+			res, ok := throttler.TryReserve()
+
+			if !ok {
+				keyed.Cancel()
+
+				return throttler.EstimateWait(1), false
+			}
+
+			methodic = res
+		}
+	}
+
+	if limiter != nil && !limiter.TryAcquire() {
+		methodic.Cancel()
+		keyed.Cancel()
+
+		var wait time.Duration
+
+		if estimator, ok := limiter.(waitEstimator); ok {
+			wait = estimator.EstimateWait(1)
+		}
+
+		return wait, false
+	}
+
+	return 0, true
+}
+
+// reject returns the status of the rejected call.
+func reject(wait time.Duration) error {
+	return status.Error(codes.ResourceExhausted, (&throttle.LimitError{RetryAfter: wait}).Error())
+}
+
+// pushback returns the trailer of the time to retry after, rounded up to milliseconds, none if it's unknown.
+func pushback(wait time.Duration) metadata.MD {
+	if wait <= 0 {
+		return nil
+	}
+
+	ms := (wait + time.Millisecond - 1) / time.Millisecond
+
+	return metadata.Pairs(RetryPushbackKey, strconv.FormatInt(int64(ms), 10))
+}
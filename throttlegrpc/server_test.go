@@ -0,0 +1,238 @@
+package throttlegrpc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttlegrpc"
+	"github.com/ziflex/throttle/throttletest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// get calls the unary method with the key in the metadata, returning the trailer of the call.
+func get(conn *grpc.ClientConn, key string) (metadata.MD, error) {
+	var trailer metadata.MD
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+	err := conn.Invoke(ctx, "/throttle.Test/Get", wrapperspb.String("hello"), &durationpb.Duration{}, grpc.Trailer(&trailer))
+
+	return trailer, err
+}
+
+// open opens a stream and waits for it to be handled, returning its trailer.
+func open(conn *grpc.ClientConn, key string) (metadata.MD, error) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+	stream, err := conn.NewStream(ctx, &chatDesc, "/throttle.Test/Chat")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stream.SendMsg(wrapperspb.String("hello")); err != nil {
+		return nil, err
+	}
+
+	if err := stream.RecvMsg(&durationpb.Duration{}); err != nil {
+		return stream.Trailer(), err
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	// the end of the stream
+	if err := stream.RecvMsg(&durationpb.Duration{}); !errors.Is(err, io.EOF) {
+		return stream.Trailer(), err
+	}
+
+	return stream.Trailer(), nil
+}
+
+func TestServerInterceptors(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Call    func(conn *grpc.ClientConn, key string) (metadata.MD, error)
+		Limiter func(clock *throttletest.ManualClock) throttle.Limiter
+		Options func(clock *throttletest.ManualClock) []throttlegrpc.Option
+		Keys    []string
+		// Admitted tells whether the call of the same index is admitted
+		Admitted []bool
+	}{
+		{
+			Name: "unary",
+			Call: get,
+			Limiter: func(clock *throttletest.ManualClock) throttle.Limiter {
+				return throttle.New(2, throttle.WithClock(clock))
+			},
+			Keys:     []string{"a", "a", "a", "b"},
+			Admitted: []bool{true, true, false, false},
+		},
+		{
+			Name: "stream",
+			Call: open,
+			Limiter: func(clock *throttletest.ManualClock) throttle.Limiter {
+				return throttle.New(2, throttle.WithClock(clock))
+			},
+			Keys:     []string{"a", "a", "a", "b"},
+			Admitted: []bool{true, true, false, false},
+		},
+		{
+			Name: "unary per key",
+			Call: get,
+			Options: func(clock *throttletest.ManualClock) []throttlegrpc.Option {
+				keyed := throttle.NewKeyed[string](2, throttle.WithClock(clock))
+
+				return []throttlegrpc.Option{throttlegrpc.WithKeys(keyed, throttlegrpc.KeyByMetadata("x-api-key"))}
+			},
+			Keys:     []string{"a", "a", "a", "b"},
+			Admitted: []bool{true, true, false, true},
+		},
+		{
+			Name: "stream per key",
+			Call: open,
+			Options: func(clock *throttletest.ManualClock) []throttlegrpc.Option {
+				keyed := throttle.NewKeyed[string](2, throttle.WithClock(clock))
+
+				return []throttlegrpc.Option{throttlegrpc.WithKeys(keyed, throttlegrpc.KeyByMetadata("x-api-key"))}
+			},
+			Keys:     []string{"a", "a", "a", "b"},
+			Admitted: []bool{true, true, false, true},
+		},
+		{
+			Name: "both limits",
+			Call: get,
+			Limiter: func(clock *throttletest.ManualClock) throttle.Limiter {
+				return throttle.New(3, throttle.WithClock(clock))
+			},
+			Options: func(clock *throttletest.ManualClock) []throttlegrpc.Option {
+				keyed := throttle.NewKeyed[string](2, throttle.WithClock(clock))
+
+				return []throttlegrpc.Option{throttlegrpc.WithKeys(keyed, throttlegrpc.KeyByMetadata("x-api-key"))}
+			},
+			Keys:     []string{"a", "a", "a", "b", "c"},
+			Admitted: []bool{true, true, false, true, false},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+
+			var (
+				limiter throttle.Limiter
+				opts    []throttlegrpc.Option
+			)
+
+			if useCase.Limiter != nil {
+				limiter = useCase.Limiter(clock)
+			}
+
+			if useCase.Options != nil {
+				opts = useCase.Options(clock)
+			}
+
+			conn, server := dial(t, clock, []grpc.ServerOption{
+				grpc.UnaryInterceptor(throttlegrpc.UnaryServerInterceptor(limiter, opts...)),
+				grpc.StreamInterceptor(throttlegrpc.StreamServerInterceptor(limiter, opts...)),
+			})
+
+			var admitted int64
+
+			// the same calls are made in 2 windows, the limits being restored in the second one
+			for window := range 2 {
+				for i, key := range useCase.Keys {
+					trailer, err := useCase.Call(conn, key)
+
+					if !useCase.Admitted[i] {
+						if status.Code(err) != codes.ResourceExhausted {
+							t.Fatal(fmt.Sprintf("Expected call #%d of window #%d to fail with codes.ResourceExhausted, but got %v", i, window, err))
+						}
+
+						if actual := trailer.Get(throttlegrpc.RetryPushbackKey); len(actual) != 1 || actual[0] != "1000" {
+							t.Fatal(fmt.Sprintf("Expected call #%d of window #%d to hint at 1000 ms, but got %v", i, window, actual))
+						}
+
+						continue
+					}
+
+					if err != nil {
+						t.Fatal(fmt.Sprintf("Expected call #%d of window #%d to succeed, but got %s", i, window, err))
+					}
+
+					admitted++
+				}
+
+				if actual := server.served.Load(); actual != admitted {
+					t.Fatal(fmt.Sprintf("Expected %d calls to be handled, but got %d", admitted, actual))
+				}
+
+				// past the end of the window, which includes its last instant
+				clock.Advance(time.Second + time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestServerInterceptors_GlobalOverload(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](3, throttle.WithClock(clock))
+	limiter := throttle.New(1, throttle.WithClock(clock))
+	opts := []throttlegrpc.Option{throttlegrpc.WithKeys(keyed, throttlegrpc.KeyByMetadata("x-api-key"))}
+	conn, _ := dial(t, clock, []grpc.ServerOption{
+		grpc.UnaryInterceptor(throttlegrpc.UnaryServerInterceptor(limiter, opts...)),
+		grpc.StreamInterceptor(throttlegrpc.StreamServerInterceptor(limiter, opts...)),
+	})
+
+	if _, err := get(conn, "a"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// the limiter is saturated, so the calls are rejected whatever their keys
+	for i, call := range []func(conn *grpc.ClientConn, key string) (metadata.MD, error){get, open, get, open} {
+		for _, key := range []string{"a", "b"} {
+			if _, err := call(conn, key); status.Code(err) != codes.ResourceExhausted {
+				t.Fatal(fmt.Sprintf("Expected call #%d of %s to fail with codes.ResourceExhausted, but got %v", i, key, err))
+			}
+		}
+	}
+
+	// the rejected calls haven't used up the quotas of the keys
+	expected := map[string]uint64{"a": 2, "b": 3}
+
+	for key, remaining := range expected {
+		if actual := keyed.Get(key).Remaining(); actual != remaining {
+			t.Fatal(fmt.Sprintf("Expected %d slots of %s to remain, but got %d", remaining, key, actual))
+		}
+	}
+}
+
+func TestKeyByPeer(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	keyed := throttle.NewKeyed[string](1, throttle.WithClock(clock))
+	conn, _ := dial(t, clock, []grpc.ServerOption{
+		grpc.UnaryInterceptor(throttlegrpc.UnaryServerInterceptor(nil, throttlegrpc.WithKeys(keyed, throttlegrpc.KeyByPeer))),
+	})
+
+	if _, err := get(conn, "a"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// the in-memory connections share a single address
+	if _, err := get(conn, "b"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatal(fmt.Sprintf("Expected codes.ResourceExhausted, but got %v", err))
+	}
+
+	if keyed.Len() != 1 {
+		t.Fatal(fmt.Sprintf("Expected a single key, but got %d", keyed.Len()))
+	}
+}
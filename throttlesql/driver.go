@@ -0,0 +1,480 @@
+// Package throttlesql provides a database/sql driver limiting the statements per window, wrapping any other driver.
+// It lives in a separate module, as the other adapters do.
+package throttlesql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/ziflex/throttle"
+)
+
+type (
+	// Option configures the driver.
+	Option func(opts *options)
+
+	// options holds configuration settings for the driver.
+	options struct {
+		beginOnly bool
+	}
+
+	// throttledDriver wraps the connections of the underlying driver.
+	throttledDriver struct {
+		driver  driver.Driver
+		limiter throttle.Limiter
+		opts    *options
+	}
+
+	// throttledConnector wraps the connections of the underlying connector.
+	throttledConnector struct {
+		connector driver.Connector
+		driver    *throttledDriver
+	}
+
+	// throttledConn takes a slot of the limiter per statement before passing it to the underlying connection.
+	// It implements all the optional interfaces of the connections, falling back to what database/sql does
+	// when the underlying connection doesn't implement them.
+	throttledConn struct {
+		conn   driver.Conn
+		driver *throttledDriver
+		// inTx reports whether a transaction is in progress, whose statements don't take slots with WithBeginOnly.
+		// A connection is used by a single goroutine at a time.
+		inTx bool
+	}
+
+	// throttledStmt takes a slot of the limiter per execution of the underlying statement.
+	throttledStmt struct {
+		stmt driver.Stmt
+		conn *throttledConn
+	}
+
+	// converterStmt is a throttledStmt whose underlying statement implements driver.ColumnConverter,
+	// which database/sql treats differently from the statements that don't.
+	converterStmt struct {
+		*throttledStmt
+	}
+
+	// throttledTx ends the transaction of the connection.
+	throttledTx struct {
+		tx   driver.Tx
+		conn *throttledConn
+	}
+)
+
+// registered is the number of drivers registered by Wrap, which makes their names unique.
+var registered atomic.Uint64
+
+// WithBeginOnly makes a transaction take a single slot, when it begins, rather than a slot per statement.
+func WithBeginOnly() Option {
+	return func(opts *options) {
+		opts.beginOnly = true
+	}
+}
+
+// Wrap registers a driver that limits the statements of the driver registered under the specified name to what the limiter admits,
+// and returns the name to pass to sql.Open. Every query, exec and prepare takes a slot, waiting for it until the context is done,
+// as does every execution of a prepared statement. The name is unique, so the same driver can be wrapped several times.
+func Wrap(driverName string, limiter throttle.Limiter, setters ...Option) (string, error) {
+	db, err := sql.Open(driverName, "")
+
+	if err != nil {
+		return "", err
+	}
+
+	defer db.Close()
+
+	name := fmt.Sprintf("throttle-%s-%d", driverName, registered.Add(1))
+	sql.Register(name, WrapDriver(db.Driver(), limiter, setters...))
+
+	return name, nil
+}
+
+// WrapDriver wraps the driver as Wrap does, without registering it, e.g. for sql.OpenDB along with WrapConnector.
+func WrapDriver(d driver.Driver, limiter throttle.Limiter, setters ...Option) driver.Driver {
+	opts := &options{}
+
+	for _, setter := range setters {
+		setter(opts)
+	}
+
+	return &throttledDriver{driver: d, limiter: limiter, opts: opts}
+}
+
+// WrapConnector wraps the connector as Wrap does the drivers, for sql.OpenDB.
+func WrapConnector(connector driver.Connector, limiter throttle.Limiter, setters ...Option) driver.Connector {
+	return &throttledConnector{
+		connector: connector,
+		driver:    WrapDriver(connector.Driver(), limiter, setters...).(*throttledDriver),
+	}
+}
+
+// Open opens a connection of the underlying driver.
+func (d *throttledDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttledConn{conn: conn, driver: d}, nil
+}
+
+// OpenConnector opens a connector of the underlying driver, or of the name if the driver doesn't implement driver.DriverContext.
+func (d *throttledDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.driver.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &throttledConnector{connector: connector, driver: d}, nil
+	}
+
+	return &throttledConnector{connector: &nameConnector{name: name, driver: d.driver}, driver: d}, nil
+}
+
+// Connect opens a connection of the underlying connector.
+func (c *throttledConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttledConn{conn: conn, driver: c.driver}, nil
+}
+
+// Driver returns the throttled driver.
+func (c *throttledConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close closes the underlying connector, if it implements io.Closer, which sql.DB.Close calls.
+func (c *throttledConnector) Close() error {
+	if closer, ok := c.connector.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// nameConnector opens the connections of the driver by name, as database/sql does for the drivers that don't implement driver.DriverContext.
+type nameConnector struct {
+	name   string
+	driver driver.Driver
+}
+
+func (c *nameConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.name)
+}
+
+func (c *nameConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// acquire waits for a slot of the limiter, unless the statement belongs to a transaction that has taken its slot already.
+func (c *throttledConn) acquire(ctx context.Context) error {
+	if c.inTx && c.driver.opts.beginOnly {
+		return nil
+	}
+
+	return c.driver.limiter.AcquireContext(ctx)
+}
+
+// Prepare prepares the statement once the limiter admits it.
+func (c *throttledConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext prepares the statement once the limiter admits it.
+func (c *throttledConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+
+	if prep, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = prep.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	paced := &throttledStmt{stmt: stmt, conn: c}
+
+	if _, ok := stmt.(driver.ColumnConverter); ok {
+		return &converterStmt{paced}, nil
+	}
+
+	return paced, nil
+}
+
+// ExecContext executes the statement once the limiter admits it,
+// or returns driver.ErrSkip if the underlying connection can't, so that database/sql prepares it.
+func (c *throttledConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	switch conn := c.conn.(type) {
+	case driver.ExecerContext:
+		if err := c.acquire(ctx); err != nil {
+			return nil, err
+		}
+
+		return conn.ExecContext(ctx, query, args)
+	case driver.Execer:
+		values, err := namedValuesToValues(args)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.acquire(ctx); err != nil {
+			return nil, err
+		}
+
+		return conn.Exec(query, values)
+	}
+
+	return nil, driver.ErrSkip
+}
+
+// QueryContext runs the query once the limiter admits it,
+// or returns driver.ErrSkip if the underlying connection can't, so that database/sql prepares it.
+func (c *throttledConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	switch conn := c.conn.(type) {
+	case driver.QueryerContext:
+		if err := c.acquire(ctx); err != nil {
+			return nil, err
+		}
+
+		return conn.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		values, err := namedValuesToValues(args)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.acquire(ctx); err != nil {
+			return nil, err
+		}
+
+		return conn.Query(query, values)
+	}
+
+	return nil, driver.ErrSkip
+}
+
+// Begin begins a transaction, see BeginTx.
+func (c *throttledConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx begins a transaction, once the limiter admits it with WithBeginOnly. The options the connection doesn't support
+// are turned down before the slot is taken, while a transaction the database fails to begin keeps it, as the failed statements do.
+func (c *throttledConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	begin, ok := c.conn.(driver.ConnBeginTx)
+
+	// the checks of database/sql for the drivers that don't implement driver.ConnBeginTx,
+	// made before the slot is taken, so the transactions turned down don't take it
+	if !ok {
+		switch {
+		case opts.Isolation != driver.IsolationLevel(sql.LevelDefault):
+			return nil, errors.New("sql: driver does not support non-default isolation level")
+		case opts.ReadOnly:
+			return nil, errors.New("sql: driver does not support read-only transactions")
+		}
+	}
+
+	if c.driver.opts.beginOnly {
+		if err := c.driver.limiter.AcquireContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		tx  driver.Tx
+		err error
+	)
+
+	if ok {
+		tx, err = begin.BeginTx(ctx, opts)
+	} else {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		tx, err = c.conn.Begin()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.inTx = true
+
+	return &throttledTx{tx: tx, conn: c}, nil
+}
+
+// Close closes the underlying connection.
+func (c *throttledConn) Close() error {
+	return c.conn.Close()
+}
+
+// Ping pings the underlying connection, if it implements driver.Pinger.
+func (c *throttledConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+// ResetSession resets the session of the underlying connection, if it implements driver.SessionResetter.
+func (c *throttledConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+// IsValid reports whether the underlying connection is valid, if it implements driver.Validator, or true otherwise.
+func (c *throttledConn) IsValid() bool {
+	if validator, ok := c.conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+
+	return true
+}
+
+// CheckNamedValue checks the argument with the underlying connection, if it implements driver.NamedValueChecker,
+// or returns driver.ErrSkip otherwise, so that database/sql converts it by default.
+func (c *throttledConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+
+	return driver.ErrSkip
+}
+
+// Close closes the underlying statement.
+func (s *throttledStmt) Close() error {
+	return s.stmt.Close()
+}
+
+// NumInput returns the number of arguments of the underlying statement.
+func (s *throttledStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+// Exec executes the statement, see ExecContext.
+func (s *throttledStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.conn.acquire(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return s.stmt.Exec(args)
+}
+
+// Query runs the query, see QueryContext.
+func (s *throttledStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.conn.acquire(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return s.stmt.Query(args)
+}
+
+// ExecContext executes the statement once the limiter admits it.
+func (s *throttledStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.conn.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	if stmt, ok := s.stmt.(driver.StmtExecContext); ok {
+		return stmt.ExecContext(ctx, args)
+	}
+
+	values, err := namedValuesToValues(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.stmt.Exec(values)
+}
+
+// QueryContext runs the query once the limiter admits it.
+func (s *throttledStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.conn.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	if stmt, ok := s.stmt.(driver.StmtQueryContext); ok {
+		return stmt.QueryContext(ctx, args)
+	}
+
+	values, err := namedValuesToValues(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.stmt.Query(values)
+}
+
+// CheckNamedValue checks the argument with the underlying statement, if it implements driver.NamedValueChecker,
+// or with the connection otherwise.
+func (s *throttledStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+
+	return s.conn.CheckNamedValue(value)
+}
+
+// ColumnConverter returns the converter of the argument of the underlying statement.
+func (s *converterStmt) ColumnConverter(idx int) driver.ValueConverter {
+	return s.stmt.(driver.ColumnConverter).ColumnConverter(idx)
+}
+
+// Commit commits the transaction.
+func (t *throttledTx) Commit() error {
+	t.conn.inTx = false
+
+	return t.tx.Commit()
+}
+
+// Rollback rolls the transaction back.
+func (t *throttledTx) Rollback() error {
+	t.conn.inTx = false
+
+	return t.tx.Rollback()
+}
+
+// namedValuesToValues converts the arguments for the former interfaces, which don't support the named ones, as database/sql does.
+func namedValuesToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+
+	for i, arg := range named {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+
+		values[i] = arg.Value
+	}
+
+	return values, nil
+}
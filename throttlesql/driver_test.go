@@ -0,0 +1,476 @@
+package throttlesql_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttlesql"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+var (
+	epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	// drivers numbers the fake drivers, registered under unique names
+	drivers atomic.Int64
+)
+
+type (
+	// recorder records the statements the fake connections run along with the time.
+	recorder struct {
+		clock *throttletest.ManualClock
+		mu    sync.Mutex
+		stmts []string
+		times []time.Duration
+	}
+
+	// fakeDriver opens the fake connections of the recorder.
+	fakeDriver struct {
+		recorder *recorder
+		// legacy makes the connections implement the required methods only
+		legacy bool
+		// closed reports whether the driver has been closed as a connector
+		closed atomic.Bool
+	}
+
+	// fakeConn is a connection implementing the optional interfaces.
+	fakeConn struct {
+		recorder *recorder
+	}
+
+	// legacyConn hides the optional interfaces of the connection.
+	legacyConn struct {
+		driver.Conn
+	}
+
+	fakeStmt struct {
+		conn  *fakeConn
+		query string
+	}
+
+	fakeTx struct {
+		conn *fakeConn
+	}
+
+	// fakeRows is a single row of a single text column.
+	fakeRows struct {
+		done bool
+	}
+
+	// point is an argument type only the fake connections accept.
+	point struct {
+		X, Y int
+	}
+)
+
+func newRecorder(clock *throttletest.ManualClock) *recorder {
+	return &recorder{clock: clock}
+}
+
+func (r *recorder) record(stmt string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stmts = append(r.stmts, stmt)
+	r.times = append(r.times, r.clock.Now().Sub(epoch))
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	conn := &fakeConn{recorder: d.recorder}
+
+	if d.legacy {
+		return &legacyConn{conn}, nil
+	}
+
+	return conn, nil
+}
+
+func (d *fakeDriver) Connect(context.Context) (driver.Conn, error) {
+	return d.Open("")
+}
+
+func (d *fakeDriver) Driver() driver.Driver {
+	return d
+}
+
+func (d *fakeDriver) Close() error {
+	d.closed.Store(true)
+
+	return nil
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.recorder.record("prepare " + query)
+
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.recorder.record("begin")
+
+	return &fakeTx{conn: c}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.recorder.record(query)
+
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.recorder.record(query)
+
+	return &fakeRows{}, nil
+}
+
+func (c *fakeConn) CheckNamedValue(value *driver.NamedValue) error {
+	if p, ok := value.Value.(point); ok {
+		value.Value = fmt.Sprintf("(%d,%d)", p.X, p.Y)
+
+		return nil
+	}
+
+	return driver.ErrSkip
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.conn.recorder.record(s.query)
+
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.conn.recorder.record(s.query)
+
+	return &fakeRows{}, nil
+}
+
+func (t *fakeTx) Commit() error {
+	t.conn.recorder.record("commit")
+
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.conn.recorder.record("rollback")
+
+	return nil
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"name"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+
+	r.done = true
+	dest[0] = "value"
+
+	return nil
+}
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(int) string {
+	return "TEXT"
+}
+
+// open opens a database of the fake driver limited by the limiter.
+func open(t *testing.T, fake *fakeDriver, limiter throttle.Limiter, setters ...throttlesql.Option) *sql.DB {
+	db := sql.OpenDB(throttlesql.WrapConnector(fake, limiter, setters...))
+	db.SetMaxOpenConns(1)
+
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return db
+}
+
+func TestWrap(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	rec := newRecorder(clock)
+	fake := fmt.Sprintf("fake-%d", drivers.Add(1))
+	sql.Register(fake, &fakeDriver{recorder: rec})
+
+	name, err := throttlesql.Wrap(fake, throttle.New(2, throttle.WithClock(clock)))
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	db, err := sql.Open(name, "")
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	defer db.Close()
+
+	for i := range 5 {
+		if _, err := db.Exec(fmt.Sprintf("exec %d", i)); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	expected := []time.Duration{0, 0, time.Second, time.Second, 2 * time.Second}
+
+	if !reflect.DeepEqual(rec.times, expected) {
+		t.Fatal(fmt.Sprintf("Expected the statements at %v, but got %v", expected, rec.times))
+	}
+
+	if _, err := throttlesql.Wrap("unknown", throttle.New(1)); err == nil {
+		t.Fatal("Expected an unknown driver to fail")
+	}
+}
+
+func TestWrapConnector(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Legacy  bool
+		Options []throttlesql.Option
+		Run     func(db *sql.DB) error
+		Stmts   []string
+		Times   []time.Duration
+	}{
+		{
+			Name: "statements",
+			Run: func(db *sql.DB) error {
+				if _, err := db.Exec("exec"); err != nil {
+					return err
+				}
+
+				rows, err := db.Query("query")
+
+				if err != nil {
+					return err
+				}
+
+				return rows.Close()
+			},
+			Stmts: []string{"exec", "query"},
+			Times: []time.Duration{0, time.Second},
+		},
+		{
+			Name: "prepared statements",
+			Run: func(db *sql.DB) error {
+				stmt, err := db.Prepare("stmt")
+
+				if err != nil {
+					return err
+				}
+
+				defer stmt.Close()
+
+				for range 2 {
+					if _, err := stmt.Exec(); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			},
+			Stmts: []string{"prepare stmt", "stmt", "stmt"},
+			Times: []time.Duration{0, time.Second, 2 * time.Second},
+		},
+		{
+			Name:   "connections without exec",
+			Legacy: true,
+			Run: func(db *sql.DB) error {
+				_, err := db.Exec("exec")
+
+				return err
+			},
+			// the statement is prepared, then executed
+			Stmts: []string{"prepare exec", "exec"},
+			Times: []time.Duration{0, time.Second},
+		},
+		{
+			Name: "transaction",
+			Run: func(db *sql.DB) error {
+				tx, err := db.Begin()
+
+				if err != nil {
+					return err
+				}
+
+				for range 2 {
+					if _, err := tx.Exec("exec"); err != nil {
+						return err
+					}
+				}
+
+				return tx.Commit()
+			},
+			Stmts: []string{"begin", "exec", "exec", "commit"},
+			Times: []time.Duration{0, 0, time.Second, time.Second},
+		},
+		{
+			Name:    "transactions taking a single slot",
+			Options: []throttlesql.Option{throttlesql.WithBeginOnly()},
+			Run: func(db *sql.DB) error {
+				for range 2 {
+					tx, err := db.Begin()
+
+					if err != nil {
+						return err
+					}
+
+					for range 2 {
+						if _, err := tx.Exec("exec"); err != nil {
+							return err
+						}
+					}
+
+					if err := tx.Rollback(); err != nil {
+						return err
+					}
+				}
+
+				// the statements out of the transactions take slots
+				_, err := db.Exec("exec")
+
+				return err
+			},
+			Stmts: []string{"begin", "exec", "exec", "rollback", "begin", "exec", "exec", "rollback", "exec"},
+			Times: []time.Duration{0, 0, 0, 0, time.Second, time.Second, time.Second, time.Second, 2 * time.Second},
+		},
+		{
+			Name:    "transactions turned down taking no slots",
+			Legacy:  true,
+			Options: []throttlesql.Option{throttlesql.WithBeginOnly()},
+			Run: func(db *sql.DB) error {
+				// the connection doesn't support read-only transactions
+				if _, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true}); err == nil {
+					return errors.New("expected the read-only transaction to be turned down")
+				}
+
+				tx, err := db.Begin()
+
+				if err != nil {
+					return err
+				}
+
+				return tx.Rollback()
+			},
+			Stmts: []string{"begin", "rollback"},
+			Times: []time.Duration{0, 0},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			rec := newRecorder(clock)
+			db := open(t, &fakeDriver{recorder: rec, legacy: useCase.Legacy}, throttle.New(1, throttle.WithClock(clock)), useCase.Options...)
+
+			if err := useCase.Run(db); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if !reflect.DeepEqual(rec.stmts, useCase.Stmts) {
+				t.Fatal(fmt.Sprintf("Expected the statements %q, but got %q", useCase.Stmts, rec.stmts))
+			}
+
+			if !reflect.DeepEqual(rec.times, useCase.Times) {
+				t.Fatal(fmt.Sprintf("Expected the statements at %v, but got %v", useCase.Times, rec.times))
+			}
+		})
+	}
+}
+
+func TestWrapConnector_Passthrough(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	db := open(t, &fakeDriver{recorder: newRecorder(clock)}, throttle.New(0))
+
+	// only the connection knows how to convert the argument
+	rows, err := db.Query("query", point{X: 1, Y: 2})
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected the argument to be checked by the connection, but got %s", err))
+	}
+
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := types[0].DatabaseTypeName(); actual != "TEXT" {
+		t.Fatal(fmt.Sprintf("Expected the type of the column to be TEXT, but got %q", actual))
+	}
+}
+
+func TestWrapConnector_Close(t *testing.T) {
+	fake := &fakeDriver{recorder: newRecorder(throttletest.NewManualClock(epoch))}
+	db := sql.OpenDB(throttlesql.WrapConnector(fake, throttle.New(0)))
+
+	if err := db.Ping(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if !fake.closed.Load() {
+		t.Fatal("Expected the underlying connector to be closed along with the database")
+	}
+}
+
+func TestWrapConnector_Cancel(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	rec := newRecorder(clock)
+	db := open(t, &fakeDriver{recorder: rec}, throttle.New(1, throttle.WithClock(clock)))
+
+	if _, err := db.Exec("first"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := db.ExecContext(ctx, "second")
+		done <- err
+	}()
+
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	if expected := []string{"first"}; !reflect.DeepEqual(rec.stmts, expected) {
+		t.Fatal(fmt.Sprintf("Expected the statements %q, but got %q", expected, rec.stmts))
+	}
+}
@@ -0,0 +1,7 @@
+module github.com/ziflex/throttle/throttlesql
+
+go 1.25.0
+
+replace github.com/ziflex/throttle => ../
+
+require github.com/ziflex/throttle v0.0.0
@@ -0,0 +1,111 @@
+package throttletest
+
+import (
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+)
+
+const mutexWaitMetric = "/sync/mutex/wait/total:seconds"
+
+// Workload describes the load a benchmark puts on a limiter.
+type Workload struct {
+	// Workers is the number of goroutines calling the limiter concurrently. Zero means one.
+	Workers int
+	// TryEvery makes every n-th call of a worker use TryAcquire instead of Acquire. Zero means never.
+	// A worker whose TryAcquire fails backs off for a tenth of a second of virtual time.
+	TryEvery int
+}
+
+// Benchmark runs b.N calls of the workload against the limiter created by the factory, driven by a manual clock.
+// The virtual time is advanced to the next deadline every time all the workers are parked, so the results
+// reflect the cost of the limiter itself rather than of waiting.
+// Besides allocations, it reports admissions per simulated second and the time spent waiting for mutexes per call.
+func Benchmark(b *testing.B, factory func(clock throttle.Clock) throttle.Limiter, workload Workload) {
+	workers := max(workload.Workers, 1)
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	limiter := factory(clock)
+
+	var (
+		admitted atomic.Int64
+		active   atomic.Int64
+		wg       sync.WaitGroup
+	)
+
+	active.Store(int64(workers))
+	wg.Add(workers)
+
+	samples := []metrics.Sample{{Name: mutexWaitMetric}}
+	metrics.Read(samples)
+	mutexWait := mutexWaitSeconds(samples[0])
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for w := range workers {
+		calls := b.N / workers
+
+		if w < b.N%workers {
+			calls++
+		}
+
+		go func() {
+			defer wg.Done()
+			defer active.Add(-1)
+
+			for i := 1; i <= calls; i++ {
+				if workload.TryEvery > 0 && i%workload.TryEvery == 0 {
+					if !limiter.TryAcquire() {
+						clock.Sleep(time.Millisecond * 100)
+
+						continue
+					}
+				} else {
+					limiter.Acquire()
+				}
+
+				admitted.Add(1)
+			}
+		}()
+	}
+
+	for {
+		left := active.Load()
+
+		if left == 0 {
+			break
+		}
+
+		if int64(clock.Sleepers()) == left {
+			clock.AdvanceToNext()
+		} else {
+			runtime.Gosched()
+		}
+	}
+
+	wg.Wait()
+	b.StopTimer()
+
+	metrics.Read(samples)
+	mutexWait = mutexWaitSeconds(samples[0]) - mutexWait
+
+	if elapsed := clock.Now().Sub(start); elapsed > 0 {
+		b.ReportMetric(float64(admitted.Load())/elapsed.Seconds(), "admissions/vsec")
+	}
+
+	b.ReportMetric(mutexWait*float64(time.Second)/float64(b.N), "mutex-wait-ns/op")
+}
+
+func mutexWaitSeconds(sample metrics.Sample) float64 {
+	if sample.Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+
+	return sample.Value.Float64()
+}
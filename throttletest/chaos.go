@@ -0,0 +1,102 @@
+package throttletest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ziflex/throttle"
+)
+
+var _ throttle.TimerClock = (*ChaosClock)(nil)
+
+type (
+	// ChaosOptions configures the perturbations of ChaosClock.
+	ChaosOptions struct {
+		// MaxOvershoot is the upper bound of the random duration added to every Sleep and After.
+		// Sleeps never return early, as a real clock wouldn't either.
+		MaxOvershoot time.Duration
+		// MaxNowIncrement is the upper bound of the random duration Now moves forward by on every call,
+		// as if the caller has been descheduled right before reading the time.
+		MaxNowIncrement time.Duration
+		// Seed seeds the source of randomness, so that a run can be reproduced.
+		Seed int64
+	}
+
+	// ChaosClock is a throttle.Clock decorator that makes sleeps overshoot and Now read slightly late.
+	// The time it reports never goes backwards. It is safe for concurrent use.
+	ChaosClock struct {
+		mu     sync.Mutex
+		inner  throttle.Clock
+		opts   ChaosOptions
+		rand   *rand.Rand
+		offset time.Duration
+		last   time.Time
+	}
+)
+
+// WithChaos wraps the clock into a ChaosClock.
+func WithChaos(inner throttle.Clock, opts ChaosOptions) *ChaosClock {
+	return &ChaosClock{
+		inner: inner,
+		opts:  opts,
+		rand:  rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+// Now returns the time of the wrapped clock, moved forward by the accumulated increments.
+func (c *ChaosClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offset += c.random(c.opts.MaxNowIncrement)
+
+	now := c.inner.Now().Add(c.offset)
+
+	if now.Before(c.last) {
+		now = c.last
+	}
+
+	c.last = now
+
+	return now
+}
+
+// Sleep waits using the wrapped clock for the duration plus a random overshoot.
+func (c *ChaosClock) Sleep(dur time.Duration) {
+	c.inner.Sleep(c.overshoot(dur))
+}
+
+// After returns a timer of the wrapped clock for the duration plus a random overshoot.
+func (c *ChaosClock) After(dur time.Duration) <-chan time.Time {
+	dur = c.overshoot(dur)
+
+	if tc, ok := c.inner.(throttle.TimerClock); ok {
+		return tc.After(dur)
+	}
+
+	ch := make(chan time.Time, 1)
+
+	go func() {
+		c.inner.Sleep(dur)
+		ch <- c.Now()
+	}()
+
+	return ch
+}
+
+func (c *ChaosClock) overshoot(dur time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return dur + c.random(c.opts.MaxOvershoot)
+}
+
+// random returns a random duration in the range [0, max]. The caller must hold the lock.
+func (c *ChaosClock) random(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(c.rand.Int63n(int64(max) + 1))
+}
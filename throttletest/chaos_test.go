@@ -0,0 +1,72 @@
+package throttletest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestChaosClock_Bounds(t *testing.T) {
+	inner := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+	clock := throttletest.WithChaos(inner, throttletest.ChaosOptions{
+		MaxOvershoot:    time.Millisecond * 10,
+		MaxNowIncrement: time.Microsecond * 100,
+		Seed:            1,
+	})
+
+	last := clock.Now()
+
+	for range 1000 {
+		clock.Sleep(time.Millisecond)
+
+		now := clock.Now()
+
+		if now.Before(last) {
+			t.Fatal(fmt.Sprintf("Expected the time not to go backwards, but got %s after %s", now, last))
+		}
+
+		last = now
+	}
+
+	for i, actual := range inner.SleepCalls() {
+		if actual < time.Millisecond || actual > time.Millisecond*11 {
+			t.Fatal(fmt.Sprintf("Expected sleep #%d to be within [1ms, 11ms], but got %s", i, actual))
+		}
+	}
+
+	// 1000 sleeps with overshoots and 1001 increments of Now
+	if elapsed := last.Sub(epoch); elapsed < time.Second || elapsed > time.Second*11+time.Microsecond*100100 {
+		t.Fatal(fmt.Sprintf("Expected the elapsed time to be bounded, but got %s", elapsed))
+	}
+}
+
+func TestChaosClock_Reproducible(t *testing.T) {
+	run := func() []time.Duration {
+		inner := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+		clock := throttletest.WithChaos(inner, throttletest.ChaosOptions{
+			MaxOvershoot:    time.Millisecond,
+			MaxNowIncrement: time.Millisecond,
+			Seed:            42,
+		})
+
+		out := make([]time.Duration, 0, 100)
+
+		for range 100 {
+			clock.Sleep(time.Millisecond)
+			out = append(out, clock.Now().Sub(epoch))
+		}
+
+		return out
+	}
+
+	first := run()
+	second := run()
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatal(fmt.Sprintf("Expected call #%d to return the same time in both runs, but got %s and %s", i, first[i], second[i]))
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package throttletest provides helpers for testing code that depends on throttle.
+package throttletest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ziflex/throttle"
+)
+
+var _ throttle.TimerClock = (*ManualClock)(nil)
+
+type (
+	// ManualClock is a throttle.Clock whose time moves only when a test tells it to.
+	// It is safe for concurrent use.
+	ManualClock struct {
+		mu       sync.Mutex
+		cond     *sync.Cond
+		now      time.Time
+		auto     bool
+		sleepers []*sleeper
+		calls    []time.Duration
+	}
+
+	// ManualClockOption configures a ManualClock.
+	ManualClockOption func(c *ManualClock)
+
+	sleeper struct {
+		until time.Time
+		ch    chan time.Time
+	}
+)
+
+// NewManualClock creates a new instance of ManualClock starting at the specified time.
+func NewManualClock(start time.Time, setters ...ManualClockOption) *ManualClock {
+	c := &ManualClock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+
+	for _, setter := range setters {
+		setter(c)
+	}
+
+	return c
+}
+
+// WithAutoAdvance makes Sleep and After move the virtual time forward by themselves instead of parking the caller.
+// It is handy for single goroutine tests, where nobody else would advance the clock.
+func WithAutoAdvance() ManualClockOption {
+	return func(c *ManualClock) {
+		c.auto = true
+	}
+}
+
+// Now returns the current virtual time.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Sleep blocks until the virtual time reaches now + dur.
+// With auto advance enabled, the virtual time is moved forward instead.
+func (c *ManualClock) Sleep(dur time.Duration) {
+	<-c.After(dur)
+}
+
+// After returns a channel that receives the virtual time once it reaches now + dur.
+// With auto advance enabled, the virtual time is moved forward and the channel is ready immediately.
+func (c *ManualClock) After(dur time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls = append(c.calls, dur)
+
+	ch := make(chan time.Time, 1)
+
+	if dur <= 0 {
+		ch <- c.now
+
+		return ch
+	}
+
+	until := c.now.Add(dur)
+
+	if c.auto {
+		c.setTime(until)
+		ch <- c.now
+
+		return ch
+	}
+
+	c.sleepers = append(c.sleepers, &sleeper{until: until, ch: ch})
+	c.cond.Broadcast()
+
+	return ch
+}
+
+// Advance moves the virtual time forward and wakes up the sleepers whose deadlines have passed.
+func (c *ManualClock) Advance(dur time.Duration) {
+	c.mu.Lock()
+	c.setTime(c.now.Add(dur))
+	c.mu.Unlock()
+}
+
+// Set moves the virtual time to the specified point and wakes up the sleepers whose deadlines have passed.
+// Moving the time backwards is allowed and does not wake anybody up.
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	c.setTime(now)
+	c.mu.Unlock()
+}
+
+// AdvanceToNext moves the virtual time to the earliest pending deadline and wakes up the sleepers waiting for it.
+// It reports whether there was anybody to wake up.
+func (c *ManualClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.sleepers) == 0 {
+		return false
+	}
+
+	next := c.sleepers[0].until
+
+	for _, s := range c.sleepers[1:] {
+		if s.until.Before(next) {
+			next = s.until
+		}
+	}
+
+	c.setTime(next)
+
+	return true
+}
+
+// Sleepers returns the number of pending Sleep and After calls.
+// Note that a timer created by After stays pending until it expires, even if nobody waits for it anymore.
+func (c *ManualClock) Sleepers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.sleepers)
+}
+
+// BlockUntilSleepers blocks until at least n Sleep or After calls are pending.
+func (c *ManualClock) BlockUntilSleepers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.sleepers) < n {
+		c.cond.Wait()
+	}
+}
+
+// SleepCalls returns the durations passed to Sleep and After, in call order.
+func (c *ManualClock) SleepCalls() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]time.Duration, len(c.calls))
+	copy(out, c.calls)
+
+	return out
+}
+
+// setTime updates the virtual time and releases the expired sleepers.
+// The caller must hold the lock.
+func (c *ManualClock) setTime(now time.Time) {
+	c.now = now
+
+	pending := c.sleepers[:0]
+
+	for _, s := range c.sleepers {
+		if s.until.After(now) {
+			pending = append(pending, s)
+		} else {
+			s.ch <- now
+		}
+	}
+
+	// drop the references left behind in the tail of the slice
+	for i := len(pending); i < len(c.sleepers); i++ {
+		c.sleepers[i] = nil
+	}
+
+	c.sleepers = pending
+	c.cond.Broadcast()
+}
@@ -0,0 +1,134 @@
+package throttletest_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle/throttletest"
+)
+
+var epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestManualClock_Advance(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+
+	clock.Advance(time.Second)
+
+	if actual := clock.Now(); !actual.Equal(epoch.Add(time.Second)) {
+		t.Fatal(fmt.Sprintf("Expected %s, but got %s", epoch.Add(time.Second), actual))
+	}
+
+	if clock.Sleepers() != 0 {
+		t.Fatal("Expected no sleepers")
+	}
+}
+
+func TestManualClock_Sleep(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	woken := make(chan time.Time, 1)
+
+	go func() {
+		clock.Sleep(time.Second)
+		woken <- clock.Now()
+	}()
+
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Millisecond * 999)
+
+	select {
+	case <-woken:
+		t.Fatal("Expected the sleeper to be parked until the deadline")
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	clock.Advance(time.Millisecond)
+
+	if actual := <-woken; !actual.Equal(epoch.Add(time.Second)) {
+		t.Fatal(fmt.Sprintf("Expected to wake up at %s, but got %s", epoch.Add(time.Second), actual))
+	}
+
+	if clock.Sleepers() != 0 {
+		t.Fatal("Expected no sleepers")
+	}
+}
+
+func TestManualClock_BlockUntilSleepers(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+
+	var wg sync.WaitGroup
+	wg.Add(5)
+
+	for i := range 5 {
+		go func(i int) {
+			defer wg.Done()
+
+			clock.Sleep(time.Duration(i+1) * time.Second)
+		}(i)
+	}
+
+	clock.BlockUntilSleepers(5)
+	clock.Advance(time.Second * 3)
+
+	if actual := clock.Sleepers(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 sleepers, but got %d", actual))
+	}
+
+	clock.Advance(time.Second * 2)
+	wg.Wait()
+
+	if actual := len(clock.SleepCalls()); actual != 5 {
+		t.Fatal(fmt.Sprintf("Expected 5 sleep calls, but got %d", actual))
+	}
+}
+
+func TestManualClock_AutoAdvance(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+
+	clock.Sleep(time.Second)
+	clock.Sleep(0)
+	clock.Sleep(time.Millisecond * 500)
+
+	if actual := clock.Now(); !actual.Equal(epoch.Add(time.Millisecond * 1500)) {
+		t.Fatal(fmt.Sprintf("Expected %s, but got %s", epoch.Add(time.Millisecond*1500), actual))
+	}
+
+	expected := []time.Duration{time.Second, 0, time.Millisecond * 500}
+	actual := clock.SleepCalls()
+
+	if len(actual) != len(expected) {
+		t.Fatal(fmt.Sprintf("Expected %d sleep calls, but got %d", len(expected), len(actual)))
+	}
+
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatal(fmt.Sprintf("Expected sleep call #%d to be %s, but got %s", i, expected[i], actual[i]))
+		}
+	}
+}
+
+func TestManualClock_AdvanceToNext(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+
+	if clock.AdvanceToNext() {
+		t.Fatal("Expected nobody to wake up")
+	}
+
+	first := clock.After(time.Second * 2)
+	second := clock.After(time.Second)
+
+	if !clock.AdvanceToNext() {
+		t.Fatal("Expected a sleeper to wake up")
+	}
+
+	if actual := (<-second).Sub(epoch); actual != time.Second {
+		t.Fatal(fmt.Sprintf("Expected to wake up at 1s, but got %s", actual))
+	}
+
+	clock.AdvanceToNext()
+
+	if actual := (<-first).Sub(epoch); actual != time.Second*2 {
+		t.Fatal(fmt.Sprintf("Expected to wake up at 2s, but got %s", actual))
+	}
+}
@@ -0,0 +1,231 @@
+package throttletest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+)
+
+var _ throttle.Limiter = (*FakeLimiter)(nil)
+
+// ErrRejected is returned by FakeLimiter when a scripted rejection is reached.
+var ErrRejected = errors.New("throttletest: rejected")
+
+type (
+	// LimiterCall describes a call made to FakeLimiter.
+	LimiterCall struct {
+		// Method is the name of the called method, e.g. "AcquireN".
+		Method string
+		// Weight is the number of requested slots, 1 for the methods without a weight.
+		Weight uint64
+		// Context is the passed context, nil for the methods without one.
+		Context context.Context
+		// Granted reports whether the call has been granted.
+		Granted bool
+	}
+
+	// FakeLimiter is a throttle.Limiter whose behavior is scripted step by step.
+	// Every call consumes the next step of the script. Once the script is over, calls are granted right away.
+	// It is safe for concurrent use.
+	FakeLimiter struct {
+		mu    sync.Mutex
+		clock throttle.TimerClock
+		steps []step
+		calls []LimiterCall
+	}
+
+	step struct {
+		wait   time.Duration
+		reject bool
+	}
+)
+
+// NewFakeLimiter creates a new instance of FakeLimiter with an empty script, waiting in real time.
+func NewFakeLimiter() *FakeLimiter {
+	return &FakeLimiter{
+		clock: &throttle.DefaultClock{},
+	}
+}
+
+// UseClock sets a clock the scripted waits are performed with, e.g. ManualClock.
+func (f *FakeLimiter) UseClock(clock throttle.TimerClock) *FakeLimiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.clock = clock
+
+	return f
+}
+
+// Grant adds n steps that grant calls right away.
+func (f *FakeLimiter) Grant(n int) *FakeLimiter {
+	for range n {
+		f.push(step{})
+	}
+
+	return f
+}
+
+// Wait adds a step that grants a call after the specified duration.
+// Context aware calls give up once the context is done, and TryAcquire calls are refused, since they can't wait.
+func (f *FakeLimiter) Wait(dur time.Duration) *FakeLimiter {
+	f.push(step{wait: dur})
+
+	return f
+}
+
+// Reject adds a step that refuses a call.
+// Context aware calls return ErrRejected and TryAcquire calls return false.
+// Acquire has no way to report a rejection, so it returns right away, and the call is recorded as not granted.
+func (f *FakeLimiter) Reject() *FakeLimiter {
+	f.push(step{reject: true})
+
+	return f
+}
+
+// Acquire consumes the next step, waiting if it says so.
+func (f *FakeLimiter) Acquire() {
+	s := f.next()
+
+	if !s.reject && s.wait > 0 {
+		f.clock.Sleep(s.wait)
+	}
+
+	f.record(LimiterCall{Method: "Acquire", Weight: 1, Granted: !s.reject})
+}
+
+// AcquireContext consumes the next step, waiting if it says so.
+func (f *FakeLimiter) AcquireContext(ctx context.Context) error {
+	return f.acquire(ctx, "AcquireContext", 1)
+}
+
+// AcquireN consumes the next step, waiting if it says so.
+func (f *FakeLimiter) AcquireN(ctx context.Context, n uint64) error {
+	return f.acquire(ctx, "AcquireN", n)
+}
+
+// TryAcquire consumes the next step, which is granted only if it requires no waiting.
+func (f *FakeLimiter) TryAcquire() bool {
+	return f.try("TryAcquire", 1)
+}
+
+// TryAcquireN consumes the next step, which is granted only if it requires no waiting.
+func (f *FakeLimiter) TryAcquireN(n uint64) bool {
+	return f.try("TryAcquireN", n)
+}
+
+// Calls returns the recorded calls in the order they have completed.
+func (f *FakeLimiter) Calls() []LimiterCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]LimiterCall, len(f.calls))
+	copy(out, f.calls)
+
+	return out
+}
+
+// Acquired returns the number of granted calls.
+func (f *FakeLimiter) Acquired() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var n int
+
+	for _, c := range f.calls {
+		if c.Granted {
+			n++
+		}
+	}
+
+	return n
+}
+
+// AssertAcquired fails the test if the number of granted calls is not n.
+func (f *FakeLimiter) AssertAcquired(t testing.TB, n int) {
+	t.Helper()
+
+	if actual := f.Acquired(); actual != n {
+		t.Fatal(fmt.Sprintf("Expected %d granted calls, but got %d", n, actual))
+	}
+}
+
+// AssertCalls fails the test if the methods of the recorded calls don't match the specified ones.
+func (f *FakeLimiter) AssertCalls(t testing.TB, methods ...string) {
+	t.Helper()
+
+	calls := f.Calls()
+
+	if len(calls) != len(methods) {
+		t.Fatal(fmt.Sprintf("Expected %d calls, but got %d", len(methods), len(calls)))
+	}
+
+	for i, c := range calls {
+		if c.Method != methods[i] {
+			t.Fatal(fmt.Sprintf("Expected call #%d to be %s, but got %s", i, methods[i], c.Method))
+		}
+	}
+}
+
+func (f *FakeLimiter) acquire(ctx context.Context, method string, n uint64) error {
+	s := f.next()
+	err := ctx.Err()
+
+	switch {
+	case err != nil:
+	case s.reject:
+		err = ErrRejected
+	case s.wait > 0:
+		select {
+		case <-f.clock.After(s.wait):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	f.record(LimiterCall{Method: method, Weight: n, Context: ctx, Granted: err == nil})
+
+	return err
+}
+
+func (f *FakeLimiter) try(method string, n uint64) bool {
+	s := f.next()
+	granted := !s.reject && s.wait <= 0
+
+	f.record(LimiterCall{Method: method, Weight: n, Granted: granted})
+
+	return granted
+}
+
+func (f *FakeLimiter) push(s step) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.steps = append(f.steps, s)
+}
+
+func (f *FakeLimiter) next() step {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.steps) == 0 {
+		return step{}
+	}
+
+	s := f.steps[0]
+	f.steps = f.steps[1:]
+
+	return s
+}
+
+func (f *FakeLimiter) record(c LimiterCall) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, c)
+}
@@ -0,0 +1,143 @@
+package throttletest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestFakeLimiter_Script(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	limiter := throttletest.NewFakeLimiter().
+		UseClock(clock).
+		Grant(2).
+		Wait(time.Millisecond * 300).
+		Reject()
+
+	ctx := context.Background()
+
+	if err := limiter.AcquireContext(ctx); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if err := limiter.AcquireN(ctx, 5); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		limiter.Acquire()
+		close(done)
+	}()
+
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Millisecond * 300)
+	<-done
+
+	if err := limiter.AcquireContext(ctx); !errors.Is(err, throttletest.ErrRejected) {
+		t.Fatal(fmt.Sprintf("Expected ErrRejected, but got %v", err))
+	}
+
+	// the script is over
+	if !limiter.TryAcquire() {
+		t.Fatal("Expected calls to be granted once the script is over")
+	}
+
+	limiter.AssertAcquired(t, 4)
+	limiter.AssertCalls(t, "AcquireContext", "AcquireN", "Acquire", "AcquireContext", "TryAcquire")
+
+	calls := limiter.Calls()
+
+	if calls[1].Weight != 5 || calls[1].Context != ctx {
+		t.Fatal(fmt.Sprintf("Expected the weight and the context to be recorded, but got %+v", calls[1]))
+	}
+
+	if calls[2].Context != nil {
+		t.Fatal("Expected no context for Acquire")
+	}
+
+	if actual := clock.SleepCalls(); len(actual) != 1 || actual[0] != time.Millisecond*300 {
+		t.Fatal(fmt.Sprintf("Expected a single wait of 300ms, but got %v", actual))
+	}
+}
+
+func TestFakeLimiter_TryAcquire(t *testing.T) {
+	limiter := throttletest.NewFakeLimiter().
+		Grant(1).
+		Wait(time.Hour).
+		Reject()
+
+	expected := []bool{true, false, false, true}
+
+	for i, exp := range expected {
+		if actual := limiter.TryAcquireN(2); actual != exp {
+			t.Fatal(fmt.Sprintf("Expected call #%d to return %t, but got %t", i, exp, actual))
+		}
+	}
+
+	limiter.AssertAcquired(t, 2)
+}
+
+func TestFakeLimiter_ContextDone(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	limiter := throttletest.NewFakeLimiter().UseClock(clock).Wait(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- limiter.AcquireN(ctx, 3)
+	}()
+
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	limiter.AssertAcquired(t, 0)
+}
+
+// apiClient is an example of code that depends on throttle.Limiter.
+type apiClient struct {
+	limiter throttle.Limiter
+	sent    int
+}
+
+func (c *apiClient) Do(ctx context.Context) error {
+	if err := c.limiter.AcquireContext(ctx); err != nil {
+		return err
+	}
+
+	c.sent++
+
+	return nil
+}
+
+func TestFakeLimiter_Consumer(t *testing.T) {
+	limiter := throttletest.NewFakeLimiter().Grant(2).Reject()
+	client := &apiClient{limiter: limiter}
+
+	for range 2 {
+		if err := client.Do(context.Background()); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	if err := client.Do(context.Background()); !errors.Is(err, throttletest.ErrRejected) {
+		t.Fatal(fmt.Sprintf("Expected ErrRejected, but got %v", err))
+	}
+
+	if client.sent != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 requests to be sent, but got %d", client.sent))
+	}
+
+	limiter.AssertAcquired(t, 2)
+}
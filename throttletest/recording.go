@@ -0,0 +1,172 @@
+package throttletest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+)
+
+// UpdateGoldenEnv is the environment variable that makes AssertGolden overwrite the golden files instead of comparing them.
+const UpdateGoldenEnv = "THROTTLETEST_UPDATE_GOLDEN"
+
+var _ throttle.TimerClock = (*RecordingClock)(nil)
+
+type (
+	// Event describes a call recorded by RecordingClock.
+	Event struct {
+		// Seq is the sequence number of the call, starting from zero.
+		Seq int
+		// Method is the name of the called method: "Now", "Sleep" or "After".
+		Method string
+		// Time is the value returned by Now.
+		Time time.Time
+		// Duration is the duration passed to Sleep or After.
+		Duration time.Duration
+	}
+
+	// RecordingClock is a throttle.Clock decorator that records every call made to the wrapped clock.
+	// It is safe for concurrent use.
+	RecordingClock struct {
+		mu    sync.Mutex
+		inner throttle.Clock
+		log   []Event
+	}
+)
+
+// String formats the event as a line of a golden file.
+func (e Event) String() string {
+	if e.Method == "Now" {
+		return fmt.Sprintf("%d %s %s", e.Seq, e.Method, e.Time.Format(time.RFC3339Nano))
+	}
+
+	return fmt.Sprintf("%d %s %s", e.Seq, e.Method, e.Duration)
+}
+
+// NewRecordingClock creates a new instance of RecordingClock wrapping the specified clock.
+func NewRecordingClock(inner throttle.Clock) *RecordingClock {
+	return &RecordingClock{inner: inner}
+}
+
+// Now returns the current time of the wrapped clock.
+func (c *RecordingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.inner.Now()
+	c.log = append(c.log, Event{Seq: len(c.log), Method: "Now", Time: now})
+
+	return now
+}
+
+// Sleep waits using the wrapped clock. The call is recorded before waiting.
+func (c *RecordingClock) Sleep(dur time.Duration) {
+	c.record("Sleep", dur)
+	c.inner.Sleep(dur)
+}
+
+// After returns a timer of the wrapped clock, or runs its Sleep in a separate goroutine if it can only sleep.
+func (c *RecordingClock) After(dur time.Duration) <-chan time.Time {
+	c.record("After", dur)
+
+	if tc, ok := c.inner.(throttle.TimerClock); ok {
+		return tc.After(dur)
+	}
+
+	ch := make(chan time.Time, 1)
+
+	go func() {
+		c.inner.Sleep(dur)
+		ch <- c.inner.Now()
+	}()
+
+	return ch
+}
+
+// Log returns the recorded calls in order.
+func (c *RecordingClock) Log() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]Event, len(c.log))
+	copy(out, c.log)
+
+	return out
+}
+
+// Golden formats the recorded calls, one per line.
+func (c *RecordingClock) Golden() []byte {
+	var buf bytes.Buffer
+
+	for _, e := range c.Log() {
+		buf.WriteString(e.String())
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
+
+// WriteGolden writes the recorded calls into the golden file, creating its directory if needed.
+func (c *RecordingClock) WriteGolden(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, c.Golden(), 0o644)
+}
+
+// CompareGolden returns an error describing the first difference between the recorded calls and the golden file.
+func (c *RecordingClock) CompareGolden(path string) error {
+	expected, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	actual := c.Golden()
+
+	if bytes.Equal(expected, actual) {
+		return nil
+	}
+
+	expectedLines := bytes.Split(expected, []byte{'\n'})
+	actualLines := bytes.Split(actual, []byte{'\n'})
+
+	for i := 0; i < len(expectedLines) && i < len(actualLines); i++ {
+		if !bytes.Equal(expectedLines[i], actualLines[i]) {
+			return fmt.Errorf("line %d: expected %q, but got %q", i+1, expectedLines[i], actualLines[i])
+		}
+	}
+
+	return fmt.Errorf("expected %d lines, but got %d", len(expectedLines), len(actualLines))
+}
+
+// AssertGolden fails the test if the recorded calls don't match the golden file.
+// If the UpdateGoldenEnv environment variable is set, the golden file is overwritten instead.
+func (c *RecordingClock) AssertGolden(t testing.TB, path string) {
+	t.Helper()
+
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := c.WriteGolden(path); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to update the golden file: %s", err))
+		}
+
+		return
+	}
+
+	if err := c.CompareGolden(path); err != nil {
+		t.Fatal(fmt.Sprintf("Recorded calls don't match %s: %s", path, err))
+	}
+}
+
+func (c *RecordingClock) record(method string, dur time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.log = append(c.log, Event{Seq: len(c.log), Method: method, Duration: dur})
+}
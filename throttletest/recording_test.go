@@ -0,0 +1,110 @@
+package throttletest_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestRecordingClock_Workload(t *testing.T) {
+	clock := throttletest.NewRecordingClock(throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance()))
+	throttler := throttle.New(2, throttle.WithClock(clock))
+
+	for range 5 {
+		throttler.Acquire()
+	}
+
+	throttler.TryAcquire()
+
+	if err := throttler.AcquireContext(context.Background()); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	expected := []throttletest.Event{
+		{Seq: 0, Method: "Now", Time: epoch},
+		{Seq: 1, Method: "Now", Time: epoch},
+		// the first window is full
+		{Seq: 2, Method: "Now", Time: epoch},
+		{Seq: 3, Method: "Sleep", Duration: time.Second},
+		{Seq: 4, Method: "Now", Time: epoch.Add(time.Second)},
+		// the second window is full
+		{Seq: 5, Method: "Now", Time: epoch.Add(time.Second)},
+		{Seq: 6, Method: "Sleep", Duration: time.Second},
+		// TryAcquire takes the last slot of the third window
+		{Seq: 7, Method: "Now", Time: epoch.Add(time.Second * 2)},
+		{Seq: 8, Method: "Now", Time: epoch.Add(time.Second * 2)},
+		{Seq: 9, Method: "After", Duration: time.Second},
+	}
+
+	actual := clock.Log()
+
+	if len(actual) != len(expected) {
+		t.Fatal(fmt.Sprintf("Expected %d calls, but got %d:\n%s", len(expected), len(actual), clock.Golden()))
+	}
+
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatal(fmt.Sprintf("Expected call #%d to be %s, but got %s", i, expected[i], actual[i]))
+		}
+	}
+
+	clock.AssertGolden(t, filepath.Join("testdata", "workload.golden"))
+}
+
+func TestRecordingClock_CompareGolden(t *testing.T) {
+	clock := throttletest.NewRecordingClock(throttletest.NewManualClock(epoch))
+	path := filepath.Join(t.TempDir(), "clock.golden")
+
+	clock.Now()
+	clock.Sleep(0)
+
+	if err := clock.WriteGolden(path); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if err := clock.CompareGolden(path); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no difference, but got %s", err))
+	}
+
+	clock.Now()
+
+	if err := clock.CompareGolden(path); err == nil {
+		t.Fatal("Expected a difference")
+	}
+}
+
+func TestRecordingClock_Concurrent(t *testing.T) {
+	clock := throttletest.NewRecordingClock(throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance()))
+
+	var wg sync.WaitGroup
+	wg.Add(10)
+
+	for range 10 {
+		go func() {
+			defer wg.Done()
+
+			for range 100 {
+				clock.Now()
+				clock.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for i, e := range clock.Log() {
+		if e.Seq != i {
+			t.Fatal(fmt.Sprintf("Expected call #%d to have a matching sequence number, but got %d", i, e.Seq))
+		}
+	}
+
+	if actual := len(clock.Log()); actual != 2000 {
+		t.Fatal(fmt.Sprintf("Expected 2000 calls, but got %d", actual))
+	}
+}
@@ -0,0 +1,155 @@
+package throttletest
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+)
+
+type (
+	// Burst is a series of calls made one after another.
+	Burst struct {
+		// Warmup is the time to wait before the first call of the burst.
+		Warmup time.Duration
+		// Latency is the time every call takes once admitted.
+		Latency time.Duration
+		// Calls is the number of calls in the burst.
+		Calls int
+	}
+
+	// Call is a call made concurrently with the others.
+	Call struct {
+		// Latency is the time the call takes once admitted.
+		Latency time.Duration
+	}
+
+	// Scenario describes a workload and the expected distribution of its calls over time.
+	Scenario struct {
+		// Bursts are executed sequentially by a single goroutine.
+		Bursts []Burst
+		// Calls are executed concurrently, each by its own goroutine, in the order they are listed.
+		Calls []Call
+		// Window is the duration of the windows the completed calls are counted in. Zero means one second.
+		Window time.Duration
+		// Expected is the number of calls completed within each window, keyed by the window index starting from zero.
+		Expected map[int]uint64
+	}
+)
+
+// Run executes the scenario against the limiter created by the factory, driven by a manual clock,
+// and fails the test if the calls completed within each window don't match the expected numbers.
+// The virtual time is advanced to the next deadline every time all the running calls are parked in the clock,
+// so the limiter must do all its waiting through the clock it receives.
+func Run(t testing.TB, factory func(clock throttle.Clock) throttle.Limiter, scenario Scenario) {
+	t.Helper()
+
+	window := scenario.Window
+
+	if window <= 0 {
+		window = time.Second
+	}
+
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	limiter := factory(clock)
+
+	var (
+		mu     sync.Mutex
+		done   []time.Time
+		active atomic.Int64
+	)
+
+	complete := func() {
+		mu.Lock()
+		done = append(done, clock.Now())
+		mu.Unlock()
+	}
+
+	// settle waits until every running goroutine is either parked in the clock or finished
+	settle := func() {
+		for int64(clock.Sleepers()) != active.Load() {
+			runtime.Gosched()
+		}
+	}
+
+	if len(scenario.Bursts) > 0 {
+		active.Add(1)
+
+		go func() {
+			defer active.Add(-1)
+
+			for _, burst := range scenario.Bursts {
+				if burst.Warmup > 0 {
+					clock.Sleep(burst.Warmup)
+				}
+
+				for range burst.Calls {
+					limiter.Acquire()
+
+					if burst.Latency > 0 {
+						clock.Sleep(burst.Latency)
+					}
+
+					complete()
+				}
+			}
+		}()
+
+		settle()
+	}
+
+	for _, call := range scenario.Calls {
+		active.Add(1)
+
+		go func(latency time.Duration) {
+			defer active.Add(-1)
+
+			limiter.Acquire()
+
+			if latency > 0 {
+				clock.Sleep(latency)
+			}
+
+			complete()
+		}(call.Latency)
+
+		settle()
+	}
+
+	for active.Load() > 0 {
+		settle()
+		clock.AdvanceToNext()
+	}
+
+	actual := map[int]uint64{}
+
+	for _, ts := range done {
+		actual[int(ts.Sub(start)/window)]++
+	}
+
+	windows := make([]int, 0, len(actual)+len(scenario.Expected))
+
+	for idx := range actual {
+		windows = append(windows, idx)
+	}
+
+	for idx := range scenario.Expected {
+		if _, found := actual[idx]; !found {
+			windows = append(windows, idx)
+		}
+	}
+
+	sort.Ints(windows)
+
+	for _, idx := range windows {
+		if actual[idx] != scenario.Expected[idx] {
+			t.Fatal(fmt.Sprintf("Expected %d calls within window #%d, but got %d", scenario.Expected[idx], idx, actual[idx]))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package throttletest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestRun_CustomWindow(t *testing.T) {
+	factory := func(clock throttle.Clock) throttle.Limiter {
+		return throttle.New(100, throttle.WithClock(clock), throttle.WithWindow(time.Minute))
+	}
+
+	throttletest.Run(t, factory, throttletest.Scenario{
+		Bursts: []throttletest.Burst{
+			{
+				Calls:   150,
+				Latency: time.Millisecond * 100,
+			},
+			{
+				Warmup: time.Minute,
+				Calls:  120,
+			},
+		},
+		Window: time.Minute,
+		Expected: map[int]uint64{
+			// 100 calls take 10s, the rest waits for the next window
+			0: 100,
+			// 50 calls take 5s, the second burst starts a minute later and is cut at 100 per window
+			1: 50,
+			2: 100,
+			3: 20,
+		},
+	})
+}
+
+func TestRun_FakeLimiter(t *testing.T) {
+	factory := func(clock throttle.Clock) throttle.Limiter {
+		return throttletest.NewFakeLimiter().
+			UseClock(clock.(throttle.TimerClock)).
+			Grant(2).
+			Wait(time.Second).
+			Wait(time.Second * 2)
+	}
+
+	throttletest.Run(t, factory, throttletest.Scenario{
+		Bursts: []throttletest.Burst{
+			{
+				Calls: 5,
+			},
+		},
+		Expected: map[int]uint64{
+			0: 2,
+			1: 1,
+			3: 2,
+		},
+	})
+}
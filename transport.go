@@ -1,27 +1,766 @@
 package throttle
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"net/http/httptrace"
+	"time"
 )
 
-type throttledRoundTripper struct {
-	transport http.RoundTripper
-	throttler *Throttler
+// ThrottledRoundTripper is an http.RoundTripper that throttles the requests before passing them to the underlying transport.
+type ThrottledRoundTripper struct {
+	transport       http.RoundTripper
+	limiter         Limiter
+	clock           TimerClock
+	keys            *keyedThrottlers
+	routes          []route
+	methods         *methods
+	retryAfter      time.Duration
+	penalized       map[int]bool
+	penalty         time.Duration
+	retries         int
+	retryable       func(request *http.Request) bool
+	skip            func(request *http.Request) bool
+	hosts           []hostPattern
+	hostPorts       bool
+	hostThrottlers  *hostThrottlers
+	limitWait       bool
+	maxWait         time.Duration
+	trace           *ThrottleTrace
+	exemptRedirects bool
+	strip           []string
+	upload          *Throttler
+	download        *Throttler
+	countBypassed   bool
+	weigher         Weigher
+	observe         func(request *http.Request, wait time.Duration)
+	waitContext     bool
+	waitHeader      string
+	inflight        inflight
+	quotas          map[*Throttler]*quota
+	aimds           map[*Throttler]*aimd
+	remaining       string
+	reset           string
+	parseReset      func(value string, now time.Time) (time.Time, bool)
+	backoff         func(response *http.Response, now time.Time) (time.Time, bool)
+	deadlineSlack   time.Duration
+	cooldown        *cooldown
+	stats           stats
 }
 
-func (t *throttledRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
-	t.throttler.Acquire()
+// RoundTrip waits for the limiter before passing the request to the underlying transport.
+// The requests exempted by WithSkip or WithHosts and the ones bypassing the limit with WithBypass are passed right away.
+// If the request context is done while waiting, the context error is returned and the slot is given back.
+func (t *ThrottledRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.skip != nil && t.skip(request) {
+		return t.forward(request)
+	}
+
+	if t.hosts != nil && !t.scoped(request) {
+		return t.forward(request)
+	}
+
+	// the client sets the response that has caused a redirect on the request following it
+	if t.exemptRedirects && request.Response != nil {
+		return t.forward(request)
+	}
+
+	limiter := t.limiterFor(request)
+
+	// the request goes to a host without a throttler
+	if limiter == nil {
+		return t.forward(request)
+	}
+
+	if bypassed(request.Context()) {
+		if t.countBypassed {
+			t.charge(limiter, t.weigh(request))
+		}
+
+		return t.forward(request)
+	}
+
+	for attempt := 0; ; attempt++ {
+		response, err := t.send(request, limiter)
+
+		if err != nil || response.StatusCode != http.StatusTooManyRequests || attempt >= t.retries || !t.retryable(request) {
+			return response, err
+		}
+
+		next, err := rewind(request)
+
+		if err != nil {
+			return response, nil
+		}
+
+		drain(response)
+
+		// wait for the deadline set by the server or, if there is none, for the next window
+		if deadline, ok := t.retryDeadline(limiter, response); !ok {
+			if throttler, ok := limiter.(*Throttler); ok {
+				throttler.PauseUntil(throttler.windowEnd())
+			}
+		} else if t.retryAfter <= 0 {
+			pause(limiter, deadline)
+		}
+
+		request = next
+	}
+}
+
+// send passes the request to the underlying transport once the limiter admits it.
+func (t *ThrottledRoundTripper) send(request *http.Request, limiter Limiter) (*http.Response, error) {
+	var (
+		q *quota
+		a *aimd
+	)
+
+	if throttler, ok := limiter.(*Throttler); ok {
+		q = t.quotas[throttler]
+		a = t.aimds[throttler]
+	}
+
+	start := t.now(limiter)
+
+	var probe bool
+
+	// the cooldown comes first, so the held requests don't take the slots of the limiter
+	if t.cooldown != nil {
+		var err error
+
+		if probe, err = t.cooldown.enter(request.Context()); err != nil {
+			if errors.Is(err, ErrCooldown) {
+				t.stats.rejected.Add(1)
+			} else {
+				t.stats.cancelled.Add(1)
+			}
+
+			return nil, err
+		}
+	}
+
+	// the in-flight slot comes next, so the requests don't wait for it after being admitted by the limiter
+	if t.inflight != nil {
+		if err := t.inflight.acquire(request.Context()); err != nil {
+			if t.cooldown != nil {
+				t.cooldown.abort(probe)
+			}
+
+			return nil, err
+		}
+	}
+
+	if err := t.acquire(request, limiter, q); err != nil {
+		var limitErr *LimitError
+
+		if errors.As(err, &limitErr) {
+			t.stats.rejected.Add(1)
+		} else if request.Context().Err() != nil {
+			t.stats.cancelled.Add(1)
+		}
+
+		if t.inflight != nil {
+			t.inflight.release()
+		}
+
+		if t.cooldown != nil {
+			t.cooldown.abort(probe)
+		}
+
+		return nil, err
+	}
+
+	wait := t.now(limiter).Sub(start)
+	t.stats.waitedFor(wait)
+
+	if t.observe != nil {
+		t.observe(request, wait)
+	}
+
+	// the traced requests are annotated only if they have waited
+	if t.waitContext || wait > 0 && t.traced(request) {
+		request = request.WithContext(context.WithValue(request.Context(), waitKey{}, wait))
+	}
+
+	if len(t.strip) > 0 {
+		request = stripHeaders(request, t.strip)
+	}
+
+	if t.upload != nil {
+		request = paceBody(request, t.upload)
+	}
+
+	t.stats.sent.Add(1)
+
+	response, err := t.transport.RoundTrip(request)
+
+	if t.cooldown != nil {
+		t.cooldown.record(probe, response, err)
+	}
+
+	if err != nil {
+		if t.inflight != nil {
+			t.inflight.release()
+		}
+
+		if q != nil {
+			q.done()
+		}
+
+		return nil, err
+	}
+
+	if t.download != nil {
+		paceResponse(request.Context(), response, t.download)
+	}
+
+	if t.inflight != nil {
+		t.inflight.hold(request.Context(), response)
+	}
+
+	if t.waitHeader != "" {
+		if response.Header == nil {
+			response.Header = make(http.Header)
+		}
+
+		response.Header.Set(t.waitHeader, wait.String())
+	}
+
+	if t.retryAfter > 0 {
+		if deadline, ok := t.retryDeadline(limiter, response); ok {
+			pause(limiter, deadline)
+		}
+	}
+
+	if t.penalized[response.StatusCode] {
+		pause(limiter, t.now(limiter).Add(t.penalty))
+	}
+
+	if t.backoff != nil {
+		if deadline, ok := t.backoff(response, t.now(limiter)); ok {
+			pause(limiter, deadline)
+		}
+	}
+
+	if q != nil {
+		t.adapt(q, response)
+	}
+
+	if a != nil {
+		failed := response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable
+		a.observe(a.throttler.clock.Now(), failed)
+	}
+
+	return response, nil
+}
+
+// forward passes the request to the underlying transport unthrottled.
+func (t *ThrottledRoundTripper) forward(request *http.Request) (*http.Response, error) {
+	t.stats.sent.Add(1)
+	t.stats.unthrottled.Add(1)
 
 	return t.transport.RoundTrip(request)
 }
 
-func NewRoundTripper(transport http.RoundTripper, limit uint64, setters ...Option) http.RoundTripper {
-	return NewRoundTripperWith(transport, New(limit, setters...))
+// acquire waits for the limiter and, if the transport is adaptive, for the quota advertised by the server.
+// If the wait is limited, the requests that would wait longer are rejected.
+func (t *ThrottledRoundTripper) acquire(request *http.Request, limiter Limiter, q *quota) error {
+	var deadline time.Time
+
+	if t.limitWait {
+		deadline = t.now(limiter).Add(t.maxWait)
+	}
+
+	for {
+		res, err := t.admit(request, limiter, deadline)
+
+		if err != nil {
+			return err
+		}
+
+		if q == nil {
+			return nil
+		}
+
+		now := q.throttler.clock.Now()
+		reset, ok := q.take(now)
+
+		if ok {
+			return nil
+		}
+
+		q.throttler.PauseUntil(reset)
+
+		if t.limitWait && reset.After(deadline) {
+			q.throttler.cancel(res)
+
+			return &LimitError{RetryAfter: reset.Sub(now)}
+		}
+	}
 }
 
-func NewRoundTripperWith(transport http.RoundTripper, throttler *Throttler) http.RoundTripper {
-	return &throttledRoundTripper{
-		transport: transport,
-		throttler: throttler,
+// admit waits for the limiter, but if the deadline is set, only as long as the slots are available by then.
+func (t *ThrottledRoundTripper) admit(request *http.Request, limiter Limiter, deadline time.Time) (reservation, error) {
+	ctx := request.Context()
+	n := t.weigh(request)
+	traced := t.traced(request)
+
+	if throttler, ok := limiter.(*Throttler); ok {
+		return t.reserve(request, throttler, n, deadline, traced)
+	}
+
+	if deadline.IsZero() && !traced {
+		return reservation{}, limiter.AcquireN(ctx, n)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return reservation{}, err
+	}
+
+	budget := time.Duration(math.MaxInt64)
+
+	if !deadline.IsZero() {
+		budget = max(deadline.Sub(t.now(limiter)), 0)
 	}
+
+	// the wait of other limiters can't be estimated, so it's traced once it's over
+	if traced {
+		start := t.clock.Now()
+
+		defer func() {
+			if wait := t.clock.Now().Sub(start); wait > 0 {
+				t.trace.start(request, wait)
+				t.trace.done(request, wait)
+			}
+		}()
+	}
+
+	if deadline.IsZero() {
+		return reservation{}, limiter.AcquireN(ctx, n)
+	}
+
+	// and it's given up on once the budget is spent
+	if budget == 0 {
+		if limiter.TryAcquireN(n) {
+			return reservation{}, nil
+		}
+
+		return reservation{}, &LimitError{}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	go func() {
+		select {
+		case <-t.clock.After(budget):
+			cancel(&LimitError{})
+		case <-ctx.Done():
+		}
+	}()
+
+	err := limiter.AcquireN(ctx, n)
+
+	var limitErr *LimitError
+
+	if err != nil && errors.As(context.Cause(ctx), &limitErr) {
+		return reservation{}, limitErr
+	}
+
+	return reservation{}, err
+}
+
+// reserve waits for the slots of the throttler, unless the wait is estimated to outlast the deadline or the request context.
+// In the latter cases, the request is rejected right away without taking any slots.
+func (t *ThrottledRoundTripper) reserve(request *http.Request, throttler *Throttler, n uint64, deadline time.Time, traced bool) (reservation, error) {
+	ctx := request.Context()
+	ctxDeadline, bounded := ctx.Deadline()
+
+	if deadline.IsZero() && !bounded && !traced {
+		return reservation{}, throttler.AcquireN(ctx, n)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return reservation{}, err
+	}
+
+	budget := time.Duration(math.MaxInt64)
+	ctxBudget := time.Duration(math.MaxInt64)
+
+	if !deadline.IsZero() {
+		budget = max(deadline.Sub(throttler.clock.Now()), 0)
+	}
+
+	// the context deadline is measured on the clock of the throttler, as the wait is
+	if bounded {
+		ctxBudget = max(ctxDeadline.Sub(throttler.clock.Now()), 0) + t.deadlineSlack
+	}
+
+	res, ok := throttler.reserveWithin(n, min(budget, ctxBudget))
+
+	if !ok {
+		if res.wait > ctxBudget {
+			return reservation{}, fmt.Errorf("%w: the wait of %s for the rate limit outlasts the request", context.DeadlineExceeded, res.wait)
+		}
+
+		return reservation{}, &LimitError{RetryAfter: res.wait}
+	}
+
+	if res.wait <= 0 || !traced {
+		return res, throttler.await(ctx, res)
+	}
+
+	start := throttler.clock.Now()
+	t.trace.start(request, res.wait)
+
+	err := throttler.await(ctx, res)
+	t.trace.done(request, throttler.clock.Now().Sub(start))
+
+	return res, err
+}
+
+// traced reports whether the request is traced with httptrace and the transport has trace hooks.
+func (t *ThrottledRoundTripper) traced(request *http.Request) bool {
+	return t.trace != nil && httptrace.ContextClientTrace(request.Context()) != nil
+}
+
+// charge takes n slots of the limiter without waiting for them.
+func (t *ThrottledRoundTripper) charge(limiter Limiter, n uint64) {
+	if throttler, ok := limiter.(*Throttler); ok {
+		// the slots are taken even if they belong to one of the following windows, so the average rate stays honest
+		throttler.reserve(n)
+
+		return
+	}
+
+	limiter.TryAcquireN(n)
+}
+
+// now returns the current time of the limiter if it is a Throttler, and of the transport otherwise.
+func (t *ThrottledRoundTripper) now(limiter Limiter) time.Time {
+	if throttler, ok := limiter.(*Throttler); ok {
+		return throttler.clock.Now()
+	}
+
+	return t.clock.Now()
+}
+
+// scoped reports whether the request host is one of the throttled ones.
+func (t *ThrottledRoundTripper) scoped(request *http.Request) bool {
+	for _, pattern := range t.hosts {
+		if pattern.match(request, t.hostPorts) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weigh returns the number of slots the request takes.
+func (t *ThrottledRoundTripper) weigh(request *http.Request) uint64 {
+	if t.weigher == nil {
+		return 1
+	}
+
+	return t.weigher(request)
+}
+
+// limiterFor returns the limiter the request is paced by.
+func (t *ThrottledRoundTripper) limiterFor(request *http.Request) Limiter {
+	if throttler := requestThrottler(request.Context()); throttler != nil {
+		return throttler
+	}
+
+	if t.keys != nil {
+		return t.keys.throttlerFor(request)
+	}
+
+	if t.hostThrottlers != nil {
+		if throttler := t.hostThrottlers.throttlerFor(request); throttler != nil {
+			return throttler
+		}
+
+		return nil
+	}
+
+	if r, found := matchRoute(t.routes, request.URL.Path); found {
+		return r.throttler
+	}
+
+	if t.methods != nil {
+		return t.methods.throttlerFor(request.Method)
+	}
+
+	return t.limiter
+}
+
+// retryDeadline returns the deadline set by the Retry-After header of a 429 or 503 response, capped as configured.
+func (t *ThrottledRoundTripper) retryDeadline(limiter Limiter, response *http.Response) (time.Time, bool) {
+	if response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable {
+		return time.Time{}, false
+	}
+
+	now := t.now(limiter)
+	deadline, ok := parseRetryAfter(response.Header.Get("Retry-After"), now)
+
+	if !ok {
+		return time.Time{}, false
+	}
+
+	maxDelay := t.retryAfter
+
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryAfterCap
+	}
+
+	if limit := now.Add(maxDelay); deadline.After(limit) {
+		deadline = limit
+	}
+
+	return deadline, true
+}
+
+// adapt updates the quota with the rate limit advertised by the response.
+// The standard RateLimit fields are preferred over the named headers.
+func (t *ThrottledRoundTripper) adapt(q *quota, response *http.Response) {
+	now := q.throttler.clock.Now()
+	remaining, reset, ok := parseStandardRateLimit(response.Header, now)
+
+	if !ok {
+		remaining, reset, ok = parseRateLimit(response.Header, t.remaining, t.reset, t.parseReset, now)
+	}
+
+	if !ok {
+		q.done()
+
+		return
+	}
+
+	q.update(now, remaining, reset)
+}
+
+// NewRoundTripper creates a throttled http.RoundTripper with a specified limit.
+// A nil transport stands for http.DefaultTransport, as in http.Client.
+func NewRoundTripper(transport http.RoundTripper, limit uint64, setters ...TransportOption) http.RoundTripper {
+	return NewTransport(transport, limit, setters...)
+}
+
+// NewRoundTripperWith creates a throttled http.RoundTripper that uses the specified throttler.
+// A nil transport stands for http.DefaultTransport, while a nil throttler makes it panic.
+func NewRoundTripperWith(transport http.RoundTripper, throttler *Throttler, setters ...TransportOption) http.RoundTripper {
+	return NewTransportWith(transport, throttler, setters...)
+}
+
+// NewKeyedRoundTripper creates a throttled http.RoundTripper that keeps a throttler with the specified limit per key of the requests,
+// e.g. per tenant taken from a header. The key function must not read the request body.
+// The number of throttlers is bounded by WithMaxKeys, and the least recently used ones are evicted beyond it.
+// The requests with an empty key share a bucket of their own, unless WithUnthrottledEmptyKey is set.
+// Keys take precedence over routes and method limits, and the adaptive limit is not applied to the keyed throttlers.
+func NewKeyedRoundTripper(transport http.RoundTripper, limitPerKey uint64, key func(request *http.Request) string, setters ...TransportOption) http.RoundTripper {
+	opts := buildTransportOptions(setters)
+	t := newRoundTripper(transport, New(limitPerKey, opts.throttler...), opts)
+	t.keys = newKeyedThrottlers(key, limitPerKey, opts)
+
+	return t
+}
+
+// NewTransport is like NewRoundTripper, but returns the concrete type, so the throttler stays within reach.
+func NewTransport(transport http.RoundTripper, limit uint64, setters ...TransportOption) *ThrottledRoundTripper {
+	opts := buildTransportOptions(setters)
+
+	return newRoundTripper(transport, New(limit, opts.throttler...), opts)
+}
+
+// NewTransportWith is like NewRoundTripperWith, but returns the concrete type.
+func NewTransportWith(transport http.RoundTripper, throttler *Throttler, setters ...TransportOption) *ThrottledRoundTripper {
+	// a nil throttler would make a non-nil limiter, so it's caught before the conversion
+	if throttler == nil {
+		panic("throttle: nil throttler")
+	}
+
+	return newRoundTripper(transport, throttler, buildTransportOptions(setters))
+}
+
+// NewRoundTripperWithLimiter creates a throttled http.RoundTripper that uses the specified limiter, e.g. an adapter of another rate limiter.
+// The features that rely on the Throttler internals degrade gracefully with other limiters:
+// the adaptive limit is not applied, Retry-After pauses only limiters with a PauseUntil method,
+// retries don't wait for the next window, and counted bypasses take a slot only if one is free.
+// A nil transport stands for http.DefaultTransport, while a nil limiter makes it panic.
+func NewRoundTripperWithLimiter(transport http.RoundTripper, limiter Limiter, setters ...TransportOption) http.RoundTripper {
+	return NewTransportWithLimiter(transport, limiter, setters...)
+}
+
+// NewTransportWithLimiter is like NewRoundTripperWithLimiter, but returns the concrete type.
+func NewTransportWithLimiter(transport http.RoundTripper, limiter Limiter, setters ...TransportOption) *ThrottledRoundTripper {
+	return newRoundTripper(transport, limiter, buildTransportOptions(setters))
+}
+
+// Throttler returns the default throttler of the transport, which paces the requests matching no route,
+// or nil if the transport uses a Limiter that is not a Throttler.
+func (t *ThrottledRoundTripper) Throttler() *Throttler {
+	throttler, _ := t.limiter.(*Throttler)
+
+	return throttler
+}
+
+// EffectiveLimit returns the current limit of the default throttler, which may differ from the configured one
+// when the transport adapts it, e.g. with WithAIMD. It returns 0 if the transport uses a Limiter that is not a Throttler.
+func (t *ThrottledRoundTripper) EffectiveLimit() uint64 {
+	if throttler := t.Throttler(); throttler != nil {
+		return throttler.Limit()
+	}
+
+	return 0
+}
+
+// Limiter returns the default limiter of the transport, which paces the requests matching no route.
+func (t *ThrottledRoundTripper) Limiter() Limiter {
+	return t.limiter
+}
+
+// Stats returns a snapshot of the counters of the transport.
+// The counters are read one by one, so a snapshot taken while requests are in progress may be slightly inconsistent.
+func (t *ThrottledRoundTripper) Stats() TransportStats {
+	return t.stats.snapshot()
+}
+
+// ResetStats zeroes the counters of the transport.
+func (t *ThrottledRoundTripper) ResetStats() {
+	t.stats.reset()
+}
+
+// Transport returns the underlying transport.
+func (t *ThrottledRoundTripper) Transport() http.RoundTripper {
+	return t.transport
+}
+
+// Unwrap returns the underlying transport, so the instrumentation libraries can discover the chain of transports.
+func (t *ThrottledRoundTripper) Unwrap() http.RoundTripper {
+	return t.transport
+}
+
+// throttlers returns the throttlers of the transport known upfront: the default one, if it is a Throttler, and the ones of the routes and methods.
+func (t *ThrottledRoundTripper) throttlers() []*Throttler {
+	var out []*Throttler
+
+	if throttler, ok := t.limiter.(*Throttler); ok {
+		out = append(out, throttler)
+	}
+
+	for _, r := range t.routes {
+		out = append(out, r.throttler)
+	}
+
+	if t.methods != nil {
+		out = append(out, t.methods.throttlers()...)
+	}
+
+	if t.hostThrottlers != nil {
+		out = append(out, t.hostThrottlers.throttlers()...)
+	}
+
+	return out
+}
+
+// pause holds the requests paced by the limiter until the deadline, if the limiter supports that.
+func pause(limiter Limiter, deadline time.Time) {
+	if p, ok := limiter.(interface{ PauseUntil(deadline time.Time) }); ok {
+		p.PauseUntil(deadline)
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport, if it supports that.
+func (t *ThrottledRoundTripper) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+
+	if transport, ok := t.transport.(closeIdler); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func newRoundTripper(transport http.RoundTripper, limiter Limiter, opts *transportOptions) *ThrottledRoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if limiter == nil {
+		panic("throttle: nil limiter")
+	}
+
+	t := &ThrottledRoundTripper{
+		transport:       transport,
+		limiter:         limiter,
+		clock:           buildOptions(opts.throttler).clock,
+		routes:          newRoutes(opts.routes, opts.throttler),
+		methods:         newMethods(opts.methods, opts.methodFallback, opts.throttler),
+		retryAfter:      opts.retryAfter,
+		penalized:       opts.penalized,
+		penalty:         opts.penalty,
+		retries:         opts.retries,
+		retryable:       opts.retryable,
+		skip:            opts.skip,
+		hosts:           opts.hosts,
+		hostPorts:       opts.hostPorts,
+		hostThrottlers:  newHostThrottlers(opts.hostThrottlers, opts.hostFallback),
+		limitWait:       opts.limitWait,
+		maxWait:         opts.maxWait,
+		trace:           opts.trace,
+		exemptRedirects: opts.exemptRedirects,
+		strip:           opts.strip,
+		countBypassed:   opts.countBypassed,
+		weigher:         opts.weigher,
+		observe:         opts.observe,
+		waitContext:     opts.waitContext,
+		waitHeader:      opts.waitHeader,
+		remaining:       opts.remaining,
+		reset:           opts.reset,
+		parseReset:      opts.parseReset,
+		backoff:         opts.backoff,
+		deadlineSlack:   opts.deadlineSlack,
+	}
+
+	if opts.upload > 0 {
+		t.upload = New(opts.upload, opts.throttler...)
+	}
+
+	if opts.download > 0 {
+		t.download = New(opts.download, opts.throttler...)
+	}
+
+	if opts.cooldownAfter > 0 {
+		statuses := opts.cooldownStatuses
+
+		if statuses == nil {
+			statuses = DefaultCooldownStatuses
+		}
+
+		t.cooldown = newCooldown(t.clock, opts.cooldownAfter, opts.cooldown, statuses, opts.cooldownFailFast)
+	}
+
+	if opts.maxInFlight > 0 {
+		t.inflight = make(inflight, opts.maxInFlight)
+	}
+
+	if opts.adaptive {
+		t.quotas = make(map[*Throttler]*quota)
+
+		for _, throttler := range t.throttlers() {
+			t.quotas[throttler] = newQuota(throttler)
+		}
+	}
+
+	if opts.aimd {
+		t.aimds = make(map[*Throttler]*aimd)
+
+		for _, throttler := range t.throttlers() {
+			t.aimds[throttler] = newAIMD(throttler)
+		}
+	}
+
+	return t
 }
@@ -0,0 +1,559 @@
+package throttle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRetryAfterCap is the longest Retry-After delay honored by default.
+	DefaultRetryAfterCap = time.Minute * 5
+
+	// DefaultRemainingHeader is the header the adaptive transport reads the remaining requests from by default.
+	DefaultRemainingHeader = "X-RateLimit-Remaining"
+
+	// DefaultWaitHeader is the synthetic response header WithWaitHeader sets by default.
+	DefaultWaitHeader = "X-Throttle-Wait"
+
+	// DefaultResetHeader is the header the adaptive transport reads the reset time from by default.
+	DefaultResetHeader = "X-RateLimit-Reset"
+)
+
+type (
+	// TransportOption configures a throttled RoundTripper.
+	// Throttler options, like WithClock, are transport options too:
+	// they apply to every throttler the transport creates by itself, see WithThrottlerOptions.
+	// The constructors panic if the options contradict each other, e.g. WithAdaptiveLimit and WithAIMD.
+	TransportOption interface {
+		applyTransport(opts *transportOptions)
+	}
+
+	// transportOptions holds configuration settings for the throttled RoundTripper.
+	transportOptions struct {
+		throttler           []Option
+		routes              map[string]uint64
+		methods             map[string]uint64
+		methodFallback      uint64
+		retryAfter          time.Duration
+		penalized           map[int]bool
+		penalty             time.Duration
+		retries             int
+		retryable           func(request *http.Request) bool
+		skip                func(request *http.Request) bool
+		hosts               []hostPattern
+		hostPorts           bool
+		hostThrottlers      map[string]*Throttler
+		hostFallback        *Throttler
+		limitWait           bool
+		maxWait             time.Duration
+		trace               *ThrottleTrace
+		exemptRedirects     bool
+		strip               []string
+		upload              uint64
+		download            uint64
+		parseReset          func(value string, now time.Time) (time.Time, bool)
+		backoff             func(response *http.Response, now time.Time) (time.Time, bool)
+		deadlineSlack       time.Duration
+		cooldownAfter       int
+		cooldown            time.Duration
+		cooldownStatuses    []int
+		cooldownFailFast    bool
+		countBypassed       bool
+		weigher             Weigher
+		observe             func(request *http.Request, wait time.Duration)
+		waitContext         bool
+		waitHeader          string
+		maxInFlight         int
+		maxKeys             int
+		unthrottledEmptyKey bool
+		adaptive            bool
+		aimd                bool
+		remaining           string
+		reset               string
+	}
+
+	transportOptionFunc func(opts *transportOptions)
+
+	// FailFastOption is the option of WithFailFast, which applies to both the throttled RoundTripper and NewPacketConn.
+	FailFastOption interface {
+		TransportOption
+		PacketConnOption
+	}
+
+	failFastOption struct{}
+
+	// ThrottleTrace is a set of hooks called when a traced request waits for the rate limit.
+	// Both are optional.
+	ThrottleTrace struct {
+		// Start is called when the request starts waiting, with the estimated wait.
+		// The wait of a limiter other than Throttler can't be estimated, so it's called with the actual one once the wait is over.
+		Start func(request *http.Request, wait time.Duration)
+		// Done is called when the request stops waiting, even if it has given up, with the actual wait.
+		Done func(request *http.Request, wait time.Duration)
+	}
+
+	// Weigher returns the number of slots a request takes.
+	Weigher func(request *http.Request) uint64
+)
+
+func (fn transportOptionFunc) applyTransport(opts *transportOptions) {
+	fn(opts)
+}
+
+func (o Option) applyTransport(opts *transportOptions) {
+	opts.throttler = append(opts.throttler, o)
+}
+
+func buildTransportOptions(setters []TransportOption) *transportOptions {
+	opts := &transportOptions{
+		remaining: DefaultRemainingHeader,
+		reset:     DefaultResetHeader,
+		retryable: IsReplayable,
+	}
+
+	for _, setter := range setters {
+		setter.applyTransport(opts)
+	}
+
+	if err := opts.validate(); err != nil {
+		panic("throttle: " + err.Error())
+	}
+
+	return opts
+}
+
+// validate rejects the options that contradict each other.
+func (opts *transportOptions) validate() error {
+	if opts.adaptive && opts.aimd {
+		return errors.New("WithAdaptiveLimit and WithAIMD can't be combined, since both set the limit")
+	}
+
+	if opts.hostThrottlers != nil && (opts.routes != nil || opts.methods != nil) {
+		return errors.New("WithHostThrottlers can't be combined with WithRouteLimits or WithMethodLimits, since it replaces them")
+	}
+
+	return nil
+}
+
+// WithThrottlerOptions sets the options of every throttler the transport creates by itself, e.g. WithClock.
+// It's the same as passing the options to the constructor directly, but keeps them apart from the transport ones.
+func WithThrottlerOptions(setters ...Option) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.throttler = append(opts.throttler, setters...)
+	})
+}
+
+// WithRouteLimits sets separate limits for the request paths matching the specified patterns.
+// Every pattern gets its own throttler, while the requests matching none of them share the default one.
+// A pattern without wildcards matches the path itself and everything below it, e.g. "/items" matches "/items" and "/items/42", but not "/itemsx".
+// A pattern with wildcards is matched against the whole path using path.Match, e.g. "/items/*/reviews".
+// If several patterns match, the longest one wins, and a pattern without wildcards wins over a pattern with them of the same length.
+// A zero limit leaves the matching requests unthrottled.
+func WithRouteLimits(limits map[string]uint64) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.routes = limits
+	})
+}
+
+// WithMethodLimits sets separate limits for the groups of HTTP methods.
+// A group is a comma-separated list of methods sharing a throttler, e.g. "POST,PUT,PATCH,DELETE", matched case-insensitively.
+// The methods that are not listed share a throttler with the fallback limit.
+// Routes set by WithRouteLimits take precedence, so the method limits apply to the requests matching no route,
+// which are then not paced by the default throttler of the transport. A zero limit leaves the matching requests unthrottled.
+func WithMethodLimits(limits map[string]uint64, fallback uint64) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.methods = limits
+		opts.methodFallback = fallback
+	})
+}
+
+// WithRetryAfter makes the transport honor the Retry-After header of 429 and 503 responses.
+// The throttler that has paced the request is paused until the deadline, so the following requests are held back.
+// Deadlines further than maxDelay are cut down to it. If maxDelay is not positive, DefaultRetryAfterCap is used.
+func WithRetryAfter(maxDelay time.Duration) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		if maxDelay <= 0 {
+			maxDelay = DefaultRetryAfterCap
+		}
+
+		opts.retryAfter = maxDelay
+	})
+}
+
+// WithFailFast makes the requests that would have to wait for the rate limit fail right away with a *LimitError,
+// which matches ErrLimitExceeded with errors.Is and hints when to retry, e.g. so the caller can serve cached data instead.
+// The rejected requests neither reach the network nor take any slots.
+// It applies to NewPacketConn as well, whose packets that would have to wait are not written.
+func WithFailFast() FailFastOption {
+	return failFastOption{}
+}
+
+func (failFastOption) applyTransport(opts *transportOptions) {
+	opts.limitWait = true
+	opts.maxWait = 0
+}
+
+// WithMaxWaitPerRequest makes the requests that would have to wait for the rate limit longer than maxWait fail right away with a *LimitError,
+// which matches ErrLimitExceeded with errors.Is and holds the estimated wait, e.g. so the caller can degrade gracefully.
+// The wait is still given up on once the request context is done, whichever comes first.
+// A zero maxWait is the same as WithFailFast.
+func WithMaxWaitPerRequest(maxWait time.Duration) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.limitWait = true
+		opts.maxWait = max(maxWait, 0)
+	})
+}
+
+// WithDeadlineSlack sets how much the estimated wait may outlast the deadline of the request context.
+// A request whose wait outlasts the deadline by more is rejected right away with an error matching context.DeadlineExceeded,
+// rather than waiting for the deadline in vain. The slack accounts for the wait turning out shorter than estimated,
+// e.g. when the waiting requests ahead give up. By default, there is none.
+// The deadline is measured on the clock of the throttler, so a custom clock should tell the real time, which the deadline is set in.
+func WithDeadlineSlack(slack time.Duration) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.deadlineSlack = max(slack, 0)
+	})
+}
+
+// WithTraceHook sets the hooks called when a request traced with httptrace, i.e. carrying a *httptrace.ClientTrace, waits for the rate limit,
+// so the throttling delay can be told apart from the other phases of the request.
+// The hooks are called only if the request actually waits, which is also recorded in its context, see WaitFromContext.
+func WithTraceHook(trace ThrottleTrace) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.trace = &trace
+	})
+}
+
+// WithExemptRedirects exempts the redirect hops followed by http.Client from throttling, so a request takes slots only once,
+// e.g. when the server counts only the final requests. By default, every hop is throttled as a request of its own.
+// A hop is told apart by the response that has caused it, which the client sets on the request.
+func WithExemptRedirects() TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.exemptRedirects = true
+	})
+}
+
+// WithSkip exempts the requests the predicate returns true for from throttling, e.g. health checks or CORS preflights.
+// They are passed straight to the underlying transport without taking any slots. The predicate is called once per request.
+func WithSkip(predicate func(request *http.Request) bool) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.skip = predicate
+	})
+}
+
+// WithHosts limits throttling to the requests to the specified hosts, while the others are passed straight to the underlying transport.
+// A host is matched exactly or, if it starts with "*.", as a wildcard subdomain, e.g. "*.vendor.com" matches "api.vendor.com", but not "vendor.com".
+// Hosts are matched case-insensitively and regardless of the port, unless WithHostPorts is set.
+// Note that a request to a host that is not listed is never throttled, even by WithRequestThrottler.
+func WithHosts(hosts ...string) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.hosts = newHostPatterns(hosts)
+	})
+}
+
+// WithHostPorts makes the hosts listed with a port, e.g. "api.vendor.com:8443", be matched with it.
+// A request without a port is matched with the default one of its scheme, and a host listed without a port matches any.
+func WithHostPorts() TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.hostPorts = true
+	})
+}
+
+// WithHostThrottlers paces the requests by the throttlers of their hosts, e.g. when a client talks to several APIs with separate quotas.
+// Hosts are looked up case-insensitively and regardless of the port, and the requests to the hosts that are not listed are paced by the fallback.
+// A nil fallback, as well as a nil throttler of a host, lets the requests through unthrottled.
+// The host throttlers replace the default throttler of the transport, so it can't be combined with WithRouteLimits and WithMethodLimits.
+func WithHostThrottlers(throttlers map[string]*Throttler, fallback *Throttler) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.hostThrottlers = throttlers
+		opts.hostFallback = fallback
+	})
+}
+
+// WithBypassCounted makes the requests bypassing the limit with WithBypass take slots as well, without waiting for them.
+// If the current window is exhausted, the slot is taken from the following one, so the average rate stays honest.
+func WithBypassCounted() TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.countBypassed = true
+	})
+}
+
+// WithWeigher makes every request take as many slots as the weigher returns, e.g. ByContentLength.
+// A zero weight leaves the request unthrottled.
+func WithWeigher(weigher Weigher) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.weigher = weigher
+	})
+}
+
+// ByContentLength returns a Weigher that makes a request take a slot per bytesPerUnit bytes of its body, rounded up, and at least one.
+// The requests whose body length is unknown, e.g. the chunked ones, take the unknown weight.
+func ByContentLength(bytesPerUnit int64, unknown uint64) Weigher {
+	bytesPerUnit = max(bytesPerUnit, 1)
+
+	return func(request *http.Request) uint64 {
+		length := request.ContentLength
+
+		// an outgoing request with a body and a zero length has the length unknown
+		if length < 0 || (length == 0 && request.Body != nil && request.Body != http.NoBody) {
+			return unknown
+		}
+
+		return max(uint64((length+bytesPerUnit-1)/bytesPerUnit), 1)
+	}
+}
+
+// ByMethod returns a Weigher that makes the requests with a safe method, that is GET, HEAD, OPTIONS and TRACE, take the safe weight,
+// and the other ones, e.g. POST and DELETE, take the unsafe weight.
+func ByMethod(safe, unsafe uint64) Weigher {
+	return func(request *http.Request) uint64 {
+		switch request.Method {
+		case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			return safe
+		default:
+			return unsafe
+		}
+	}
+}
+
+// ByHeader returns a Weigher that makes a request take as many slots as the integer in its header, e.g. a cost set by the caller.
+// The requests without the header take a slot, as well as the ones whose header can't be parsed, which are reported to onError, if it's set.
+// The header can be kept from the server with WithStripHeaders.
+func ByHeader(name string, onError func(request *http.Request, err error)) Weigher {
+	return func(request *http.Request) uint64 {
+		value := request.Header.Get(name)
+
+		if value == "" {
+			return 1
+		}
+
+		weight, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+
+		if err != nil {
+			if onError != nil {
+				onError(request, err)
+			}
+
+			return 1
+		}
+
+		return weight
+	}
+}
+
+// WithStripHeaders removes the headers from the requests before they are sent, e.g. the ones only meant for the transport, like a cost read by ByHeader.
+// The request is cloned rather than changed, as http.RoundTripper requires.
+func WithStripHeaders(names ...string) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.strip = append(opts.strip, names...)
+	})
+}
+
+// WithUploadBandwidth caps the bytes of the request bodies sent per second, shared by all the requests of the transport.
+// The bodies, including the ones made by GetBody for retries, are read by the underlying transport at that pace,
+// while their content length is left intact. The window of the bandwidth throttler follows the throttler options, e.g. WithWindow.
+func WithUploadBandwidth(bytesPerSec uint64) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.upload = bytesPerSec
+	})
+}
+
+// WithDownloadBandwidth caps the bytes of the response bodies received per second, shared by all the requests of the transport.
+// The bodies are paced by a PacedReader as they are read, while the headers, including the content length, are left intact.
+// Closing a body stops its pending reads right away.
+func WithDownloadBandwidth(bytesPerSec uint64) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.download = bytesPerSec
+	})
+}
+
+// WithWaitObserver sets a callback that is called once the request is admitted, right before it is sent,
+// with the time it has spent waiting, zero if none. Retried requests are reported on every attempt.
+// The callback is called without holding any locks.
+func WithWaitObserver(observer func(request *http.Request, wait time.Duration)) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.observe = observer
+	})
+}
+
+// WithWaitContext makes the transport record the time a request has spent waiting in the request context,
+// where WaitFromContext finds it, e.g. WaitFromContext(response.Request.Context()).
+func WithWaitContext() TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.waitContext = true
+	})
+}
+
+// WithWaitHeader makes the transport set a synthetic header with the time a request has spent waiting, e.g. "1.5s", on the response.
+// If the name is empty, DefaultWaitHeader is used.
+func WithWaitHeader(name string) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		if name == "" {
+			name = DefaultWaitHeader
+		}
+
+		opts.waitHeader = name
+	})
+}
+
+// WithMaxInFlight caps the number of requests in flight in addition to the rate limit.
+// A request holds its slot until the response body is closed, the request fails, or its context is done.
+// Like with any http.Client, the response bodies have to be closed, otherwise the slots of the requests
+// whose context is never done are never given back.
+func WithMaxInFlight(n int) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.maxInFlight = n
+	})
+}
+
+// WithMaxKeys sets the number of keys NewKeyedRoundTripper keeps throttlers for, DefaultMaxKeys by default,
+// or the number of keys KeyedThrottler does, unbounded by default.
+// Beyond it, the throttler of the least recently used key is evicted, so the key starts afresh once it is seen again.
+func WithMaxKeys(n int) KeysOption {
+	return maxKeysOption(n)
+}
+
+// WithUnthrottledEmptyKey makes NewKeyedRoundTripper leave the requests with an empty key unthrottled
+// instead of pacing them with a bucket of their own.
+func WithUnthrottledEmptyKey() TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.unthrottledEmptyKey = true
+	})
+}
+
+// WithRetryOn429 makes the transport retry the requests answered with 429 up to maxAttempts times.
+// Before a retry, the throttler is paused until the deadline set by the Retry-After header or, if there is none, until its next window.
+// Only the requests that are safe to replay are retried, as decided by IsReplayable or the predicate set by WithRetryable.
+// The body of a failed response is drained and closed, and once the attempts are used up, the last response is returned.
+func WithRetryOn429(maxAttempts int) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.retries = max(maxAttempts, 0)
+	})
+}
+
+// WithRetryable sets the predicate deciding whether a request is safe to retry with WithRetryOn429.
+// The request body is replayed by GetBody, so the requests with a body and without GetBody are never retried regardless of the predicate.
+func WithRetryable(predicate func(request *http.Request) bool) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		if predicate == nil {
+			predicate = IsReplayable
+		}
+
+		opts.retryable = predicate
+	})
+}
+
+// WithPenalty makes the transport pause the throttler that has paced a request for the specified duration
+// once the response comes with one of the listed status codes, e.g. 429 and 503, without retrying the request.
+// Overlapping penalties extend the pause rather than add up. Retry-After is honored separately with WithRetryAfter.
+func WithPenalty(on []int, d time.Duration) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.penalized = make(map[int]bool, len(on))
+		opts.penalty = d
+
+		for _, status := range on {
+			opts.penalized[status] = true
+		}
+	})
+}
+
+// WithErrorCooldown makes the transport hold all requests for the cooldown once consecutive requests in a row
+// have failed with a transport error or a status listed by WithCooldownStatuses, DefaultCooldownStatuses by default.
+// The held requests wait for the cooldown to pass, or fail with ErrCooldown if WithCooldownFailFast is set.
+// Then a single request is let through as a probe: if it succeeds, the transport reopens, otherwise the cooldown starts over.
+func WithErrorCooldown(consecutive int, cooldown time.Duration) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.cooldownAfter = consecutive
+		opts.cooldown = cooldown
+	})
+}
+
+// WithCooldownStatuses sets the response statuses WithErrorCooldown counts as failures.
+func WithCooldownStatuses(statuses ...int) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.cooldownStatuses = statuses
+	})
+}
+
+// WithCooldownFailFast makes the requests held by WithErrorCooldown fail with ErrCooldown right away instead of waiting.
+// The requests arriving while the probe is in flight fail too.
+func WithCooldownFailFast() TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.cooldownFailFast = true
+	})
+}
+
+// WithAdaptiveLimit makes the transport follow the rate limit advertised by the server in the response headers.
+// The standard RateLimit and RateLimit-Policy fields are preferred, with the most restrictive quota taken into account,
+// while the headers named by WithRateLimitHeaders are used when they are absent.
+// When the remaining requests are few for the time left until the reset, the limit is lowered to spread them evenly,
+// and once they are used up, the requests are held until the reset. Then the configured limit applies again.
+// The requests sent before the reset never outnumber the advertised remaining ones.
+// The headers are read per throttler, so with WithRouteLimits every route adapts on its own.
+func WithAdaptiveLimit() TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.adaptive = true
+	})
+}
+
+// WithAIMD makes the transport adapt the limit to the outcomes of the requests, starting at the configured limit:
+// the limit is halved, down to 1, once per window that has seen a 429 or 503 response,
+// and raised by one after every window without them, up to the configured limit.
+// The current limit is reported by EffectiveLimit. It can't be combined with WithAdaptiveLimit, which sets the limit too.
+func WithAIMD() TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		opts.aimd = true
+	})
+}
+
+// WithProvider configures the transport for a well-known API described by the profile, e.g. ProfileGitHub:
+// it adapts to the advertised quota, honors Retry-After and backs off as the API expects.
+// See LookupProfile for the profiles registered by name.
+func WithProvider(profile Profile) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		if profile.RemainingHeader != "" && profile.ResetHeader != "" {
+			opts.adaptive = true
+			opts.remaining = profile.RemainingHeader
+			opts.reset = profile.ResetHeader
+			opts.parseReset = profile.ParseReset
+		}
+
+		if profile.RetryAfter > 0 {
+			opts.retryAfter = profile.RetryAfter
+		}
+
+		opts.backoff = profile.Backoff
+	})
+}
+
+// WithRateLimitHeaders sets the names of the headers WithAdaptiveLimit reads.
+// The reset header holds either a Unix time or a number of seconds until the reset.
+// Empty names keep DefaultRemainingHeader and DefaultResetHeader.
+func WithRateLimitHeaders(remaining, reset string) TransportOption {
+	return transportOptionFunc(func(opts *transportOptions) {
+		if remaining != "" {
+			opts.remaining = remaining
+		}
+
+		if reset != "" {
+			opts.reset = reset
+		}
+	})
+}
+
+// start calls the Start hook, if any.
+func (trace *ThrottleTrace) start(request *http.Request, wait time.Duration) {
+	if trace.Start != nil {
+		trace.Start(request, wait)
+	}
+}
+
+// done calls the Done hook, if any.
+func (trace *ThrottleTrace) done(request *http.Request, wait time.Duration) {
+	if trace.Done != nil {
+		trace.Done(request, wait)
+	}
+}
@@ -0,0 +1,2543 @@
+package throttle_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+// newCountingServer starts a test server that counts the requests it receives.
+func newCountingServer(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	var received atomic.Int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, &received
+}
+
+func doRequest(client *http.Client, ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func TestRoundTripper_ContextCancelled(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, 1, throttle.WithClock(clock)),
+	}
+
+	if err := doRequest(client, context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- doRequest(client, ctx, server.URL)
+	}()
+
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the cancelled request to return before the window opens")
+	}
+
+	if actual := received.Load(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 1 request, but got %d", actual))
+	}
+
+	// the cancelled request has given its slot back, so the next window is free
+	clock.Advance(time.Second)
+
+	go func() {
+		done <- doRequest(client, context.Background(), server.URL)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request not to wait for the following window")
+	}
+
+	if actual := received.Load(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 2 requests, but got %d", actual))
+	}
+}
+
+// goRequest sends a request in the background and returns a channel with its result.
+func goRequest(client *http.Client, url string) <-chan error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- doRequest(client, context.Background(), url)
+	}()
+
+	return done
+}
+
+func TestRoundTripper_RouteLimits(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			1,
+			throttle.WithClock(clock),
+			throttle.WithRouteLimits(map[string]uint64{
+				"/items":           2,
+				"/items/*/reviews": 1,
+				"/items/special":   1,
+				"/health":          0,
+			}),
+		),
+	}
+
+	// every class takes as many requests as its limit allows without waiting
+	immediate := []string{
+		"/items",
+		"/items/1",
+		"/items/1/reviews",
+		"/items/special/1",
+		"/other",
+		"/health",
+		"/health",
+		"/health",
+	}
+
+	for _, p := range immediate {
+		select {
+		case err := <-goRequest(client, server.URL+p):
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error for %s, but got %s", p, err))
+			}
+		case <-time.After(time.Second):
+			t.Fatal(fmt.Sprintf("Expected %s not to wait", p))
+		}
+	}
+
+	// the next request of every class waits for the following window
+	waiting := []string{
+		"/items/2",
+		"/items/2/reviews",
+		"/items/special",
+		"/itemsx",
+	}
+
+	results := make([]<-chan error, 0, len(waiting))
+
+	for i, p := range waiting {
+		results = append(results, goRequest(client, server.URL+p))
+		clock.BlockUntilSleepers(i + 1)
+	}
+
+	if actual := received.Load(); actual != int64(len(immediate)) {
+		t.Fatal(fmt.Sprintf("Expected the server to receive %d requests, but got %d", len(immediate), actual))
+	}
+
+	clock.Advance(time.Second)
+
+	for i, done := range results {
+		if err := <-done; err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error for %s, but got %s", waiting[i], err))
+		}
+	}
+}
+
+func TestRoundTripper_RouteLimits_Precedence(t *testing.T) {
+	useCases := []struct {
+		Name   string
+		Routes map[string]uint64
+		Path   string
+		Shared string
+	}{
+		{
+			Name:   "longer prefix wins",
+			Routes: map[string]uint64{"/a": 1, "/a/b": 1},
+			Path:   "/a/b/c",
+			Shared: "/a/b",
+		},
+		{
+			Name:   "longer glob wins over prefix",
+			Routes: map[string]uint64{"/a/b": 1, "/a/*/c": 1},
+			Path:   "/a/b/c",
+			Shared: "/a/x/c",
+		},
+		{
+			Name:   "prefix wins over glob of the same length",
+			Routes: map[string]uint64{"/a/b": 1, "/a/*": 1},
+			Path:   "/a/b",
+			Shared: "/a/b/c",
+		},
+		{
+			Name:   "prefix matches whole segments only",
+			Routes: map[string]uint64{"/a": 1},
+			Path:   "/ab",
+			Shared: "/b",
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			server, _ := newCountingServer(t)
+			clock := throttletest.NewManualClock(epoch)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(
+					http.DefaultTransport,
+					1,
+					throttle.WithClock(clock),
+					throttle.WithRouteLimits(useCase.Routes),
+				),
+			}
+
+			if err := doRequest(client, context.Background(), server.URL+useCase.Path); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			// a request of the same class has to wait
+			done := goRequest(client, server.URL+useCase.Shared)
+
+			select {
+			case <-done:
+				t.Fatal(fmt.Sprintf("Expected %s to share the class of %s", useCase.Shared, useCase.Path))
+			case <-time.After(time.Millisecond * 50):
+			}
+
+			clock.BlockUntilSleepers(1)
+			clock.Advance(time.Second)
+
+			if err := <-done; err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+		})
+	}
+}
+
+func TestRoundTripper_RetryAfter(t *testing.T) {
+	useCases := []struct {
+		Name       string
+		RetryAfter string
+		Cap        time.Duration
+		Expected   time.Duration
+	}{
+		{
+			Name:       "delta seconds",
+			RetryAfter: "3",
+			Expected:   time.Second * 3,
+		},
+		{
+			Name:       "HTTP date",
+			RetryAfter: epoch.Add(time.Second * 4).Format(http.TimeFormat),
+			Expected:   time.Second * 4,
+		},
+		{
+			Name:       "capped",
+			RetryAfter: "3600",
+			Cap:        time.Second * 2,
+			Expected:   time.Second * 2,
+		},
+		{
+			Name:       "malformed",
+			RetryAfter: "soon",
+			Expected:   0,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var calls atomic.Int64
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Header().Set("Retry-After", useCase.RetryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			t.Cleanup(server.Close)
+
+			clock := throttletest.NewManualClock(epoch)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(
+					http.DefaultTransport,
+					10,
+					throttle.WithClock(clock),
+					throttle.WithRetryAfter(useCase.Cap),
+				),
+			}
+
+			if err := doRequest(client, context.Background(), server.URL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			done := goRequest(client, server.URL)
+
+			if useCase.Expected > 0 {
+				clock.BlockUntilSleepers(1)
+				clock.Advance(useCase.Expected - time.Millisecond)
+
+				select {
+				case <-done:
+					t.Fatal(fmt.Sprintf("Expected the request to be held for %s", useCase.Expected))
+				case <-time.After(time.Millisecond * 50):
+				}
+
+				clock.Advance(time.Millisecond)
+			}
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+			case <-time.After(time.Second):
+				t.Fatal(fmt.Sprintf("Expected the request to be sent after %s", useCase.Expected))
+			}
+		})
+	}
+}
+
+// newQuotaServer starts a test server that accepts quota requests per window of the clock
+// and advertises the remaining ones with the specified headers.
+func newQuotaServer(t *testing.T, clock throttle.Clock, quota int, window time.Duration, advertise func(h http.Header, remaining int, reset, now time.Time)) (*httptest.Server, func() map[int][]time.Duration) {
+	var mu sync.Mutex
+	received := make(map[int][]time.Duration)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := clock.Now()
+		elapsed := now.Sub(epoch)
+		idx := int(elapsed / window)
+		received[idx] = append(received[idx], elapsed)
+
+		advertise(w.Header(), max(quota-len(received[idx]), 0), epoch.Add(window*time.Duration(idx+1)), now)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() map[int][]time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return received
+	}
+}
+
+// await waits for the result of a request, advancing the clock whenever the request is the only one waiting for it.
+func await(clock *throttletest.ManualClock, done <-chan error) error {
+	for {
+		select {
+		case err := <-done:
+			return err
+		// polling with a timer rather than yielding lets the network poller run on a single CPU
+		case <-time.After(time.Millisecond):
+			if clock.Sleepers() == 1 {
+				clock.AdvanceToNext()
+			}
+		}
+	}
+}
+
+// sendSequentially sends n requests one after another, advancing the clock whenever the next one waits.
+func sendSequentially(t *testing.T, client *http.Client, clock *throttletest.ManualClock, url string, n int) {
+	for i := range n {
+		if err := await(clock, goRequest(client, url)); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error for request #%d, but got %s", i, err))
+		}
+	}
+}
+
+func TestRoundTripper_AdaptiveLimit(t *testing.T) {
+	useCases := []struct {
+		Name      string
+		Options   []throttle.TransportOption
+		Advertise func(h http.Header, remaining int, reset, now time.Time)
+	}{
+		{
+			Name: "default headers with Unix time",
+			Advertise: func(h http.Header, remaining int, reset, _ time.Time) {
+				h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+				h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			},
+		},
+		{
+			Name:    "custom headers with seconds",
+			Options: []throttle.TransportOption{throttle.WithRateLimitHeaders("Quota-Left", "Quota-Reset-In")},
+			Advertise: func(h http.Header, remaining int, reset, now time.Time) {
+				h.Set("Quota-Left", strconv.Itoa(remaining))
+				h.Set("Quota-Reset-In", strconv.Itoa(int(reset.Sub(now)/time.Second)))
+			},
+		},
+		{
+			Name: "standard fields preferred",
+			Advertise: func(h http.Header, remaining int, reset, now time.Time) {
+				h.Set("RateLimit-Policy", `"burst";q=5;w=10, "daily";q=1000;w=86400`)
+				h.Set("RateLimit", fmt.Sprintf(`"burst";r=%d;t=%d, "daily";r=900;t=86000`, remaining, int(reset.Sub(now)/time.Second)))
+				h.Set("X-RateLimit-Remaining", "1000")
+				h.Set("X-RateLimit-Reset", "1")
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			clock := throttletest.NewManualClock(epoch)
+			server, received := newQuotaServer(t, clock, 5, time.Second*10, useCase.Advertise)
+
+			setters := append([]throttle.TransportOption{throttle.WithClock(clock), throttle.WithAdaptiveLimit()}, useCase.Options...)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(http.DefaultTransport, 10, setters...),
+			}
+
+			sendSequentially(t, client, clock, server.URL, 15)
+
+			windows := received()
+
+			for idx := range 3 {
+				arrivals := windows[idx]
+
+				if len(arrivals) != 5 {
+					t.Fatal(fmt.Sprintf("Expected the server to receive 5 requests in window #%d, but got %v", idx, arrivals))
+				}
+
+				// the advertised requests are spread over the window rather than sent at once
+				for i := 1; i < len(arrivals); i++ {
+					if arrivals[i]-arrivals[i-1] < time.Second {
+						t.Fatal(fmt.Sprintf("Expected the requests of window #%d to be spread, but got %v", idx, arrivals))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTripper_RetryOn429(t *testing.T) {
+	useCases := []struct {
+		Name      string
+		Failures  int64
+		Retries   int
+		Retryable func(req *http.Request) bool
+		Request   func(url string) *http.Request
+		Status    int
+		Received  int64
+	}{
+		{
+			Name:     "success after retry",
+			Failures: 2,
+			Retries:  3,
+			Request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodGet, url, nil)
+
+				return req
+			},
+			Status:   http.StatusOK,
+			Received: 3,
+		},
+		{
+			Name:     "exhaustion",
+			Failures: 10,
+			Retries:  2,
+			Request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodGet, url, nil)
+
+				return req
+			},
+			Status:   http.StatusTooManyRequests,
+			Received: 3,
+		},
+		{
+			Name:     "POST without GetBody",
+			Failures: 1,
+			Retries:  3,
+			Request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodPost, url, io.NopCloser(strings.NewReader("payload")))
+
+				return req
+			},
+			Status:   http.StatusTooManyRequests,
+			Received: 1,
+		},
+		{
+			Name:     "POST with idempotency key",
+			Failures: 1,
+			Retries:  3,
+			Request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("payload"))
+				req.Header.Set("Idempotency-Key", "42")
+
+				return req
+			},
+			Status:   http.StatusOK,
+			Received: 2,
+		},
+		{
+			Name:     "POST with custom predicate",
+			Failures: 1,
+			Retries:  3,
+			Retryable: func(req *http.Request) bool {
+				return req.Method == http.MethodPost
+			},
+			Request: func(url string) *http.Request {
+				req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("payload"))
+
+				return req
+			},
+			Status:   http.StatusOK,
+			Received: 2,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var received atomic.Int64
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if body, _ := io.ReadAll(r.Body); r.Method == http.MethodPost && string(body) != "payload" {
+					t.Error(fmt.Sprintf("Expected the body to be replayed, but got %q", body))
+				}
+
+				if received.Add(1) <= useCase.Failures {
+					w.WriteHeader(http.StatusTooManyRequests)
+					io.WriteString(w, "slow down")
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			t.Cleanup(server.Close)
+
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(
+					http.DefaultTransport,
+					10,
+					throttle.WithWindow(time.Millisecond*10),
+					throttle.WithRetryOn429(useCase.Retries),
+					throttle.WithRetryable(useCase.Retryable),
+				),
+			}
+
+			res, err := client.Do(useCase.Request(server.URL))
+
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			defer res.Body.Close()
+
+			if res.StatusCode != useCase.Status {
+				t.Fatal(fmt.Sprintf("Expected status %d, but got %d", useCase.Status, res.StatusCode))
+			}
+
+			// the last response is returned intact
+			if body, _ := io.ReadAll(res.Body); res.StatusCode == http.StatusTooManyRequests && string(body) != "slow down" {
+				t.Fatal(fmt.Sprintf("Expected the body of the last response, but got %q", body))
+			}
+
+			if actual := received.Load(); actual != useCase.Received {
+				t.Fatal(fmt.Sprintf("Expected the server to receive %d requests, but got %d", useCase.Received, actual))
+			}
+		})
+	}
+}
+
+func TestRoundTripper_RetryOn429_RetryAfter(t *testing.T) {
+	var calls atomic.Int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, 10, throttle.WithClock(clock), throttle.WithRetryOn429(1)),
+	}
+
+	done := goRequest(client, server.URL)
+
+	clock.BlockUntilSleepers(1)
+
+	if actual := clock.SleepCalls(); actual[len(actual)-1] != time.Second*3 {
+		t.Fatal(fmt.Sprintf("Expected the retry to wait for 3s, but got %s", actual[len(actual)-1]))
+	}
+
+	clock.Advance(time.Second * 3)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := calls.Load(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 2 requests, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_Skip(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+
+	var checked atomic.Int64
+
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			1,
+			throttle.WithClock(clock),
+			throttle.WithSkip(func(req *http.Request) bool {
+				checked.Add(1)
+
+				return req.URL.Path == "/health" || req.Method == http.MethodOptions
+			}),
+		),
+	}
+
+	if err := doRequest(client, context.Background(), server.URL+"/items"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// the window is exhausted, so the next throttled request waits
+	throttled := goRequest(client, server.URL+"/items")
+	clock.BlockUntilSleepers(1)
+
+	// while the skipped ones go right away
+	for range 3 {
+		if err := doRequest(client, context.Background(), server.URL+"/health"); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		req, _ := http.NewRequest(http.MethodOptions, server.URL+"/items", nil)
+		res, err := client.Do(req)
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		res.Body.Close()
+	}
+
+	if actual := received.Load(); actual != 7 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 7 requests, but got %d", actual))
+	}
+
+	if actual := clock.Sleepers(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected the throttled request to keep waiting, but got %d sleepers", actual))
+	}
+
+	clock.Advance(time.Second)
+
+	if err := <-throttled; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := checked.Load(); actual != 8 {
+		t.Fatal(fmt.Sprintf("Expected the predicate to be called once per request, but got %d calls", actual))
+	}
+}
+
+func TestRoundTripper_RequestThrottler(t *testing.T) {
+	server, _ := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, 1, throttle.WithClock(clock)),
+	}
+
+	admin := throttle.New(3, throttle.WithClock(clock))
+	adminCtx := throttle.WithRequestThrottler(context.Background(), admin)
+
+	// every stream takes as many requests as its own limit allows
+	for range 3 {
+		if err := doRequest(client, adminCtx, server.URL); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	if err := doRequest(client, context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// then both of them wait
+	normal := goRequest(client, server.URL)
+	clock.BlockUntilSleepers(1)
+
+	adminDone := make(chan error, 1)
+
+	go func() {
+		adminDone <- doRequest(client, adminCtx, server.URL)
+	}()
+
+	clock.BlockUntilSleepers(2)
+
+	// the override is paced by its own throttler only
+	if admin.TryAcquire() {
+		t.Fatal("Expected the admin throttler to be exhausted")
+	}
+
+	clock.Advance(time.Second)
+
+	for _, done := range []<-chan error{normal, adminDone} {
+		if err := <-done; err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+}
+
+func TestRoundTripper_Bypass(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Options []throttle.TransportOption
+		Wait    time.Duration
+	}{
+		{
+			Name: "not counted",
+			Wait: time.Second,
+		},
+		{
+			Name:    "counted",
+			Options: []throttle.TransportOption{throttle.WithBypassCounted()},
+			Wait:    time.Second * 2,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			server, received := newCountingServer(t)
+			clock := throttletest.NewManualClock(epoch)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(
+					http.DefaultTransport,
+					1,
+					append([]throttle.TransportOption{throttle.WithClock(clock)}, useCase.Options...)...,
+				),
+			}
+
+			if err := doRequest(client, context.Background(), server.URL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			// the window is saturated, but the bypassed request goes out right away
+			if err := doRequest(client, throttle.WithBypass(context.Background()), server.URL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if actual := received.Load(); actual != 2 {
+				t.Fatal(fmt.Sprintf("Expected the server to receive 2 requests, but got %d", actual))
+			}
+
+			done := goRequest(client, server.URL)
+			clock.BlockUntilSleepers(1)
+
+			if actual := clock.SleepCalls(); actual[len(actual)-1] != useCase.Wait {
+				t.Fatal(fmt.Sprintf("Expected the next request to wait for %s, but got %s", useCase.Wait, actual[len(actual)-1]))
+			}
+
+			clock.Advance(useCase.Wait)
+
+			if err := <-done; err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+		})
+	}
+}
+
+func TestThrottledRoundTripper_Accessors(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	transport := throttle.NewTransport(http.DefaultTransport, 1, throttle.WithClock(clock))
+	client := &http.Client{Transport: transport}
+
+	if transport.Transport() != http.DefaultTransport {
+		t.Fatal("Expected the underlying transport to be returned")
+	}
+
+	// raise the limit at runtime
+	transport.Throttler().SetLimit(3)
+
+	for range 3 {
+		select {
+		case err := <-goRequest(client, server.URL):
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the raised limit to apply right away")
+		}
+	}
+
+	if actual := received.Load(); actual != 3 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 3 requests, but got %d", actual))
+	}
+}
+
+// idleClosingTransport is a stub transport that records the calls of CloseIdleConnections.
+type idleClosingTransport struct {
+	roundTripperFunc
+	closed atomic.Int64
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	t.closed.Add(1)
+}
+
+func TestThrottledRoundTripper_CloseIdleConnections(t *testing.T) {
+	stub := &idleClosingTransport{}
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(stub, 1),
+	}
+
+	client.CloseIdleConnections()
+
+	if actual := stub.closed.Load(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected CloseIdleConnections to be delegated once, but got %d calls", actual))
+	}
+
+	// a transport without CloseIdleConnections is left alone
+	throttle.NewTransport(roundTripperFunc(nil), 1).CloseIdleConnections()
+}
+
+func TestThrottledRoundTripper_Unwrap(t *testing.T) {
+	stub := &idleClosingTransport{}
+	var transport http.RoundTripper = throttle.NewRoundTripper(stub, 1)
+
+	unwrapper, ok := transport.(interface{ Unwrap() http.RoundTripper })
+
+	if !ok {
+		t.Fatal("Expected the transport to implement Unwrap")
+	}
+
+	if unwrapper.Unwrap() != stub {
+		t.Fatal("Expected Unwrap to return the underlying transport")
+	}
+}
+
+func TestRoundTripper_NilTransport(t *testing.T) {
+	server, received := newCountingServer(t)
+	transport := throttle.NewTransport(nil, 1)
+
+	if transport.Transport() != http.DefaultTransport {
+		t.Fatal("Expected a nil transport to stand for http.DefaultTransport")
+	}
+
+	if err := doRequest(&http.Client{Transport: transport}, context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := received.Load(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 1 request, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_NilThrottler(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		New      func()
+		Expected string
+	}{
+		{
+			Name: "throttler",
+			New: func() {
+				throttle.NewRoundTripperWith(http.DefaultTransport, nil)
+			},
+			Expected: "throttle: nil throttler",
+		},
+		{
+			Name: "limiter",
+			New: func() {
+				throttle.NewRoundTripperWithLimiter(http.DefaultTransport, nil)
+			},
+			Expected: "throttle: nil limiter",
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			defer func() {
+				if actual := recover(); actual != useCase.Expected {
+					t.Fatal(fmt.Sprintf("Expected to panic with %q, but got %v", useCase.Expected, actual))
+				}
+			}()
+
+			useCase.New()
+		})
+	}
+}
+
+func TestRoundTripper_Weigher(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+
+	var mu sync.Mutex
+	var received []time.Duration
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+
+		mu.Lock()
+		received = append(received, clock.Now().Sub(epoch))
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			10,
+			throttle.WithClock(clock),
+			throttle.WithWeigher(throttle.ByContentLength(100, 4)),
+		),
+	}
+
+	bodies := []io.Reader{
+		// 10 units take the whole first window
+		strings.NewReader(strings.Repeat("x", 1000)),
+		// 5 + 3 units fit into the second one
+		strings.NewReader(strings.Repeat("x", 500)),
+		strings.NewReader(strings.Repeat("x", 201)),
+		// 4 units of the unknown length spill over into the third one
+		io.MultiReader(strings.NewReader("unknown")),
+		// a request without a body takes a unit
+		nil,
+	}
+	expected := []time.Duration{0, time.Second, time.Second, time.Second * 2, time.Second * 2}
+
+	for i, body := range bodies {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, body)
+		done := make(chan error, 1)
+
+		go func() {
+			res, err := client.Do(req)
+
+			if err == nil {
+				res.Body.Close()
+			}
+
+			done <- err
+		}()
+
+		if err := await(clock, done); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error for request #%d, but got %s", i, err))
+		}
+	}
+
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Fatal(fmt.Sprintf("Expected request #%d to be received after %s, but got %s", i, expected[i], received[i]))
+		}
+	}
+}
+
+func TestRoundTripper_MethodLimits(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			100,
+			throttle.WithClock(clock),
+			throttle.WithMethodLimits(map[string]uint64{
+				"get":                    3,
+				"POST, put,PATCH,DELETE": 1,
+			}, 2),
+		),
+	}
+
+	send := func(method string) <-chan error {
+		done := make(chan error, 1)
+
+		go func() {
+			req, _ := http.NewRequest(method, server.URL, nil)
+			res, err := client.Do(req)
+
+			if err == nil {
+				res.Body.Close()
+			}
+
+			done <- err
+		}()
+
+		return done
+	}
+
+	expectSent := func(method string) {
+		select {
+		case err := <-send(method):
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error for %s, but got %s", method, err))
+			}
+		case <-time.After(time.Second):
+			t.Fatal(fmt.Sprintf("Expected %s not to wait", method))
+		}
+	}
+
+	// saturate the write limiter
+	expectSent(http.MethodPost)
+
+	var waiting []<-chan error
+
+	waiting = append(waiting, send(http.MethodPut))
+	clock.BlockUntilSleepers(1)
+
+	// reads still flow at their own rate
+	for range 3 {
+		expectSent(http.MethodGet)
+	}
+
+	// and so do the methods that are not listed
+	expectSent(http.MethodHead)
+	expectSent(http.MethodOptions)
+
+	waiting = append(waiting, send(http.MethodGet), send(http.MethodHead), send(http.MethodDelete))
+	clock.BlockUntilSleepers(4)
+
+	if actual := received.Load(); actual != 6 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 6 requests, but got %d", actual))
+	}
+
+	clock.Advance(time.Second)
+
+	// the second write waits for the window after the next one
+	for _, done := range waiting[:3] {
+		if err := <-done; err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	clock.Advance(time.Second)
+
+	if err := <-waiting[3]; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+}
+
+func TestRoundTripper_MaxInFlight(t *testing.T) {
+	var (
+		current atomic.Int64
+		peak    atomic.Int64
+	)
+
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+
+		for {
+			p := peak.Load()
+
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, 100, throttle.WithMaxInFlight(2)),
+	}
+
+	results := make([]<-chan error, 0, 5)
+
+	for range 5 {
+		results = append(results, goRequest(client, server.URL))
+	}
+
+	for current.Load() != 2 {
+		runtime.Gosched()
+	}
+
+	// the slow requests hold their slots, so the rest wait
+	time.Sleep(time.Millisecond * 50)
+
+	if actual := current.Load(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected 2 requests in flight, but got %d", actual))
+	}
+
+	close(release)
+
+	for _, done := range results {
+		if err := <-done; err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	if actual := peak.Load(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected at most 2 requests in flight, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_MaxInFlight_Release(t *testing.T) {
+	server, _ := newCountingServer(t)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, 100, throttle.WithMaxInFlight(2)),
+	}
+
+	send := func(ctx context.Context) <-chan *http.Response {
+		out := make(chan *http.Response, 1)
+
+		go func() {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			res, err := client.Do(req)
+
+			if err != nil {
+				t.Error(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			out <- res
+		}()
+
+		return out
+	}
+
+	expectSent := func(out <-chan *http.Response) *http.Response {
+		select {
+		case res := <-out:
+			return res
+		case <-time.After(time.Second):
+			t.Fatal("Expected the request to take a free slot")
+		}
+
+		return nil
+	}
+
+	expectWaiting := func(out <-chan *http.Response) {
+		select {
+		case <-out:
+			t.Fatal("Expected the request to wait for a slot")
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	first := expectSent(send(context.Background()))
+	second := expectSent(send(context.Background()))
+	third := send(context.Background())
+
+	expectWaiting(third)
+
+	// closing a body twice gives back a single slot
+	first.Body.Close()
+	first.Body.Close()
+
+	fourth := send(context.Background())
+	res := expectSent(third)
+
+	expectWaiting(fourth)
+
+	// a body that is never closed gives its slot back once the request context is done
+	second.Body.Close()
+	res.Body.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	expectSent(fourth).Body.Close()
+	expectSent(send(ctx))
+
+	blocked := expectSent(send(context.Background()))
+	pending := send(context.Background())
+
+	expectWaiting(pending)
+	cancel()
+	expectSent(pending).Body.Close()
+	blocked.Body.Close()
+}
+
+func TestRoundTripper_Limiter(t *testing.T) {
+	server, received := newCountingServer(t)
+	limiter := throttletest.NewFakeLimiter().Grant(1).Reject()
+	transport := throttle.NewTransportWithLimiter(http.DefaultTransport, limiter, throttle.WithWeigher(func(*http.Request) uint64 {
+		return 2
+	}))
+	client := &http.Client{Transport: transport}
+
+	if transport.Limiter() != limiter || transport.Throttler() != nil {
+		t.Fatal("Expected the transport to use the limiter")
+	}
+
+	type ctxKey struct{}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+
+	if err := doRequest(client, ctx, server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if err := doRequest(client, ctx, server.URL); !errors.Is(err, throttletest.ErrRejected) {
+		t.Fatal(fmt.Sprintf("Expected throttletest.ErrRejected, but got %v", err))
+	}
+
+	limiter.AssertCalls(t, "AcquireN", "AcquireN")
+	limiter.AssertAcquired(t, 1)
+
+	for i, call := range limiter.Calls() {
+		if call.Weight != 2 {
+			t.Fatal(fmt.Sprintf("Expected call #%d to take 2 slots, but got %d", i, call.Weight))
+		}
+
+		// the limiter gets the request context to give up on
+		if call.Context.Value(ctxKey{}) != "request" {
+			t.Fatal(fmt.Sprintf("Expected call #%d to get the request context", i))
+		}
+	}
+
+	if actual := received.Load(); actual != 1 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 1 request, but got %d", actual))
+	}
+}
+
+func TestKeyedRoundTripper(t *testing.T) {
+	server, _ := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewKeyedRoundTripper(http.DefaultTransport, 1, func(req *http.Request) string {
+			return req.Header.Get("X-Tenant")
+		}, throttle.WithClock(clock)),
+	}
+
+	send := func(tenant string) <-chan error {
+		done := make(chan error, 1)
+
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			req.Header.Set("X-Tenant", tenant)
+			res, err := client.Do(req)
+
+			if err == nil {
+				res.Body.Close()
+			}
+
+			done <- err
+		}()
+
+		return done
+	}
+
+	// every tenant takes its own slot
+	for _, tenant := range []string{"a", "b", ""} {
+		select {
+		case err := <-send(tenant):
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+		case <-time.After(time.Second):
+			t.Fatal(fmt.Sprintf("Expected tenant %q not to wait", tenant))
+		}
+	}
+
+	// and then waits for its own window
+	waiting := []<-chan error{send("a"), send("b"), send("")}
+	clock.BlockUntilSleepers(3)
+	clock.Advance(time.Second)
+
+	for _, done := range waiting {
+		if err := <-done; err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+}
+
+func TestKeyedRoundTripper_Eviction(t *testing.T) {
+	server, _ := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewKeyedRoundTripper(http.DefaultTransport, 1, func(req *http.Request) string {
+			return strings.TrimPrefix(req.URL.Path, "/")
+		}, throttle.WithClock(clock), throttle.WithMaxKeys(2), throttle.WithUnthrottledEmptyKey()),
+	}
+
+	expectSent := func(path string) {
+		select {
+		case err := <-goRequest(client, server.URL+path):
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+		case <-time.After(time.Second):
+			t.Fatal(fmt.Sprintf("Expected %s not to wait", path))
+		}
+	}
+
+	expectSent("/a")
+	expectSent("/b")
+
+	// the empty key is unthrottled and doesn't take a key
+	for range 3 {
+		expectSent("/")
+	}
+
+	// a third key evicts the least recently used one
+	expectSent("/c")
+
+	// so the evicted key starts afresh
+	expectSent("/a")
+
+	// while the ones that are kept are still exhausted
+	done := goRequest(client, server.URL+"/c")
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Second)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+}
+
+func TestRoundTripper_Penalty(t *testing.T) {
+	var calls atomic.Int64
+
+	// the first two requests are answered with 429 together
+	barrier := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			<-barrier
+		case 2:
+			close(barrier)
+		default:
+			w.WriteHeader(http.StatusOK)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(server.Close)
+
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			10,
+			throttle.WithClock(clock),
+			throttle.WithPenalty([]int{http.StatusTooManyRequests, http.StatusServiceUnavailable}, time.Second*2),
+		),
+	}
+
+	// overlapping penalties extend rather than add up
+	for _, done := range []<-chan error{goRequest(client, server.URL), goRequest(client, server.URL)} {
+		if err := <-done; err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	done := goRequest(client, server.URL)
+	clock.BlockUntilSleepers(1)
+
+	if actual := clock.SleepCalls(); actual[len(actual)-1] != time.Second*2 {
+		t.Fatal(fmt.Sprintf("Expected the next request to be delayed by 2s, but got %s", actual[len(actual)-1]))
+	}
+
+	clock.Advance(time.Second * 2)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := calls.Load(); actual != 3 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 3 requests, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_AIMD(t *testing.T) {
+	const capacity = 5
+
+	clock := throttletest.NewManualClock(epoch)
+
+	var (
+		mu       sync.Mutex
+		received = make(map[time.Duration]int)
+	)
+
+	// the server fails the requests over its capacity per second
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		second := clock.Now().Sub(epoch).Truncate(time.Second)
+		received[second]++
+
+		if received[second] > capacity {
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	transport := throttle.NewTransport(http.DefaultTransport, 20, throttle.WithClock(clock), throttle.WithAIMD())
+	client := &http.Client{Transport: transport}
+
+	var limits []uint64
+
+	for clock.Now().Sub(epoch) < time.Minute {
+		if err := await(clock, goRequest(client, server.URL)); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		if clock.Now().Sub(epoch) >= time.Second*30 {
+			limits = append(limits, transport.EffectiveLimit())
+		}
+	}
+
+	// once converged, the limit oscillates around the capacity of the server
+	for _, limit := range limits {
+		if limit < capacity/2 || limit > capacity+1 {
+			t.Fatal(fmt.Sprintf("Expected the limit to stay near %d, but got %d", capacity, limit))
+		}
+	}
+}
+
+func TestRoundTripper_WaitObserver(t *testing.T) {
+	server, _ := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+
+	var (
+		mu    sync.Mutex
+		waits = make(map[string]time.Duration)
+	)
+
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			1,
+			throttle.WithClock(clock),
+			throttle.WithWaitObserver(func(req *http.Request, wait time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				waits[req.URL.Path] = wait
+			}),
+		),
+	}
+
+	if err := doRequest(client, context.Background(), server.URL+"/first"); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	done := goRequest(client, server.URL+"/queued")
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Second)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	expected := map[string]time.Duration{"/first": 0, "/queued": time.Second}
+
+	if !reflect.DeepEqual(waits, expected) {
+		t.Fatal(fmt.Sprintf("Expected the waits to be %v, but got %v", expected, waits))
+	}
+}
+
+func TestRoundTripper_WaitRecording(t *testing.T) {
+	server, _ := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			1,
+			throttle.WithClock(clock),
+			throttle.WithWaitContext(),
+			throttle.WithWaitHeader(""),
+		),
+	}
+
+	send := func() <-chan *http.Response {
+		out := make(chan *http.Response, 1)
+
+		go func() {
+			res, err := client.Get(server.URL)
+
+			if err != nil {
+				t.Error(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			res.Body.Close()
+			out <- res
+		}()
+
+		return out
+	}
+
+	first := <-send()
+	queued := send()
+
+	clock.BlockUntilSleepers(1)
+	clock.Advance(time.Second)
+
+	for expected, res := range map[time.Duration]*http.Response{0: first, time.Second: <-queued} {
+		actual, ok := throttle.WaitFromContext(res.Request.Context())
+
+		if !ok || actual != expected {
+			t.Fatal(fmt.Sprintf("Expected the context to record %s, but got %s", expected, actual))
+		}
+
+		if actual := res.Header.Get(throttle.DefaultWaitHeader); actual != expected.String() {
+			t.Fatal(fmt.Sprintf("Expected the header to be %s, but got %s", expected, actual))
+		}
+	}
+
+	if _, ok := throttle.WaitFromContext(context.Background()); ok {
+		t.Fatal("Expected no wait in a context that hasn't been through the transport")
+	}
+}
+
+func TestRoundTripper_Hosts(t *testing.T) {
+	useCases := []struct {
+		Name      string
+		Options   []throttle.TransportOption
+		URL       string
+		Throttled bool
+	}{
+		{
+			Name:      "exact host",
+			URL:       "http://api.vendor.com/items",
+			Throttled: true,
+		},
+		{
+			Name:      "exact host in another case",
+			URL:       "http://API.Vendor.com/items",
+			Throttled: true,
+		},
+		{
+			Name:      "exact host with a port",
+			URL:       "http://api.vendor.com:8080/items",
+			Throttled: true,
+		},
+		{
+			Name:      "wildcard subdomain",
+			URL:       "https://eu.cdn.partner.io/items",
+			Throttled: true,
+		},
+		{
+			Name:      "wildcard parent domain",
+			URL:       "https://partner.io/items",
+			Throttled: false,
+		},
+		{
+			Name:      "other host",
+			URL:       "http://vendor.com/items",
+			Throttled: false,
+		},
+		{
+			Name:      "other host with a matching suffix",
+			URL:       "http://mypartner.io/items",
+			Throttled: false,
+		},
+		{
+			Name:      "matching port",
+			Options:   []throttle.TransportOption{throttle.WithHostPorts()},
+			URL:       "http://localhost:8080/items",
+			Throttled: true,
+		},
+		{
+			Name:      "other port",
+			Options:   []throttle.TransportOption{throttle.WithHostPorts()},
+			URL:       "http://localhost:9090/items",
+			Throttled: false,
+		},
+		{
+			Name:      "default port of the scheme",
+			Options:   []throttle.TransportOption{throttle.WithHostPorts()},
+			URL:       "https://auth.partner.io/token",
+			Throttled: true,
+		},
+		{
+			Name:      "default port of another scheme",
+			Options:   []throttle.TransportOption{throttle.WithHostPorts()},
+			URL:       "http://auth.partner.io/token",
+			Throttled: false,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var received int
+
+			transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				received++
+
+				return &http.Response{StatusCode: http.StatusOK, Request: req, Body: http.NoBody}, nil
+			})
+			limiter := throttletest.NewFakeLimiter()
+			options := append([]throttle.TransportOption{
+				throttle.WithHosts("api.vendor.com", "*.partner.io:443", "localhost:8080"),
+			}, useCase.Options...)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripperWithLimiter(transport, limiter, options...),
+			}
+
+			if err := doRequest(client, context.Background(), useCase.URL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if received != 1 {
+				t.Fatal(fmt.Sprintf("Expected the request to be sent once, but got %d", received))
+			}
+
+			var expected int
+
+			if useCase.Throttled {
+				expected = 1
+			}
+
+			limiter.AssertAcquired(t, expected)
+		})
+	}
+}
+
+func TestRoundTripper_HostThrottlers(t *testing.T) {
+	first, firstReceived := newCountingServer(t)
+	second, secondReceived := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+
+	// the servers listen on the same address, so they are told apart by the host names
+	firstURL := strings.Replace(first.URL, "127.0.0.1", "localhost", 1)
+	secondURL := second.URL
+
+	useCases := []struct {
+		Name      string
+		Fallback  *throttle.Throttler
+		Throttled bool
+	}{
+		{
+			Name:      "fallback",
+			Fallback:  throttle.New(1, throttle.WithClock(clock)),
+			Throttled: true,
+		},
+		{
+			Name:      "no fallback",
+			Throttled: false,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			firstReceived.Store(0)
+			secondReceived.Store(0)
+
+			throttler := throttle.New(1, throttle.WithClock(clock))
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(
+					http.DefaultTransport,
+					1,
+					throttle.WithClock(clock),
+					throttle.WithHostThrottlers(map[string]*throttle.Throttler{
+						"LocalHost:80": throttler,
+					}, useCase.Fallback),
+				),
+			}
+
+			if err := doRequest(client, context.Background(), firstURL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			// the window of the first host is exhausted, so its next request waits
+			throttled := goRequest(client, firstURL)
+			clock.BlockUntilSleepers(1)
+
+			// while the second host has a window of its own, if any
+			if err := doRequest(client, context.Background(), secondURL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			var waiting <-chan error
+
+			if useCase.Throttled {
+				waiting = goRequest(client, secondURL)
+				clock.BlockUntilSleepers(2)
+			} else {
+				for range 3 {
+					if err := doRequest(client, context.Background(), secondURL); err != nil {
+						t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+					}
+				}
+
+				if actual := secondReceived.Load(); actual != 4 {
+					t.Fatal(fmt.Sprintf("Expected the second server to receive 4 requests, but got %d", actual))
+				}
+			}
+
+			if actual := firstReceived.Load(); actual != 1 {
+				t.Fatal(fmt.Sprintf("Expected the first server to receive 1 request, but got %d", actual))
+			}
+
+			clock.Advance(time.Second)
+
+			if err := <-throttled; err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if waiting != nil {
+				if err := <-waiting; err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+			}
+
+			if actual := firstReceived.Load(); actual != 2 {
+				t.Fatal(fmt.Sprintf("Expected the first server to receive 2 requests, but got %d", actual))
+			}
+		})
+	}
+}
+
+func TestRoundTripper_FailFast(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, 2, throttle.WithClock(clock), throttle.WithFailFast()),
+	}
+
+	for range 2 {
+		if err := doRequest(client, context.Background(), server.URL); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	clock.Advance(time.Millisecond * 400)
+
+	// the window is exhausted, so the following requests are rejected right away
+	for range 3 {
+		err := doRequest(client, context.Background(), server.URL)
+
+		if !errors.Is(err, throttle.ErrLimitExceeded) {
+			t.Fatal(fmt.Sprintf("Expected throttle.ErrLimitExceeded, but got %v", err))
+		}
+
+		var limitErr *throttle.LimitError
+
+		if !errors.As(err, &limitErr) {
+			t.Fatal(fmt.Sprintf("Expected *throttle.LimitError, but got %T", err))
+		}
+
+		if limitErr.RetryAfter != time.Millisecond*600 {
+			t.Fatal(fmt.Sprintf("Expected to be told to retry after 600ms, but got %s", limitErr.RetryAfter))
+		}
+	}
+
+	if actual := received.Load(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 2 requests, but got %d", actual))
+	}
+
+	if actual := clock.Sleepers(); actual != 0 {
+		t.Fatal(fmt.Sprintf("Expected no request to wait, but got %d sleepers", actual))
+	}
+
+	// the rejected requests have taken no slots of the next window
+	clock.Advance(time.Millisecond * 601)
+
+	for range 2 {
+		if err := doRequest(client, context.Background(), server.URL); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	if actual := received.Load(); actual != 4 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 4 requests, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_MaxWaitPerRequest(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		MaxWait  time.Duration
+		Cancel   bool
+		Expected error
+	}{
+		{
+			Name:    "wait just under the budget",
+			MaxWait: time.Millisecond * 600,
+		},
+		{
+			Name:     "wait just over the budget",
+			MaxWait:  time.Millisecond * 598,
+			Expected: throttle.ErrLimitExceeded,
+		},
+		{
+			Name:     "context done before the budget is spent",
+			MaxWait:  time.Second,
+			Cancel:   true,
+			Expected: context.Canceled,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			server, received := newCountingServer(t)
+			clock := throttletest.NewManualClock(epoch)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(
+					http.DefaultTransport,
+					1,
+					throttle.WithClock(clock),
+					throttle.WithMaxWaitPerRequest(useCase.MaxWait),
+				),
+			}
+
+			if err := doRequest(client, context.Background(), server.URL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			clock.Advance(time.Millisecond * 401)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			done := make(chan error, 1)
+
+			go func() {
+				done <- doRequest(client, ctx, server.URL)
+			}()
+
+			var err error
+
+			if useCase.Cancel {
+				clock.BlockUntilSleepers(1)
+				cancel()
+
+				err = <-done
+			} else {
+				err = await(clock, done)
+			}
+
+			if useCase.Expected == nil {
+				if err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+
+				if actual := received.Load(); actual != 2 {
+					t.Fatal(fmt.Sprintf("Expected the server to receive 2 requests, but got %d", actual))
+				}
+
+				if actual := clock.Now().Sub(epoch); actual != time.Second {
+					t.Fatal(fmt.Sprintf("Expected the request to be sent after 1s, but got %s", actual))
+				}
+
+				return
+			}
+
+			if !errors.Is(err, useCase.Expected) {
+				t.Fatal(fmt.Sprintf("Expected %s, but got %v", useCase.Expected, err))
+			}
+
+			var limitErr *throttle.LimitError
+
+			if errors.As(err, &limitErr) && limitErr.RetryAfter != time.Millisecond*599 {
+				t.Fatal(fmt.Sprintf("Expected the estimated wait of 599ms, but got %s", limitErr.RetryAfter))
+			}
+
+			if actual := received.Load(); actual != 1 {
+				t.Fatal(fmt.Sprintf("Expected the server to receive 1 request, but got %d", actual))
+			}
+		})
+	}
+}
+
+func TestRoundTripper_MaxWaitPerRequest_Limiter(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	limiter := throttletest.NewFakeLimiter().UseClock(clock).Wait(time.Second * 2)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripperWithLimiter(
+			http.DefaultTransport,
+			limiter,
+			throttle.WithClock(clock),
+			throttle.WithMaxWaitPerRequest(time.Second),
+		),
+	}
+
+	done := goRequest(client, server.URL)
+
+	// the wait of the limiter can't be estimated, so it's given up on once the budget is spent
+	clock.BlockUntilSleepers(2)
+	clock.AdvanceToNext()
+
+	if err := <-done; !errors.Is(err, throttle.ErrLimitExceeded) {
+		t.Fatal(fmt.Sprintf("Expected throttle.ErrLimitExceeded, but got %v", err))
+	}
+
+	if actual := clock.Now().Sub(epoch); actual != time.Second {
+		t.Fatal(fmt.Sprintf("Expected to give up after 1s, but got %s", actual))
+	}
+
+	if actual := received.Load(); actual != 0 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive no requests, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_TraceHook(t *testing.T) {
+	type event struct {
+		Name string
+		Path string
+		Wait time.Duration
+	}
+
+	var (
+		mu     sync.Mutex
+		events []event
+		waits  = make(map[string]time.Duration)
+	)
+
+	record := func(name string) func(*http.Request, time.Duration) {
+		return func(req *http.Request, wait time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			events = append(events, event{Name: name, Path: req.URL.Path, Wait: wait})
+		}
+	}
+
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if wait, ok := throttle.WaitFromContext(req.Context()); ok {
+			mu.Lock()
+			waits[req.URL.Path] = wait
+			mu.Unlock()
+		}
+
+		return &http.Response{StatusCode: http.StatusOK, Request: req, Body: http.NoBody}, nil
+	})
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			transport,
+			1,
+			throttle.WithClock(clock),
+			throttle.WithTraceHook(throttle.ThrottleTrace{
+				Start: record("start"),
+				Done:  record("done"),
+			}),
+		),
+	}
+
+	traced := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{})
+
+	for _, path := range []string{"/first", "/second", "/untraced"} {
+		ctx := traced
+
+		if path == "/untraced" {
+			ctx = context.Background()
+		}
+
+		done := make(chan error, 1)
+
+		go func() {
+			done <- doRequest(client, ctx, "http://example.com"+path)
+		}()
+
+		if err := await(clock, done); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	// the first request hasn't waited, and the last one is not traced
+	expected := []event{
+		{Name: "start", Path: "/second", Wait: time.Second},
+		{Name: "done", Path: "/second", Wait: time.Second},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatal(fmt.Sprintf("Expected the events %v, but got %v", expected, events))
+	}
+
+	if !reflect.DeepEqual(waits, map[string]time.Duration{"/second": time.Second}) {
+		t.Fatal(fmt.Sprintf("Expected only the waited request to be annotated, but got %v", waits))
+	}
+}
+
+func TestRoundTripper_ThrottlerOptions(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			1,
+			throttle.WithThrottlerOptions(throttle.WithClock(clock), throttle.WithWindow(time.Second*2)),
+		),
+	}
+
+	if err := doRequest(client, context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	done := goRequest(client, server.URL)
+
+	// the throttler waits on the clock set through the transport options, for the window set the same way
+	clock.BlockUntilSleepers(1)
+
+	if actual := clock.SleepCalls(); actual[len(actual)-1] != time.Second*2 {
+		t.Fatal(fmt.Sprintf("Expected the request to wait for 2s, but got %s", actual[len(actual)-1]))
+	}
+
+	clock.Advance(time.Second * 2)
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if actual := received.Load(); actual != 2 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 2 requests, but got %d", actual))
+	}
+}
+
+func TestRoundTripper_ConflictingOptions(t *testing.T) {
+	useCases := []struct {
+		Name    string
+		Options []throttle.TransportOption
+	}{
+		{
+			Name:    "adaptive limit and AIMD",
+			Options: []throttle.TransportOption{throttle.WithAdaptiveLimit(), throttle.WithAIMD()},
+		},
+		{
+			Name: "host throttlers and route limits",
+			Options: []throttle.TransportOption{
+				throttle.WithHostThrottlers(map[string]*throttle.Throttler{"api.vendor.com": throttle.New(1)}, nil),
+				throttle.WithRouteLimits(map[string]uint64{"/search": 1}),
+			},
+		},
+		{
+			Name: "host throttlers and method limits",
+			Options: []throttle.TransportOption{
+				throttle.WithMethodLimits(map[string]uint64{"POST": 1}, 10),
+				throttle.WithHostThrottlers(map[string]*throttle.Throttler{"api.vendor.com": throttle.New(1)}, nil),
+			},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("Expected the constructor to reject the options")
+				}
+			}()
+
+			throttle.NewRoundTripper(http.DefaultTransport, 1, useCase.Options...)
+		})
+	}
+}
+
+func TestRoundTripper_Redirects(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Options  []throttle.TransportOption
+		Expected time.Duration
+	}{
+		{
+			Name:     "every hop is counted",
+			Expected: time.Second * 5,
+		},
+		{
+			Name:     "hops are exempt",
+			Options:  []throttle.TransportOption{throttle.WithExemptRedirects()},
+			Expected: time.Second,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			var received atomic.Int64
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received.Add(1)
+
+				switch r.URL.Path {
+				case "/a":
+					http.Redirect(w, r, "/b", http.StatusFound)
+				case "/b":
+					http.Redirect(w, r, "/c", http.StatusFound)
+				default:
+					w.WriteHeader(http.StatusOK)
+				}
+			}))
+			t.Cleanup(server.Close)
+
+			clock := throttletest.NewManualClock(epoch)
+			client := &http.Client{
+				Transport: throttle.NewRoundTripper(http.DefaultTransport, 1, append(useCase.Options, throttle.WithClock(clock))...),
+			}
+
+			for range 2 {
+				if err := await(clock, goRequest(client, server.URL+"/a")); err != nil {
+					t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+				}
+			}
+
+			if actual := received.Load(); actual != 6 {
+				t.Fatal(fmt.Sprintf("Expected the server to receive 6 requests, but got %d", actual))
+			}
+
+			if actual := clock.Now().Sub(epoch); actual != useCase.Expected {
+				t.Fatal(fmt.Sprintf("Expected the requests to take %s, but got %s", useCase.Expected, actual))
+			}
+		})
+	}
+}
+
+func TestRoundTripper_CostHeader(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	costs := []string{"3", "4", "5", "", "2", "10", "x", "6", " 4 "}
+	weights := []uint64{3, 4, 5, 1, 2, 10, 1, 6, 4}
+	totals := make(map[time.Duration]uint64)
+
+	var failures int
+
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("X-Request-Cost") != "" {
+			t.Fatal("Expected the cost header to be stripped")
+		}
+
+		i, _ := strconv.Atoi(req.URL.Query().Get("i"))
+		totals[clock.Now().Sub(epoch)] += weights[i]
+
+		return &http.Response{StatusCode: http.StatusOK, Request: req, Body: http.NoBody}, nil
+	})
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			transport,
+			10,
+			throttle.WithClock(clock),
+			throttle.WithWeigher(throttle.ByHeader("X-Request-Cost", func(*http.Request, error) {
+				failures++
+			})),
+			throttle.WithStripHeaders("X-Request-Cost"),
+		),
+	}
+
+	for i, cost := range costs {
+		req, _ := http.NewRequest(http.MethodPost, "http://example.com/graphql?i="+strconv.Itoa(i), nil)
+
+		if cost != "" {
+			req.Header.Set("X-Request-Cost", cost)
+		}
+
+		done := make(chan error, 1)
+
+		go func() {
+			res, err := client.Do(req)
+
+			if err == nil {
+				res.Body.Close()
+			}
+
+			done <- err
+		}()
+
+		if err := await(clock, done); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		if req.Header.Get("X-Request-Cost") != cost {
+			t.Fatal("Expected the request of the caller to be left intact")
+		}
+	}
+
+	var sum uint64
+
+	for window, total := range totals {
+		if total > 10 {
+			t.Fatal(fmt.Sprintf("Expected the window at %s to cost no more than 10, but got %d", window, total))
+		}
+
+		sum += total
+	}
+
+	if sum != 36 {
+		t.Fatal(fmt.Sprintf("Expected the requests to cost 36 in total, but got %d", sum))
+	}
+
+	if len(totals) != 5 {
+		t.Fatal(fmt.Sprintf("Expected the requests to span 5 windows, but got %d", len(totals)))
+	}
+
+	if failures != 1 {
+		t.Fatal(fmt.Sprintf("Expected 1 parse failure, but got %d", failures))
+	}
+}
+
+func TestThrottledRoundTripper_Stats(t *testing.T) {
+	server, received := newCountingServer(t)
+	clock := throttletest.NewManualClock(epoch)
+	transport := throttle.NewTransport(
+		http.DefaultTransport,
+		1,
+		throttle.WithClock(clock),
+		throttle.WithMaxWaitPerRequest(time.Second),
+		throttle.WithSkip(func(req *http.Request) bool {
+			return req.URL.Path == "/health"
+		}),
+	)
+	client := &http.Client{Transport: transport}
+
+	if err := doRequest(client, context.Background(), server.URL); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// waits for the next window
+	if err := await(clock, goRequest(client, server.URL)); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// waits for the window after it, so the next one would wait longer than allowed
+	waiting := goRequest(client, server.URL)
+	clock.BlockUntilSleepers(1)
+
+	if err := doRequest(client, context.Background(), server.URL); !errors.Is(err, throttle.ErrLimitExceeded) {
+		t.Fatal(fmt.Sprintf("Expected throttle.ErrLimitExceeded, but got %v", err))
+	}
+
+	clock.Advance(time.Second)
+
+	if err := <-waiting; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	// gives up while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+
+	go func() {
+		cancelled <- doRequest(client, ctx, server.URL)
+	}()
+
+	clock.BlockUntilSleepers(1)
+	cancel()
+
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	for range 2 {
+		if err := doRequest(client, context.Background(), server.URL+"/health"); err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+	}
+
+	expected := throttle.TransportStats{
+		Sent:        5,
+		Unthrottled: 2,
+		Waited:      2,
+		Wait:        time.Second * 2,
+		Rejected:    1,
+		Cancelled:   1,
+	}
+
+	if actual := transport.Stats(); actual != expected {
+		t.Fatal(fmt.Sprintf("Expected the stats %+v, but got %+v", expected, actual))
+	}
+
+	if actual := received.Load(); actual != 5 {
+		t.Fatal(fmt.Sprintf("Expected the server to receive 5 requests, but got %d", actual))
+	}
+
+	transport.ResetStats()
+
+	if actual := transport.Stats(); actual != (throttle.TransportStats{}) {
+		t.Fatal(fmt.Sprintf("Expected the stats to be reset, but got %+v", actual))
+	}
+}
+
+func TestRoundTripper_UploadBandwidth(t *testing.T) {
+	const size = 3 << 20
+
+	var (
+		mu       sync.Mutex
+		attempts []int64
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+
+		mu.Lock()
+		attempts = append(attempts, n)
+		first := len(attempts) == 1
+		mu.Unlock()
+
+		if r.ContentLength != size {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		// the first attempt is retried, so the body is read again
+		if first {
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(
+			http.DefaultTransport,
+			100,
+			throttle.WithClock(clock),
+			throttle.WithUploadBandwidth(1<<20),
+			throttle.WithRetryOn429(1),
+		),
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		req, _ := http.NewRequest(http.MethodPut, server.URL, bytes.NewReader(make([]byte, size)))
+		res, err := client.Do(req)
+
+		if err == nil {
+			if res.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %d", res.StatusCode)
+			}
+
+			res.Body.Close()
+		}
+
+		done <- err
+	}()
+
+	if err := await(clock, done); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if !reflect.DeepEqual(attempts, []int64{size, size}) {
+		t.Fatal(fmt.Sprintf("Expected the whole body to be sent twice, but got %v", attempts))
+	}
+
+	// 6 MB at 1 MB per second, the first megabyte going right away
+	if actual := clock.Now().Sub(epoch); actual != time.Second*5 {
+		t.Fatal(fmt.Sprintf("Expected the upload to take 5s, but got %s", actual))
+	}
+}
+
+func TestRoundTripper_DownloadBandwidth(t *testing.T) {
+	const size = 3 << 20
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		_, _ = w.Write(make([]byte, size))
+	}))
+	t.Cleanup(server.Close)
+
+	clock := throttletest.NewManualClock(epoch)
+	client := &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, 100, throttle.WithClock(clock), throttle.WithDownloadBandwidth(1<<20)),
+	}
+
+	res, err := client.Get(server.URL)
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if res.ContentLength != size {
+		t.Fatal(fmt.Sprintf("Expected the content length to be left intact, but got %d", res.ContentLength))
+	}
+
+	done := make(chan error, 1)
+
+	var n int64
+
+	go func() {
+		var err error
+
+		n, err = io.Copy(io.Discard, res.Body)
+		done <- err
+	}()
+
+	if err := await(clock, done); err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	if n != size {
+		t.Fatal(fmt.Sprintf("Expected to read %d bytes, but got %d", size, n))
+	}
+
+	// 3 MB at 1 MB per second, the first megabyte going right away,
+	// while the reads of arbitrary sizes that don't fit into the rest of a window go into the next one
+	elapsed := clock.Now().Sub(epoch)
+
+	if elapsed < time.Second*2 || elapsed > time.Second*3 {
+		t.Fatal(fmt.Sprintf("Expected the download to take 2-3s, but got %s", elapsed))
+	}
+
+	res.Body.Close()
+
+	// an early close stops the pending read
+	res, err = client.Get(server.URL)
+
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+
+	go func() {
+		_, err := io.Copy(io.Discard, res.Body)
+		done <- err
+	}()
+
+	clock.BlockUntilSleepers(1)
+	res.Body.Close()
+
+	if err := <-done; !errors.Is(err, throttle.ErrReaderClosed) {
+		t.Fatal(fmt.Sprintf("Expected throttle.ErrReaderClosed, but got %v", err))
+	}
+
+	if actual := clock.Now().Sub(epoch); actual != elapsed {
+		t.Fatal(fmt.Sprintf("Expected the clock to stay at %s, but got %s", elapsed, actual))
+	}
+}
+
+func TestRoundTripper_DeadlineFeasibility(t *testing.T) {
+	useCases := []struct {
+		Name     string
+		Timeout  time.Duration
+		Slack    time.Duration
+		Feasible bool
+	}{
+		{
+			Name:     "deadline after the admission",
+			Timeout:  time.Second * 10,
+			Feasible: true,
+		},
+		{
+			Name:     "deadline before the admission",
+			Timeout:  time.Millisecond * 500,
+			Feasible: false,
+		},
+		{
+			// the deadline is measured on the clock, which has advanced by 300ms, rather than in real time
+			Name:     "deadline before the admission on the clock",
+			Timeout:  time.Millisecond * 900,
+			Feasible: false,
+		},
+		{
+			Name:     "deadline before the admission within the slack",
+			Timeout:  time.Millisecond * 500,
+			Slack:    time.Millisecond * 600,
+			Feasible: true,
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			server, received := newCountingServer(t)
+			// the context deadline is set in real time, so the clock starts at it
+			clock := throttletest.NewManualClock(time.Now())
+			transport := throttle.NewTransport(http.DefaultTransport, 1, throttle.WithClock(clock), throttle.WithDeadlineSlack(useCase.Slack))
+			client := &http.Client{Transport: transport}
+
+			ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(useCase.Timeout))
+			defer cancel()
+
+			if err := doRequest(client, context.Background(), server.URL); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			// the next request is admitted in 700ms
+			clock.Advance(time.Millisecond * 300)
+
+			done := make(chan error, 1)
+
+			go func() {
+				done <- doRequest(client, ctx, server.URL)
+			}()
+
+			if !useCase.Feasible {
+				// rejected right away rather than once the deadline passes
+				select {
+				case err := <-done:
+					if !errors.Is(err, context.DeadlineExceeded) {
+						t.Fatal(fmt.Sprintf("Expected context.DeadlineExceeded, but got %v", err))
+					}
+				case <-time.After(useCase.Timeout / 2):
+					t.Fatal("Expected the request to be rejected right away")
+				}
+
+				if actual := received.Load(); actual != 1 {
+					t.Fatal(fmt.Sprintf("Expected the server to receive 1 request, but got %d", actual))
+				}
+
+				// and without taking the slot of the next window
+				clock.Advance(time.Millisecond * 701)
+
+				if !transport.Throttler().TryAcquire() {
+					t.Fatal("Expected the slot of the next window to be free")
+				}
+
+				return
+			}
+
+			if err := await(clock, done); err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if actual := received.Load(); actual != 2 {
+				t.Fatal(fmt.Sprintf("Expected the server to receive 2 requests, but got %d", actual))
+			}
+		})
+	}
+}
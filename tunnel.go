@@ -0,0 +1,71 @@
+package throttle
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Tunnel copies the bytes from a to b and from b to a at the specified numbers of bytes per window each, one second by default,
+// 0 meaning no limit for the direction, e.g. to proxy a TCP stream, until both directions are over, either connection fails or the context is done.
+// Once a direction reaches io.EOF, the writing side of its destination is closed if it implements CloseWrite, as *net.TCPConn does,
+// so that the peer sees the end of the stream while the other direction goes on. Otherwise, the end of a direction ends the tunnel.
+// Both connections are closed once the tunnel ends, and the first error is returned, the one of the context if it's done first,
+// while io.EOF and the errors of the connections closed by the tunnel itself are not reported.
+func Tunnel(ctx context.Context, a, b net.Conn, aToBBps, bToABps uint64, setters ...Option) error {
+	var (
+		once  sync.Once
+		first error
+		wg    sync.WaitGroup
+	)
+
+	// shutdown closes both connections, which unblocks the pending reads and writes, keeping the error that ends the tunnel
+	shutdown := func(err error) {
+		once.Do(func() {
+			first = err
+			a.Close()
+			b.Close()
+		})
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		shutdown(ctx.Err())
+	})
+	defer stop()
+
+	opts := make([]CopyOption, 0, len(setters))
+
+	for _, setter := range setters {
+		opts = append(opts, setter)
+	}
+
+	pipe := func(dst, src net.Conn, bytesPerSec uint64) {
+		defer wg.Done()
+
+		if _, err := Copy(ctx, dst, src, bytesPerSec, opts...); err != nil {
+			shutdown(err)
+
+			return
+		}
+
+		if conn, ok := dst.(interface{ CloseWrite() error }); ok {
+			if err := conn.CloseWrite(); err != nil {
+				shutdown(err)
+			}
+
+			return
+		}
+
+		shutdown(nil)
+	}
+
+	wg.Add(2)
+
+	go pipe(b, a, aToBBps)
+	go pipe(a, b, bToABps)
+
+	wg.Wait()
+	shutdown(nil)
+
+	return first
+}
@@ -0,0 +1,199 @@
+package throttle_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ziflex/throttle"
+	"github.com/ziflex/throttle/throttletest"
+)
+
+func TestTunnel(t *testing.T) {
+	useCases := []struct {
+		Name   string
+		ToB    bool
+		Bytes  int
+		Totals map[time.Duration]int
+	}{
+		{
+			Name:   "a to b",
+			ToB:    true,
+			Bytes:  30,
+			Totals: map[time.Duration]int{0: 10, time.Second: 10, 2 * time.Second: 10},
+		},
+		{
+			Name:   "b to a",
+			Bytes:  60,
+			Totals: map[time.Duration]int{0: 20, time.Second: 20, 2 * time.Second: 20},
+		},
+	}
+
+	for _, useCase := range useCases {
+		t.Run(useCase.Name, func(t *testing.T) {
+			// a direction at a time, since the auto-advanced clock is shared by both
+			clock := throttletest.NewManualClock(epoch, throttletest.WithAutoAdvance())
+			clientA, a := net.Pipe()
+			b, serverB := net.Pipe()
+			toA, toB := newWindowWriter(clock), newWindowWriter(clock)
+			done := make(chan error, 1)
+
+			go func() {
+				done <- throttle.Tunnel(context.Background(), &recordingConn{a, toA}, &recordingConn{b, toB}, 10, 20, throttle.WithClock(clock))
+			}()
+
+			src, dst, writes := clientA, serverB, toB
+
+			if !useCase.ToB {
+				src, dst, writes = serverB, clientA, toA
+			}
+
+			payload := strings.Repeat("x", useCase.Bytes)
+
+			go src.Write([]byte(payload))
+
+			received := make([]byte, len(payload))
+
+			if _, err := io.ReadFull(dst, received); err != nil || string(received) != payload {
+				t.Fatal(fmt.Sprintf("Expected %q to be received, but got %q and %v", payload, received, err))
+			}
+
+			// the end of a direction ends the tunnel, as net.Pipe can't be half-closed
+			src.Close()
+
+			if err := <-done; err != nil {
+				t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+			}
+
+			if _, err := dst.Read(make([]byte, 1)); err == nil {
+				t.Fatal("Expected the tunnel to close the connections")
+			}
+
+			if !reflect.DeepEqual(writes.totals, useCase.Totals) {
+				t.Fatal(fmt.Sprintf("Expected the bytes written per window to be %v, but got %v", useCase.Totals, writes.totals))
+			}
+		})
+	}
+}
+
+func TestTunnel_Cancel(t *testing.T) {
+	clientA, a := net.Pipe()
+	b, serverB := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- throttle.Tunnel(ctx, a, b, 10, 10)
+	}()
+
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Sprintf("Expected context.Canceled, but got %v", err))
+	}
+
+	if _, err := clientA.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected a to be closed")
+	}
+
+	if _, err := serverB.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected b to be closed")
+	}
+}
+
+func TestTunnel_Error(t *testing.T) {
+	clientA, a := net.Pipe()
+	b, serverB := net.Pipe()
+	failing := errors.New("write failed")
+	done := make(chan error, 1)
+
+	go func() {
+		done <- throttle.Tunnel(context.Background(), a, &failingConn{b, failing}, 0, 0)
+	}()
+
+	go serverB.Read(make([]byte, 1))
+
+	clientA.Write([]byte("x"))
+
+	if err := <-done; !errors.Is(err, failing) {
+		t.Fatal(fmt.Sprintf("Expected the error of the write, but got %v", err))
+	}
+}
+
+func TestTunnel_HalfClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Skip(fmt.Sprintf("TCP is not available: %s", err))
+	}
+
+	defer listener.Close()
+
+	// pair returns both sides of a TCP connection
+	pair := func() (net.Conn, net.Conn) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		server, err := listener.Accept()
+
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+		}
+
+		return client, server
+	}
+
+	clientA, a := pair()
+	b, serverB := pair()
+
+	defer clientA.Close()
+	defer serverB.Close()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- throttle.Tunnel(context.Background(), a, b, 0, 0)
+	}()
+
+	clientA.Write([]byte("request"))
+	clientA.(*net.TCPConn).CloseWrite()
+
+	// b sees the end of the request while its response is still to be written
+	request, err := io.ReadAll(serverB)
+
+	if err != nil || string(request) != "request" {
+		t.Fatal(fmt.Sprintf("Expected the request to be received by b, but got %q and %v", request, err))
+	}
+
+	serverB.Write([]byte("response"))
+	serverB.Close()
+
+	response, err := io.ReadAll(clientA)
+
+	if err != nil || string(response) != "response" {
+		t.Fatal(fmt.Sprintf("Expected the response to be received by a, but got %q and %v", response, err))
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(fmt.Sprintf("Expected no error, but got %s", err))
+	}
+}
+
+// failingConn fails the writes with the error.
+type failingConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingConn) Write([]byte) (int, error) {
+	return 0, c.err
+}